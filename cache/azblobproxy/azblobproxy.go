@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"path"
 	"time"
 
@@ -111,35 +112,37 @@ func (c *azBlobCache) Get(ctx context.Context, kind cache.EntryKind, hash string
 
 var errNotFound = errors.New("NOT FOUND")
 
-func (c *azBlobCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+func (c *azBlobCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 	key := c.objectKey(hash, kind)
 	if c.prefix != "" {
 		key = c.prefix + "/" + key
 	}
 
-	size := int64(-1)
-	exists := false
-
 	client, err := c.containerClient.NewBlobClient(key)
 	if err != nil {
 		logResponse(c.accessLogger, "CONTAINS", c.storageAccount, c.container, key, err)
-		return exists, size
+		return false, -1, err
 	}
 
 	props, err := client.GetProperties(context.Background(), nil)
-
-	exists = (err == nil)
 	if err != nil {
-		err = errNotFound
-	} else if kind != cache.CAS || !c.v2mode {
-		if props.ContentLength != nil {
-			size = *props.ContentLength
+		var stgErr *azblob.StorageError
+		if errors.As(err, &stgErr) && stgErr.ErrorCode == azblob.StorageErrorCodeBlobNotFound {
+			logResponse(c.accessLogger, "CONTAINS", c.storageAccount, c.container, key, errNotFound)
+			return false, -1, nil
 		}
+		logResponse(c.accessLogger, "CONTAINS", c.storageAccount, c.container, key, err)
+		return false, -1, err
 	}
 
-	logResponse(c.accessLogger, "CONTAINS", c.storageAccount, c.container, key, err)
+	logResponse(c.accessLogger, "CONTAINS", c.storageAccount, c.container, key, nil)
 
-	return exists, size
+	size := int64(-1)
+	if (kind != cache.CAS || !c.v2mode) && props.ContentLength != nil {
+		size = *props.ContentLength
+	}
+
+	return true, size, nil
 }
 
 func New(
@@ -149,11 +152,19 @@ func New(
 	creds azcore.TokenCredential,
 	sharedKey string,
 	UpdateTimestamps bool,
+	transport http.RoundTripper,
 	storageMode string, accessLogger cache.Logger,
 	errorLogger cache.Logger, numUploaders, maxQueuedUploads int,
 ) cache.Proxy {
 	url := fmt.Sprintf("https://%s.blob.core.windows.net/", storageAccount)
 
+	var options *azblob.ClientOptions
+	if transport != nil {
+		options = &azblob.ClientOptions{
+			Transport: &http.Client{Transport: transport},
+		}
+	}
+
 	var err error
 	var serviceClient *azblob.ServiceClient
 	if creds == nil && len(sharedKey) > 0 {
@@ -161,10 +172,10 @@ func New(
 		if e != nil {
 			log.Fatalln(e)
 		}
-		serviceClient, err = azblob.NewServiceClientWithSharedKey(url, cred, nil)
+		serviceClient, err = azblob.NewServiceClientWithSharedKey(url, cred, options)
 
 	} else {
-		serviceClient, err = azblob.NewServiceClient(url, creds, nil)
+		serviceClient, err = azblob.NewServiceClient(url, creds, options)
 	}
 
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"math/rand"
 )
 
 // EntryKind describes the kind of cache entry
@@ -48,6 +49,30 @@ type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
+// SampledLogger is a Logger which only logs a fraction of the messages
+// about successful requests passed to LogSuccess. Messages passed
+// directly to Printf are always logged.
+type SampledLogger struct {
+	Logger
+	rate float64
+}
+
+// NewSampledLogger returns a SampledLogger which logs approximately
+// rate (between 0 and 1) of the successful requests via l.
+func NewSampledLogger(l Logger, rate float64) *SampledLogger {
+	return &SampledLogger{Logger: l, rate: rate}
+}
+
+// LogSuccess logs a message about a successful request (including cache
+// misses) to l. If l is a SampledLogger then the message might be dropped,
+// so errors should be logged with Printf instead.
+func LogSuccess(l Logger, format string, v ...interface{}) {
+	if s, ok := l.(*SampledLogger); ok && rand.Float64() >= s.rate {
+		return
+	}
+	l.Printf(format, v...)
+}
+
 // Error is used by Cache implementations to return a structured error.
 type Error struct {
 	// Corresponds to a http.Status* code
@@ -81,8 +106,10 @@ type Proxy interface {
 
 	// Contains returns whether or not the cache item exists on the
 	// remote end, and the size if it exists (and -1 if the size is
-	// unknown).
-	Contains(ctx context.Context, kind EntryKind, hash string, size int64) (bool, int64)
+	// unknown). A non-nil error means that the backend could not be
+	// checked (eg due to a network or authentication failure), which
+	// is different from the item being absent.
+	Contains(ctx context.Context, kind EntryKind, hash string, size int64) (bool, int64, error)
 }
 
 // TransformActionCacheKey takes an ActionCache key and an instance name
@@ -104,6 +131,119 @@ func TransformActionCacheKey(key, instance string, logger Logger) string {
 	return newKey
 }
 
+// NoPromoteHeader is the name of the HTTP header (or lowercased, the gRPC
+// metadata key) which clients can set to a true value to request that
+// cache lookups do not update the LRU order. This is useful for scans that
+// read every blob, which would otherwise destroy the working set ordering.
+const NoPromoteHeader = "X-Bazel-Remote-No-Promote"
+
+type noPromoteKey struct{}
+
+// WithNoPromote returns a copy of ctx which indicates that cache lookups
+// made with it should not promote the items that are found.
+func WithNoPromote(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noPromoteKey{}, true)
+}
+
+// NoPromote returns true if ctx was returned by WithNoPromote.
+func NoPromote(ctx context.Context) bool {
+	noPromote, _ := ctx.Value(noPromoteKey{}).(bool)
+	return noPromote
+}
+
+// LocalOnlyHeader is the name of the HTTP header which clients can set to
+// a true value on HEAD requests, to only check whether the blob is in the
+// local cache, without asking the proxy backend. This makes the check
+// cheaper, and lets clients distinguish blobs which are present locally
+// from those which might be available from the proxy.
+const LocalOnlyHeader = "X-Bazel-Remote-Local-Only"
+
+type localOnlyKey struct{}
+
+// WithLocalOnly returns a copy of ctx which indicates that Contains calls
+// made with it should not consult the proxy backend.
+func WithLocalOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localOnlyKey{}, true)
+}
+
+// LocalOnly returns true if ctx was returned by WithLocalOnly.
+func LocalOnly(ctx context.Context) bool {
+	localOnly, _ := ctx.Value(localOnlyKey{}).(bool)
+	return localOnly
+}
+
+// PriorityHeader is the name of the HTTP header (or lowercased, the gRPC
+// metadata key) which clients can set to "high" to request that their
+// requests are scheduled before other requests when the server is busy,
+// eg for interactive builds which share a cache with batch CI jobs.
+const PriorityHeader = "X-Bazel-Remote-Priority"
+
+type highPriorityKey struct{}
+
+// WithHighPriority returns a copy of ctx which indicates that requests
+// made with it should be scheduled before requests without it, where
+// they need to wait for a limited resource.
+func WithHighPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, highPriorityKey{}, true)
+}
+
+// HighPriority returns true if ctx was returned by WithHighPriority.
+func HighPriority(ctx context.Context) bool {
+	highPriority, _ := ctx.Value(highPriorityKey{}).(bool)
+	return highPriority
+}
+
+type contentTypeKey struct{}
+
+// WithContentType returns a copy of ctx which indicates that the item
+// uploaded with it has the given content type, eg from the Content-Type
+// header of an HTTP PUT request.
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// ContentType returns the content type set by WithContentType, or an
+// empty string.
+func ContentType(ctx context.Context) string {
+	contentType, _ := ctx.Value(contentTypeKey{}).(string)
+	return contentType
+}
+
+type tagKey struct{}
+
+// WithTag returns a copy of ctx which indicates that items uploaded with
+// it should be tagged with tag, so that they can later be evicted as a
+// group.
+func WithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// Tag returns the tag set by WithTag, or an empty string.
+func Tag(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+type readLimitKey struct{}
+
+// WithReadLimit returns a copy of ctx which indicates that the caller will
+// read at most limit bytes of the uncompressed blobs returned by lookups
+// made with it, so that compressed blobs only need to be decompressed as far
+// as necessary.
+func WithReadLimit(ctx context.Context, limit int64) context.Context {
+	return context.WithValue(ctx, readLimitKey{}, limit)
+}
+
+// ReadLimit returns the limit set by WithReadLimit, or -1 if there is no
+// limit.
+func ReadLimit(ctx context.Context) int64 {
+	limit, ok := ctx.Value(readLimitKey{}).(int64)
+	if !ok {
+		return -1
+	}
+	return limit
+}
+
 func LookupKey(kind EntryKind, hash string) string {
 	return kind.String() + "/" + hash
 }
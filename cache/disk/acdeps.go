@@ -0,0 +1,95 @@
+package disk
+
+import (
+	"context"
+	"io"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ActionResults larger than this are not checked for dependencies to
+// protect, to bound the memory used by Put.
+const maxProtectedACSize = 4 * 1024 * 1024
+
+// touchACDependencies moves the CAS blobs referenced by the serialized
+// ActionResult in acData to the front of the LRU, so that they are less
+// likely to be evicted before the AC entry that refers to them. This is
+// best-effort: blobs that are not in the local cache are ignored, and
+// referenced blobs can still be evicted later.
+func (c *diskCache) touchACDependencies(ctx context.Context, acData []byte) {
+	result := &pb.ActionResult{}
+	err := proto.Unmarshal(acData, result)
+	if err != nil {
+		return
+	}
+
+	keys := make([]string, 0, len(result.OutputFiles)+2)
+	addKey := func(d *pb.Digest) {
+		if d != nil && d.SizeBytes > 0 {
+			keys = append(keys, cache.LookupKey(cache.CAS, d.Hash))
+		}
+	}
+
+	for _, f := range result.OutputFiles {
+		addKey(f.Digest)
+	}
+	addKey(result.StdoutDigest)
+	addKey(result.StderrDigest)
+
+	for _, d := range result.OutputDirectories {
+		if d.TreeDigest == nil {
+			continue
+		}
+		addKey(d.TreeDigest)
+
+		tree := c.localTree(ctx, d.TreeDigest)
+		if tree == nil {
+			continue
+		}
+		for _, f := range tree.Root.GetFiles() {
+			addKey(f.Digest)
+		}
+		for _, child := range tree.GetChildren() {
+			for _, f := range child.GetFiles() {
+				addKey(f.Digest)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	for _, key := range keys {
+		c.lru.Get(key) // Promotes the item if it exists.
+	}
+	c.unlock()
+}
+
+// localTree returns the Tree with the given digest if it is in the local
+// cache, otherwise nil.
+func (c *diskCache) localTree(ctx context.Context, d *pb.Digest) *pb.Tree {
+	c.mu.Lock()
+	_, exists := c.lru.Peek(cache.LookupKey(cache.CAS, d.Hash))
+	c.unlock()
+	if !exists {
+		return nil
+	}
+
+	rc, _, err := c.get(cache.WithNoPromote(ctx), cache.CAS, d.Hash, d.SizeBytes, 0, false)
+	if err != nil || rc == nil {
+		return nil
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil
+	}
+
+	tree := &pb.Tree{}
+	err = proto.Unmarshal(data, tree)
+	if err != nil {
+		return nil
+	}
+	return tree
+}
@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"sync"
+)
+
+const (
+	// The number of counters to allocate per expected item, and the
+	// number of counters each key maps to. This gives a false positive
+	// rate of about 1% when the filter holds the expected number of items.
+	bloomCountersPerItem = 10
+	bloomNumHashes       = 7
+
+	// The minimum number of items to size the filter for, so that an
+	// initially empty cache has room to grow.
+	bloomMinItems = 1 << 20
+)
+
+// bloomFilter is a counting bloom filter of the keys in the LRU index.
+// It is used to skip the LRU lookup (and lock) for keys which are
+// definitely not in the cache. Counters saturate at their maximum value
+// and are never decremented after that, which can only cause false
+// positives.
+//
+// Lookups with false positives fall through to the LRU index, so the
+// filter only needs to be accurate in one direction: a key which is in
+// the LRU index must always be reported as possibly present.
+type bloomFilter struct {
+	mu       sync.RWMutex
+	counters []uint8
+}
+
+func newBloomFilter(expectedItems int) *bloomFilter {
+	if expectedItems < bloomMinItems {
+		expectedItems = bloomMinItems
+	}
+
+	return &bloomFilter{
+		counters: make([]uint8, expectedItems*bloomCountersPerItem),
+	}
+}
+
+// indexes returns the counter indexes for key, using double hashing
+// of a 64 bit FNV-1a hash.
+func (b *bloomFilter) indexes(key string) [bloomNumHashes]uint64 {
+	const offset64 = 14695981039346656037
+	const prime64 = 1099511628211
+
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+
+	h1 := h & 0xffffffff
+	h2 := (h >> 32) | 1
+
+	n := uint64(len(b.counters))
+
+	var idx [bloomNumHashes]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) % n
+	}
+
+	return idx
+}
+
+func (b *bloomFilter) add(key string) {
+	idx := b.indexes(key)
+
+	b.mu.Lock()
+	for _, i := range idx {
+		if b.counters[i] < 255 {
+			b.counters[i]++
+		}
+	}
+	b.mu.Unlock()
+}
+
+func (b *bloomFilter) remove(key string) {
+	idx := b.indexes(key)
+
+	b.mu.Lock()
+	for _, i := range idx {
+		if b.counters[i] > 0 && b.counters[i] < 255 {
+			b.counters[i]--
+		}
+	}
+	b.mu.Unlock()
+}
+
+// mayContain returns false if key is definitely not in the filter.
+func (b *bloomFilter) mayContain(key string) bool {
+	idx := b.indexes(key)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, i := range idx {
+		if b.counters[i] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,6 +2,7 @@ package casblob
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -43,7 +44,7 @@ type header struct {
 	// Then we put our metadata:
 
 	uncompressedSize int64           // 8 bytes
-	compression      CompressionType // uint8, 1 byte
+	compression      CompressionType // uint8, 1 byte, see also encryptedFlag
 	chunkSize        uint32          // 4 bytes
 
 	// Offsets in the file on disk, of each chunk, with an additional
@@ -53,6 +54,9 @@ type header struct {
 	// and a final value for the size of the file (header + data).
 	// 8 bytes + (n+1)*8 bytes.
 	chunkOffsets []int64
+
+	// Stored as encryptedFlag in the compression field.
+	encrypted bool
 }
 
 const chunkTableOffset = 4 + 4 + 8 + 1 + 4 + 8
@@ -119,6 +123,10 @@ func readHeader(f *os.File) (*header, error) {
 	if err != nil {
 		return nil, err
 	}
+	if h.compression&encryptedFlag != 0 {
+		h.encrypted = true
+		h.compression &^= encryptedFlag
+	}
 
 	err = binary.Read(f, binary.LittleEndian, &h.chunkSize)
 	if err != nil {
@@ -211,11 +219,36 @@ func (m *multiReadCloser) Close() error {
 	return m.rc.Close()
 }
 
-// Returns an io.ReadCloser that provides uncompressed data. The caller
-// must close the returned io.ReadCloser if it is non-nil. Doing so
-// will automatically close f. If there is an error f will be closed, the caller
-// does not need to do so.
-func GetUncompressedReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize int64, offset int64) (io.ReadCloser, error) {
+// Returns an io.ReadCloser that provides uncompressed data, starting at
+// offset. If length is non-negative, at most length bytes are returned and
+// chunks after that point are not decompressed. The caller must close the
+// returned io.ReadCloser if it is non-nil. Doing so will automatically
+// close f. If there is an error f will be closed, the caller does not need
+// to do so. aead is used to decrypt encrypted blobs, and may be nil if
+// there are none. hash is the blob's hash, which encrypted blobs are
+// authenticated with.
+func GetUncompressedReadCloser(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, f *os.File, hash string, expectedSize int64, offset int64, length int64) (io.ReadCloser, error) {
+	rc, err := getUncompressedReadCloser(zstd, aead, f, hash, expectedSize, offset)
+	if err != nil || length < 0 {
+		return rc, err
+	}
+
+	return &limitedReadCloser{
+		Reader: io.LimitReader(rc, length),
+		rc:     rc,
+	}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader // This will be a LimitedReader.
+	rc        io.ReadCloser
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+func getUncompressedReadCloser(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, f *os.File, hash string, expectedSize int64, offset int64) (io.ReadCloser, error) {
 	h, err := readHeader(f)
 	if err != nil {
 		f.Close()
@@ -228,6 +261,10 @@ func GetUncompressedReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize
 			expectedSize, h.uncompressedSize)
 	}
 
+	if h.encrypted {
+		return getDecryptedReadCloser(zstd, aead, h, f, hash, offset)
+	}
+
 	if h.compression == Identity {
 		// Simple case. Assumes that we only have one chunk if the data is
 		// uncompressed (which makes sense).
@@ -315,8 +352,10 @@ func GetUncompressedReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize
 // Returns an io.ReadCloser that provides zstandard compressed data. The
 // caller must close the returned io.ReadCloser if it is non-nil. Doing so
 // will automatically close f. If there is an error f will be closed, the caller
-// does not need to do so.
-func GetZstdReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize int64, offset int64) (io.ReadCloser, error) {
+// does not need to do so. aead is used to decrypt encrypted blobs, and may be
+// nil if there are none. hash is the blob's hash, which encrypted blobs are
+// authenticated with.
+func GetZstdReadCloser(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, f *os.File, hash string, expectedSize int64, offset int64) (io.ReadCloser, error) {
 
 	h, err := readHeader(f)
 	if err != nil {
@@ -330,6 +369,10 @@ func GetZstdReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize int64, o
 			expectedSize, h.uncompressedSize)
 	}
 
+	if h.encrypted {
+		return getDecryptedZstdReadCloser(zstd, aead, h, f, hash, offset)
+	}
+
 	if h.compression == Identity {
 		// Simple case. Assumes that we only have one chunk if the data is
 		// uncompressed (which makes sense).
@@ -412,8 +455,8 @@ func GetZstdReadCloser(zstd zstdimpl.ZstdImpl, f *os.File, expectedSize int64, o
 }
 
 // GetLegacyZstdReadCloser returns an io.ReadCloser that provides
-// zstandard-compressed data from an uncompressed file.
-func GetLegacyZstdReadCloser(zstd zstdimpl.ZstdImpl, f *os.File) (io.ReadCloser, error) {
+// zstandard-compressed data from an uncompressed file (or other reader).
+func GetLegacyZstdReadCloser(zstd zstdimpl.ZstdImpl, f io.ReadCloser) (io.ReadCloser, error) {
 
 	pr, pw := io.Pipe()
 
@@ -453,9 +496,14 @@ func GetLegacyZstdReadCloser(zstd zstdimpl.ZstdImpl, f *os.File) (io.ReadCloser,
 	return pr, nil
 }
 
-func (h *header) write(f *os.File) error {
+func (h *header) write(f io.Writer) error {
 	var err error
 
+	compression := h.compression
+	if h.encrypted {
+		compression |= encryptedFlag
+	}
+
 	err = binary.Write(f, binary.LittleEndian, uint32(skippableFrameMagicNumber))
 	if err != nil {
 		return err
@@ -471,7 +519,7 @@ func (h *header) write(f *os.File) error {
 		return err
 	}
 
-	err = binary.Write(f, binary.LittleEndian, h.compression)
+	err = binary.Write(f, binary.LittleEndian, compression)
 	if err != nil {
 		return err
 	}
@@ -517,9 +565,38 @@ var chunkBufferPool = &sync.Pool{
 	},
 }
 
-// Read from r and write to f, using CompressionType t.
-// Return the size on disk or an error if something went wrong.
-func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t CompressionType, hash string, size int64) (int64, error) {
+// Returns the size of the chunks to compress independently with zstd.
+// In long mode the chunks are as large as the window, since matches
+// cannot be found across chunk boundaries.
+func chunkSizeFor(zstd zstdimpl.ZstdImpl) uint32 {
+	if windowSize := zstd.LongModeWindowSize(); windowSize > defaultChunkSize {
+		return uint32(windowSize)
+	}
+	return defaultChunkSize
+}
+
+// Returns a buffer which can hold a chunk of the given size from a blob
+// of the given size, and a function to call once the buffer is no longer
+// used. Large chunks are only used in long mode, and are not pooled.
+func getChunkBuffer(chunkSize uint32, size int64) ([]byte, func()) {
+	if chunkSize <= defaultChunkSize {
+		chunkBufferPtr := chunkBufferPool.Get().(*[]byte)
+		return *chunkBufferPtr, func() { chunkBufferPool.Put(chunkBufferPtr) }
+	}
+
+	return make([]byte, min(int64(chunkSize), size)), func() {}
+}
+
+// Read from r and write to f, using CompressionType t, then call sync
+// on f before closing it. If aead is not nil, the data is encrypted with
+// it. Return the size on disk or an error if something went wrong.
+func WriteAndClose(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, r io.Reader, f *os.File, t CompressionType, hash string, size int64, sync func(*os.File) error) (int64, error) {
+	return WriteAndCloseVia(zstd, aead, r, f, f, t, hash, size, sync)
+}
+
+// Like WriteAndClose, but writes to f go through w, which must write to
+// f at its current offset (eg to retry transient write errors).
+func WriteAndCloseVia(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, r io.Reader, f *os.File, w io.Writer, t CompressionType, hash string, size int64, sync func(*os.File) error) (int64, error) {
 	var err error
 	defer f.Close()
 
@@ -527,11 +604,16 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 		return -1, fmt.Errorf("invalid file size: %d", size)
 	}
 
+	if aead != nil {
+		return writeEncryptedAndClose(zstd, aead, r, f, w, t, hash, size, sync)
+	}
+
 	chunkSize := uint32(defaultChunkSize)
 
 	numChunks := int64(1)
 	remainder := int64(0)
 	if t == Zstandard {
+		chunkSize = chunkSizeFor(zstd)
 		numChunks = size / int64(chunkSize)
 		remainder = size % int64(chunkSize)
 		if remainder > 0 {
@@ -549,7 +631,7 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 
 	h.chunkOffsets[0] = chunkTableOffset
 
-	err = h.write(f)
+	err = h.write(w)
 	if err != nil {
 		return -1, err
 	}
@@ -561,7 +643,7 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 	if t == Identity {
 		hasher := sha256.New()
 
-		n, err = io.Copy(io.MultiWriter(f, hasher), r)
+		n, err = io.Copy(io.MultiWriter(w, hasher), r)
 		if err != nil {
 			return -1, err
 		}
@@ -577,6 +659,25 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 					hash, actualHash)
 		}
 
+		// The data is stored in a single chunk.
+		h.chunkOffsets[0] = fileOffset
+		h.chunkOffsets[1] = fileOffset + n
+
+		_, err = f.Seek(chunkTableOffset, io.SeekStart)
+		if err != nil {
+			return -1, fmt.Errorf("Failed to seek to offset %d: %w", chunkTableOffset, err)
+		}
+
+		err = binary.Write(w, binary.LittleEndian, h.chunkOffsets)
+		if err != nil {
+			return -1, fmt.Errorf("Failed to write chunk offsets: %w", err)
+		}
+
+		err = sync(f)
+		if err != nil {
+			return -1, fmt.Errorf("Failed to sync file: %w", err)
+		}
+
 		return n + fileOffset, f.Close()
 	}
 
@@ -586,11 +687,8 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 	remainingRawData := size
 	var numRead int
 
-	chunkBufferPtr := chunkBufferPool.Get().(*[]byte)
-	defer func() {
-		chunkBufferPool.Put(chunkBufferPtr)
-	}()
-	uncompressedChunk := *chunkBufferPtr
+	uncompressedChunk, releaseChunk := getChunkBuffer(chunkSize, size)
+	defer releaseChunk()
 
 	hasher := sha256.New()
 
@@ -613,7 +711,7 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 
 		hasher.Write(uncompressedChunk[0:chunkEnd])
 
-		written, err := f.Write(compressedChunk)
+		written, err := w.Write(compressedChunk)
 		if err != nil {
 			return -1, fmt.Errorf("Failed to write compressed chunk to disk: %w", err)
 		}
@@ -642,12 +740,12 @@ func WriteAndClose(zstd zstdimpl.ZstdImpl, r io.Reader, f *os.File, t Compressio
 		return -1, fmt.Errorf("Failed to seek to offset %d: %w", chunkTableOffset, err)
 	}
 
-	err = binary.Write(f, binary.LittleEndian, h.chunkOffsets)
+	err = binary.Write(w, binary.LittleEndian, h.chunkOffsets)
 	if err != nil {
 		return -1, fmt.Errorf("Failed to write chunk offsets: %w", err)
 	}
 
-	err = f.Sync()
+	err = sync(f)
 	if err != nil {
 		return -1, fmt.Errorf("Failed to sync file: %w", err)
 	}
@@ -2,6 +2,9 @@ package casblob_test
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -79,3 +82,304 @@ func TestZstdFromLegacy(t *testing.T) {
 		t.Fatalf("Unexpected content sha %s, expected %s", hs, hash)
 	}
 }
+
+func TestZstdEncoderOptionsRoundTrip(t *testing.T) {
+	size := int64(3 * 1024 * 1024)
+
+	testCases := []zstdimpl.EncoderOptions{
+		{LongMode: true},
+		{Level: "default"},
+		{Level: "better"},
+		{Level: "best", LongMode: true},
+	}
+
+	for _, impl := range []string{"go", "cgo"} {
+		for _, opts := range testCases {
+			zstd, err := zstdimpl.GetWithOptions(impl, opts)
+			if err != nil {
+				t.Logf("Skipping unavailable zstd implementation %q: %v", impl, err)
+				break
+			}
+
+			data, hash := testutils.RandomDataAndHash(size)
+			filename := fmt.Sprintf("%s/%s", testutils.TempDir(t), hash)
+			file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = casblob.WriteAndClose(zstd, nil, bytes.NewReader(data), file,
+				casblob.Zstandard, hash, size, (*os.File).Sync)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file, err = os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := casblob.GetUncompressedReadCloser(zstd, nil, file, hash, size, 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := bytes.NewBuffer(nil)
+			_, err = io.Copy(buf, rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatalf("Data mismatch after round trip with %q implementation and options %+v",
+					impl, opts)
+			}
+		}
+	}
+}
+
+func TestZstdLongModeRatio(t *testing.T) {
+	// Random data which is repeated further apart than the default chunk
+	// size, so that only long mode can find the repetition.
+	half, _ := testutils.RandomDataAndHash(2 * 1024 * 1024)
+	data := append(append([]byte{}, half...), half...)
+	size := int64(len(data))
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	for _, impl := range []string{"go", "cgo"} {
+		var sizeOnDisk [2]int64
+		for i, longMode := range []bool{false, true} {
+			zstd, err := zstdimpl.GetWithOptions(impl,
+				zstdimpl.EncoderOptions{LongMode: longMode})
+			if err != nil {
+				t.Logf("Skipping unavailable zstd implementation %q: %v", impl, err)
+				break
+			}
+
+			filename := fmt.Sprintf("%s/%s", testutils.TempDir(t), hash)
+			file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sizeOnDisk[i], err = casblob.WriteAndClose(zstd, nil, bytes.NewReader(data), file,
+				casblob.Zstandard, hash, size, (*os.File).Sync)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Check a read from inside the chunk too.
+			offset := size/2 + 7
+			file, err = os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := casblob.GetUncompressedReadCloser(zstd, nil, file, hash, size, offset, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(found, data[offset:]) {
+				t.Fatalf("Data mismatch with %q implementation and long mode %v", impl, longMode)
+			}
+		}
+
+		if sizeOnDisk[1] == 0 {
+			continue
+		}
+
+		t.Logf("%q implementation: %d bytes without long mode, %d bytes with long mode",
+			impl, sizeOnDisk[0], sizeOnDisk[1])
+		if sizeOnDisk[0] < size {
+			t.Fatalf("Expected random data to be incompressible without long mode, found %d bytes",
+				sizeOnDisk[0])
+		}
+		if sizeOnDisk[1] > size*3/4 {
+			t.Fatalf("Expected long mode to find the repetition with %q implementation, found %d bytes",
+				impl, sizeOnDisk[1])
+		}
+	}
+}
+
+func TestIdentityRoundTrip(t *testing.T) {
+	size := int64(1024)
+	zstd, err := zstdimpl.Get("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(size)
+	filename := fmt.Sprintf("%s/%s", testutils.TempDir(t), hash)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = casblob.WriteAndClose(zstd, nil, bytes.NewReader(data), file,
+		casblob.Identity, hash, size, (*os.File).Sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := casblob.GetUncompressedReadCloser(zstd, nil, file, hash, size, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(found, data) {
+		t.Fatal("Data mismatch after round trip of an uncompressed casblob")
+	}
+}
+
+func newTestAEAD(t *testing.T) cipher.AEAD {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	zstd, err := zstdimpl.Get("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead := newTestAEAD(t)
+
+	// Large enough for multiple chunks, with a partial final chunk.
+	size := int64(2*1024*1024 + 1000)
+	data, hash := testutils.RandomDataAndHash(size)
+
+	for _, compression := range []casblob.CompressionType{casblob.Identity, casblob.Zstandard} {
+		dir := testutils.TempDir(t)
+		filename := fmt.Sprintf("%s/%s", dir, hash)
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = casblob.WriteAndClose(zstd, aead, bytes.NewReader(data), file,
+			compression, hash, size, (*os.File).Sync)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		onDisk, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(onDisk, data[:1024]) {
+			t.Fatalf("Found plaintext on disk with compression %d", compression)
+		}
+
+		for _, offset := range []int64{0, 1, 1024 * 1024, 1024*1024 + 7, size - 1} {
+			file, err = os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := casblob.GetUncompressedReadCloser(zstd, aead, file, hash, size, offset, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(found, data[offset:]) {
+				t.Fatalf("Data mismatch at offset %d with compression %d", offset, compression)
+			}
+		}
+
+		// Full zstd reads return an unencrypted casblob.
+		file, err = os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zrc, err := casblob.GetZstdReadCloser(zstd, aead, file, hash, size, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainFilename := filename + ".plain"
+		plainFile, err := os.Create(plainFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(plainFile, zrc)
+		zrc.Close()
+		plainFile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plainFile, err = os.Open(plainFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := casblob.GetUncompressedReadCloser(zstd, nil, plainFile, hash, size, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, data) {
+			t.Fatalf("Data mismatch in zstd read with compression %d", compression)
+		}
+
+		// The blob cannot be read with another key, or without a key.
+		for _, otherAEAD := range []cipher.AEAD{newTestAEAD(t), nil} {
+			file, err = os.Open(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := casblob.GetUncompressedReadCloser(zstd, otherAEAD, file, hash, size, 0, -1)
+			if err == nil {
+				_, err = io.ReadAll(rc)
+				rc.Close()
+			}
+			if err == nil {
+				t.Fatalf("Expected an error when reading with the wrong key, compression %d", compression)
+			}
+		}
+
+		// The blob cannot be read as a blob with another hash.
+		_, otherHash := testutils.RandomDataAndHash(size)
+		file, err = os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err = casblob.GetUncompressedReadCloser(zstd, aead, file, otherHash, size, 0, -1)
+		if err == nil {
+			_, err = io.ReadAll(rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Fatalf("Expected an error when reading with the wrong hash, compression %d", compression)
+		}
+	}
+}
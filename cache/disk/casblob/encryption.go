@@ -0,0 +1,353 @@
+package casblob
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk/zstdimpl"
+)
+
+// If this bit is set in the compression field on disk, each chunk
+// is sealed with AES-GCM after it has been compressed (or not). Encrypted
+// blobs are always split into chunks, even if they are not compressed.
+//
+// Each encrypted chunk is stored as a random nonce followed by the sealed
+// data. The chunk number, the blob's uncompressed size and its lookup key
+// (which includes the kind and the hash) are used as additional
+// authenticated data, so chunks cannot be reordered, or moved between
+// blobs, without being detected.
+const encryptedFlag CompressionType = 0x80
+
+var errNoEncryptionKey = errors.New("found an encrypted blob, but no encryption key was provided")
+
+// Returns the additional authenticated data for the given chunk of the
+// cas blob with the given hash.
+func chunkAAD(hash string, chunkNum int64, uncompressedSize int64) []byte {
+	key := cache.LookupKey(cache.CAS, hash)
+	aad := make([]byte, 16, 16+len(key))
+	binary.LittleEndian.PutUint64(aad, uint64(chunkNum))
+	binary.LittleEndian.PutUint64(aad[8:], uint64(uncompressedSize))
+	return append(aad, key...)
+}
+
+func sealChunk(aead cipher.AEAD, hash string, chunkNum int64, uncompressedSize int64, data []byte) ([]byte, error) {
+	sealed := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := rand.Read(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(sealed, sealed, data, chunkAAD(hash, chunkNum, uncompressedSize)), nil
+}
+
+func openChunk(aead cipher.AEAD, hash string, chunkNum int64, uncompressedSize int64, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("encrypted chunk %d is too small (%d)", chunkNum, len(sealed))
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], chunkAAD(hash, chunkNum, uncompressedSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d: %w", chunkNum, err)
+	}
+
+	return data, nil
+}
+
+// Like the chunked part of WriteAndClose, but each chunk is encrypted.
+func writeEncryptedAndClose(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, r io.Reader, f *os.File, w io.Writer, t CompressionType, hash string, size int64, sync func(*os.File) error) (int64, error) {
+	chunkSize := uint32(defaultChunkSize)
+	if t == Zstandard {
+		chunkSize = chunkSizeFor(zstd)
+	}
+
+	numChunks := size / int64(chunkSize)
+	if size%int64(chunkSize) > 0 {
+		numChunks++
+	}
+
+	h := header{
+		uncompressedSize: size,
+		compression:      t,
+		chunkSize:        chunkSize,
+		chunkOffsets:     make([]int64, numChunks+1),
+		encrypted:        true,
+	}
+
+	err := h.write(w)
+	if err != nil {
+		return -1, err
+	}
+
+	fileOffset := h.size()
+	remainingRawData := size
+
+	uncompressedChunk, releaseChunk := getChunkBuffer(chunkSize, size)
+	defer releaseChunk()
+
+	hasher := sha256.New()
+
+	for chunkNum := int64(0); chunkNum < numChunks; chunkNum++ {
+		h.chunkOffsets[chunkNum] = fileOffset
+
+		chunkEnd := int64(chunkSize)
+		if remainingRawData <= int64(chunkSize) {
+			chunkEnd = remainingRawData
+		}
+		remainingRawData -= chunkEnd
+
+		numRead, err := io.ReadFull(r, uncompressedChunk[0:chunkEnd])
+		if err != nil {
+			return -1, fmt.Errorf("Only managed to read %d of %d bytes: %w", numRead, chunkEnd, err)
+		}
+
+		hasher.Write(uncompressedChunk[0:chunkEnd])
+
+		chunk := uncompressedChunk[0:chunkEnd]
+		if t == Zstandard {
+			chunk = zstd.EncodeAll(chunk)
+		}
+
+		sealedChunk, err := sealChunk(aead, hash, chunkNum, size, chunk)
+		if err != nil {
+			return -1, fmt.Errorf("Failed to encrypt chunk: %w", err)
+		}
+
+		written, err := w.Write(sealedChunk)
+		if err != nil {
+			return -1, fmt.Errorf("Failed to write encrypted chunk to disk: %w", err)
+		}
+
+		fileOffset += int64(written)
+	}
+	h.chunkOffsets[numChunks] = fileOffset
+
+	// Confirm that there is no data left to be read.
+	bytesAfter, err := io.ReadFull(r, uncompressedChunk)
+	if err == nil {
+		return -1, fmt.Errorf("expected %d bytes but got at least %d more", size, bytesAfter)
+	} else if err != io.EOF {
+		return -1, fmt.Errorf("Failed to read chunk of size %d: %w", len(uncompressedChunk), err)
+	}
+
+	// The hash is checked against the plaintext.
+	actualHash := hex.EncodeToString(hasher.Sum(nil))
+	if actualHash != hash {
+		return -1, fmt.Errorf("checksums don't match. Expected %s, found %s",
+			hash, actualHash)
+	}
+
+	_, err = f.Seek(chunkTableOffset, io.SeekStart)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to seek to offset %d: %w", chunkTableOffset, err)
+	}
+
+	err = binary.Write(w, binary.LittleEndian, h.chunkOffsets)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to write chunk offsets: %w", err)
+	}
+
+	err = sync(f)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to sync file: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return -1, fmt.Errorf("Failed to close file: %w", err)
+	}
+
+	return fileOffset, nil
+}
+
+// Provides an io.ReadCloser that returns the decrypted chunks of an
+// encrypted cas blob, optionally decompressing them.
+type decryptingReader struct {
+	*header
+
+	zstd       zstdimpl.ZstdImpl
+	aead       cipher.AEAD
+	hash       string
+	decompress bool
+
+	nextChunk int64
+	buf       []byte // The remaining data from the current chunk.
+
+	file *os.File
+}
+
+// Returns a decryptingReader for h's chunks, starting from the given
+// chunk. f must already be positioned at the start of that chunk.
+func newDecryptingReader(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, h *header, f *os.File, hash string, chunkNum int64, decompress bool) *decryptingReader {
+	return &decryptingReader{
+		header:     h,
+		zstd:       zstd,
+		aead:       aead,
+		hash:       hash,
+		decompress: decompress,
+		nextChunk:  chunkNum,
+		file:       f,
+	}
+}
+
+func (d *decryptingReader) readChunk() ([]byte, error) {
+	chunkNum := d.nextChunk
+	sealed := make([]byte, d.chunkOffsets[chunkNum+1]-d.chunkOffsets[chunkNum])
+	_, err := io.ReadFull(d.file, sealed)
+	if err != nil {
+		return nil, err
+	}
+	d.nextChunk++
+
+	data, err := openChunk(d.aead, d.hash, chunkNum, d.uncompressedSize, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.decompress && d.compression == Zstandard {
+		return d.zstd.DecodeAll(data)
+	}
+
+	return data, nil
+}
+
+func (d *decryptingReader) numChunks() int64 {
+	return int64(len(d.chunkOffsets) - 1)
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.nextChunk >= d.numChunks() {
+			return 0, io.EOF
+		}
+
+		var err error
+		d.buf, err = d.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return n, nil
+}
+
+func (d *decryptingReader) Close() error {
+	if d.file == nil {
+		return nil
+	}
+
+	f := d.file
+	d.file = nil
+
+	return f.Close()
+}
+
+// Returns an io.ReadCloser that provides uncompressed data from an
+// encrypted blob with header h, starting at offset. f is closed on error.
+func getDecryptedReadCloser(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, h *header, f *os.File, hash string, offset int64) (io.ReadCloser, error) {
+	if aead == nil {
+		f.Close()
+		return nil, errNoEncryptionKey
+	}
+
+	// Find the first relevant chunk.
+	chunkNum := int64(offset / int64(h.chunkSize))
+	remainder := offset % int64(h.chunkSize)
+
+	if chunkNum >= int64(len(h.chunkOffsets)-1) {
+		f.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	_, err := f.Seek(h.chunkOffsets[chunkNum], io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := newDecryptingReader(zstd, aead, h, f, hash, chunkNum, true)
+	if remainder > 0 {
+		firstChunk, err := d.readChunk()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if remainder < int64(len(firstChunk)) {
+			d.buf = firstChunk[remainder:]
+		}
+	}
+
+	return d, nil
+}
+
+// Returns an io.ReadCloser that provides a zstandard compressed stream of
+// an encrypted blob with header h, starting at offset. For full reads the
+// result is an unencrypted casblob, including the header, as returned by
+// GetZstdReadCloser for unencrypted blobs. f is closed on error.
+func getDecryptedZstdReadCloser(zstd zstdimpl.ZstdImpl, aead cipher.AEAD, h *header, f *os.File, hash string, offset int64) (io.ReadCloser, error) {
+	if aead == nil {
+		f.Close()
+		return nil, errNoEncryptionKey
+	}
+
+	if offset > 0 {
+		rc, err := getDecryptedReadCloser(zstd, aead, h, f, hash, offset)
+		if err != nil {
+			return nil, err
+		}
+		return GetLegacyZstdReadCloser(zstd, rc)
+	}
+
+	// Describe the same chunks without encryption.
+	plain := header{
+		uncompressedSize: h.uncompressedSize,
+		compression:      h.compression,
+		chunkSize:        h.chunkSize,
+	}
+	if h.compression == Zstandard {
+		plain.chunkOffsets = make([]int64, len(h.chunkOffsets))
+		overhead := int64(aead.NonceSize() + aead.Overhead())
+		plain.chunkOffsets[0] = h.chunkOffsets[0]
+		for i := 1; i < len(h.chunkOffsets); i++ {
+			chunkSize := h.chunkOffsets[i] - h.chunkOffsets[i-1] - overhead
+			plain.chunkOffsets[i] = plain.chunkOffsets[i-1] + chunkSize
+		}
+	} else {
+		// Uncompressed casblobs have a single chunk.
+		plain.chunkOffsets = make([]int64, 2)
+		plain.chunkOffsets[0] = plain.size()
+		plain.chunkOffsets[1] = plain.size() + h.uncompressedSize
+	}
+
+	var buf bytes.Buffer
+	err := plain.write(&buf)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	_, err = f.Seek(h.chunkOffsets[0], io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := newDecryptingReader(zstd, aead, h, f, hash, 0, false)
+
+	return &multiReadCloser{
+		Reader: io.MultiReader(&buf, d),
+		rc:     d,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package disk
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/buchgr/bazel-remote/v2/utils/tempfile"
+)
+
+// The directory, relative to the cache dir, which contains the
+// client-supplied content types of RAW entries. Each content type is
+// stored in a small file named after the RAW entry's hash.
+const rawContentTypesDir = "raw.content-types"
+
+// The maximum length of a stored content type.
+const maxContentTypeLength = 256
+
+func (c *diskCache) rawContentTypePath(hash string) string {
+	return filepath.Join(c.dir, rawContentTypesDir, hash)
+}
+
+// writeRawContentType stores contentType for the RAW entry with the given
+// hash, replacing any previous value. If contentType is empty, any
+// previous value is removed.
+func (c *diskCache) writeRawContentType(hash string, contentType string) error {
+	p := c.rawContentTypePath(hash)
+
+	if contentType == "" {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if len(contentType) > maxContentTypeLength {
+		contentType = contentType[:maxContentTypeLength]
+	}
+
+	f, random, err := tfc.Create(p, false)
+	if err != nil {
+		return err
+	}
+	tmpName := p + "-" + random
+
+	_, err = f.WriteString(contentType)
+	if err == nil {
+		err = f.Chmod(tempfile.FinalMode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, p)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// RawContentType returns the content type that was stored with the RAW
+// entry with the given hash, or "" if there is none.
+func (c *diskCache) RawContentType(hash string) string {
+	if !c.rawContentTypes {
+		return ""
+	}
+
+	data, err := os.ReadFile(c.rawContentTypePath(hash))
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+func (c *diskCache) removeRawContentType(hash string) {
+	err := os.Remove(c.rawContentTypePath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: failed to remove content type for RAW entry %s: %v", hash, err)
+	}
+}
@@ -1,11 +1,14 @@
 package disk
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net/http"
@@ -14,6 +17,8 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
@@ -30,6 +35,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -42,11 +48,20 @@ type Cache interface {
 	GetValidatedActionResult(ctx context.Context, hash string) (*pb.ActionResult, []byte, error)
 	GetZstd(ctx context.Context, hash string, size int64, offset int64) (io.ReadCloser, int64, error)
 	Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) error
-	Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64)
+	Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64, error)
 	FindMissingCasBlobs(ctx context.Context, blobs []*pb.Digest) ([]*pb.Digest, error)
 
 	MaxSize() int64
 	Stats() (totalSize int64, reservedSize int64, numItems int, uncompressedSize int64)
+	RecentStats() (hits int64, misses int64, evictions int64)
+	EvictTo(targetSize int64) (numItems int, numBytes int64)
+	EvictTag(tag string) (numItems int, numBytes int64)
+	Remove(kind cache.EntryKind, hash string) bool
+	Pin(kind cache.EntryKind, hash string) (bool, error)
+	Unpin(kind cache.EntryKind, hash string) (bool, error)
+	Pins() []string
+	RawContentType(hash string) string
+	StopWrites(ctx context.Context) error
 	RegisterMetrics()
 }
 
@@ -64,27 +79,211 @@ type lruItem struct {
 	// If true, the blob is a raw CAS file (no header, uncompressed)
 	// with a ".v1" filename suffix.
 	legacy bool
+
+	// If true, the item is not evicted to make space, see Pin.
+	pinned bool
 }
 
-// diskCache is a filesystem-based LRU cache, with an optional backend proxy.
+// diskCache is a filesystem-based LRU cache, with optional backend proxies.
 // It is safe for concurrent use.
 type diskCache struct {
-	dir              string
-	proxy            cache.Proxy
-	storageMode      casblob.CompressionType
-	zstd             zstdimpl.ZstdImpl
-	maxBlobSize      int64
-	maxProxyBlobSize int64
-	accessLogger     *log.Logger
-	containsQueue    chan proxyCheck
+	dir string
+
+	// Proxy backends by kind, may be nil or have nil values. RAW items
+	// use the same proxy backend as AC items.
+	proxies map[cache.EntryKind]cache.Proxy
+
+	// If true, the CAS proxy backend stores uncompressed blobs, even if
+	// the local storage mode is zstd.
+	uncompressedCASProxy bool
+
+	// If true, AC and RAW items are uploaded to the proxy backend, but
+	// never read from it.
+	noProxyForAC bool
+
+	storageMode casblob.CompressionType
+
+	// If non-nil, CAS blobs are encrypted with this cipher on disk.
+	aead cipher.AEAD
+
+	// If non-zero, CAS blobs larger than this are stored uncompressed,
+	// even in zstd mode.
+	zstdMaxSize int64
+
+	// If non-zero, CAS blobs whose first compressionBypassSampleSize bytes
+	// are incompressible are stored uncompressed, even in zstd mode.
+	compressionBypassSampleSize int
+	zstd                        zstdimpl.ZstdImpl
+	maxBlobSize                 int64
+	maxProxyBlobSize            int64
+	accessLogger                cache.Logger
+	containsQueue               chan proxyCheck
+
+	// CAS blobs referenced by recently validated ActionResults, which
+	// should be fetched from the proxy backend. Nil if disabled.
+	prefetchQueue chan *pb.Digest
+
+	// If true, existing AC entries are never replaced.
+	acWriteOnce bool
+
+	// Serialize the commits of AC entries with the same key when
+	// acWriteOnce is set, so that concurrent uploads of different
+	// ActionResults cannot all pass the comparison with the existing entry.
+	acWriteOnceLocks [acWriteOnceLockStripes]sync.Mutex
+
+	// If true, the CAS blobs referenced by new AC entries are moved to
+	// the front of the LRU.
+	protectACDeps bool
+
+	// If true, cache files are stored directly in the ac.v2/, cas.v2/ and
+	// raw.v2/ directories, instead of in subdirectories named after the
+	// first two characters of their hash.
+	flatLayout bool
+
+	// If true, New returns before the existing files have been loaded,
+	// and they are added to the LRU index in the background.
+	serveDuringLoad bool
+
+	// If true, files left behind by interrupted uploads are skipped
+	// rather than removed when the cache dir is scanned.
+	keepIncompleteFiles bool
+
+	// If true, the RAW keyspace is not loaded or created on disk, and
+	// RAW requests are rejected.
+	rawDisabled bool
+
+	// If true, the content types supplied with RAW uploads are stored,
+	// and returned by RawContentType.
+	rawContentTypes bool
+
+	// The number of directory entries to read at a time when migrating
+	// old directory structures, or 0 for the default.
+	migrationBatchSize int
+
+	// The maximum number of blobs to check when validating an
+	// ActionResult's dependencies, or 0 for no limit.
+	maxACValidationEntries int
+
+	// The maximum depth of OutputDirectory trees when validating an
+	// ActionResult, or 0 for no limit.
+	maxTreeDepth int
+
+	// The maximum number of OutputDirectory Tree blobs to read at the
+	// same time when validating an ActionResult. If 0 or 1, they are
+	// read one at a time.
+	acValidationConcurrency int
+
+	// The fraction of complete, uncompressed CAS reads to verify against
+	// their hash, or 0 to disable verification.
+	verifyOnReadRate float64
+
+	// The number of randomly chosen CAS blobs which are verified once
+	// the existing files are loaded, and whether blobs which fail are
+	// removed from the cache.
+	startupVerifySample int
+	startupVerifyEvict  bool
+
+	// If true, bloom is populated when the cache is loaded and
+	// consulted by FindMissingBlobs before the LRU index.
+	bloomFilterEnabled bool
+
+	// A filter of the keys in the LRU index, or nil if disabled.
+	bloom *bloomFilter
+
+	// Maps tags to AC entries, or nil if tagging is disabled. Protected
+	// by mu.
+	tags *tagIndex
+
+	// Keys which should not be read through from the proxy backend, or
+	// nil if tombstones are disabled.
+	tombstones *tombstoneSet
+
+	// The lookup keys of the pinned items, see Pin. Protected by mu.
+	pins map[string]struct{}
+
+	// Serializes Pin and Unpin, so that the pin files can be created
+	// and removed without holding mu.
+	pinsMu sync.Mutex
+
+	// Called to flush new cache files to stable storage.
+	syncFile syncFunc
 
 	// Limit the number of simultaneous file removals.
 	fileRemovalSem *semaphore.Weighted
 
+	// The files of items which were evicted while mu was held, which
+	// are removed when it is released. Guarded by mu.
+	evictedFiles []string
+
+	// The maximum number of files from a single batch of evictions (eg
+	// those made room for by one upload) which are removed concurrently,
+	// or 0 for no limit other than fileRemovalSem.
+	evictionRemovalConcurrency int
+
+	// If non-empty, new cache files are written in this directory and
+	// moved to their final path when they are complete. It must be on
+	// the same filesystem as dir.
+	tempDir string
+
+	// The number of times that writes to new cache files are retried
+	// if they fail with one of diskWriteRetryErrnos.
+	diskWriteRetries     int
+	diskWriteRetryErrnos []syscall.Errno
+
+	// If non-empty, evicted files are moved to this directory, and
+	// removed after trashTTL.
+	trashDir string
+	trashTTL time.Duration
+
+	// If non-nil, notified when items are added to or evicted from
+	// the cache.
+	events EventSink
+
+	// If true, the canonical empty Tree is treated as always present,
+	// like the empty CAS blob.
+	synthesizeEmptyTree bool
+
+	// If true, Put fails with errReadOnly and items are not read through
+	// from the proxy backend. This is set by WithReadOnly, or when writes
+	// fail because the filesystem is read-only.
+	readOnly atomic.Bool
+
+	// Tracks in-flight Put calls, and refuses new ones after StopWrites
+	// is called.
+	writes writeGate
+
+	// Limit the number of simultaneous proxy backend downloads, or nil
+	// for no limit. High priority requests acquire this first.
+	proxyDownloadSem *prioritySemaphore
+
+	// If true, Contains and FindMissingCasBlobs return errors when the
+	// proxy backend cannot be checked, instead of reporting a miss.
+	strictProxyErrors bool
+
+	// The fraction of the cache size which can be reserved for in-flight
+	// uploads, or 0 for no limit.
+	maxReservedFraction float64
+
+	// The number of Get and GetZstd calls in the last hour which found,
+	// or did not find, the requested blob.
+	recentHits   hourlyCounter
+	recentMisses hourlyCounter
+
 	mu  sync.Mutex
 	lru SizedLRU
 
 	gaugeCacheAge prometheus.Gauge
+
+	// The number of internal LRU invariant violations, eg failures to
+	// add a committed item or to release its reserved space.
+	counterLRUInconsistency prometheus.Counter
+
+	// The number of disk writes that were retried after a transient error.
+	counterDiskWriteRetries prometheus.Counter
+
+	// If true, the server exits on LRU invariant violations instead of
+	// dropping the affected entry and continuing.
+	failOnLRUInconsistency bool
 }
 
 const sha256HashStrSize = sha256.Size * 2 // Two hex characters per byte.
@@ -97,6 +296,15 @@ func internalErr(err error) *cache.Error {
 	}
 }
 
+// proxyErr returns an error for a proxy backend failure, which is
+// reported to clients as the service being unavailable.
+func proxyErr(err error) *cache.Error {
+	return &cache.Error{
+		Code: http.StatusServiceUnavailable,
+		Text: "proxy backend error: " + err.Error(),
+	}
+}
+
 func badReqErr(format string, a ...interface{}) *cache.Error {
 	return &cache.Error{
 		Code: http.StatusBadRequest,
@@ -109,6 +317,8 @@ func (c *diskCache) RegisterMetrics() {
 	c.lru.RegisterMetrics()
 
 	prometheus.MustRegister(c.gaugeCacheAge)
+	prometheus.MustRegister(c.counterLRUInconsistency)
+	prometheus.MustRegister(c.counterDiskWriteRetries)
 
 	// Update the cache age metric on a static interval
 	// Note: this could be modeled as a GuageFunc that updates as needed
@@ -145,7 +355,7 @@ func (c *diskCache) updateCacheAgeMetric() {
 		}
 	}
 
-	c.mu.Unlock()
+	c.unlock()
 
 	if validAge {
 		c.gaugeCacheAge.Set(age)
@@ -167,55 +377,123 @@ func (c *diskCache) getElementPath(key Key, value lruItem) string {
 	return filepath.Join(c.dir, c.FileLocation(kind, value.legacy, hash, value.size, value.random))
 }
 
+// unlock releases c.mu, and then removes the files of the items which
+// were evicted while it was held.
+func (c *diskCache) unlock() {
+	files := c.evictedFiles
+	c.evictedFiles = nil
+	c.mu.Unlock()
+
+	c.removeEvicted(files)
+}
+
+// removeEvicted removes the evicted files (or moves them to the trash
+// dir) in the background, at most evictionRemovalConcurrency at a time if
+// that is set. Removals are also limited by c.fileRemovalSem.
+func (c *diskCache) removeEvicted(files []string) {
+	if len(files) == 0 {
+		return
+	}
+
+	remove := c.removeFile
+	if c.trashDir != "" {
+		remove = c.moveToTrash
+	}
+
+	if c.evictionRemovalConcurrency <= 0 {
+		for _, f := range files {
+			go remove(f)
+		}
+		return
+	}
+
+	go func() {
+		var g errgroup.Group
+		g.SetLimit(c.evictionRemovalConcurrency)
+		for _, f := range files {
+			g.Go(func() error {
+				remove(f)
+				return nil
+			})
+		}
+		_ = g.Wait()
+	}()
+}
+
 func (c *diskCache) removeFile(f string) {
-	if err := c.fileRemovalSem.Acquire(context.Background(), 1); err != nil {
-		log.Printf("ERROR: failed to aquire semaphore: %v, unable to remove %s", err, f)
+	if !c.acquireFileRemovalSem(f) {
 		return
 	}
 	defer c.fileRemovalSem.Release(1)
 
+	c.removeFileNow(f)
+}
+
+// acquireFileRemovalSem returns true if a slot was acquired in
+// c.fileRemovalSem, which the caller must release, before removing f.
+func (c *diskCache) acquireFileRemovalSem(f string) bool {
+	if err := c.fileRemovalSem.Acquire(context.Background(), 1); err != nil {
+		log.Printf("ERROR: failed to aquire semaphore: %v, unable to remove %s", err, f)
+		return false
+	}
+	return true
+}
+
+func (c *diskCache) removeFileNow(f string) {
 	err := os.Remove(f)
 	if err != nil {
 		log.Printf("ERROR: failed to remove evicted cache file: %s", f)
 	}
 }
 
+// blobDir returns the directory containing the files for hash, relative to
+// the cache dir. kindDir is the top level directory for the keyspace, eg
+// "cas.v2". By default files are stored in subdirectories named after the
+// first two characters of their hash, unless the flat layout is used.
+func (c *diskCache) blobDir(kindDir string, hash string) string {
+	if c.flatLayout {
+		return kindDir
+	}
+
+	return path.Join(kindDir, hash[:2])
+}
+
 func (c *diskCache) FileLocationBase(kind cache.EntryKind, legacy bool, hash string, size int64) string {
 	if kind == cache.RAW {
-		return path.Join("raw.v2", hash[:2], hash)
+		return path.Join(c.blobDir("raw.v2", hash), hash)
 	}
 
 	if kind == cache.AC {
-		return path.Join("ac.v2", hash[:2], hash)
+		return path.Join(c.blobDir("ac.v2", hash), hash)
 	}
 
 	if legacy {
-		return path.Join("cas.v2", hash[:2], hash)
+		return path.Join(c.blobDir("cas.v2", hash), hash)
 	}
 
-	return fmt.Sprintf("cas.v2/%s/%s-%d", hash[:2], hash, size)
+	return fmt.Sprintf("%s/%s-%d", c.blobDir("cas.v2", hash), hash, size)
 }
 
 func (c *diskCache) FileLocation(kind cache.EntryKind, legacy bool, hash string, size int64, random string) string {
 	if kind == cache.RAW {
-		return path.Join("raw.v2", hash[:2], hash+"-"+random)
+		return path.Join(c.blobDir("raw.v2", hash), hash+"-"+random)
 	}
 
 	if kind == cache.AC {
-		return path.Join("ac.v2", hash[:2], hash+"-"+random)
+		return path.Join(c.blobDir("ac.v2", hash), hash+"-"+random)
 	}
 
 	if legacy {
-		return fmt.Sprintf("cas.v2/%s/%s-%s.v1", hash[:2], hash, random)
+		return fmt.Sprintf("%s/%s-%s.v1", c.blobDir("cas.v2", hash), hash, random)
 	}
 
-	return fmt.Sprintf("cas.v2/%s/%s-%d-%s", hash[:2], hash, size, random)
+	return fmt.Sprintf("%s/%s-%d-%s", c.blobDir("cas.v2", hash), hash, size, random)
 }
 
 // Put stores a stream of `size` bytes from `r` into the cache.
 // If `hash` is not the empty string, and the contents don't match it,
-// a non-nil error is returned. All data will be read from `r` before
-// this function returns.
+// a non-nil error is returned. Zero-size CAS blobs must have the empty
+// SHA256 hash. All data will be read from `r` before this function returns.
 func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string, size int64, r io.Reader) (rErr error) {
 	defer func() {
 		if r != nil {
@@ -227,6 +505,19 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 		return badReqErr("Invalid (negative) size: %d", size)
 	}
 
+	if c.readOnly.Load() {
+		return errReadOnly
+	}
+
+	if !c.writes.enter() {
+		return errNotAcceptingWrites
+	}
+	defer c.writes.exit()
+
+	if kind == cache.RAW && c.rawDisabled {
+		return errRawDisabled
+	}
+
 	if size > c.maxBlobSize {
 		return badReqErr("Blob size %d too large, max blob size is %d", size, c.maxBlobSize)
 	}
@@ -237,8 +528,26 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 		return badReqErr("Invalid hash size: %d, expected: %d", len(hash), sha256.Size)
 	}
 
-	if kind == cache.CAS && size == 0 && hash == emptySha256 {
-		return nil
+	if kind == cache.CAS && size == 0 {
+		if hash == emptySha256 {
+			return nil
+		}
+
+		// Only the empty blob can have size 0, anything else would
+		// create an entry that can never be read back correctly.
+		return badReqErr("Invalid zero-length CAS blob with non-empty hash: %s", hash)
+	}
+
+	writeOnce := kind == cache.AC && c.acWriteOnce
+	var writeOnceData []byte
+	if writeOnce {
+		var exists bool
+		var err error
+		writeOnceData, exists, err = c.compareExistingAC(ctx, hash, size, r)
+		if exists || err != nil {
+			return err
+		}
+		r = bytes.NewReader(writeOnceData)
 	}
 
 	key := cache.LookupKey(kind, hash)
@@ -270,29 +579,29 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 				rErr = internalErr(err)
 				log.Println(rErr.Error())
 			}
-			c.mu.Unlock()
+			c.unlock()
 		}
 	}()
 
 	if size > 0 {
 		c.mu.Lock()
-		ok, err := c.lru.Reserve(size)
+		ok, err := c.lru.ReserveUpload(size)
 		if err != nil {
-			c.mu.Unlock()
+			c.unlock()
 			return &cache.Error{
 				Code: http.StatusInsufficientStorage,
 				Text: err.Error(),
 			}
 		}
 		if !ok {
-			c.mu.Unlock()
+			c.unlock()
 			return &cache.Error{
 				Code: http.StatusInsufficientStorage,
 				Text: fmt.Sprintf("The item (%d) + reserved space is larger than the cache's maximum size (%d).",
 					size, c.lru.MaxSize()),
 			}
 		}
-		c.mu.Unlock()
+		c.unlock()
 		unreserve = true
 	}
 
@@ -302,8 +611,9 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 	filePath := path.Join(c.dir, c.FileLocationBase(kind, legacy, hash, size))
 
 	// We will download to this temporary file.
-	tf, random, err := tfc.Create(filePath, legacy)
+	tf, random, finalPath, err := c.createTempfile(filePath, legacy)
 	if err != nil {
+		c.checkReadOnlyFS(err)
 		return internalErr(err)
 	}
 	if tf == nil {
@@ -315,32 +625,144 @@ func (c *diskCache) Put(ctx context.Context, kind cache.EntryKind, hash string,
 	blobFile = tf.Name()
 	removeTempfile = true
 
+	// Keep a copy of ActionResults, to find their dependencies.
+	var src io.Reader = r
+	var acData *bytes.Buffer
+	if kind == cache.AC && c.protectACDeps && size <= maxProtectedACSize {
+		acData = bytes.NewBuffer(make([]byte, 0, size))
+		src = io.TeeReader(r, acData)
+	}
+
 	var sizeOnDisk int64
-	sizeOnDisk, err = c.writeAndCloseFile(ctx, r, kind, hash, size, tf)
+	sizeOnDisk, err = c.writeAndCloseFile(ctx, src, kind, hash, size, tf)
 	if err != nil {
+		c.checkReadOnlyFS(err)
 		return internalErr(err)
 	}
 
 	r = nil // We read all the data from r.
 
-	if c.proxy != nil {
-		rc, err := os.Open(blobFile)
+	err = moveToFinalPath(blobFile, finalPath)
+	if err != nil {
+		return internalErr(err)
+	}
+	blobFile = finalPath
+
+	if writeOnce {
+		// Another upload might have committed an entry since the
+		// comparison above. Hold the lock until the new entry has been
+		// committed, so that only one of them can be accepted.
+		mu := c.acWriteOnceLock(hash)
+		mu.Lock()
+		defer mu.Unlock()
+
+		oldData, exists, err := c.readLocalAC(hash)
+		if err != nil {
+			return internalErr(err)
+		}
+		if exists {
+			return compareAC(oldData, writeOnceData)
+		}
+	}
+
+	if proxy := c.proxies[kind]; proxy != nil {
+		rc, proxySize, err := c.openForProxy(kind, hash, blobFile, size, sizeOnDisk)
 		if err != nil {
 			log.Println("Failed to proxy Put:", err)
 		} else {
 			// Doesn't block, should be fast.
-			c.proxy.Put(ctx, kind, hash, size, sizeOnDisk, rc)
+			proxy.Put(ctx, kind, hash, size, proxySize, rc)
 		}
 	}
 
-	unreserve, removeTempfile, err = c.commit(key, legacy, blobFile, size, size, sizeOnDisk, random)
+	tag := ""
+	if kind != cache.CAS {
+		tag = cache.Tag(ctx)
+	}
+
+	// Store the content type first, so that it is available as soon as
+	// the entry can be read.
+	if kind == cache.RAW && c.rawContentTypes {
+		err = c.writeRawContentType(hash, cache.ContentType(ctx))
+		if err != nil {
+			log.Printf("Failed to store the content type of RAW entry %s: %v", hash, err)
+		}
+	}
+
+	unreserve, removeTempfile, err = c.commit(key, legacy, blobFile, size, size, sizeOnDisk, random, tag)
+	if cerr, ok := err.(*cache.Error); ok {
+		return cerr
+	}
 	if err != nil {
 		return internalErr(err)
 	}
 
+	if acData != nil {
+		c.touchACDependencies(ctx, acData.Bytes())
+	}
+
 	return nil
 }
 
+// Return an io.ReadCloser for blobFile in the format expected by the proxy
+// backend for `kind`, and the number of bytes that it will return.
+func (c *diskCache) openForProxy(kind cache.EntryKind, hash string, blobFile string, size int64, sizeOnDisk int64) (io.ReadCloser, int64, error) {
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if !c.transcodeForProxy(kind) {
+		return f, sizeOnDisk, nil
+	}
+
+	rc, err := casblob.GetUncompressedReadCloser(c.zstd, c.aead, f, hash, size, 0, -1)
+	if err != nil {
+		return nil, -1, err // f was closed by GetUncompressedReadCloser.
+	}
+
+	return rc, size, nil
+}
+
+// Return true if items of the given kind are stored in a different format
+// by the proxy backend than in the local cache.
+//
+// Encrypted blobs are always transcoded, so that proxy backends receive
+// plaintext.
+func (c *diskCache) transcodeForProxy(kind cache.EntryKind) bool {
+	return kind == cache.CAS && (c.uncompressedCASProxy || c.aead != nil) &&
+		c.storageMode != casblob.Identity
+}
+
+// If compressing a sample from the start of a blob saves less than this
+// percentage of its size, the blob is considered to be incompressible.
+const minCompressionSavingsPercent = 5
+
+// chooseCompression compresses a sample from the start of the blob read
+// from r, and returns casblob.Identity if the blob seems to be already
+// compressed, or c.storageMode otherwise. The returned reader must be used
+// instead of r to read the blob, including the sampled data.
+func (c *diskCache) chooseCompression(r io.Reader, size int64) (io.Reader, casblob.CompressionType) {
+	sampleSize := c.compressionBypassSampleSize
+	if size < int64(sampleSize) {
+		sampleSize = int(size)
+	}
+
+	br := bufio.NewReaderSize(r, sampleSize)
+	sample, err := br.Peek(sampleSize)
+	if err != nil || len(sample) == 0 {
+		// Let the write fail or succeed as usual.
+		return br, c.storageMode
+	}
+
+	compressed := c.zstd.EncodeAll(sample)
+	if len(compressed)*100 > len(sample)*(100-minCompressionSavingsPercent) {
+		return br, casblob.Identity
+	}
+
+	return br, c.storageMode
+}
+
 func (c *diskCache) writeAndCloseFile(ctx context.Context, r io.Reader, kind cache.EntryKind, hash string, size int64, f *os.File) (int64, error) {
 	closeFile := true
 	defer func() {
@@ -353,7 +775,14 @@ func (c *diskCache) writeAndCloseFile(ctx context.Context, r io.Reader, kind cac
 	var sizeOnDisk int64
 
 	if kind == cache.CAS && c.storageMode != casblob.Identity {
-		sizeOnDisk, err = casblob.WriteAndClose(c.zstd, r, f, c.storageMode, hash, size)
+		compression := c.storageMode
+		if c.zstdMaxSize > 0 && size > c.zstdMaxSize {
+			compression = casblob.Identity
+		} else if c.compressionBypassSampleSize > 0 {
+			r, compression = c.chooseCompression(r, size)
+		}
+
+		sizeOnDisk, err = casblob.WriteAndCloseVia(c.zstd, c.aead, r, f, c.fileWriter(f), compression, hash, size, c.syncFile)
 		if err != nil {
 			return -1, annotate.Err(ctx, "Failed to write compressed CAS blob to disk", err)
 		}
@@ -361,7 +790,7 @@ func (c *diskCache) writeAndCloseFile(ctx context.Context, r io.Reader, kind cac
 		return sizeOnDisk, nil
 	}
 
-	if sizeOnDisk, err = io.Copy(f, r); err != nil {
+	if sizeOnDisk, err = io.Copy(c.fileWriter(f), r); err != nil {
 		return -1, annotate.Err(ctx, "Failed to copy data to disk", err)
 	}
 
@@ -370,7 +799,7 @@ func (c *diskCache) writeAndCloseFile(ctx context.Context, r io.Reader, kind cac
 			"Sizes don't match. Expected %d, found %d", size, sizeOnDisk)
 	}
 
-	if err = f.Sync(); err != nil {
+	if err = c.syncFile(f); err != nil {
 		return -1, fmt.Errorf("Failed to sync file to disk: %w", err)
 	}
 
@@ -382,18 +811,34 @@ func (c *diskCache) writeAndCloseFile(ctx context.Context, r io.Reader, kind cac
 	return sizeOnDisk, nil
 }
 
+// lruInconsistency handles an internal LRU invariant violation for key,
+// described by err. If failOnLRUInconsistency is set the server exits,
+// otherwise any existing entry for key is dropped from the index so that
+// it is not served in an inconsistent state, and the server continues.
+// This must be called when the lock is held.
+func (c *diskCache) lruInconsistency(key string, err error) {
+	c.counterLRUInconsistency.Inc()
+
+	if c.failOnLRUInconsistency {
+		log.Fatalf("%s (exiting due to fail_on_lru_inconsistency)", err.Error())
+	}
+
+	log.Printf("%s (dropping the entry and continuing)", err.Error())
+	c.lru.Remove(key)
+}
+
 // This must be called when the lock is not held.
-func (c *diskCache) commit(key string, legacy bool, tempfile string, reservedSize int64, logicalSize int64, sizeOnDisk int64, random string) (unreserve bool, removeTempfile bool, err error) {
+func (c *diskCache) commit(key string, legacy bool, tempfile string, reservedSize int64, logicalSize int64, sizeOnDisk int64, random string, tag string) (unreserve bool, removeTempfile bool, err error) {
 	unreserve = reservedSize > 0
 	removeTempfile = true
 
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	if unreserve {
 		err = c.lru.Unreserve(reservedSize)
 		if err != nil {
-			log.Println(err.Error())
+			c.lruInconsistency(key, err)
 			return true, removeTempfile, err
 		}
 	}
@@ -404,35 +849,151 @@ func (c *diskCache) commit(key string, legacy bool, tempfile string, reservedSiz
 		sizeOnDisk: sizeOnDisk,
 		legacy:     legacy,
 		random:     random,
+		pinned:     c.isPinned(key),
+	}
+
+	// Add the key to the bloom filter first, so that the counters stay
+	// balanced if the new item is evicted by lru.Add.
+	if c.bloom != nil {
+		c.bloom.add(key)
 	}
 
 	if !c.lru.Add(key, newItem) {
-		err = fmt.Errorf("INTERNAL ERROR: failed to add: %s, size %d (on disk: %d)",
-			key, logicalSize, sizeOnDisk)
-		log.Println(err.Error())
+		// Not an inconsistency, the item can legitimately fail to fit,
+		// eg if it is larger on disk than the space that was reserved
+		// for it and the rest of the cache is reserved. Any existing
+		// entry for key is kept.
+		if c.bloom != nil {
+			c.bloom.remove(key)
+		}
+		err = &cache.Error{
+			Code: http.StatusInsufficientStorage,
+			Text: fmt.Sprintf("Not enough space in the cache to add %s, size %d (on disk: %d)",
+				key, logicalSize, sizeOnDisk),
+		}
 		return unreserve, removeTempfile, err
 	}
 
 	removeTempfile = false
 
+	if c.tags != nil && tag != "" {
+		c.tags.add(key, tag)
+	}
+
+	if c.events != nil {
+		kind, hash := splitLookupKey(key)
+		c.events.Put(kind, hash, logicalSize)
+	}
+
 	// Commit successful if we made it this far! \o/
 	return unreserve, removeTempfile, nil
 }
 
+// The number of locks used to serialize write-once AC uploads.
+const acWriteOnceLockStripes = 256
+
+// acWriteOnceLock returns the lock which serializes write-once uploads of
+// the AC entry with the given hash.
+func (c *diskCache) acWriteOnceLock(hash string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	return &c.acWriteOnceLocks[h.Sum32()%acWriteOnceLockStripes]
+}
+
+var errACAlreadyExists = &cache.Error{
+	Code: http.StatusConflict,
+	Text: "A different ActionResult already exists for this key",
+}
+
+// Read the ActionResult of `size` bytes from `r`, and if an AC entry for
+// `hash` already exists in the local cache or the proxy backend, compare
+// them. Return the new data, true if there is an existing entry, and an
+// error if the entries differ or something went wrong.
+func (c *diskCache) compareExistingAC(ctx context.Context, hash string, size int64, r io.Reader) ([]byte, bool, error) {
+	newData, err := io.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(newData)) != size {
+		return nil, false, badReqErr("Expected %d bytes, got %d", size, len(newData))
+	}
+
+	rc, _, err := c.get(ctx, cache.AC, hash, -1, 0, false)
+	if err != nil {
+		return nil, false, err
+	}
+	if rc == nil {
+		return newData, false, nil
+	}
+	oldData, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return newData, true, compareAC(oldData, newData)
+}
+
+// Read the AC entry for `hash` from the local cache, and return true if
+// it exists.
+func (c *diskCache) readLocalAC(hash string) ([]byte, bool, error) {
+	key := cache.LookupKey(cache.AC, hash)
+
+	for {
+		c.mu.Lock()
+		item, exists := c.lru.Peek(key)
+		c.unlock()
+
+		if !exists {
+			return nil, false, nil
+		}
+
+		data, err := os.ReadFile(path.Join(c.dir, c.FileLocation(cache.AC, item.legacy, hash, item.size, item.random)))
+		if os.IsNotExist(err) {
+			// The entry was replaced or removed, look again.
+			continue
+		}
+		return data, true, err
+	}
+}
+
+// Return an error if the ActionResults in oldData and newData differ.
+// ExecutionMetadata is ignored, since it typically differs between
+// otherwise identical uploads.
+func compareAC(oldData []byte, newData []byte) error {
+	if bytes.Equal(oldData, newData) {
+		return nil
+	}
+
+	oldAR := &pb.ActionResult{}
+	newAR := &pb.ActionResult{}
+	if proto.Unmarshal(oldData, oldAR) != nil || proto.Unmarshal(newData, newAR) != nil {
+		return errACAlreadyExists
+	}
+	oldAR.ExecutionMetadata = nil
+	newAR.ExecutionMetadata = nil
+
+	if !proto.Equal(oldAR, newAR) {
+		return errACAlreadyExists
+	}
+
+	return nil
+}
+
 // Return a non-nil io.ReadCloser and non-negative size if the item is available
 // locally, and a boolean that indicates if the item is not available locally
 // but that we can try the proxy backend.
 //
 // This function assumes that only CAS blobs are requested in zstd form.
-func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size int64, offset int64, zstd bool) (io.ReadCloser, int64, bool, error) {
+func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size int64, offset int64, limit int64, zstd bool, noPromote bool) (io.ReadCloser, int64, bool, error) {
 	locked := true
 	var err error
 	c.mu.Lock()
 
 	key := cache.LookupKey(kind, hash)
-	item, available := c.lru.Get(key)
+	item, available := c.lruGet(key, noPromote)
 	if available {
-		c.mu.Unlock() // We expect a cache hit below.
+		c.unlock() // We expect a cache hit below.
 		locked = false
 
 		blobPath := path.Join(c.dir, c.FileLocation(kind, item.legacy, hash, item.size, item.random))
@@ -445,12 +1006,12 @@ func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size
 				// Enter slow path.
 
 				c.mu.Lock()
-				item, available = c.lru.Get(key)
+				item, available = c.lruGet(key, noPromote)
 				if available {
 					blobPath = path.Join(c.dir, c.FileLocation(kind, item.legacy, hash, item.size, item.random))
 					f, err = os.Open(blobPath)
 				}
-				c.mu.Unlock()
+				c.unlock()
 			}
 
 			if err != nil {
@@ -469,9 +1030,9 @@ func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size
 				} else {
 					// The file is compressed.
 					if zstd {
-						rc, err = casblob.GetZstdReadCloser(c.zstd, f, size, offset)
+						rc, err = casblob.GetZstdReadCloser(c.zstd, c.aead, f, hash, size, offset)
 					} else {
-						rc, err = casblob.GetUncompressedReadCloser(c.zstd, f, size, offset)
+						rc, err = casblob.GetUncompressedReadCloser(c.zstd, c.aead, f, hash, size, offset, limit)
 					}
 				}
 
@@ -479,6 +1040,9 @@ func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size
 					log.Printf("Warning: expected item to be on disk, but something happened when retrieving %s (compressed: %v, legacy: %v): %v", blobPath, item.legacy, zstd, err)
 					f.Close()
 				} else {
+					if c.shouldVerifyRead(offset, limit, zstd) {
+						rc = c.newVerifyingReader(rc, key, hash, item)
+					}
 					return rc, item.size, false, nil
 				}
 			} else {
@@ -504,14 +1068,14 @@ func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size
 
 	var tryProxy bool
 
-	if c.proxy != nil && size <= c.maxProxyBlobSize {
+	if c.readProxy(kind) != nil && size <= c.maxProxyBlobSize {
 		if size > 0 {
 			// If we know the size, attempt to reserve that much space.
 			if !locked {
 				c.mu.Lock()
 			}
 			tryProxy, err = c.lru.Reserve(size)
-			c.mu.Unlock()
+			c.unlock()
 			locked = false
 		} else {
 			// If the size is unknown, take a risk and hope it's not
@@ -521,17 +1085,31 @@ func (c *diskCache) availableOrTryProxy(kind cache.EntryKind, hash string, size
 	}
 
 	if locked {
-		c.mu.Unlock()
+		c.unlock()
 	}
 
 	return nil, -1, tryProxy, err
 }
 
+// Look up key in the LRU index, and move it to the front of the eviction
+// list unless noPromote is true. The caller must hold c.mu.
+func (c *diskCache) lruGet(key Key, noPromote bool) (lruItem, bool) {
+	if noPromote {
+		return c.lru.Peek(key)
+	}
+	return c.lru.Get(key)
+}
+
 var errOnlyCompressedCAS = &cache.Error{
 	Code: http.StatusBadRequest,
 	Text: "Only CAS blobs are available in compressed form",
 }
 
+var errRawDisabled = &cache.Error{
+	Code: http.StatusNotImplemented,
+	Text: "The RAW keyspace is disabled",
+}
+
 // Get returns an io.ReadCloser with the content of the cache item stored
 // under `hash` and the number of bytes that can be read from it. If the
 // item is not found, the io.ReadCloser will be nil. If some error occurred
@@ -549,6 +1127,17 @@ func (c *diskCache) GetZstd(ctx context.Context, hash string, size int64, offset
 }
 
 func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string, size int64, offset int64, zstd bool) (rc io.ReadCloser, s int64, rErr error) {
+	defer func() {
+		if rErr != nil {
+			return
+		}
+		if rc != nil {
+			c.recentHits.inc()
+		} else {
+			c.recentMisses.inc()
+		}
+	}()
+
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
 	if len(hash) != sha256HashStrSize {
@@ -567,6 +1156,10 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 		return nil, -1, errOnlyCompressedCAS
 	}
 
+	if kind == cache.RAW && c.rawDisabled {
+		return nil, -1, errRawDisabled
+	}
+
 	if offset < 0 {
 		return nil, -1, badReqErr("Invalid offset: %d", offset)
 	}
@@ -574,6 +1167,14 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 		return nil, -1, badReqErr("Invalid offset: %d for size %d", offset, size)
 	}
 
+	if offset == 0 && c.isSynthesizedEmptyTree(kind, hash, size) {
+		if zstd {
+			return io.NopCloser(bytes.NewReader(emptyTreeZstdBlob)), int64(len(emptyTreeBlob)), nil
+		}
+
+		return io.NopCloser(bytes.NewReader(emptyTreeBlob)), int64(len(emptyTreeBlob)), nil
+	}
+
 	var err error
 	key := cache.LookupKey(kind, hash)
 
@@ -604,11 +1205,11 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 				rErr = internalErr(err)
 				log.Println(rErr.Error())
 			}
-			c.mu.Unlock()
+			c.unlock()
 		}
 	}()
 
-	f, foundSize, tryProxy, err := c.availableOrTryProxy(kind, hash, size, offset, zstd)
+	f, foundSize, tryProxy, err := c.availableOrTryProxy(kind, hash, size, offset, cache.ReadLimit(ctx), zstd, cache.NoPromote(ctx))
 	if err != nil {
 		return nil, -1, internalErr(err)
 	}
@@ -623,7 +1224,24 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 		return nil, -1, nil
 	}
 
-	r, foundSize, err := c.proxy.Get(ctx, kind, hash, size)
+	if c.tombstones != nil && c.tombstones.has(key) {
+		return nil, -1, nil
+	}
+
+	// Items from the proxy backend could not be stored.
+	if c.readOnly.Load() {
+		return nil, -1, nil
+	}
+
+	if c.proxyDownloadSem != nil {
+		err = c.proxyDownloadSem.Acquire(ctx, cache.HighPriority(ctx))
+		if err != nil {
+			return nil, -1, internalErr(err)
+		}
+		defer c.proxyDownloadSem.Release()
+	}
+
+	r, foundSize, err := c.readProxy(kind).Get(ctx, kind, hash, size)
 	if r != nil {
 		defer r.Close()
 	}
@@ -645,8 +1263,9 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 	legacy := kind == cache.CAS && c.storageMode == casblob.Identity
 
 	blobPathBase := path.Join(c.dir, c.FileLocationBase(kind, legacy, hash, foundSize))
-	tf, random, err := tfc.Create(blobPathBase, legacy)
+	tf, random, finalPath, err := c.createTempfile(blobPathBase, legacy)
 	if err != nil {
+		c.checkReadOnlyFS(err)
 		return nil, -1, internalErr(err)
 	}
 	removeTempfile = true
@@ -654,12 +1273,24 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 	blobFile = tf.Name()
 
 	var sizeOnDisk int64
-	sizeOnDisk, err = io.Copy(tf, r)
-	tf.Close()
+	if c.transcodeForProxy(kind) {
+		// The proxy returned an uncompressed blob, compress it to
+		// match the local storage mode.
+		sizeOnDisk, err = c.writeAndCloseFile(ctx, r, kind, hash, foundSize, tf)
+	} else {
+		sizeOnDisk, err = io.Copy(c.fileWriter(tf), r)
+		tf.Close()
+	}
 	if err != nil {
 		return nil, -1, internalErr(err)
 	}
 
+	err = moveToFinalPath(blobFile, finalPath)
+	if err != nil {
+		return nil, -1, internalErr(err)
+	}
+	blobFile = finalPath
+
 	rcf, err := os.Open(blobFile)
 	if err != nil {
 		return nil, -1, internalErr(err)
@@ -681,16 +1312,16 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 		}
 	} else { // Compressed CAS blob.
 		if zstd {
-			rc, err = casblob.GetZstdReadCloser(c.zstd, rcf, foundSize, offset)
+			rc, err = casblob.GetZstdReadCloser(c.zstd, c.aead, rcf, hash, foundSize, offset)
 		} else {
-			rc, err = casblob.GetUncompressedReadCloser(c.zstd, rcf, foundSize, offset)
+			rc, err = casblob.GetUncompressedReadCloser(c.zstd, c.aead, rcf, hash, foundSize, offset, cache.ReadLimit(ctx))
 		}
 	}
 	if err != nil {
 		return nil, -1, internalErr(err)
 	}
 
-	unreserve, removeTempfile, err = c.commit(key, legacy, blobFile, size, foundSize, sizeOnDisk, random)
+	unreserve, removeTempfile, err = c.commit(key, legacy, blobFile, size, foundSize, sizeOnDisk, random, "")
 	if err != nil {
 		rc.Close()
 		return nil, -1, internalErr(err)
@@ -703,42 +1334,73 @@ func (c *diskCache) get(ctx context.Context, kind cache.EntryKind, hash string,
 // the size if known (or -1 if unknown).
 //
 // If there is a local cache miss, the proxy backend (if there is
-// one) will be checked.
+// one) will be checked. Errors from the proxy backend are only returned
+// if WithStrictProxyErrors was used, otherwise they are reported as a
+// cache miss.
 //
 // Callers should provide the `size` of the item, or -1 if unknown.
-func (c *diskCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
+func (c *diskCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64, error) {
 	// The hash format is checked properly in the http/grpc code.
 	// Just perform a simple/fast check here, to catch bad tests.
 	if len(hash) != sha256HashStrSize {
-		return false, -1
+		return false, -1, nil
 	}
 
 	if kind == cache.CAS && size <= 0 && hash == emptySha256 {
-		return true, 0
+		return true, 0, nil
+	}
+
+	if c.isSynthesizedEmptyTree(kind, hash, size) {
+		return true, int64(len(emptyTreeBlob)), nil
+	}
+
+	if kind == cache.RAW && c.rawDisabled {
+		return false, -1, nil
 	}
 
 	foundSize := int64(-1)
 	key := cache.LookupKey(kind, hash)
 
 	c.mu.Lock()
-	item, exists := c.lru.Get(key)
+	item, exists := c.lruGet(key, cache.NoPromote(ctx))
 	if exists {
 		foundSize = item.size
 	}
-	c.mu.Unlock()
+	c.unlock()
 
 	if exists && !isSizeMismatch(size, foundSize) {
-		return true, foundSize
+		return true, foundSize, nil
+	}
+
+	if c.tombstones != nil && c.tombstones.has(key) {
+		return false, -1, nil
+	}
+
+	if cache.LocalOnly(ctx) {
+		return false, -1, nil
 	}
 
-	if c.proxy != nil && size <= c.maxProxyBlobSize {
-		exists, foundSize = c.proxy.Contains(ctx, kind, hash, size)
+	if proxy := c.readProxy(kind); proxy != nil && size <= c.maxProxyBlobSize {
+		var err error
+		exists, foundSize, err = proxy.Contains(ctx, kind, hash, size)
+		if err != nil && c.strictProxyErrors {
+			return false, -1, proxyErr(err)
+		}
 		if exists && foundSize <= c.maxProxyBlobSize && !isSizeMismatch(size, foundSize) {
-			return true, foundSize
+			return true, foundSize, nil
 		}
 	}
 
-	return false, -1
+	return false, -1, nil
+}
+
+// readProxy returns the proxy backend which items of the given kind are
+// read from, or nil if they are only read from the local disk.
+func (c *diskCache) readProxy(kind cache.EntryKind) cache.Proxy {
+	if c.noProxyForAC && kind != cache.CAS {
+		return nil
+	}
+	return c.proxies[kind]
 }
 
 // MaxSize returns the maximum cache size in bytes.
@@ -751,11 +1413,151 @@ func (c *diskCache) MaxSize() int64 {
 // items stored in the cache.
 func (c *diskCache) Stats() (totalSize int64, reservedSize int64, numItems int, uncompressedSize int64) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
 	return c.lru.TotalSize(), c.lru.ReservedSize(), c.lru.Len(), c.lru.UncompressedSize()
 }
 
+// RecentStats returns the number of Get and GetZstd calls which found, or
+// did not find, the requested blob in the last hour, and the number of
+// items removed from the cache in the last hour.
+func (c *diskCache) RecentStats() (hits int64, misses int64, evictions int64) {
+	return c.recentHits.total(), c.recentMisses.total(), c.lru.recentEvictions.total()
+}
+
+// EvictTo evicts the least recently used items until the total size of
+// the cache is at most targetSize bytes, and returns the number of items
+// evicted and their total size on disk.
+func (c *diskCache) EvictTo(targetSize int64) (numItems int, numBytes int64) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	return c.lru.EvictTo(targetSize)
+}
+
+// EvictTag evicts all the AC and RAW entries that were uploaded with the given tag,
+// and returns the number of items evicted and their total size on disk.
+// This does nothing if tagging is disabled.
+func (c *diskCache) EvictTag(tag string) (numItems int, numBytes int64) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.tags == nil {
+		return 0, 0
+	}
+
+	for _, key := range c.tags.keysWithTag(tag) {
+		item, ok := c.lru.Peek(key)
+		if !ok {
+			c.tags.remove(key)
+			continue
+		}
+
+		// This calls onEvict, which removes the key from c.tags.
+		c.lru.Remove(key)
+		if c.tombstones != nil {
+			c.tombstones.add(key)
+		}
+		numItems++
+		numBytes += item.sizeOnDisk
+	}
+
+	return numItems, numBytes
+}
+
+// Remove removes the item with the given kind and hash from the cache, and
+// returns true if it was found.
+func (c *diskCache) Remove(kind cache.EntryKind, hash string) bool {
+	c.mu.Lock()
+	defer c.unlock()
+
+	key := cache.LookupKey(kind, hash)
+	_, ok := c.lru.Peek(key)
+	if !ok {
+		return false
+	}
+
+	// This calls onEvict, which removes the file.
+	c.lru.Remove(key)
+	return true
+}
+
+// getOutputTree returns the Tree with the given digest, or errMissingBlob
+// if it is not in the cache.
+func (c *diskCache) getOutputTree(ctx context.Context, d *pb.Digest) (*pb.Tree, error) {
+	// d was validated in validate.ActionResult but blobs were not checked for existence
+	r, size, err := c.Get(ctx, cache.CAS, d.Hash, d.SizeBytes, 0)
+	if r == nil {
+		if err == nil {
+			err = errMissingBlob
+		}
+		return nil, err
+	}
+	defer r.Close()
+	if err != nil {
+		return nil, err
+	}
+	if size != d.SizeBytes {
+		return nil, fmt.Errorf("expected %d bytes, found %d", d.SizeBytes, size)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &pb.Tree{}
+	err = proto.Unmarshal(data, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// getOutputTrees returns the Trees of the given output directories, in
+// the same order. Up to acValidationConcurrency Trees are read at the same
+// time. If any of them is not in the cache, errMissingBlob is returned.
+func (c *diskCache) getOutputTrees(ctx context.Context, dirs []*pb.OutputDirectory) ([]*pb.Tree, error) {
+	trees := make([]*pb.Tree, len(dirs))
+
+	if c.acValidationConcurrency <= 1 || len(dirs) <= 1 {
+		for i, d := range dirs {
+			tree, err := c.getOutputTree(ctx, d.TreeDigest)
+			if err != nil {
+				return nil, err
+			}
+			trees[i] = tree
+		}
+		return trees, nil
+	}
+
+	// Stop reading the remaining Trees after the first error.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(c.acValidationConcurrency)
+	for i, d := range dirs {
+		g.Go(func() error {
+			if gctx.Err() != nil {
+				return gctx.Err()
+			}
+
+			tree, err := c.getOutputTree(gctx, d.TreeDigest)
+			if err != nil {
+				return err
+			}
+			trees[i] = tree
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return trees, nil
+}
+
 func isSizeMismatch(requestedSize int64, foundSize int64) bool {
 	return requestedSize > -1 && foundSize > -1 && requestedSize != foundSize
 }
@@ -796,63 +1598,82 @@ func (c *diskCache) GetValidatedActionResult(ctx context.Context, hash string) (
 
 	pendingValidations := []*pb.Digest{}
 
+	// Add d to pendingValidations, or return an error if that would
+	// exceed the configured limit.
+	addPending := func(d *pb.Digest) error {
+		if c.maxACValidationEntries > 0 && len(pendingValidations) >= c.maxACValidationEntries {
+			return fmt.Errorf("ActionResult %s has too many entries to validate (limit: %d)",
+				hash, c.maxACValidationEntries)
+		}
+		pendingValidations = append(pendingValidations, d)
+		return nil
+	}
+
 	for _, f := range result.OutputFiles {
 		// f was validated in validate.ActionResult but blobs were not checked for existence
 		if len(f.Contents) == 0 {
-			pendingValidations = append(pendingValidations, f.Digest)
+			err = addPending(f.Digest)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
-	for _, d := range result.OutputDirectories {
-		// d was validated in validate.ActionResult but blobs were not checked for existence
-		r, size, err := c.Get(ctx, cache.CAS, d.TreeDigest.Hash, d.TreeDigest.SizeBytes, 0)
-		if r == nil {
-			return nil, nil, err // aka "not found", or an err if non-nil
-		}
-		if err != nil {
-			r.Close()
-			return nil, nil, err
-		}
-		if size != d.TreeDigest.SizeBytes {
-			r.Close()
-			return nil, nil, fmt.Errorf("expected %d bytes, found %d",
-				d.TreeDigest.SizeBytes, size)
-		}
-
-		var oddata []byte
-		oddata, err = io.ReadAll(r)
-		r.Close()
-		if err != nil {
-			return nil, nil, err
-		}
+	trees, err := c.getOutputTrees(ctx, result.OutputDirectories)
+	if errors.Is(err, errMissingBlob) {
+		return nil, nil, nil // aka "not found"
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-		tree := pb.Tree{}
-		err = proto.Unmarshal(oddata, &tree)
-		if err != nil {
-			return nil, nil, err
+	for _, tree := range trees {
+		if c.maxTreeDepth > 0 {
+			err = checkTreeDepth(tree, c.maxTreeDepth)
+			if err != nil {
+				return nil, nil, fmt.Errorf("ActionResult %s: %w", hash, err)
+			}
 		}
 
 		for _, f := range tree.Root.GetFiles() {
 			if f.Digest != nil {
-				pendingValidations = append(pendingValidations, f.Digest)
+				err = addPending(f.Digest)
+				if err != nil {
+					return nil, nil, err
+				}
 			}
 		}
 
 		for _, child := range tree.GetChildren() {
 			for _, f := range child.GetFiles() {
 				if f.Digest != nil {
-					pendingValidations = append(pendingValidations, f.Digest)
+					err = addPending(f.Digest)
+					if err != nil {
+						return nil, nil, err
+					}
 				}
 			}
 		}
 	}
 
 	if result.StdoutDigest != nil {
-		pendingValidations = append(pendingValidations, result.StdoutDigest)
+		err = addPending(result.StdoutDigest)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	if result.StderrDigest != nil {
-		pendingValidations = append(pendingValidations, result.StderrDigest)
+		err = addPending(result.StderrDigest)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var prefetch []*pb.Digest
+	if c.prefetchQueue != nil {
+		// findMissingCasBlobsInternal clears the entries that it finds.
+		prefetch = append(prefetch, pendingValidations...)
 	}
 
 	err = c.findMissingCasBlobsInternal(ctx, pendingValidations, true)
@@ -863,5 +1684,9 @@ func (c *diskCache) GetValidatedActionResult(ctx context.Context, hash string) (
 		return nil, nil, err
 	}
 
+	if prefetch != nil {
+		c.queuePrefetch(prefetch)
+	}
+
 	return result, acdata, nil
 }
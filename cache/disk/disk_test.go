@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -13,8 +14,14 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -23,6 +30,7 @@ import (
 	"github.com/buchgr/bazel-remote/v2/cache/disk/zstdimpl"
 	"github.com/buchgr/bazel-remote/v2/cache/httpproxy"
 	testutils "github.com/buchgr/bazel-remote/v2/utils"
+	"github.com/buchgr/bazel-remote/v2/utils/tempfile"
 
 	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
 	"google.golang.org/protobuf/proto"
@@ -133,6 +141,47 @@ func TestCachePutWrongSize(t *testing.T) {
 	}
 }
 
+func TestCachePutZeroSizeNonEmptyHash(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	for _, mode := range []string{"zstd", "uncompressed"} {
+		testCache, err := New(cacheDir, BlockSize*10,
+			WithStorageMode(mode),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The empty blob is always accepted.
+		err = testCache.Put(context.Background(), cache.CAS, emptySha256, 0, bytes.NewReader([]byte{}))
+		if err != nil {
+			t.Fatalf("Expected success for the empty blob (%s): %v", mode, err)
+		}
+
+		hash := hashStr("not empty")
+		err = testCache.Put(context.Background(), cache.CAS, hash, 0, bytes.NewReader([]byte{}))
+		if err == nil {
+			t.Fatalf("Expected an error for a zero-size blob with a non-empty hash (%s)", mode)
+		}
+		cerr, ok := err.(*cache.Error)
+		if !ok || cerr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected a bad request error (%s), got: %v", mode, err)
+		}
+
+		found, _, _ := testCache.Contains(context.Background(), cache.CAS, hash, 0)
+		if found {
+			t.Fatalf("Expected the blob not to be stored (%s)", mode)
+		}
+
+		// Zero-size AC entries are not affected.
+		err = testCache.Put(context.Background(), cache.AC, hash, 0, bytes.NewReader([]byte{}))
+		if err != nil {
+			t.Fatalf("Expected success for an empty AC entry (%s): %v", mode, err)
+		}
+	}
+}
+
 func TestCacheGetContainsWrongSize(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -152,7 +201,7 @@ func TestCacheGetContainsWrongSize(t *testing.T) {
 		t.Fatal("Expected success", err)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength+1)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength+1)
 	if found {
 		t.Error("Expected not found, due to size being different")
 	}
@@ -162,7 +211,7 @@ func TestCacheGetContainsWrongSize(t *testing.T) {
 		t.Error("Expected not found, due to size being different")
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, contentsHash, -1)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, contentsHash, -1)
 	if !found {
 		t.Error("Expected found, when unknown size")
 	}
@@ -195,7 +244,7 @@ func TestCacheGetContainsWrongSizeWithProxy(t *testing.T) {
 			testCache.lru.Len())
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength+1)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength+1)
 	if found {
 		t.Fatal("Expected not found, due to size being different")
 	}
@@ -210,7 +259,7 @@ func TestCacheGetContainsWrongSizeWithProxy(t *testing.T) {
 			testCache.lru.Len())
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, contentsHash, -1)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, contentsHash, -1)
 	if !found {
 		t.Fatal("Expected found, when unknown size")
 	}
@@ -253,10 +302,10 @@ func (d proxyStub) Get(ctx context.Context, kind cache.EntryKind, hash string, _
 	}
 
 	_, err = casblob.WriteAndClose(
-		zi,
+		zi, nil,
 		io.NopCloser(
 			strings.NewReader(contents)), tmpfile, casblob.Zstandard,
-		hash, contentsLength)
+		hash, contentsLength, (*os.File).Sync)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -269,12 +318,310 @@ func (d proxyStub) Get(ctx context.Context, kind cache.EntryKind, hash string, _
 	return readme, contentsLength, nil
 }
 
-func (d proxyStub) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+func (d proxyStub) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 	if hash != contentsHash || kind != cache.CAS {
-		return false, -1
+		return false, -1, nil
+	}
+
+	return true, contentsLength, nil
+}
+
+// putRecordingProxy implements the cache.Proxy interface, and records the
+// kinds of the items that are Put. It never contains anything.
+type putRecordingProxy struct {
+	mu   sync.Mutex
+	puts []cache.EntryKind
+}
+
+func (p *putRecordingProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+
+	p.mu.Lock()
+	p.puts = append(p.puts, kind)
+	p.mu.Unlock()
+}
+
+func (p *putRecordingProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	return nil, -1, nil
+}
+
+func (p *putRecordingProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
+	return false, -1, nil
+}
+
+// errorProxy implements the cache.Proxy interface for a proxy backend
+// that cannot be reached.
+type errorProxy struct{}
+
+var errProxyUnreachable = errors.New("proxy backend unreachable")
+
+func (p errorProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+}
+
+func (p errorProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	return nil, -1, errProxyUnreachable
+}
+
+func (p errorProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
+	return false, -1, errProxyUnreachable
+}
+
+func TestStrictProxyErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, strict := range []bool{false, true} {
+		opts := []Option{
+			WithProxyBackend(errorProxy{}),
+			WithAccessLogger(testutils.NewSilentLogger()),
+		}
+		if strict {
+			opts = append(opts, WithStrictProxyErrors())
+		}
+
+		testCache, err := New(tempDir(t), BlockSize, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, _, err := testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength)
+		if found {
+			t.Errorf("strict=%v: expected the item to be missing", strict)
+		}
+		if !strict && err != nil {
+			t.Errorf("expected proxy errors to be cache misses, got: %v", err)
+		}
+		if strict {
+			var cerr *cache.Error
+			if !errors.As(err, &cerr) || cerr.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected a %d error, got: %v", http.StatusServiceUnavailable, err)
+			}
+		}
+	}
+}
+
+func TestPerKindProxyBackends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	acProxy := &putRecordingProxy{}
+	testCacheI, err := New(cacheDir, 10*BlockSize,
+		WithACProxyBackend(acProxy),
+		WithCASProxyBackend(new(proxyStub)),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	// The proxyStub contains the CAS blob {contentsHash, contentsLength}.
+	found, _, _ := testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength)
+	if !found {
+		t.Fatal("Expected the CAS blob to be found via the CAS proxy")
+	}
+
+	err = testCache.Put(ctx, cache.CAS, hashStr("cas"), 3, strings.NewReader("cas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testCache.Put(ctx, cache.RAW, hashStr("raw"), 3, strings.NewReader("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acProxy.mu.Lock()
+	puts := acProxy.puts
+	acProxy.mu.Unlock()
+	if len(puts) != 1 || puts[0] != cache.RAW {
+		t.Fatalf("Expected only the RAW item to be sent to the AC proxy, got %v", puts)
+	}
+
+	_, err = New(tempDir(t), 10*BlockSize,
+		WithProxyBackend(acProxy),
+		WithCASProxyBackend(new(proxyStub)))
+	if err == nil {
+		t.Fatal("Expected an error when setting the CAS proxy backend twice")
+	}
+}
+
+// memoryProxy implements the cache.Proxy interface, and stores items in
+// memory in whatever format they are given.
+type memoryProxy struct {
+	mu    sync.Mutex
+	items map[string][]byte
+}
+
+func (p *memoryProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil || int64(len(data)) != sizeOnDisk {
+		return
+	}
+
+	p.mu.Lock()
+	p.items[kind.String()+"/"+hash] = data
+	p.mu.Unlock()
+}
+
+func (p *memoryProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	p.mu.Lock()
+	data, ok := p.items[kind.String()+"/"+hash]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, -1, nil
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (p *memoryProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
+	p.mu.Lock()
+	data, ok := p.items[kind.String()+"/"+hash]
+	p.mu.Unlock()
+
+	if !ok {
+		return false, -1, nil
+	}
+
+	return true, int64(len(data)), nil
+}
+
+func TestUncompressedCASProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := &memoryProxy{items: make(map[string][]byte)}
+
+	newCache := func() *diskCache {
+		cacheDir := tempDir(t)
+		t.Cleanup(func() { os.RemoveAll(cacheDir) })
+
+		testCacheI, err := New(cacheDir, 100*BlockSize,
+			WithStorageMode("zstd"),
+			WithCASProxyBackend(proxy),
+			WithUncompressedCASProxy(),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testCacheI.(*diskCache)
+	}
+
+	data, hash := testutils.RandomDataAndHash(10 * 1024)
+
+	err := newCache().Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.mu.Lock()
+	uploaded := proxy.items[cache.CAS.String()+"/"+hash]
+	proxy.mu.Unlock()
+	if !bytes.Equal(uploaded, data) {
+		t.Fatal("Expected the proxy backend to receive the uncompressed blob")
+	}
+
+	// A different cache should be able to fetch the uncompressed blob from
+	// the proxy backend, and store it compressed.
+	testCache := newCache()
+	rc, size, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expectContentEquals(rc, size, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err = testCache.GetZstd(ctx, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	zr, err := testCache.zstd.GetDecoder(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	err = expectContentEquals(zr, int64(len(data)), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoProxyForAC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := &memoryProxy{items: make(map[string][]byte)}
+
+	newCache := func(opts ...Option) Cache {
+		cacheDir := tempDir(t)
+		t.Cleanup(func() { os.RemoveAll(cacheDir) })
+
+		opts = append(opts,
+			WithProxyBackend(proxy),
+			WithUncompressedCASProxy(),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		testCache, err := New(cacheDir, 100*BlockSize, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testCache
+	}
+
+	casData, casHash := testutils.RandomDataAndHash(1024)
+	acData, acHash := testutils.RandomDataAndHash(1024)
+
+	testCache := newCache(WithNoProxyForAC())
+	err := testCache.Put(ctx, cache.AC, acHash, int64(len(acData)), bytes.NewReader(acData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newCache().Put(ctx, cache.CAS, casHash, int64(len(casData)), bytes.NewReader(casData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.mu.Lock()
+	_, uploaded := proxy.items[cache.AC.String()+"/"+acHash]
+	proxy.mu.Unlock()
+	if !uploaded {
+		t.Fatal("Expected the AC item to be uploaded to the proxy backend")
 	}
 
-	return true, contentsLength
+	// A different cache can read the CAS blob from the proxy backend,
+	// but not the AC item.
+	testCache = newCache(WithNoProxyForAC())
+
+	rc, size, err := testCache.Get(ctx, cache.CAS, casHash, int64(len(casData)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expectContentEquals(rc, size, casData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, err := testCache.Contains(ctx, cache.AC, acHash, int64(len(acData)))
+	if err != nil || found {
+		t.Fatal("Expected the AC item not to be found via the proxy backend:", err)
+	}
+
+	rc, _, err = testCache.Get(ctx, cache.AC, acHash, int64(len(acData)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc != nil {
+		rc.Close()
+		t.Fatal("Expected the AC item not to be read from the proxy backend")
+	}
 }
 
 func expectContentEquals(rdr io.ReadCloser, sizeBytes int64, expectedContent []byte) error {
@@ -366,102 +713,347 @@ func TestOverwrite(t *testing.T) {
 	}
 }
 
-func ensureDirExists(path string, t *testing.T) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err = os.MkdirAll(path, os.ModePerm)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-}
-
-func TestCacheExistingFiles(t *testing.T) {
+func TestACWriteOnce(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
 
-	items := []struct {
-		contents string
-		hash     string
-		key      string
-		file     string
-	}{
-		{
-			"hej",
-			"9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba",
-			"cas/9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba",
-			"cas.v2/9c/9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba-3-123456789",
-		},
-		{
-			"världen",
-			"d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1",
-			"cas/d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1",
-			"cas.v2/d4/d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1-8-123456789",
-		},
-		{
-			"foo",
-			"733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
-			"ac/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
-			"ac.v2/73/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54-123456789",
-		},
-		{
-			"bar",
-			"733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
-			"raw/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
-			"raw.v2/73/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54-123456789",
-		},
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithACWriteOnce())
+	if err != nil {
+		t.Fatal(err)
 	}
+	testCache := testCacheI.(*diskCache)
 
-	var err error
-	for _, it := range items {
-
-		fp := path.Join(cacheDir, it.file)
-		ensureDirExists(path.Dir(fp), t)
-
-		if strings.HasPrefix(it.file, "cas.v2/") {
-			r := bytes.NewReader([]byte(it.contents))
-			var f *os.File
-			f, err = os.Create(fp)
-			if err == nil {
-				var zi zstdimpl.ZstdImpl
-				zi, err = zstdimpl.Get("go")
-				if err != nil {
-					t.Fatal(err)
-				}
-				_, err = casblob.WriteAndClose(zi, r, f, casblob.Zstandard,
-					it.hash, int64(len(it.contents)))
-			}
-		} else {
-			err = os.WriteFile(fp, []byte(it.contents), os.ModePerm)
-		}
+	marshal := func(ar *pb.ActionResult) []byte {
+		data, err := proto.Marshal(ar)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		// Wait a bit to account for atime granularity
-		time.Sleep(10 * time.Millisecond)
+		return data
 	}
 
-	// Add some overhead for likely CAS blob storage expansion.
-	const cacheSize = BlockSize * 5
+	original := marshal(&pb.ActionResult{
+		ExitCode:          1,
+		ExecutionMetadata: &pb.ExecutedActionMetadata{Worker: "worker1"},
+	})
+	sameButDifferentWorker := marshal(&pb.ActionResult{
+		ExitCode:          1,
+		ExecutionMetadata: &pb.ExecutedActionMetadata{Worker: "worker2"},
+	})
+	different := marshal(&pb.ActionResult{
+		ExitCode:          2,
+		ExecutionMetadata: &pb.ExecutedActionMetadata{Worker: "worker1"},
+	})
 
-	testCacheI, err := New(cacheDir, cacheSize, WithAccessLogger(testutils.NewSilentLogger()))
+	hash := hashStr("action")
+
+	err = putGetCompareBytes(ctx, cache.AC, hash, original, testCache)
 	if err != nil {
 		t.Fatal(err)
 	}
-	testCache := testCacheI.(*diskCache)
 
-	evicted := []Key{}
-	origOnEvict := testCache.lru.onEvict
-	testCache.lru.onEvict = func(key Key, value lruItem) {
-		evicted = append(evicted, key.(string))
-		origOnEvict(key, value)
+	// Identical ActionResults are accepted, but the original is kept.
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(sameButDifferentWorker)),
+		bytes.NewReader(sameButDifferentWorker))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if testCache.lru.Len() != 4 {
-		t.Fatal("expected four items in the cache, found", testCache.lru.Len())
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(different)),
+		bytes.NewReader(different))
+	if err != errACAlreadyExists {
+		t.Fatalf("Expected errACAlreadyExists, got: %v", err)
+	}
+
+	rc, size, err := testCache.Get(ctx, cache.AC, hash, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expectContentEquals(rc, size, original)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowReader sleeps for delay before each Read from r.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestACWriteOnceConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*100,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithACWriteOnce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	hash := hashStr("action")
+
+	const numWriters = 10
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < numWriters; i++ {
+		data, err := proto.Marshal(&pb.ActionResult{ExitCode: int32(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Slow down the upload, so that the uploads overlap.
+			r := &slowReader{r: bytes.NewReader(data), delay: 10 * time.Millisecond}
+			err := testCache.Put(ctx, cache.AC, hash, int64(len(data)), r)
+			if err == nil {
+				accepted.Add(1)
+			} else if err != errACAlreadyExists {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted.Load() != 1 {
+		t.Fatalf("Expected exactly one of the different ActionResults to be accepted, got %d",
+			accepted.Load())
+	}
+}
+
+func TestACWriteOnceProxy(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	proxy := &memoryProxy{items: make(map[string][]byte)}
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithProxyBackend(proxy),
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithACWriteOnce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	original, err := proto.Marshal(&pb.ActionResult{ExitCode: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	different, err := proto.Marshal(&pb.ActionResult{ExitCode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := hashStr("action")
+
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(original)), bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry is only left in the proxy backend.
+	if !testCache.Remove(cache.AC, hash) {
+		t.Fatal("Expected the local entry to be removed")
+	}
+
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(different)), bytes.NewReader(different))
+	if err != errACAlreadyExists {
+		t.Fatalf("Expected errACAlreadyExists, got: %v", err)
+	}
+
+	proxy.mu.Lock()
+	proxied := proxy.items["ac/"+hash]
+	proxy.mu.Unlock()
+	if !bytes.Equal(proxied, original) {
+		t.Fatal("Expected the proxy backend to keep the original entry")
+	}
+
+	// Identical uploads are still accepted.
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(original)), bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingReader blocks in Read until unblock is closed.
+type blockingReader struct {
+	r       io.Reader
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return r.r.Read(p)
+}
+
+func TestACWriteOnceStalledUpload(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithACWriteOnce())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	stalled, err := proto.Marshal(&pb.ActionResult{ExitCode: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := proto.Marshal(&pb.ActionResult{ExitCode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := hashStr("action")
+
+	// A stalled client must not block other uploads of the same key.
+	unblock := make(chan struct{})
+	stalledErr := make(chan error)
+	go func() {
+		r := &blockingReader{r: bytes.NewReader(stalled), unblock: unblock}
+		stalledErr <- testCache.Put(ctx, cache.AC, hash, int64(len(stalled)), r)
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- testCache.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Upload was blocked by a stalled upload of the same key")
+	}
+
+	close(unblock)
+	err = <-stalledErr
+	if err != errACAlreadyExists {
+		t.Fatalf("Expected errACAlreadyExists for the stalled upload, got: %v", err)
+	}
+}
+
+func ensureDirExists(path string, t *testing.T) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = os.MkdirAll(path, os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCacheExistingFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	items := []struct {
+		contents string
+		hash     string
+		key      string
+		file     string
+	}{
+		{
+			"hej",
+			"9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba",
+			"cas/9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba",
+			"cas.v2/9c/9c478bf63e9500cb5db1e85ece82f18c8eb9e52e2f9135acd7f10972c8d563ba-3-123456789",
+		},
+		{
+			"världen",
+			"d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1",
+			"cas/d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1",
+			"cas.v2/d4/d497feaa39156f4ae61317db9d2adc3a8f2ff1437fd48ccb56f814f0b7ac5fe1-8-123456789",
+		},
+		{
+			"foo",
+			"733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
+			"ac/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
+			"ac.v2/73/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54-123456789",
+		},
+		{
+			"bar",
+			"733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
+			"raw/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54",
+			"raw.v2/73/733e21b37cef883579a88183eed0d00cdeea0b59e1bcd77db6957f881c3a6b54-123456789",
+		},
+	}
+
+	var err error
+	for _, it := range items {
+
+		fp := path.Join(cacheDir, it.file)
+		ensureDirExists(path.Dir(fp), t)
+
+		if strings.HasPrefix(it.file, "cas.v2/") {
+			r := bytes.NewReader([]byte(it.contents))
+			var f *os.File
+			f, err = os.Create(fp)
+			if err == nil {
+				var zi zstdimpl.ZstdImpl
+				zi, err = zstdimpl.Get("go")
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = casblob.WriteAndClose(zi, nil, r, f, casblob.Zstandard,
+					it.hash, int64(len(it.contents)), (*os.File).Sync)
+			}
+		} else {
+			err = os.WriteFile(fp, []byte(it.contents), os.ModePerm)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait a bit to account for atime granularity
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Add some overhead for likely CAS blob storage expansion.
+	const cacheSize = BlockSize * 5
+
+	testCacheI, err := New(cacheDir, cacheSize, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	evicted := []Key{}
+	origOnEvict := testCache.lru.onEvict
+	testCache.lru.onEvict = func(key Key, value lruItem) {
+		evicted = append(evicted, key.(string))
+		origOnEvict(key, value)
+	}
+
+	if testCache.lru.Len() != 4 {
+		t.Fatal("expected four items in the cache, found", testCache.lru.Len())
 	}
 
 	// Adding new blobs should eventually evict the oldest (items[0]).
@@ -492,7 +1084,7 @@ func TestCacheExistingFiles(t *testing.T) {
 		break // First item evicted as expected.
 	}
 
-	found, _ := testCache.Contains(ctx, cache.CAS, items[0].hash, contentsLength)
+	found, _, _ := testCache.Contains(ctx, cache.CAS, items[0].hash, contentsLength)
 	if found {
 		t.Fatalf("%s should have been evicted", items[0].file)
 	}
@@ -610,7 +1202,11 @@ func TestMigrateFromOldDirectoryStructure(t *testing.T) {
 	// Add some overhead for likely CAS blob storage expansion.
 	const cacheSize = 2560*2 + BlockSize*2
 
-	testCacheI, err := New(cacheDir, cacheSize, WithAccessLogger(testutils.NewSilentLogger()))
+	// Use a small batch size, so the directories are read in more than
+	// one batch.
+	testCacheI, err := New(cacheDir, cacheSize,
+		WithMigrationBatchSize(1),
+		WithAccessLogger(testutils.NewSilentLogger()))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -622,17 +1218,17 @@ func TestMigrateFromOldDirectoryStructure(t *testing.T) {
 	}
 
 	var found bool
-	found, _ = testCache.Contains(ctx, cache.AC, acHash, 512)
+	found, _, _ = testCache.Contains(ctx, cache.AC, acHash, 512)
 	if !found {
 		t.Fatalf("Expected cache to contain AC entry '%s'", acHash)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, casHash1, 1024)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casHash1, 1024)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash1)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, casHash2, 1024)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casHash2, 1024)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash2)
 	}
@@ -737,22 +1333,22 @@ func TestLoadExistingEntries(t *testing.T) {
 
 	var found bool
 
-	found, _ = testCache.Contains(ctx, cache.AC, acHash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.AC, acHash, blobSize)
 	if !found {
 		t.Fatalf("Expected cache to contain AC entry '%s'", acHash)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS entry '%s'", casHash)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.CAS, casV1Hash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casV1Hash, blobSize)
 	if !found {
 		t.Fatalf("Expected cache to contain CAS V1 entry '%s'", casV1Hash)
 	}
 
-	found, _ = testCache.Contains(ctx, cache.RAW, rawHash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.RAW, rawHash, blobSize)
 	if !found {
 		t.Fatalf("Expected cache to contain RAW entry '%s'", rawHash)
 	}
@@ -804,6 +1400,49 @@ func TestDistinctKeyspaces(t *testing.T) {
 	}
 }
 
+func TestRawDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithRawDisabled())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	_, err = os.Stat(path.Join(cacheDir, cache.RAW.DirName()))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected %s not to be created, got: %v", cache.RAW.DirName(), err)
+	}
+
+	blob, hash := testutils.RandomDataAndHash(256)
+
+	err = putGetCompareBytes(ctx, cache.AC, hash, blob, testCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testCache.Put(ctx, cache.RAW, hash, int64(len(blob)), bytes.NewReader(blob))
+	if err != errRawDisabled {
+		t.Fatalf("Expected errRawDisabled from Put, got: %v", err)
+	}
+
+	_, _, err = testCache.Get(ctx, cache.RAW, hash, int64(len(blob)), 0)
+	if err != errRawDisabled {
+		t.Fatalf("Expected errRawDisabled from Get, got: %v", err)
+	}
+
+	found, _, _ := testCache.Contains(ctx, cache.RAW, hash, int64(len(blob)))
+	if found {
+		t.Fatal("Expected Contains to return false for RAW items")
+	}
+}
+
 // Code copied from cache/http/http_test.go
 type testServer struct {
 	srv *httptest.Server
@@ -946,7 +1585,7 @@ func TestHttpProxyBackend(t *testing.T) {
 	// Confirm that it does not contain the item we added to the
 	// first testCache and the proxy backend.
 
-	found, _ := testCache.Contains(ctx, cache.CAS, casHash, blobSize)
+	found, _, _ := testCache.Contains(ctx, cache.CAS, casHash, blobSize)
 	if found {
 		t.Fatalf("Expected the cache not to contain %s", casHash)
 	}
@@ -960,9 +1599,9 @@ func TestHttpProxyBackend(t *testing.T) {
 	}
 
 	// Add the proxy backend
-	testCache.proxy = proxy
+	testCache.proxies = map[cache.EntryKind]cache.Proxy{cache.CAS: proxy}
 	testCache.maxProxyBlobSize = blobSize - 1
-	found, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
 	if found {
 		t.Fatalf("Expected the cache to not contain %s (via the proxy)", casHash)
 	}
@@ -978,7 +1617,7 @@ func TestHttpProxyBackend(t *testing.T) {
 	// Set a larger max proxy blob size and check that we can Get the item.
 	testCache.maxProxyBlobSize = math.MaxInt64
 
-	found, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
+	found, _, _ = testCache.Contains(ctx, cache.CAS, casHash, blobSize)
 	if !found {
 		t.Fatalf("Expected the cache to contain %s (via the proxy)",
 			casHash)
@@ -1184,6 +1823,27 @@ func TestGetValidatedActionResult(t *testing.T) {
 	if !proto.Equal(rAR, &ar) {
 		t.Fatal("Returned ActionResult proto does not match")
 	}
+
+	// The ActionResult refers to four blobs, two output files and
+	// two files in the output directory.
+
+	testCache.maxACValidationEntries = 4
+	rAR, _, err = testCache.GetValidatedActionResult(ctx, arDataHashStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rAR == nil {
+		t.Fatal("Expected the ActionResult to be found within the validation limit")
+	}
+
+	testCache.maxACValidationEntries = 3
+	rAR, _, err = testCache.GetValidatedActionResult(ctx, arDataHashStr)
+	if err == nil {
+		t.Fatal("Expected an error when exceeding the validation limit")
+	}
+	if rAR != nil {
+		t.Fatal("Expected no ActionResult when exceeding the validation limit")
+	}
 }
 
 func TestGetWithOffset(t *testing.T) {
@@ -1251,32 +1911,137 @@ func TestGetWithOffset(t *testing.T) {
 	}
 }
 
-func count(counter *prometheus.CounterVec, kind string, status string) float64 {
-	gets := testutil.ToFloat64(counter.With(prometheus.Labels{"method": getMethod, "kind": kind, "status": status}))
-	contains := testutil.ToFloat64(counter.With(prometheus.Labels{"method": containsMethod, "kind": kind, "status": status}))
-	return gets + contains
-}
+func TestGetNoPromote(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-func TestMetricsUnvalidatedAC(t *testing.T) {
 	cacheDir := tempDir(t)
 	defer os.RemoveAll(cacheDir)
 
-	cacheSize := int64(100000)
-
-	testCacheI, err := New(cacheDir, cacheSize,
-		WithAccessLogger(testutils.NewSilentLogger()),
-		WithEndpointMetrics())
+	testCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
 	if err != nil {
 		t.Fatal(err)
 	}
-	testCache := testCacheI.(*metricsDecorator)
+	testCache := testCacheI.(*diskCache)
 
-	// Add an AC entry with a missing cas blob.
-	randomBlob, hash := testutils.RandomDataAndHash(100)
-	ar := pb.ActionResult{
-		StdoutDigest: &pb.Digest{
-			Hash:      hash,
-			SizeBytes: int64(len(randomBlob)),
+	data1, hash1 := testutils.RandomDataAndHash(64)
+	data2, hash2 := testutils.RandomDataAndHash(64)
+
+	for _, d := range []struct {
+		data []byte
+		hash string
+	}{{data1, hash1}, {data2, hash2}} {
+		err = testCache.Put(ctx, cache.CAS, d.hash, int64(len(d.data)), bytes.NewReader(d.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkTail := func(expectedHash string) {
+		t.Helper()
+		testCache.mu.Lock()
+		key, _ := testCache.lru.getTailItem()
+		testCache.mu.Unlock()
+		if key != cache.LookupKey(cache.CAS, expectedHash) {
+			t.Fatalf("Expected %s to be the least recently used item, found %v",
+				expectedHash, key)
+		}
+	}
+
+	checkTail(hash1)
+
+	noPromoteCtx := cache.WithNoPromote(ctx)
+
+	rc, _, err := testCache.Get(noPromoteCtx, cache.CAS, hash1, int64(len(data1)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("expected to find", hash1)
+	}
+	rc.Close()
+
+	found, _, _ := testCache.Contains(noPromoteCtx, cache.CAS, hash1, int64(len(data1)))
+	if !found {
+		t.Fatal("expected to find", hash1)
+	}
+
+	checkTail(hash1)
+
+	rc, _, err = testCache.Get(ctx, cache.CAS, hash1, int64(len(data1)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("expected to find", hash1)
+	}
+	rc.Close()
+
+	checkTail(hash2)
+}
+
+func TestContainsLocalOnly(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCache, err := New(cacheDir, BlockSize*10,
+		WithProxyBackend(new(proxyStub)),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxyStub contains {contentsHash, contentsLength}.
+	found, _, _ := testCache.Contains(cache.WithLocalOnly(ctx), cache.CAS, contentsHash, contentsLength)
+	if found {
+		t.Fatal("Expected a local only check not to consult the proxy")
+	}
+
+	found, _, _ = testCache.Contains(ctx, cache.CAS, contentsHash, contentsLength)
+	if !found {
+		t.Fatal("Expected to find the blob in the proxy")
+	}
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, _ = testCache.Contains(cache.WithLocalOnly(ctx), cache.CAS, hash, int64(len(data)))
+	if !found {
+		t.Fatal("Expected to find the local blob", hash)
+	}
+}
+
+func count(counter *prometheus.CounterVec, kind string, status string) float64 {
+	gets := testutil.ToFloat64(counter.With(prometheus.Labels{"method": getMethod, "kind": kind, "status": status}))
+	contains := testutil.ToFloat64(counter.With(prometheus.Labels{"method": containsMethod, "kind": kind, "status": status}))
+	return gets + contains
+}
+
+func TestMetricsUnvalidatedAC(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	cacheSize := int64(100000)
+
+	testCacheI, err := New(cacheDir, cacheSize,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithEndpointMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*metricsDecorator)
+
+	// Add an AC entry with a missing cas blob.
+	randomBlob, hash := testutils.RandomDataAndHash(100)
+	ar := pb.ActionResult{
+		StdoutDigest: &pb.Digest{
+			Hash:      hash,
+			SizeBytes: int64(len(randomBlob)),
 		},
 	}
 	arData, err := proto.Marshal(&ar)
@@ -1290,7 +2055,7 @@ func TestMetricsUnvalidatedAC(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	contains, size := testCache.Contains(context.Background(), cache.AC, fakeActionHash, -1)
+	contains, size, _ := testCache.Contains(context.Background(), cache.AC, fakeActionHash, -1)
 	if !contains {
 		t.Fatalf("Expected hash %q to exist in the cache", fakeActionHash)
 	}
@@ -1477,3 +2242,1811 @@ func TestCacheDirLostAndFound(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestEvictTag(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithAccessLogger(testutils.NewSilentLogger()),
+		WithTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	put := func(kind cache.EntryKind, name string, tag string) string {
+		ctx := context.Background()
+		if tag != "" {
+			ctx = cache.WithTag(ctx, tag)
+		}
+		data := []byte(name)
+		hash := hashStr(name)
+		err := testCache.Put(ctx, kind, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	branchAC1 := put(cache.AC, "branch-1", "branch")
+	branchAC2 := put(cache.AC, "branch-2", "branch")
+	branchRAW := put(cache.RAW, "branch-raw", "branch")
+	branchCAS := put(cache.CAS, "branch-cas", "branch")
+	mainAC := put(cache.AC, "main", "main")
+	untaggedAC := put(cache.AC, "untagged", "")
+
+	// Re-uploading with a different tag moves the entry to the new tag.
+	movedAC := put(cache.AC, "moved", "branch")
+	put(cache.AC, "moved", "main")
+
+	numItems, numBytes := testCache.EvictTag("branch")
+	if numItems != 3 {
+		t.Errorf("Expected 3 items to be evicted, got %d", numItems)
+	}
+	if numBytes <= 0 {
+		t.Errorf("Expected a positive number of bytes to be evicted, got %d", numBytes)
+	}
+
+	expectContains := func(kind cache.EntryKind, hash string, expected bool) {
+		found, _, _ := testCache.Contains(context.Background(), kind, hash, -1)
+		if found != expected {
+			t.Errorf("Expected Contains(%s, %s) == %t", kind, hash, expected)
+		}
+	}
+
+	expectContains(cache.AC, branchAC1, false)
+	expectContains(cache.AC, branchAC2, false)
+	expectContains(cache.RAW, branchRAW, false)
+	expectContains(cache.CAS, branchCAS, true)
+	expectContains(cache.AC, mainAC, true)
+	expectContains(cache.AC, untaggedAC, true)
+	expectContains(cache.AC, movedAC, true)
+
+	if keys := testCache.tags.keysWithTag("branch"); len(keys) != 0 {
+		t.Errorf("Expected no keys to remain for the evicted tag, found %v", keys)
+	}
+
+	// Items removed by regular eviction are removed from the index too.
+	testCache.EvictTo(0)
+	if keys := testCache.tags.keysWithTag("main"); len(keys) != 0 {
+		t.Errorf("Expected no keys to remain after eviction, found %v", keys)
+	}
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	for _, policy := range []string{"always", "never", "batch"} {
+		t.Run(policy, func(t *testing.T) {
+			cacheDir := tempDir(t)
+			defer os.RemoveAll(cacheDir)
+
+			testCacheI, err := New(cacheDir, BlockSize*100,
+				WithAccessLogger(testutils.NewSilentLogger()),
+				WithFsyncPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testCache := testCacheI.(*diskCache)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 20)
+			for i := 0; i < 10; i++ {
+				for _, kind := range []cache.EntryKind{cache.AC, cache.CAS} {
+					wg.Add(1)
+					go func(i int, kind cache.EntryKind) {
+						defer wg.Done()
+						data, hash := testutils.RandomDataAndHash(int64(100 + i))
+						errs <- putGetCompareBytes(context.Background(), kind, hash, data, testCache)
+					}(i, kind)
+				}
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	_, err := New(cacheDir, BlockSize, WithFsyncPolicy("sometimes"))
+	if err == nil {
+		t.Error("Expected an error for an invalid fsync policy")
+	}
+}
+
+func TestCheckTreeDepth(t *testing.T) {
+	digestOf := func(dir *pb.Directory) *pb.Digest {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		return &pb.Digest{Hash: hex.EncodeToString(sum[:]), SizeBytes: int64(len(data))}
+	}
+
+	leaf := &pb.Directory{Files: []*pb.FileNode{{Name: "file"}}}
+	middle := &pb.Directory{Directories: []*pb.DirectoryNode{
+		{Name: "a", Digest: digestOf(leaf)},
+		{Name: "b", Digest: digestOf(leaf)},
+	}}
+	root := &pb.Directory{Directories: []*pb.DirectoryNode{
+		{Name: "middle", Digest: digestOf(middle)},
+		{Name: "leaf", Digest: digestOf(leaf)},
+		{Name: "missing", Digest: &pb.Digest{Hash: hashStr("missing"), SizeBytes: 1}},
+	}}
+	tree := &pb.Tree{Root: root, Children: []*pb.Directory{middle, leaf}}
+
+	if err := checkTreeDepth(tree, 3); err != nil {
+		t.Error("Expected a tree of depth 3 to be accepted:", err)
+	}
+	if err := checkTreeDepth(tree, 2); err == nil {
+		t.Error("Expected a tree of depth 3 to be rejected with a limit of 2")
+	}
+}
+
+func TestProtectACDependencies(t *testing.T) {
+	for _, protect := range []bool{false, true} {
+		t.Run(fmt.Sprintf("protect=%t", protect), func(t *testing.T) {
+			cacheDir := tempDir(t)
+			defer os.RemoveAll(cacheDir)
+
+			opts := []Option{WithAccessLogger(testutils.NewSilentLogger())}
+			if protect {
+				opts = append(opts, WithProtectACDependencies())
+			}
+			testCacheI, err := New(cacheDir, BlockSize*10, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testCache := testCacheI.(*diskCache)
+
+			var digests []*pb.Digest
+			for i := 0; i < 3; i++ {
+				data, hash := testutils.RandomDataAndHash(100)
+				err = testCache.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				digests = append(digests, &pb.Digest{Hash: hash, SizeBytes: int64(len(data))})
+			}
+
+			// Refer to the least recently used blob.
+			ar := &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{Path: "out", Digest: digests[0]}},
+			}
+			arData, err := proto.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testCache.Put(context.Background(), cache.AC, hashStr("action"), int64(len(arData)), bytes.NewReader(arData))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			totalSize, _, _, _ := testCache.Stats()
+			numItems, _ := testCache.EvictTo(totalSize - 1)
+			if numItems != 1 {
+				t.Fatalf("Expected 1 item to be evicted, got %d", numItems)
+			}
+
+			// Without protection, the referenced blob is evicted first.
+			expectedEvicted := digests[0]
+			if protect {
+				expectedEvicted = digests[1]
+			}
+			for _, d := range digests {
+				found, _, _ := testCache.Contains(context.Background(), cache.CAS, d.Hash, d.SizeBytes)
+				if found == (d == expectedEvicted) {
+					t.Errorf("Unexpected Contains result for %s: %t", d.Hash, found)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithVerifyOnRead(1),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	data, hash := testutils.RandomDataAndHash(100)
+	err = testCache.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Intact blobs can be read as usual.
+	rc, _, err := testCache.Get(context.Background(), cache.CAS, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the last byte of the blob on disk.
+	key := cache.LookupKey(cache.CAS, hash)
+	item, ok := testCache.lru.Peek(key)
+	if !ok {
+		t.Fatal("Expected the blob to be in the cache")
+	}
+	blobPath := path.Join(cacheDir,
+		testCache.FileLocation(cache.CAS, item.legacy, hash, item.size, item.random))
+	onDisk, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk[len(onDisk)-1] ^= 0xff
+	err = os.WriteFile(blobPath, onDisk, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err = testCache.Get(context.Background(), cache.CAS, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(rc)
+	rc.Close()
+	if err == nil {
+		t.Fatal("Expected an error when reading a corrupt blob")
+	}
+
+	found, _, _ := testCache.Contains(context.Background(), cache.CAS, hash, int64(len(data)))
+	if found {
+		t.Fatal("Expected the corrupt blob to be removed from the cache")
+	}
+}
+
+// concurrencyProxy implements the cache.Proxy interface, and records the
+// maximum number of concurrent Get calls. It never contains anything.
+type concurrencyProxy struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (p *concurrencyProxy) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
+	rc.Close()
+}
+
+func (p *concurrencyProxy) Get(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (io.ReadCloser, int64, error) {
+	p.mu.Lock()
+	p.current++
+	if p.current > p.max {
+		p.max = p.current
+	}
+	p.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	p.mu.Lock()
+	p.current--
+	p.mu.Unlock()
+
+	return nil, -1, nil
+}
+
+func (p *concurrencyProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
+	return false, -1, nil
+}
+
+func TestMaxConcurrentProxyDownloads(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	proxy := &concurrencyProxy{}
+	testCache, err := New(cacheDir, BlockSize*100,
+		WithProxyBackend(proxy),
+		WithMaxConcurrentProxyDownloads(2),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := testCache.Get(context.Background(), cache.CAS, hashStr(fmt.Sprint(i)), 100, 0)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if proxy.max > 2 {
+		t.Fatalf("Expected at most 2 concurrent proxy downloads, found %d", proxy.max)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	proxy := &memoryProxy{items: make(map[string][]byte)}
+
+	const ttl = 200 * time.Millisecond
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithProxyBackend(proxy),
+		WithTags(),
+		WithTombstoneTTL(ttl),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	// The upload is also stored in the proxy backend.
+	data := []byte("poisoned")
+	hash := hashStr("poisoned")
+	ctx := cache.WithTag(context.Background(), "bad")
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numItems, _ := testCache.EvictTag("bad")
+	if numItems != 1 {
+		t.Fatalf("Expected 1 item to be evicted, got %d", numItems)
+	}
+
+	found, _, _ := testCache.Contains(context.Background(), cache.AC, hash, -1)
+	if found {
+		t.Error("Expected the evicted item to not be found via the proxy")
+	}
+
+	rc, _, err := testCache.Get(context.Background(), cache.AC, hash, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc != nil {
+		rc.Close()
+		t.Error("Expected the evicted item to not be read through from the proxy")
+	}
+
+	// Once the tombstone expires, the item can be read through again.
+	time.Sleep(ttl + 50*time.Millisecond)
+
+	found, _, _ = testCache.Contains(context.Background(), cache.AC, hash, -1)
+	if !found {
+		t.Error("Expected the item to be found via the proxy after the tombstone expired")
+	}
+
+	rc, _, err = testCache.Get(context.Background(), cache.AC, hash, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected the item to be read through from the proxy after the tombstone expired")
+	}
+	rc.Close()
+}
+
+func TestTombstoneSetPruning(t *testing.T) {
+	ts := newTombstoneSet(time.Nanosecond)
+
+	for i := 0; i < 10*minTombstonePruneSize; i++ {
+		ts.add(strconv.Itoa(i))
+	}
+
+	// The tombstones expire immediately, so they are forgotten in
+	// batches, without growing the threshold.
+	if len(ts.expires) >= minTombstonePruneSize {
+		t.Fatalf("Expected fewer than %d tombstones, found %d",
+			minTombstonePruneSize, len(ts.expires))
+	}
+	if ts.pruneAt != minTombstonePruneSize {
+		t.Fatalf("Expected the prune threshold to be %d, found %d",
+			minTombstonePruneSize, ts.pruneAt)
+	}
+
+	ts = newTombstoneSet(time.Hour)
+	for i := 0; i < minTombstonePruneSize; i++ {
+		ts.add(strconv.Itoa(i))
+	}
+
+	// Unexpired tombstones are kept, and the threshold grows.
+	if len(ts.expires) != minTombstonePruneSize {
+		t.Fatalf("Expected %d tombstones, found %d",
+			minTombstonePruneSize, len(ts.expires))
+	}
+	if ts.pruneAt != 2*minTombstonePruneSize {
+		t.Fatalf("Expected the prune threshold to be %d, found %d",
+			2*minTombstonePruneSize, ts.pruneAt)
+	}
+	if !ts.has("0") {
+		t.Fatal("Expected an unexpired tombstone")
+	}
+}
+
+func TestFlatDirLayout(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	opts := []Option{
+		WithDirLayout("flat"),
+		WithAccessLogger(testutils.NewSilentLogger()),
+	}
+
+	testCache, err := New(cacheDir, BlockSize*10, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No hash prefix subdirectories should be created.
+	_, err = os.Stat(path.Join(cacheDir, "cas.v2", "00"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected cas.v2/00 not to exist, got: %v", err)
+	}
+
+	ctx := context.Background()
+	data, hash := testutils.RandomDataAndHash(100)
+
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testCache.Put(ctx, cache.AC, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"cas.v2", "ac.v2"} {
+		des, err := os.ReadDir(path.Join(cacheDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(des) != 1 || !strings.HasPrefix(des[0].Name(), hash) {
+			t.Fatalf("Expected a single file for %s in %s, got: %v", hash, dir, des)
+		}
+	}
+
+	// Reload the cache, and check that the items are found.
+	testCache, err = New(cacheDir, BlockSize*10, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kind := range []cache.EntryKind{cache.CAS, cache.AC} {
+		rc, _, err := testCache.Get(ctx, kind, hash, int64(len(data)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc == nil {
+			t.Fatalf("Expected to find %s/%s after reloading", kind, hash)
+		}
+		found, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, data) {
+			t.Fatalf("Unexpected data for %s/%s", kind, hash)
+		}
+	}
+
+	// The default layout can't load the flat cache dir.
+	_, err = New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err == nil {
+		t.Fatal("Expected an error when loading a flat cache dir with the default layout")
+	}
+}
+
+func TestPrefetchACOutputs(t *testing.T) {
+	ctx := context.Background()
+	proxy := &memoryProxy{items: make(map[string][]byte)}
+
+	newCache := func(opts ...Option) *diskCache {
+		cacheDir := tempDir(t)
+		t.Cleanup(func() { os.RemoveAll(cacheDir) })
+
+		// memoryProxy returns the size of the data it was given, so
+		// store blobs uncompressed to match their logical size.
+		opts = append(opts, WithProxyBackend(proxy),
+			WithStorageMode("uncompressed"),
+			WithAccessLogger(testutils.NewSilentLogger()))
+		c, err := New(cacheDir, BlockSize*10, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*diskCache)
+	}
+
+	// Populate the proxy backend with an ActionResult and its output.
+	uploader := newCache()
+
+	data, hash := testutils.RandomDataAndHash(256)
+	err := uploader.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar := &pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{{
+			Path:   "foo",
+			Digest: &pb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+		}},
+	}
+	arData, err := proto.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arHash := hashStr(string(arData))
+	err = uploader.Put(ctx, cache.AC, arHash, int64(len(arData)), bytes.NewReader(arData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache := newCache(WithPrefetchACOutputs(2))
+
+	result, _, err := testCache.GetValidatedActionResult(ctx, arHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("Expected the ActionResult to be found via the proxy")
+	}
+
+	// The output blob should be downloaded in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for testCache.findMissingLocalCAS([]*pb.Digest{{Hash: hash, SizeBytes: int64(len(data))}}, true) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the output blob to be prefetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeDuringLoad(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	firstCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstCache := firstCacheI.(*diskCache)
+
+	// Add some blobs, and give them access times in a different order
+	// to the order they were added.
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		data, hash := testutils.RandomDataAndHash(64)
+		err = firstCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	now := time.Now()
+	atimes := []time.Time{now.Add(-time.Hour), now.Add(-3 * time.Hour), now.Add(-2 * time.Hour)}
+	for i, hash := range hashes {
+		key := cache.LookupKey(cache.CAS, hash)
+		item, ok := firstCache.lru.Peek(key)
+		if !ok {
+			t.Fatalf("Expected %s to be in the cache", key)
+		}
+		err = os.Chtimes(firstCache.getElementPath(key, item), atimes[i], atimes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithServeDuringLoad(),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	// New items can be added while the existing items are loaded.
+	data, newHash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, newHash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once loading is complete, the LRU should be ordered by atime,
+	// behind the newly added item.
+	expected := []string{newHash, hashes[0], hashes[2], hashes[1]}
+
+	lruOrder := func() []string {
+		testCache.mu.Lock()
+		defer testCache.mu.Unlock()
+
+		var order []string
+		for e := testCache.lru.ll.Front(); e != nil; e = e.Next() {
+			key := e.Value.(*entry).key.(string)
+			order = append(order, strings.TrimPrefix(key, "cas/"))
+		}
+		return order
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		order := lruOrder()
+		if reflect.DeepEqual(order, expected) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected LRU order %v, got %v", expected, order)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, hash := range append(hashes, newHash) {
+		found, _, _ := testCache.Contains(ctx, cache.CAS, hash, 64)
+		if !found {
+			t.Errorf("Expected %s to be found", hash)
+		}
+	}
+}
+
+func TestServeDuringLoadFull(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	// Fill the cache, with access times in the opposite order to the
+	// hashes, so that the scan order does not match the access times.
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		data, hash := testutils.RandomDataAndHash(64)
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	now := time.Now()
+	paths := make(map[string]string)
+	for i, hash := range hashes {
+		key := cache.LookupKey(cache.CAS, hash)
+		item, ok := testCache.lru.Peek(key)
+		if !ok {
+			t.Fatalf("Expected %s to be in the cache", key)
+		}
+		paths[hash] = testCache.getElementPath(key, item)
+		atime := now.Add(-time.Duration(len(hashes)-i) * time.Hour)
+		err = os.Chtimes(paths[hash], atime, atime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Start again with an empty index, as if the cache was started with
+	// WithServeDuringLoad, and add new items before the scan.
+	testCache.mu.Lock()
+	testCache.lru = NewSizedLRU(BlockSize*10, testCache.onEvict, 0)
+	testCache.serveDuringLoad = true
+	testCache.mu.Unlock()
+
+	var newHashes []string
+	for i := 0; i < 3; i++ {
+		data, hash := testutils.RandomDataAndHash(64)
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		newHashes = append(newHashes, hash)
+	}
+
+	testCache.loadExistingFilesInBackground()
+
+	// The new items and the most recently used existing items are kept.
+	kept := append(newHashes, hashes[3:]...)
+	for _, hash := range kept {
+		if _, ok := testCache.lru.Peek(cache.LookupKey(cache.CAS, hash)); !ok {
+			t.Errorf("Expected %s to be in the cache", hash)
+		}
+	}
+	checkSizeAndNumItems(t, testCache.lru, BlockSize*10, 10)
+
+	for _, hash := range hashes[3:] {
+		if _, err := os.Stat(paths[hash]); err != nil {
+			t.Errorf("Expected %s to be kept on disk: %v", hash, err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, hash := range hashes[:3] {
+		for {
+			_, err := os.Stat(paths[hash])
+			if os.IsNotExist(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the least recently used item %s to be removed", hash)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestEvictionTrash(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	trashDir := tempDir(t)
+	defer os.RemoveAll(trashDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithEvictionTrash(trashDir, time.Hour),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := cache.LookupKey(cache.CAS, hash)
+	testCache.mu.Lock()
+	item, _ := testCache.lru.Peek(key)
+	testCache.mu.Unlock()
+
+	cachePath := testCache.getElementPath(key, item)
+	rel, err := filepath.Rel(cacheDir, cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashPath := filepath.Join(trashDir, trashSubdir, rel)
+
+	// Files which were not moved to the trash by the cache are never
+	// purged.
+	unrelated := filepath.Join(trashDir, "unrelated")
+	err = os.WriteFile(unrelated, []byte("data"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testCache.Remove(cache.CAS, hash) {
+		t.Fatal("Expected the item to be removed")
+	}
+
+	// The file is moved in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = os.Stat(trashPath)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected evicted file to be moved to %s: %v", trashPath, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = os.Stat(cachePath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected evicted file %s to be removed from the cache dir, got: %v", cachePath, err)
+	}
+
+	recovered, err := os.ReadFile(trashPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, data) {
+		t.Fatal("Expected the trash file to contain the evicted blob")
+	}
+
+	// Unexpired files are not purged.
+	testCache.purgeTrash()
+	_, err = os.Stat(trashPath)
+	if err != nil {
+		t.Fatalf("Expected unexpired trash file to be kept: %v", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(trashPath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(unrelated, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache.purgeTrash()
+	_, err = os.Stat(trashPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected expired trash file to be removed, got: %v", err)
+	}
+	_, err = os.Stat(unrelated)
+	if err != nil {
+		t.Fatalf("Expected unrelated file in the trash dir to be kept: %v", err)
+	}
+}
+
+func TestCompressionBypass(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*100,
+		WithStorageMode("zstd"),
+		WithCompressionBypass(4096),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	ctx := context.Background()
+
+	// Returns the compression type recorded in the blob's casblob header.
+	compressionType := func(data []byte) casblob.CompressionType {
+		hashBytes := sha256.Sum256(data)
+		hash := hex.EncodeToString(hashBytes[:])
+
+		err := testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, _, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, data) {
+			t.Fatal("Expected to read back the same data")
+		}
+
+		key := cache.LookupKey(cache.CAS, hash)
+		item, _ := testCache.lru.Peek(key)
+		fileData, err := os.ReadFile(testCache.getElementPath(key, item))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Skip the magic number, frame size and uncompressed size.
+		return casblob.CompressionType(fileData[16])
+	}
+
+	randomData, _ := testutils.RandomDataAndHash(20000)
+	if ct := compressionType(randomData); ct != casblob.Identity {
+		t.Errorf("Expected incompressible blob to be stored uncompressed, got compression type %d", ct)
+	}
+
+	repetitiveData := bytes.Repeat([]byte("compressible "), 2000)
+	if ct := compressionType(repetitiveData); ct != casblob.Zstandard {
+		t.Errorf("Expected compressible blob to be stored with zstd, got compression type %d", ct)
+	}
+}
+
+func TestZstdMaxSize(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*100,
+		WithStorageMode("zstd"),
+		WithZstdMaxSize(10000),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	ctx := context.Background()
+
+	// Returns the compression type recorded in the blob's casblob header.
+	compressionType := func(data []byte) casblob.CompressionType {
+		hashBytes := sha256.Sum256(data)
+		hash := hex.EncodeToString(hashBytes[:])
+
+		err := testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, _, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(found, data) {
+			t.Fatal("Expected to read back the same data")
+		}
+
+		key := cache.LookupKey(cache.CAS, hash)
+		item, _ := testCache.lru.Peek(key)
+		fileData, err := os.ReadFile(testCache.getElementPath(key, item))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Skip the magic number, frame size and uncompressed size.
+		return casblob.CompressionType(fileData[16])
+	}
+
+	large := bytes.Repeat([]byte("compressible "), 2000)
+	if ct := compressionType(large); ct != casblob.Identity {
+		t.Errorf("Expected large blob to be stored uncompressed, got compression type %d", ct)
+	}
+
+	small := bytes.Repeat([]byte("compressible "), 500)
+	if ct := compressionType(small); ct != casblob.Zstandard {
+		t.Errorf("Expected small blob to be stored with zstd, got compression type %d", ct)
+	}
+}
+
+type recordingEventSink struct {
+	events []string
+}
+
+func (s *recordingEventSink) Put(kind string, hash string, size int64) {
+	s.events = append(s.events, fmt.Sprintf("put %s/%s %d", kind, hash, size))
+}
+
+func (s *recordingEventSink) Evict(kind string, hash string, size int64) {
+	s.events = append(s.events, fmt.Sprintf("evict %s/%s %d", kind, hash, size))
+}
+
+func TestEventSink(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	sink := &recordingEventSink{}
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithEventSink(sink),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	ctx := context.Background()
+	hash := strings.Repeat("a", sha256HashStrSize)
+
+	// Overwriting an item should not be reported as an eviction.
+	for _, data := range [][]byte{[]byte("first"), []byte("second")} {
+		err = testCache.Put(ctx, cache.RAW, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !testCache.Remove(cache.RAW, hash) {
+		t.Fatal("Expected the item to be removed")
+	}
+
+	expected := []string{
+		"put raw/" + hash + " 5",
+		"put raw/" + hash + " 6",
+		"evict raw/" + hash + " 6",
+	}
+	if !reflect.DeepEqual(sink.events, expected) {
+		t.Fatalf("Expected events %q, got %q", expected, sink.events)
+	}
+}
+
+func TestSynthesizedEmptyTree(t *testing.T) {
+	emptyTree, err := proto.Marshal(&pb.Tree{Root: &pb.Directory{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(emptyTree, emptyTreeBlob) {
+		t.Fatalf("Expected the empty Tree to be %x, got %x", emptyTreeBlob, emptyTree)
+	}
+	hash := sha256.Sum256(emptyTree)
+	if hex.EncodeToString(hash[:]) != emptyTreeSha256 {
+		t.Fatalf("Expected the empty Tree hash to be %s, got %x", emptyTreeSha256, hash)
+	}
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithSynthesizedEmptyTree(),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	ctx := context.Background()
+	size := int64(len(emptyTree))
+
+	found, foundSize, _ := testCache.Contains(ctx, cache.CAS, emptyTreeSha256, size)
+	if !found || foundSize != size {
+		t.Fatalf("Expected the empty Tree to be found with size %d, got %v %d", size, found, foundSize)
+	}
+
+	rc, foundSize, err := testCache.Get(ctx, cache.CAS, emptyTreeSha256, size, 0)
+	if err != nil || rc == nil {
+		t.Fatal("Expected to get the empty Tree:", err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundSize != size || !bytes.Equal(data, emptyTree) {
+		t.Fatalf("Expected %x, got %x (size %d)", emptyTree, data, foundSize)
+	}
+
+	rc, _, err = testCache.GetZstd(ctx, emptyTreeSha256, size, 0)
+	if err != nil || rc == nil {
+		t.Fatal("Expected to get the compressed empty Tree:", err)
+	}
+	compressed, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zi, err := zstdimpl.Get("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = zi.DecodeAll(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, emptyTree) {
+		t.Fatalf("Expected %x after decompression, got %x", emptyTree, data)
+	}
+
+	missing, err := testCache.FindMissingCasBlobs(ctx, []*pb.Digest{
+		{Hash: emptyTreeSha256, SizeBytes: size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("Expected no missing blobs, got %v", missing)
+	}
+
+	// An ActionResult which references the empty Tree is valid.
+	arData, err := proto.Marshal(&pb.ActionResult{
+		OutputDirectories: []*pb.OutputDirectory{{
+			Path:       "empty",
+			TreeDigest: &pb.Digest{Hash: emptyTreeSha256, SizeBytes: size},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arHash := sha256.Sum256([]byte("empty tree action"))
+	arHashStr := hex.EncodeToString(arHash[:])
+	err = testCache.Put(ctx, cache.AC, arHashStr, int64(len(arData)), bytes.NewReader(arData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar, _, err := testCache.GetValidatedActionResult(ctx, arHashStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar == nil {
+		t.Fatal("Expected the ActionResult to be valid")
+	}
+}
+
+func TestACValidationConcurrency(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	testCache, err := New(cacheDir, BlockSize*100,
+		WithACValidationConcurrency(4),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(kind cache.EntryKind, data []byte) *pb.Digest {
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		err := testCache.Put(ctx, kind, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pb.Digest{Hash: hash, SizeBytes: int64(len(data))}
+	}
+
+	var ar pb.ActionResult
+	var treeDigests []*pb.Digest
+	for i := 0; i < 10; i++ {
+		fileDigest := put(cache.CAS, []byte(fmt.Sprintf("file %d", i)))
+		treeData, err := proto.Marshal(&pb.Tree{
+			Root: &pb.Directory{
+				Files: []*pb.FileNode{{Name: "f", Digest: fileDigest}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		treeDigest := put(cache.CAS, treeData)
+		treeDigests = append(treeDigests, treeDigest)
+
+		ar.OutputDirectories = append(ar.OutputDirectories, &pb.OutputDirectory{
+			Path:       fmt.Sprintf("dir%d", i),
+			TreeDigest: treeDigest,
+		})
+	}
+
+	arData, err := proto.Marshal(&ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arDigest := put(cache.AC, arData)
+
+	result, _, err := testCache.GetValidatedActionResult(ctx, arDigest.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("Expected the ActionResult to be valid")
+	}
+
+	// A missing Tree makes the ActionResult invalid.
+	if !testCache.Remove(cache.CAS, treeDigests[7].Hash) {
+		t.Fatal("Expected to remove the Tree")
+	}
+	result, _, err = testCache.GetValidatedActionResult(ctx, arDigest.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != nil {
+		t.Fatal("Expected the ActionResult to be invalid when a Tree is missing")
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+	tmpDir := tempDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	ctx := context.Background()
+
+	// An incomplete file left behind by an interrupted upload.
+	leftover := filepath.Join(tmpDir, "leftover")
+	err := os.WriteFile(leftover, []byte("partial"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(leftover, 0664|os.ModeSetgid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache, err := New(cacheDir, BlockSize*10,
+		WithTempDir(tmpDir),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(leftover)
+	if !os.IsNotExist(err) {
+		t.Fatal("Expected the incomplete file in the temp dir to be removed:", err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	des, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(des) != 0 {
+		t.Fatalf("Expected the temp dir to be empty, found %d entries", len(des))
+	}
+
+	// The committed file is found after a restart.
+	testCache, err = New(cacheDir, BlockSize*10,
+		WithTempDir(tmpDir),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, size, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expectContentEquals(rc, size, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	testCache, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache, err = New(cacheDir, BlockSize*10,
+		WithReadOnly(),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+	if err != nil || rc == nil {
+		t.Fatal("Expected to read the existing item:", err)
+	}
+	rc.Close()
+
+	data2, hash2 := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash2, int64(len(data2)), bytes.NewReader(data2))
+	if err != errReadOnly {
+		t.Fatalf("Expected errReadOnly, got: %v", err)
+	}
+}
+
+func TestStopWrites(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	testCache, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start an upload which is still in progress when writes are stopped.
+	data, hash := testutils.RandomDataAndHash(64)
+	pr, pw := io.Pipe()
+	putErr := make(chan error, 1)
+	go func() {
+		putErr <- testCache.Put(ctx, cache.CAS, hash, int64(len(data)), pr)
+	}()
+	_, err = pw.Write(data[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = testCache.StopWrites(shortCtx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the in-flight write to be waited for, got: %v", err)
+	}
+
+	data2, hash2 := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash2, int64(len(data2)), bytes.NewReader(data2))
+	if err != errNotAcceptingWrites {
+		t.Fatalf("Expected errNotAcceptingWrites, got: %v", err)
+	}
+
+	// The in-flight upload can still be committed.
+	_, err = pw.Write(data[32:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	err = <-putErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = testCache.StopWrites(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, err := testCache.Contains(ctx, cache.CAS, hash, int64(len(data)))
+	if err != nil || !found {
+		t.Fatal("Expected the in-flight upload to be committed:", err)
+	}
+}
+
+func TestReadOnlyFilesystemDetection(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	testCache.checkReadOnlyFS(fmt.Errorf("unrelated: %w", os.ErrPermission))
+	if testCache.readOnly.Load() {
+		t.Fatal("Expected the cache to remain writable after an unrelated error")
+	}
+
+	testCache.checkReadOnlyFS(fmt.Errorf("failed to create tempfile: %w",
+		&os.PathError{Op: "open", Path: cacheDir, Err: syscall.EROFS}))
+	if !testCache.readOnly.Load() {
+		t.Fatal("Expected the cache to switch to read-only mode after EROFS")
+	}
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != errReadOnly {
+		t.Fatalf("Expected errReadOnly, got: %v", err)
+	}
+}
+
+func TestCapToOpenFiles(t *testing.T) {
+	tcs := []struct {
+		limit     int64
+		openFiles uint64
+		expected  int64
+	}{
+		{5000, 1048576, 5000},
+		{5000, 20000, 5000},
+		{5000, 1024, 256},
+		{5000, 2, 1},
+		{5000, math.MaxUint64, 5000}, // RLIM_INFINITY.
+	}
+
+	for _, tc := range tcs {
+		got := capToOpenFiles(tc.limit, tc.openFiles)
+		if got != tc.expected {
+			t.Errorf("capToOpenFiles(%d, %d): expected %d, got %d",
+				tc.limit, tc.openFiles, tc.expected, got)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	ctx := context.Background()
+
+	keyFile := filepath.Join(tempDir(t), "key")
+	key := strings.Repeat("0123456789abcdef", 4)
+	err := os.WriteFile(keyFile, []byte(key+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache, err := New(cacheDir, BlockSize*1024,
+		WithEncryptionKeyFile(keyFile),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(64 * 1024)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+	if err != nil || rc == nil {
+		t.Fatal("Expected to read the item:", err)
+	}
+	found, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(found, data) {
+		t.Fatal("Unexpected data read from the encrypted cache")
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheDir, "cas.v2", hash[:2], hash+"-*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected to find one file for the blob, found %v: %v", files, err)
+	}
+	onDisk, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, data[:1024]) {
+		t.Fatal("Found unencrypted data on disk")
+	}
+
+	// Without the key, the blob cannot be read.
+	testCache, err = New(cacheDir, BlockSize*1024, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _, _ = testCache.Get(ctx, cache.CAS, hash, int64(len(data)), 0)
+	if rc != nil {
+		rc.Close()
+		t.Fatal("Expected the encrypted blob to be unreadable without the key")
+	}
+
+	_, err = New(cacheDir, BlockSize*1024,
+		WithStorageMode("uncompressed"),
+		WithEncryptionKeyFile(keyFile))
+	if err == nil {
+		t.Fatal("Expected an error for encryption with the uncompressed storage mode")
+	}
+
+	err = os.WriteFile(keyFile, []byte("0123"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(cacheDir, BlockSize*1024, WithEncryptionKeyFile(keyFile))
+	if err == nil {
+		t.Fatal("Expected an error for a short encryption key")
+	}
+}
+
+func TestIncompleteFilesOnStartup(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		cacheDir := tempDir(t)
+		defer os.RemoveAll(cacheDir)
+
+		_, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Simulate an upload which was interrupted by a crash, by leaving
+		// a file which has not been marked as complete.
+		_, hash := testutils.RandomDataAndHash(64)
+		base := filepath.Join(cacheDir, "cas.v2", hash[:2], hash+"-64")
+		f, random, err := tempfile.NewCreator().Create(base, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write([]byte("partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		incompletePath := base + "-" + random
+
+		opts := []Option{WithAccessLogger(testutils.NewSilentLogger())}
+		if keep {
+			opts = append(opts, WithKeepIncompleteFiles())
+		}
+		testCacheI, err := New(cacheDir, BlockSize*10, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCache := testCacheI.(*diskCache)
+
+		if testCache.lru.Len() != 0 {
+			t.Errorf("Expected the incomplete file not to be indexed, found %d items", testCache.lru.Len())
+		}
+
+		_, err = os.Stat(incompletePath)
+		if keep && err != nil {
+			t.Errorf("Expected the incomplete file to be kept, got: %v", err)
+		}
+		if !keep && !os.IsNotExist(err) {
+			t.Errorf("Expected the incomplete file to be removed, got: %v", err)
+		}
+	}
+}
+
+func TestLRUInconsistencyRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unreserving space which was never reserved breaks the LRU's
+	// accounting invariants.
+	key := cache.LookupKey(cache.CAS, hash)
+	_, _, err = testCache.commit(key, false, "", BlockSize*5, 64, 64, "123", "")
+	if err == nil {
+		t.Fatal("Expected commit to fail")
+	}
+
+	if n := testutil.ToFloat64(testCache.counterLRUInconsistency); n != 1 {
+		t.Errorf("Expected 1 LRU inconsistency, got %v", n)
+	}
+
+	found, _, _ := testCache.Contains(ctx, cache.CAS, hash, int64(len(data)))
+	if found {
+		t.Error("Expected the inconsistent entry to be dropped")
+	}
+}
+
+func TestLRUAddCapacityFailure(t *testing.T) {
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10, WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	data, hash := testutils.RandomDataAndHash(64)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An item which does not fit in the cache is an ordinary failure,
+	// not an inconsistency, and the existing entry is kept.
+	key := cache.LookupKey(cache.CAS, hash)
+	tooLarge := int64(BlockSize * 11)
+	_, _, err = testCache.commit(key, false, "", 0, tooLarge, tooLarge, "123", "")
+	if err == nil {
+		t.Fatal("Expected commit to fail")
+	}
+	if cerr, ok := err.(*cache.Error); !ok || cerr.Code != http.StatusInsufficientStorage {
+		t.Errorf("Expected an insufficient storage error, got: %v", err)
+	}
+
+	if n := testutil.ToFloat64(testCache.counterLRUInconsistency); n != 0 {
+		t.Errorf("Expected no LRU inconsistencies, got %v", n)
+	}
+
+	found, _, _ := testCache.Contains(ctx, cache.CAS, hash, int64(len(data)))
+	if !found {
+		t.Error("Expected the existing entry to be kept")
+	}
+}
+
+// flakyWriter fails its first writes with err, after writing part of
+// the data.
+type flakyWriter struct {
+	bytes.Buffer
+	failures int
+	err      error
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.failures > 0 && len(p) > 1 {
+		w.failures--
+		n, _ := w.Buffer.Write(p[:1])
+		return n, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestDiskWriteRetries(t *testing.T) {
+	data := []byte("some data that is written to disk")
+
+	errnos, err := parseRetryableErrnos(DefaultDiskWriteRetryErrnos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw := &flakyWriter{failures: 2, err: &os.PathError{Op: "write", Err: syscall.EAGAIN}}
+	retries := 0
+	w := &retryWriter{w: fw, retries: 2, errnos: errnos, onRetry: func() { retries++ }}
+
+	n, err := w.Write(data)
+	if err != nil {
+		t.Fatal("Expected the transient errors to be retried:", err)
+	}
+	if n != len(data) || !bytes.Equal(fw.Bytes(), data) {
+		t.Fatalf("Expected %q to be written, got %q (n=%d)", data, fw.Bytes(), n)
+	}
+	if retries != 2 {
+		t.Fatalf("Expected 2 retries, got %d", retries)
+	}
+
+	// Too many failures.
+	fw = &flakyWriter{failures: 3, err: syscall.EAGAIN}
+	w = &retryWriter{w: fw, retries: 2, errnos: errnos}
+	_, err = w.Write(data)
+	if !errors.Is(err, syscall.EAGAIN) {
+		t.Fatal("Expected EAGAIN after running out of retries, got:", err)
+	}
+
+	// Errors which are not configured as transient are not retried.
+	fw = &flakyWriter{failures: 1, err: syscall.ENOSPC}
+	w = &retryWriter{w: fw, retries: 2, errnos: errnos}
+	n, err = w.Write(data)
+	if !errors.Is(err, syscall.ENOSPC) || n != 1 {
+		t.Fatalf("Expected ENOSPC without a retry, got n=%d err=%v", n, err)
+	}
+
+	// EIO is not supported, since the data might have been lost.
+	_, err = parseRetryableErrnos([]string{"EIO"})
+	if err == nil {
+		t.Fatal("Expected EIO to be rejected")
+	}
+
+	_, err = New(tempDir(t), BlockSize*10, WithDiskWriteRetries(3, []string{"ENOSPC"}))
+	if err == nil {
+		t.Fatal("Expected an unsupported errno to be rejected")
+	}
+}
+
+func TestEvictionRemovalConcurrency(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithEvictionRemovalConcurrency(1),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	ctx := context.Background()
+
+	var smallPaths []string
+	for i := 0; i < 8; i++ {
+		data, hash := testutils.RandomDataAndHash(BlockSize)
+		err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := cache.LookupKey(cache.CAS, hash)
+		testCache.mu.Lock()
+		item, _ := testCache.lru.Peek(key)
+		testCache.mu.Unlock()
+		smallPaths = append(smallPaths, testCache.getElementPath(key, item))
+	}
+
+	// This evicts most of the small items.
+	data, hash := testutils.RandomDataAndHash(8 * BlockSize)
+	err = testCache.Put(ctx, cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCache.mu.Lock()
+	pending := len(testCache.evictedFiles)
+	numItems := testCache.lru.Len()
+	testCache.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected evicted files to be handed off when the lock is released, found %d", pending)
+	}
+
+	expectedRemoved := 8 - (numItems - 1)
+	if expectedRemoved < 2 {
+		t.Fatalf("Expected several items to be evicted, %d items remain", numItems)
+	}
+
+	// The files are removed in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		removed := 0
+		for _, p := range smallPaths {
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				removed++
+			}
+		}
+		if removed == expectedRemoved {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d evicted files to be removed, found %d", expectedRemoved, removed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartupVerifySample(t *testing.T) {
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	testCacheI, err := New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache := testCacheI.(*diskCache)
+
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		data, hash := testutils.RandomDataAndHash(100)
+		err = testCache.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// Corrupt the last byte of the first blob on disk.
+	key := cache.LookupKey(cache.CAS, hashes[0])
+	item, ok := testCache.lru.Peek(key)
+	if !ok {
+		t.Fatal("Expected the blob to be in the cache")
+	}
+	blobPath := testCache.getElementPath(key, item)
+	onDisk, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk[len(onDisk)-1] ^= 0xff
+	err = os.WriteFile(blobPath, onDisk, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload the cache, and verify all of the blobs.
+	testCacheI, err = New(cacheDir, BlockSize*10,
+		WithStorageMode("uncompressed"),
+		WithStartupVerifySample(10, true),
+		WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCache = testCacheI.(*diskCache)
+
+	for i, hash := range hashes {
+		_, found := testCache.lru.Peek(cache.LookupKey(cache.CAS, hash))
+		if i == 0 && found {
+			t.Error("Expected the corrupt blob to be removed at startup")
+		}
+		if i > 0 && !found {
+			t.Errorf("Expected intact blob %s to stay in the cache", hash)
+		}
+	}
+}
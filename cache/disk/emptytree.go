@@ -0,0 +1,21 @@
+package disk
+
+import "github.com/buchgr/bazel-remote/v2/cache"
+
+// The canonical empty Tree, ie a serialized Tree message with an empty
+// root Directory, which some clients reference from ActionResults without
+// uploading it.
+var emptyTreeBlob = []byte{0x0a, 0x00}
+
+const emptyTreeSha256 = "102b51b9765a56a3e899f7cf0ee38e5251f9c503b357b330a49183eb7b155604"
+
+// emptyTreeBlob as a zstd frame with a single raw block.
+var emptyTreeZstdBlob = []byte{40, 181, 47, 253, 32, 2, 17, 0, 0, 10, 0}
+
+// isSynthesizedEmptyTree returns true if the empty Tree is treated as
+// always present, and the given item refers to it. size may be -1 if
+// unknown.
+func (c *diskCache) isSynthesizedEmptyTree(kind cache.EntryKind, hash string, size int64) bool {
+	return c.synthesizeEmptyTree && kind == cache.CAS && hash == emptyTreeSha256 &&
+		(size < 0 || size == int64(len(emptyTreeBlob)))
+}
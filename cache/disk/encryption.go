@@ -0,0 +1,38 @@
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The size of AES-256 keys, in bytes.
+const encryptionKeySize = 32
+
+// loadEncryptionKey returns an AES-GCM cipher using the key in keyFile,
+// which must contain a hex-encoded 256 bit key.
+func loadEncryptionKey(keyFile string) (cipher.AEAD, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read encryption key file: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode encryption key file %s: %w", keyFile, err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("Expected a %d bit encryption key in %s, found %d bits",
+			encryptionKeySize*8, keyFile, len(key)*8)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,21 @@
+package disk
+
+import "strings"
+
+// EventSink receives notifications of items being added to and removed
+// from the cache. kind is the lowercase name of the cache.EntryKind, eg
+// "cas", and size is the logical (uncompressed) size of the item.
+//
+// The methods are called while the cache lock is held, so they must not
+// block.
+type EventSink interface {
+	Put(kind string, hash string, size int64)
+	Evict(kind string, hash string, size int64)
+}
+
+// splitLookupKey returns the kind and hash of a key created by
+// cache.LookupKey.
+func splitLookupKey(key string) (kind string, hash string) {
+	kind, hash, _ = strings.Cut(key, "/")
+	return kind, hash
+}
@@ -14,10 +14,11 @@ import (
 )
 
 type proxyCheck struct {
-	wg          *sync.WaitGroup
-	digest      **pb.Digest
-	ctx         context.Context
-	onProxyMiss func()
+	wg           *sync.WaitGroup
+	digest       **pb.Digest
+	ctx          context.Context
+	onProxyMiss  func()
+	onProxyError func(error)
 }
 
 var errMissingBlob = errors.New("a blob could not be found")
@@ -47,10 +48,13 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 	// batchSize moderates how long the cache lock is held by findMissingLocalCAS.
 	const batchSize = 20
 
+	noPromote := cache.NoPromote(ctx)
+	proxy := c.proxies[cache.CAS]
+
 	var cancelContextForFailFast context.CancelFunc = nil
 	cancelledDueToFailFast := false
 
-	if failFast && c.proxy != nil {
+	if failFast && proxy != nil {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithCancel(ctx)
 		defer cancel()
@@ -62,6 +66,21 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 		}
 	}
 
+	// With strict proxy errors, remember the first proxy backend error so
+	// that it can be returned instead of reporting the blob as missing.
+	var onProxyError func(error)
+	var proxyErrMu sync.Mutex
+	var firstProxyErr error
+	if c.strictProxyErrors && proxy != nil {
+		onProxyError = func(err error) {
+			proxyErrMu.Lock()
+			if firstProxyErr == nil {
+				firstProxyErr = err
+			}
+			proxyErrMu.Unlock()
+		}
+	}
+
 	var wg sync.WaitGroup
 
 	var chunk []*pb.Digest
@@ -85,17 +104,17 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 			remaining = remaining[batchSize:]
 		}
 
-		numMissing := c.findMissingLocalCAS(chunk)
+		numMissing := c.findMissingLocalCAS(chunk, noPromote)
 		if numMissing == 0 {
 			continue
 		}
 
-		if c.proxy == nil && failFast {
+		if proxy == nil && failFast {
 			// There's no proxy, there are missing blobs from the local cache, and we are failing fast.
 			return errMissingBlob
 		}
 
-		if c.proxy != nil {
+		if proxy != nil {
 			for i := range chunk {
 				if chunk[i] == nil {
 					continue
@@ -109,6 +128,15 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 					continue
 				}
 
+				if c.tombstones != nil && c.tombstones.has(cache.LookupKey(cache.CAS, chunk[i].Hash)) {
+					// The blob was deliberately removed, don't look for it
+					// in the proxy.
+					if failFast {
+						return errMissingBlob
+					}
+					continue
+				}
+
 				// Adding to the containsQueue channel may have blocked on a previous iteration,
 				// so check to see if the context has cancelled.
 				select {
@@ -127,13 +155,14 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 					ctx:    ctx,
 					// When failFast is true, onProxyMiss will have been set to a function that
 					// will cancel the context, causing the remaining proxyChecks to short-circuit.
-					onProxyMiss: cancelContextForFailFast,
+					onProxyMiss:  cancelContextForFailFast,
+					onProxyError: onProxyError,
 				}
 			}
 		}
 	}
 
-	if c.proxy != nil {
+	if proxy != nil {
 		// Adapt the waitgroup for select
 		waitCh := make(chan struct{})
 		go func() {
@@ -150,6 +179,12 @@ func (c *diskCache) findMissingCasBlobsInternal(ctx context.Context, blobs []*pb
 			return errRequestCancelled
 		case <-waitCh: // Everything in the waitgroup has finished.
 		}
+
+		// No lock required, all of the proxyChecks have finished.
+		if firstProxyErr != nil {
+			return status.Error(codes.Unavailable,
+				"proxy backend error: "+firstProxyErr.Error())
+		}
 	}
 
 	return nil
@@ -171,43 +206,74 @@ func filterNonNil(blobs []*pb.Digest) []*pb.Digest {
 
 // Set blobs that exist in the disk cache to nil, and return the number
 // of missing blobs.
-func (c *diskCache) findMissingLocalCAS(blobs []*pb.Digest) int {
+func (c *diskCache) findMissingLocalCAS(blobs []*pb.Digest, noPromote bool) int {
 	var exists bool
 	var item lruItem
 	var key string
 	missing := 0
 
+	// If the bloom filter is enabled, check it first so that we can
+	// avoid taking the lock for blobs which are definitely missing.
+	var absent []bool
+	if c.bloom != nil {
+		absent = make([]bool, len(blobs))
+		numAbsent := 0
+		for i := range blobs {
+			if blobs[i].SizeBytes == 0 && blobs[i].Hash == emptySha256 {
+				continue
+			}
+			if c.isSynthesizedEmptyTree(cache.CAS, blobs[i].Hash, blobs[i].SizeBytes) {
+				continue
+			}
+			if !c.bloom.mayContain(cache.LookupKey(cache.CAS, blobs[i].Hash)) {
+				absent[i] = true
+				numAbsent++
+			}
+		}
+
+		if numAbsent == len(blobs) {
+			return numAbsent
+		}
+	}
+
 	c.mu.Lock()
 
 	for i := range blobs {
-		if blobs[i].SizeBytes == 0 && blobs[i].Hash == emptySha256 {
-			c.accessLogger.Printf("GRPC CAS HEAD %s OK", blobs[i].Hash)
+		if (blobs[i].SizeBytes == 0 && blobs[i].Hash == emptySha256) ||
+			c.isSynthesizedEmptyTree(cache.CAS, blobs[i].Hash, blobs[i].SizeBytes) {
+			cache.LogSuccess(c.accessLogger, "GRPC CAS HEAD %s OK", blobs[i].Hash)
 			blobs[i] = nil
 			continue
 		}
 
+		if absent != nil && absent[i] {
+			missing++
+			continue
+		}
+
 		foundSize := int64(-1)
 		key = cache.LookupKey(cache.CAS, blobs[i].Hash)
-		item, exists = c.lru.Get(key)
+		item, exists = c.lruGet(key, noPromote)
 		if exists {
 			foundSize = item.size
 		}
 
 		if exists && !isSizeMismatch(blobs[i].SizeBytes, foundSize) {
-			c.accessLogger.Printf("GRPC CAS HEAD %s OK", blobs[i].Hash)
+			cache.LogSuccess(c.accessLogger, "GRPC CAS HEAD %s OK", blobs[i].Hash)
 			blobs[i] = nil
 		} else {
 			missing++
 		}
 	}
 
-	c.mu.Unlock()
+	c.unlock()
 
 	return missing
 }
 
 func (c *diskCache) containsWorker() {
 	var ok bool
+	var err error
 	for req := range c.containsQueue {
 		if req.ctx != nil {
 			select {
@@ -220,14 +286,17 @@ func (c *diskCache) containsWorker() {
 			}
 		}
 
-		ok, _ = c.proxy.Contains(req.ctx, cache.CAS, (*req.digest).Hash, (*req.digest).SizeBytes)
-		if ok {
-			c.accessLogger.Printf("GRPC CAS HEAD %s OK", (*req.digest).Hash)
+		ok, _, err = c.proxies[cache.CAS].Contains(req.ctx, cache.CAS, (*req.digest).Hash, (*req.digest).SizeBytes)
+		if err != nil && req.onProxyError != nil {
+			c.accessLogger.Printf("GRPC CAS HEAD %s PROXY ERROR: %v", (*req.digest).Hash, err)
+			req.onProxyError(err)
+		} else if ok {
+			cache.LogSuccess(c.accessLogger, "GRPC CAS HEAD %s OK", (*req.digest).Hash)
 			// The blob exists on the proxy, remove it from the
 			// list of missing blobs.
 			*(req.digest) = nil
 		} else {
-			c.accessLogger.Printf("GRPC CAS HEAD %s NOT FOUND", (*req.digest).Hash)
+			cache.LogSuccess(c.accessLogger, "GRPC CAS HEAD %s NOT FOUND", (*req.digest).Hash)
 			if req.onProxyMiss != nil {
 				req.onProxyMiss()
 			}
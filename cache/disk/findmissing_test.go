@@ -97,11 +97,11 @@ func (p *testCWProxy) Get(ctx context.Context, kind cache.EntryKind, hash string
 	return nil, -1, nil
 }
 
-func (p *testCWProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+func (p *testCWProxy) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 	if kind == cache.CAS && hash == p.blob {
-		return true, 42
+		return true, 42, nil
 	}
-	return false, -1
+	return false, -1, nil
 }
 
 func TestContainsWorker(t *testing.T) {
@@ -111,7 +111,7 @@ func TestContainsWorker(t *testing.T) {
 
 	c := diskCache{
 		accessLogger:  testutils.NewSilentLogger(),
-		proxy:         &tp,
+		proxies:       map[cache.EntryKind]cache.Proxy{cache.CAS: &tp},
 		containsQueue: make(chan proxyCheck, 2),
 	}
 
@@ -180,7 +180,7 @@ func (p *proxyAdapter) Get(ctx context.Context, kind cache.EntryKind, hash strin
 	return p.cache.Get(ctx, kind, hash, size, 0)
 }
 
-func (p *proxyAdapter) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+func (p *proxyAdapter) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 	return p.cache.Contains(ctx, kind, hash, -1)
 }
 
@@ -267,7 +267,7 @@ func TestFindMissingCasBlobsWithProxyFailFast(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualDiskCache := testCacheI.(*diskCache)
-	actualDiskCache.proxy = proxy
+	actualDiskCache.proxies = map[cache.EntryKind]cache.Proxy{cache.CAS: proxy}
 	actualDiskCache.containsQueue = make(chan proxyCheck, 4)
 	defer func() {
 		close(actualDiskCache.containsQueue)
@@ -326,7 +326,7 @@ func TestFindMissingCasBlobsWithProxyFailFastNoneMissing(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualDiskCache := testCacheI.(*diskCache)
-	actualDiskCache.proxy = proxy
+	actualDiskCache.proxies = map[cache.EntryKind]cache.Proxy{cache.CAS: proxy}
 	actualDiskCache.containsQueue = make(chan proxyCheck, 4)
 	defer func() {
 		close(actualDiskCache.containsQueue)
@@ -400,7 +400,7 @@ func TestFindMissingCasBlobsWithProxyFailFastMaxProxyBlobSize(t *testing.T) {
 		t.Fatal(err)
 	}
 	actualDiskCache := testCacheI.(*diskCache)
-	actualDiskCache.proxy = proxy
+	actualDiskCache.proxies = map[cache.EntryKind]cache.Proxy{cache.CAS: proxy}
 	actualDiskCache.containsQueue = make(chan proxyCheck, 4)
 	defer func() {
 		close(actualDiskCache.containsQueue)
@@ -489,3 +489,73 @@ func TestFindMissingCasBlobsWithProxyMaxProxyBlobSize(t *testing.T) {
 		t.Fatalf("Expected missing[0] == digest2, got %+v", missing[0])
 	}
 }
+
+func TestFindMissingCasBlobsWithBloomFilter(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	cacheDir := tempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	opts := []Option{
+		WithBloomFilter(),
+		WithStorageMode("uncompressed"),
+		WithAccessLogger(testutils.NewSilentLogger()),
+	}
+
+	testCache, err := New(cacheDir, 2*BlockSize, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data1, digest1 := testutils.RandomDataAndDigest(100)
+	_, digest2 := testutils.RandomDataAndDigest(200)
+
+	err = testCache.Put(ctx, cache.CAS, digest1.Hash, digest1.SizeBytes, bytes.NewReader(data1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := testCache.(*diskCache)
+	if !dc.bloom.mayContain(cache.LookupKey(cache.CAS, digest1.Hash)) {
+		t.Fatal("Expected the bloom filter to contain digest1 after Put")
+	}
+
+	missing, err := testCache.FindMissingCasBlobs(ctx, []*pb.Digest{&digest1, &digest2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || !proto.Equal(missing[0], &digest2) {
+		t.Fatalf("Expected only digest2 to be missing, got: %v", missing)
+	}
+
+	// Reload the cache, the bloom filter should be populated from disk.
+	testCache, err = New(cacheDir, 2*BlockSize, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc = testCache.(*diskCache)
+	if !dc.bloom.mayContain(cache.LookupKey(cache.CAS, digest1.Hash)) {
+		t.Fatal("Expected the bloom filter to contain digest1 after reloading")
+	}
+
+	// Fill the cache so that digest1 is evicted.
+	for i := 0; i < 2; i++ {
+		data, digest := testutils.RandomDataAndDigest(100)
+		err = testCache.Put(ctx, cache.CAS, digest.Hash, digest.SizeBytes, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	missing, err = testCache.FindMissingCasBlobs(ctx, []*pb.Digest{&digest1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || !proto.Equal(missing[0], &digest1) {
+		t.Fatalf("Expected digest1 to be missing after eviction, got: %v", missing)
+	}
+	if dc.bloom.mayContain(cache.LookupKey(cache.CAS, digest1.Hash)) {
+		t.Fatal("Expected digest1 to be removed from the bloom filter after eviction")
+	}
+}
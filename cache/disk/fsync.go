@@ -0,0 +1,77 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+)
+
+// syncFunc flushes the contents of a newly written cache file to stable
+// storage, before the file is closed.
+type syncFunc func(f *os.File) error
+
+// newSyncFunc returns the syncFunc for the given fsync policy, which must
+// be one of "always", "never" or "batch".
+func newSyncFunc(policy string) (syncFunc, error) {
+	switch policy {
+	case "always":
+		return (*os.File).Sync, nil
+	case "never":
+		return func(*os.File) error { return nil }, nil
+	case "batch":
+		b := &batchSyncer{requests: make(chan syncRequest, 1024)}
+		go b.run()
+		return b.sync, nil
+	default:
+		return nil, fmt.Errorf("Unsupported fsync policy: %q", policy)
+	}
+}
+
+type syncRequest struct {
+	f    *os.File
+	done chan error
+}
+
+// batchSyncer coalesces fsyncs from concurrent writes. Callers block until
+// a sync which covers their file has completed, but all the requests that
+// arrive while a sync is in progress are handled by a single sync of the
+// filesystem afterwards, where the platform supports that.
+type batchSyncer struct {
+	requests chan syncRequest
+}
+
+func (b *batchSyncer) sync(f *os.File) error {
+	req := syncRequest{f: f, done: make(chan error, 1)}
+	b.requests <- req
+	return <-req.done
+}
+
+func (b *batchSyncer) run() {
+	var batch []syncRequest
+	var files []*os.File
+
+	for req := range b.requests {
+		batch = append(batch[:0], req)
+
+		// Gather everything else that is waiting.
+	gather:
+		for {
+			select {
+			case r := <-b.requests:
+				batch = append(batch, r)
+			default:
+				break gather
+			}
+		}
+
+		files = files[:0]
+		for _, r := range batch {
+			files = append(files, r.f)
+		}
+
+		err := syncFiles(files)
+
+		for _, r := range batch {
+			r.done <- err
+		}
+	}
+}
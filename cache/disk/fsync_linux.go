@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package disk
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncFiles flushes files to stable storage with a single syncfs call.
+// All the files are assumed to be on the same filesystem, which is true
+// for files inside the cache directory.
+func syncFiles(files []*os.File) error {
+	return unix.Syncfs(int(files[0].Fd()))
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package disk
+
+import "os"
+
+// syncFiles flushes each of files to stable storage. Syncing a whole
+// filesystem at once is not supported on this platform.
+func syncFiles(files []*os.File) error {
+	var firstErr error
+	for _, f := range files {
+		err := f.Sync()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,52 @@
+package disk
+
+import (
+	"sync"
+	"time"
+)
+
+// hourlyCounter counts events over the last hour, in one minute buckets.
+// hourlyCounter is safe for concurrent use.
+type hourlyCounter struct {
+	mu      sync.Mutex
+	counts  [60]int64
+	minutes [60]int64 // The unix minute that each bucket is counting.
+}
+
+func (h *hourlyCounter) inc() {
+	h.add(time.Now(), 1)
+}
+
+func (h *hourlyCounter) add(now time.Time, n int64) {
+	minute := now.Unix() / 60
+	i := minute % int64(len(h.counts))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.minutes[i] != minute {
+		h.minutes[i] = minute
+		h.counts[i] = 0
+	}
+	h.counts[i] += n
+}
+
+// total returns the number of events counted in the last hour.
+func (h *hourlyCounter) total() int64 {
+	return h.totalAt(time.Now())
+}
+
+func (h *hourlyCounter) totalAt(now time.Time) int64 {
+	minute := now.Unix() / 60
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var total int64
+	for i := range h.counts {
+		if minute-h.minutes[i] < int64(len(h.counts)) {
+			total += h.counts[i]
+		}
+	}
+	return total
+}
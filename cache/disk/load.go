@@ -2,6 +2,7 @@ package disk
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -13,11 +14,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
 	"github.com/buchgr/bazel-remote/v2/cache/disk/casblob"
 	"github.com/buchgr/bazel-remote/v2/cache/disk/zstdimpl"
+	"github.com/buchgr/bazel-remote/v2/utils/rlimit"
 	"github.com/buchgr/bazel-remote/v2/utils/validate"
 
 	"github.com/djherbis/atime"
@@ -30,6 +33,10 @@ import (
 
 const lowercaseDSStoreFile = ".ds_store"
 
+// At most 1/fileRemovalFDFraction of the open files limit is used for
+// concurrent file removals.
+const fileRemovalFDFraction = 4
+
 // New returns a new instance of a filesystem-based cache rooted at `dir`,
 // with a maximum size of `maxSizeBytes` bytes and `opts` Options set.
 func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
@@ -56,31 +63,45 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 		// lots of files, so allow fewer than linux.
 		semaphoreWeight = 3000
 	}
-	log.Printf("Limiting concurrent file removals to %d\n", semaphoreWeight)
 
-	zi, err := zstdimpl.Get("go")
+	// On hosts with a low limit on open files, leave most of them for
+	// serving requests.
+	openFiles, err := rlimit.OpenFiles()
 	if err != nil {
-		return nil, err
+		log.Println("Failed to find the open files limit:", err)
+	} else if limit := capToOpenFiles(semaphoreWeight, openFiles); limit < semaphoreWeight {
+		log.Printf("Reducing the file removal limit to fit RLIMIT_NOFILE %d", openFiles)
+		semaphoreWeight = limit
 	}
+	log.Printf("Limiting concurrent file removals to %d\n", semaphoreWeight)
 
 	c := diskCache{
 		dir: dir,
 
 		// Not using config here, to avoid test import cycles.
 		storageMode:      casblob.Zstandard,
-		zstd:             zi,
 		maxBlobSize:      math.MaxInt64,
 		maxProxyBlobSize: math.MaxInt64,
 
+		syncFile: (*os.File).Sync,
+
 		fileRemovalSem: semaphore.NewWeighted(semaphoreWeight),
 
 		gaugeCacheAge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "bazel_remote_disk_cache_longest_item_idle_time_seconds",
 			Help: "The idle time (now - atime) of the last item in the LRU cache, updated once per minute. Depending on filesystem mount options (e.g. relatime), the resolution may be measured in 'days' and not accurate to the second. If using noatime this will be 0.",
 		}),
+		counterLRUInconsistency: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bazel_remote_lru_inconsistency_total",
+			Help: "The number of internal LRU index inconsistencies that were detected",
+		}),
+		counterDiskWriteRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "bazel_remote_disk_write_retries_total",
+			Help: "The number of writes to new cache files that were retried after a transient error",
+		}),
 	}
 
-	cc := CacheConfig{diskCache: &c}
+	cc := CacheConfig{diskCache: &c, zstdImpl: "go"}
 
 	// Apply options.
 	for _, o := range opts {
@@ -90,35 +111,71 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 		}
 	}
 
+	c.zstd, err = zstdimpl.GetWithOptions(cc.zstdImpl, cc.zstdOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.aead != nil && c.storageMode != casblob.Zstandard {
+		return nil, fmt.Errorf("Encryption requires the zstd storage mode")
+	}
+
+	if c.rawContentTypes && c.rawDisabled {
+		return nil, fmt.Errorf("RAW content types cannot be stored when the RAW keyspace is disabled")
+	}
+
 	// Create the directory structure.
-	hexLetters := []byte("0123456789abcdef")
-	for _, c1 := range hexLetters {
-		for _, c2 := range hexLetters {
-			subDir := string(c1) + string(c2)
-			err := os.MkdirAll(filepath.Join(dir, cache.CAS.DirName(), subDir), os.ModePerm)
-			if err != nil {
-				return nil, err
-			}
-			err = os.MkdirAll(filepath.Join(dir, cache.AC.DirName(), subDir), os.ModePerm)
-			if err != nil {
-				return nil, err
-			}
-			err = os.MkdirAll(filepath.Join(dir, cache.RAW.DirName(), subDir), os.ModePerm)
-			if err != nil {
-				return nil, err
-			}
+	err = c.createDirectories()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail early with a clear error, rather than failing every Put.
+	if !c.readOnly.Load() {
+		err = checkWritable(dir)
+		if err != nil {
+			return nil, fmt.Errorf("The cache directory %s is not writable, use read-only mode to only serve the existing items: %w", dir, err)
 		}
 	}
 
-	err = c.migrateDirectories()
+	if c.tempDir != "" && !c.readOnly.Load() {
+		err = c.prepareTempDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.trashDir != "" {
+		err = os.MkdirAll(c.trashDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		go c.pollTrash()
+	}
+
+	// The old directory structures can only be migrated to the default
+	// layout. With the flat layout, any old directories are reported as
+	// unexpected when scanning the cache dir.
+	if !c.flatLayout && !c.readOnly.Load() {
+		err = c.migrateDirectories()
+		if err != nil {
+			return nil, fmt.Errorf("Attempting to migrate the old directory structure failed: %w", err)
+		}
+	}
+	err = c.loadPins()
 	if err != nil {
-		return nil, fmt.Errorf("Attempting to migrate the old directory structure failed: %w", err)
+		return nil, fmt.Errorf("Loading of pinned items failed due to error: %w", err)
 	}
+
 	err = c.loadExistingFiles(maxSizeBytes)
 	if err != nil {
 		return nil, fmt.Errorf("Loading of existing cache entries failed due to error: %w", err)
 	}
 
+	if c.startupVerifySample > 0 && !c.serveDuringLoad {
+		c.verifyStartupSample(c.startupVerifySample)
+	}
+
 	if cc.metrics == nil {
 		return &c, nil
 	}
@@ -128,23 +185,110 @@ func New(dir string, maxSizeBytes int64, opts ...Option) (Cache, error) {
 	return cc.metrics, nil
 }
 
+// capToOpenFiles returns limit, reduced if necessary to at most
+// 1/fileRemovalFDFraction of openFiles, but at least 1.
+func capToOpenFiles(limit int64, openFiles uint64) int64 {
+	fdLimit := openFiles / fileRemovalFDFraction
+	if fdLimit >= uint64(limit) {
+		return limit
+	}
+
+	return max(int64(fdLimit), 1)
+}
+
+func (c *diskCache) createDirectories() error {
+	kinds := []cache.EntryKind{cache.CAS, cache.AC}
+	if !c.rawDisabled {
+		kinds = append(kinds, cache.RAW)
+	}
+
+	if c.rawContentTypes {
+		err := os.MkdirAll(filepath.Join(c.dir, rawContentTypesDir), os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.flatLayout {
+		for _, kind := range kinds {
+			err := os.MkdirAll(filepath.Join(c.dir, kind.DirName()), os.ModePerm)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	hexLetters := []byte("0123456789abcdef")
+	for _, c1 := range hexLetters {
+		for _, c2 := range hexLetters {
+			subDir := string(c1) + string(c2)
+			for _, kind := range kinds {
+				err := os.MkdirAll(filepath.Join(c.dir, kind.DirName(), subDir), os.ModePerm)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *diskCache) migrateDirectories() error {
-	err := migrateDirectory(c.dir, cache.AC)
+	batchSize := c.migrationBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMigrationBatchSize
+	}
+
+	err := migrateDirectory(c.dir, cache.AC, batchSize)
 	if err != nil {
 		return err
 	}
-	err = migrateDirectory(c.dir, cache.CAS)
+	err = migrateDirectory(c.dir, cache.CAS, batchSize)
 	if err != nil {
 		return err
 	}
-	err = migrateDirectory(c.dir, cache.RAW)
+	err = migrateDirectory(c.dir, cache.RAW, batchSize)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func migrateDirectory(baseDir string, kind cache.EntryKind) error {
+// The default number of directory entries to read at a time when
+// migrating old directory structures.
+const defaultMigrationBatchSize = 10000
+
+// forEachDirEntries calls fn with the entries of dir, at most batchSize
+// at a time, so that huge directories are not listed in memory at once.
+// Entries may be renamed or removed by fn while dir is being read.
+func forEachDirEntries(dir string, batchSize int, fn func([]os.DirEntry) error) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	for {
+		entries, err := d.ReadDir(batchSize)
+		if len(entries) > 0 {
+			fnErr := fn(entries)
+			if fnErr != nil {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func migrateDirectory(baseDir string, kind cache.EntryKind, batchSize int) error {
 	sourceDir := path.Join(baseDir, kind.String())
 
 	_, err := os.Stat(sourceDir)
@@ -154,11 +298,6 @@ func migrateDirectory(baseDir string, kind cache.EntryKind) error {
 
 	log.Println("Migrating files (if any) to new directory structure:", sourceDir)
 
-	listing, err := os.ReadDir(sourceDir)
-	if err != nil {
-		return err
-	}
-
 	// The v0 directory structure was lowercase sha256 hash filenames
 	// stored directly in the ac/ and cas/ directories.
 
@@ -189,7 +328,7 @@ func migrateDirectory(baseDir string, kind cache.EntryKind) error {
 					}
 
 					destDir := filepath.Join(targetDir, oldName[:2])
-					err := migrateV1Subdir(oldNamePath, destDir, kind)
+					err := migrateV1Subdir(oldNamePath, destDir, kind, batchSize)
 					if err != nil {
 						log.Printf("Warning: failed to read subdir %q: %s",
 							oldNamePath, err)
@@ -228,19 +367,20 @@ func migrateDirectory(baseDir string, kind cache.EntryKind) error {
 		}()
 	}
 
-	err = nil
-	numItems := len(listing)
 	i := 1
-	for _, item := range listing {
-		select {
-		case itemChan <- item:
-			log.Printf("Migrating %s item(s) %d/%d, %s\n", sourceDir, i, numItems, item.Name())
-			i++
-		case err = <-errChan:
-			log.Println("Encountered error while migrating files:", err)
-			close(itemChan)
+	err = forEachDirEntries(sourceDir, batchSize, func(listing []os.DirEntry) error {
+		for _, item := range listing {
+			select {
+			case itemChan <- item:
+				log.Printf("Migrating %s item %d, %s\n", sourceDir, i, item.Name())
+				i++
+			case err := <-errChan:
+				log.Println("Encountered error while migrating files:", err)
+				return err
+			}
 		}
-	}
+		return nil
+	})
 	close(itemChan)
 	wg.Wait()
 
@@ -252,39 +392,50 @@ func migrateDirectory(baseDir string, kind cache.EntryKind) error {
 	return os.RemoveAll(sourceDir)
 }
 
-func migrateV1Subdir(oldDir string, destDir string, kind cache.EntryKind) error {
-	listing, err := os.ReadDir(oldDir)
-	if err != nil {
-		return err
-	}
-
+func migrateV1Subdir(oldDir string, destDir string, kind cache.EntryKind, batchSize int) error {
 	if kind == cache.CAS {
-		for _, item := range listing {
+		err := forEachDirEntries(oldDir, batchSize, func(listing []os.DirEntry) error {
+			return migrateV1CASEntries(oldDir, destDir, listing)
+		})
+		if err != nil {
+			return err
+		}
 
-			name := item.Name()
+		return os.Remove(oldDir)
+	}
 
-			oldPath := path.Join(oldDir, name)
+	return forEachDirEntries(oldDir, batchSize, func(listing []os.DirEntry) error {
+		return migrateV1Entries(oldDir, destDir, listing)
+	})
+}
 
-			if !validate.HashKeyRegex.MatchString(name) {
-				if strings.ToLower(name) == lowercaseDSStoreFile {
-					os.Remove(oldPath)
-					continue
-				}
+func migrateV1CASEntries(oldDir string, destDir string, listing []os.DirEntry) error {
+	for _, item := range listing {
+		name := item.Name()
 
-				return fmt.Errorf("Unexpected file: %s", oldPath)
-			}
+		oldPath := path.Join(oldDir, name)
 
-			destPath := path.Join(destDir, name) + "-556677.v1"
-			err = os.Rename(oldPath, destPath)
-			if err != nil {
-				return fmt.Errorf("Failed to migrate CAS blob %s: %w",
-					oldPath, err)
+		if !validate.HashKeyRegex.MatchString(name) {
+			if strings.ToLower(name) == lowercaseDSStoreFile {
+				os.Remove(oldPath)
+				continue
 			}
+
+			return fmt.Errorf("Unexpected file: %s", oldPath)
 		}
 
-		return os.Remove(oldDir)
+		destPath := path.Join(destDir, name) + "-556677.v1"
+		err := os.Rename(oldPath, destPath)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate CAS blob %s: %w",
+				oldPath, err)
+		}
 	}
 
+	return nil
+}
+
+func migrateV1Entries(oldDir string, destDir string, listing []os.DirEntry) error {
 	for _, item := range listing {
 		name := item.Name()
 
@@ -302,7 +453,7 @@ func migrateV1Subdir(oldDir string, destDir string, kind cache.EntryKind) error
 		destPath := path.Join(destDir, name) + "-112233"
 
 		// TODO: support cross-filesystem migration.
-		err = os.Rename(oldPath, destPath)
+		err := os.Rename(oldPath, destPath)
 		if err != nil {
 			return fmt.Errorf("Failed to migrate blob %s: %w", oldPath, err)
 		}
@@ -344,7 +495,9 @@ func (r scanResult) Swap(i, j int) {
 	r.metadata[i], r.metadata[j] = r.metadata[j], r.metadata[i]
 }
 
-func (c *diskCache) scanDir() (scanResult, error) {
+// scanDir lists the cache items in the cache dir. If partial is non-nil,
+// it is called with the items from each directory as they are scanned.
+func (c *diskCache) scanDir(partial func(scanResult)) (scanResult, error) {
 
 	numWorkers := runtime.NumCPU()
 	if numWorkers < 4 {
@@ -354,17 +507,21 @@ func (c *diskCache) scanDir() (scanResult, error) {
 	}
 	log.Println("Scanning cache directory with", numWorkers, "goroutines")
 
+	dirListers := new(errgroup.Group)
+
 	dc := make(chan string, numWorkers) // Feed directory names to workers.
 	dcClosed := false
-	defer func() {
-		if !dcClosed {
-			close(dc)
-		}
-	}()
 
 	scanResults := make(chan scanResult, numWorkers) // Received from workers.
 	scanResultsClosed := false
+
 	defer func() {
+		// If we return early, wait for the workers to finish before
+		// closing scanResults, so they don't send on a closed channel.
+		if !dcClosed {
+			close(dc)
+			_ = dirListers.Wait()
+		}
 		if !scanResultsClosed {
 			close(scanResults)
 		}
@@ -375,18 +532,19 @@ func (c *diskCache) scanDir() (scanResult, error) {
 		metadata: []*keyAndAtime{},
 	}
 
-	received := make(chan struct{})
+	received := make(chan struct{}, 1)
 
 	go func() {
 		for sr := range scanResults {
+			if partial != nil {
+				partial(sr)
+			}
 			finalScanResult.item = append(finalScanResult.item, sr.item...)
 			finalScanResult.metadata = append(finalScanResult.metadata, sr.metadata...)
 		}
 		received <- struct{}{}
 	}()
 
-	dirListers := new(errgroup.Group)
-
 	// compressed CAS items: <hash>-<logical size>-<random digits/ascii letters>
 	// uncompressed CAS items: <hash>-<logical size>-<random digits/ascii letters>.v1
 	// AC and RAW items: <hash>-<random digits/ascii letters>
@@ -396,17 +554,22 @@ func (c *diskCache) scanDir() (scanResult, error) {
 	// root dir of some unix style filesystems.
 	const lostAndFound = "lost+found"
 
+	// The number of files found with the setgid bit set, which were
+	// not completely written.
+	var incompleteFiles atomic.Int64
+
 	for i := 0; i < numWorkers; i++ {
 		dirListers.Go(func() error {
 			for d := range dc {
 				dirName := path.Join(c.dir, d)
 
 				var lookupKeyPrefix string
-				if strings.HasPrefix(d, "cas.v2/") {
+				kindDir, _, _ := strings.Cut(d, "/")
+				if kindDir == "cas.v2" {
 					lookupKeyPrefix = "cas/"
-				} else if strings.HasPrefix(d, "ac.v2/") {
+				} else if kindDir == "ac.v2" {
 					lookupKeyPrefix = "ac/"
-				} else if strings.HasPrefix(d, "raw.v2/") {
+				} else if kindDir == "raw.v2" {
 					lookupKeyPrefix = "raw/"
 				} else {
 					return fmt.Errorf("Unrecognised directory in cache dir: %q", dirName)
@@ -431,14 +594,41 @@ func (c *diskCache) scanDir() (scanResult, error) {
 							continue
 						}
 
+						if c.flatLayout {
+							return fmt.Errorf("Unexpected directory: %q (was the cache dir created with a different dir_layout?)", path.Join(dirName, name))
+						}
+
 						return fmt.Errorf("Unexpected directory: %q", path.Join(dirName, name))
 					}
 
 					info, err := de.Info()
 					if err != nil {
+						if c.serveDuringLoad && os.IsNotExist(err) {
+							continue // Removed since the dir was listed.
+						}
 						return fmt.Errorf("Failed to get file info for %q: %w", path.Join(dirName, name), err)
 					}
 
+					if info.Mode()&os.ModeSetgid != 0 {
+						if c.serveDuringLoad {
+							// The file is still being written, and will be
+							// added to the index when it is committed.
+							continue
+						}
+
+						// Otherwise the file was left behind by an upload
+						// which was interrupted, eg by a crash.
+						incompleteFiles.Add(1)
+						if c.keepIncompleteFiles {
+							continue
+						}
+						err = os.Remove(path.Join(dirName, name))
+						if err != nil && !os.IsNotExist(err) {
+							return fmt.Errorf("Failed to remove incomplete file %q: %w", path.Join(dirName, name), err)
+						}
+						continue
+					}
+
 					fields := strings.Split(name, "/")
 					file := fields[len(fields)-1]
 
@@ -493,6 +683,23 @@ func (c *diskCache) scanDir() (scanResult, error) {
 
 	dre := regexp.MustCompile(`^[a-f0-9]{2}$`)
 
+	// The directories to scan, relative to c.dir, and their modification
+	// times if serveDuringLoad is set.
+	var dirs []string
+	mtimes := make(map[string]time.Time)
+	addDir := func(dirPath string, de os.DirEntry) error {
+		dirs = append(dirs, dirPath)
+		if !c.serveDuringLoad {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		mtimes[dirPath] = info.ModTime()
+		return nil
+	}
+
 	for _, de := range des {
 		name := de.Name()
 
@@ -508,10 +715,34 @@ func (c *diskCache) scanDir() (scanResult, error) {
 			continue
 		}
 
+		if name == rawContentTypesDir {
+			// Not cache entries, see RawContentType.
+			continue
+		}
+
+		if name == pinnedItemsDir {
+			// Not cache entries, see Pin.
+			continue
+		}
+
 		if name != "ac.v2" && name != "cas.v2" && name != "raw.v2" {
 			return scanResult{}, fmt.Errorf("Unexpected dir: %s", name)
 		}
 
+		if name == cache.RAW.DirName() && c.rawDisabled {
+			log.Printf("The RAW keyspace is disabled, ignoring %s", path.Join(c.dir, name))
+			continue
+		}
+
+		if c.flatLayout {
+			// The files are stored directly in this directory.
+			err = addDir(name, de)
+			if err != nil {
+				return scanResult{}, err
+			}
+			continue
+		}
+
 		dir := path.Join(c.dir, name)
 		des2, err := os.ReadDir(dir)
 		if err != nil {
@@ -528,7 +759,7 @@ func (c *diskCache) scanDir() (scanResult, error) {
 					continue
 				}
 
-				return scanResult{}, fmt.Errorf("Unexpected file: %s", dirPath)
+				return scanResult{}, fmt.Errorf("Unexpected file: %s (was the cache dir created with a different dir_layout?)", dirPath)
 			}
 
 			if name2 == lostAndFound {
@@ -539,10 +770,27 @@ func (c *diskCache) scanDir() (scanResult, error) {
 				return scanResult{}, fmt.Errorf("Unexpected dir: %s", dirPath)
 			}
 
-			dc <- dirPath
+			err = addDir(dirPath, de2)
+			if err != nil {
+				return scanResult{}, err
+			}
 		}
 	}
 
+	if c.serveDuringLoad {
+		// Scan the most recently used directories first, so that the
+		// most recently used items are likely to be served soonest.
+		// Directories are modified when files are added to them, which
+		// is a cheap approximation of when they were last used.
+		sort.SliceStable(dirs, func(i, j int) bool {
+			return mtimes[dirs[i]].After(mtimes[dirs[j]])
+		})
+	}
+
+	for _, d := range dirs {
+		dc <- d
+	}
+
 	close(dc) // Ensure that the workers exit their range loop.
 	dcClosed = true
 
@@ -553,18 +801,48 @@ func (c *diskCache) scanDir() (scanResult, error) {
 	close(scanResults)
 	scanResultsClosed = true
 
+	if n := incompleteFiles.Load(); n > 0 {
+		if c.keepIncompleteFiles {
+			log.Printf("Skipped %d incomplete file(s) left by interrupted uploads", n)
+		} else {
+			log.Printf("Removed %d incomplete file(s) left by interrupted uploads", n)
+		}
+	}
+
 	<-received
 
 	return finalScanResult, nil
 }
 
+// maxReservedSize returns the limit on the LRU's reserved size for a cache
+// with the given maximum size, or 0 if there is no limit.
+func (c *diskCache) maxReservedSize(maxSizeBytes int64) int64 {
+	if c.maxReservedFraction <= 0 {
+		return 0
+	}
+	return int64(c.maxReservedFraction * float64(maxSizeBytes))
+}
+
 // loadExistingFiles lists all files in the cache directory, and adds them to the
 // LRU index so that they can be served. Files are sorted by access time first,
 // so that the eviction behavior is preserved across server restarts.
 func (c *diskCache) loadExistingFiles(maxSizeBytes int64) error {
 	log.Printf("Loading existing files in %s.\n", c.dir)
 
-	result, err := c.scanDir()
+	if c.serveDuringLoad {
+		c.lru = NewSizedLRU(maxSizeBytes, c.onEvict, 0)
+		c.lru.maxReservedSize = c.maxReservedSize(maxSizeBytes)
+		if c.bloomFilterEnabled {
+			c.bloom = newBloomFilter(0)
+		}
+
+		log.Println("Serving requests while existing files are loaded in the background.")
+		go c.loadExistingFilesInBackground()
+
+		return nil
+	}
+
+	result, err := c.scanDir(nil)
 	if err != nil {
 		log.Printf("Failed to scan cache dir: %s", err.Error())
 		return err
@@ -573,22 +851,25 @@ func (c *diskCache) loadExistingFiles(maxSizeBytes int64) error {
 	log.Println("Sorting cache files by atime.")
 	sort.Sort(result)
 
-	// The eviction callback deletes the file from disk.
-	// This function is only called while the lock is held
-	// by the current goroutine.
-	onEvict := func(key Key, value lruItem) {
-		f := c.getElementPath(key, value)
-		// Run in a goroutine so we can release the lock sooner.
-		go c.removeFile(f)
-	}
-
 	log.Println("Building LRU index.")
 
-	c.lru = NewSizedLRU(maxSizeBytes, onEvict, len(result.item))
+	c.lru = NewSizedLRU(maxSizeBytes, c.onEvict, len(result.item))
+	c.lru.maxReservedSize = c.maxReservedSize(maxSizeBytes)
+
+	if c.bloomFilterEnabled {
+		c.bloom = newBloomFilter(2 * len(result.item))
+	}
 
 	for i := 0; i < len(result.item); i++ {
+		if c.bloom != nil {
+			c.bloom.add(result.metadata[i].lookupKey)
+		}
+		result.item[i].pinned = c.isPinned(result.metadata[i].lookupKey)
 		ok := c.lru.Add(result.metadata[i].lookupKey, *result.item[i])
 		if !ok {
+			if c.bloom != nil {
+				c.bloom.remove(result.metadata[i].lookupKey)
+			}
 			err = os.Remove(filepath.Join(c.dir, result.metadata[i].lookupKey))
 			if err != nil {
 				return err
@@ -596,7 +877,153 @@ func (c *diskCache) loadExistingFiles(maxSizeBytes int64) error {
 		}
 	}
 
+	// Nothing else uses the cache yet, so the lock is not held here.
+	c.removeEvicted(c.evictedFiles)
+	c.evictedFiles = nil
+
 	log.Println("Finished loading disk cache files.")
 
 	return nil
 }
+
+// The eviction callback deletes the file from disk.
+// This function is only called while the lock is held
+// by the current goroutine.
+func (c *diskCache) onEvict(key Key, value lruItem) {
+	if c.tags != nil {
+		c.tags.remove(key.(string))
+	}
+
+	if c.bloom != nil {
+		c.bloom.remove(key.(string))
+	}
+
+	// Overwritten items are still present in the index, and are reported
+	// by the Put event for their replacement instead.
+	_, overwritten := c.lru.cache[key]
+	if c.events != nil && !overwritten {
+		kind, hash := splitLookupKey(key.(string))
+		c.events.Evict(kind, hash, value.size)
+	}
+
+	// Overwritten RAW entries keep the content type of their replacement.
+	if c.rawContentTypes && !overwritten {
+		kind, hash := splitLookupKey(key.(string))
+		if kind == cache.RAW.String() {
+			go c.removeRawContentType(hash)
+		}
+	}
+
+	// The file is removed by unlock, so that no file IO happens while the
+	// lock is held.
+	c.evictedFiles = append(c.evictedFiles, c.getElementPath(key, value))
+}
+
+// loadExistingFilesInBackground adds the files in the cache directory to
+// the LRU index while the cache is in use. The items from each directory
+// are added as soon as it has been scanned, most recently used first and
+// behind any items which were added since the cache started. Items which
+// do not fit are kept on disk until the scan has finished. Then the loaded
+// items are reordered by access time, and the items which did not fit
+// are added if they are more recent than other loaded items, which are
+// evicted instead.
+func (c *diskCache) loadExistingFilesInBackground() {
+	// The scanned items which were not added to the index.
+	unindexed := make(map[*lruItem]struct{})
+
+	result, err := c.scanDir(func(sr scanResult) {
+		sort.Sort(sort.Reverse(sr))
+
+		c.mu.Lock()
+		defer c.unlock()
+
+		for i := range sr.item {
+			key := sr.metadata[i].lookupKey
+			sr.item[i].pinned = c.isPinned(key)
+			if !c.lru.AddBack(key, *sr.item[i]) {
+				unindexed[sr.item[i]] = struct{}{}
+				continue
+			}
+			if c.bloom != nil {
+				c.bloom.add(key)
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to scan cache dir, some existing files were not loaded: %s", err.Error())
+		return
+	}
+
+	log.Println("Sorting loaded cache files by atime.")
+	sort.Sort(result)
+
+	// Remove the scanned item at index i, to make space for more recently
+	// used items. This must be called when the lock is held.
+	evictScanned := func(i int) {
+		key := result.metadata[i].lookupKey
+		item := result.item[i]
+
+		existing, found := c.lru.Peek(key)
+		sameFile := found && existing.random == item.random
+		if _, ok := unindexed[item]; ok {
+			if !sameFile {
+				c.evictedFiles = append(c.evictedFiles, c.getElementPath(key, *item))
+			}
+			return
+		}
+
+		// Skip items which were already evicted or replaced.
+		if sameFile && !existing.pinned {
+			c.lru.Remove(key)
+		}
+	}
+
+	// Move the loaded items to the back of the LRU, newest first, so that
+	// they end up in access time order. Items which did not fit during the
+	// scan are added in the same way, evicting the oldest loaded items if
+	// necessary. Release the lock between batches so that requests are not
+	// blocked for too long.
+	const batchSize = 10000
+	oldest := 0 // The items before this index have been evicted.
+	for i := len(result.item) - 1; i >= oldest; {
+		c.mu.Lock()
+		for n := 0; n < batchSize && i >= oldest; n, i = n+1, i-1 {
+			key := result.metadata[i].lookupKey
+			item := result.item[i]
+
+			if _, ok := unindexed[item]; !ok {
+				c.lru.MoveToBack(key, *item)
+				continue
+			}
+
+			if _, found := c.lru.Peek(key); found {
+				// Replaced since it was scanned.
+				evictScanned(i)
+				continue
+			}
+
+			added := c.lru.AddBack(key, *item)
+			for !added && oldest < i {
+				evictScanned(oldest)
+				oldest++
+				added = c.lru.AddBack(key, *item)
+			}
+			if !added {
+				// Older than everything else which was loaded.
+				evictScanned(i)
+				continue
+			}
+			delete(unindexed, item)
+			if c.bloom != nil {
+				c.bloom.add(key)
+			}
+		}
+		c.unlock()
+	}
+
+	log.Printf("Finished loading %d disk cache files.", len(result.item))
+
+	if c.startupVerifySample > 0 {
+		c.verifyStartupSample(c.startupVerifySample)
+	}
+}
@@ -38,12 +38,22 @@ type SizedLRU struct {
 	// Number of bytes reserved for incoming blobs.
 	reservedSize int64
 
+	// Total size of the pinned items, rounded up like currentSize.
+	pinnedSize int64
+
 	// SizedLRU will evict items as needed to maintain the total size of the
 	// cache below maxSize.
 	maxSize int64
 
+	// If non-zero, Reserve fails rather than letting reservedSize
+	// exceed maxReservedSize.
+	maxReservedSize int64
+
 	onEvict EvictCallback
 
+	// The number of items removed in the last hour. May be nil.
+	recentEvictions *hourlyCounter
+
 	gaugeCacheSizeBytes     prometheus.Gauge
 	gaugeCacheLogicalBytes  prometheus.Gauge
 	counterEvictedBytes     prometheus.Counter
@@ -68,6 +78,8 @@ func NewSizedLRU(maxSize int64, onEvict EvictCallback, initialCapacity int) Size
 		cache:   make(map[interface{}]*list.Element, initialCapacity),
 		onEvict: onEvict,
 
+		recentEvictions: &hourlyCounter{},
+
 		gaugeCacheSizeBytes: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "bazel_remote_disk_cache_size_bytes",
 			Help: "The current number of bytes in the disk backend",
@@ -108,7 +120,8 @@ func (c *SizedLRU) RegisterMetrics() {
 // Add adds a (key, value) to the cache, evicting items as necessary.
 // Add returns false and does not add the item if the item size is
 // larger than the maximum size of the cache, or if the item cannot
-// be added to the cache because too much space is reserved.
+// be added to the cache because too much space is reserved or
+// pinned.
 //
 // Note that this function rounds file sizes up to the nearest
 // BlockSize (4096) bytes, as an estimate of actual disk usage since
@@ -121,39 +134,56 @@ func (c *SizedLRU) Add(key Key, value lruItem) (ok bool) {
 		return false
 	}
 
+	// Reserved space and pinned items cannot be evicted to make room.
+	unevictable := c.reservedSize + c.pinnedSize
+	if ee, ok := c.cache[key]; ok && ee.Value.(*entry).value.pinned {
+		unevictable -= roundUp4k(ee.Value.(*entry).value.sizeOnDisk)
+	}
+	if unevictable+roundedUpSizeOnDisk > c.maxSize {
+		return false
+	}
+
 	var sizeDelta, uncompressedSizeDelta int64
 	if ee, ok := c.cache[key]; ok {
 		sizeDelta = roundedUpSizeOnDisk - roundUp4k(ee.Value.(*entry).value.sizeOnDisk)
-		if c.reservedSize+sizeDelta > c.maxSize {
-			return false
-		}
 		uncompressedSizeDelta = roundUp4k(value.size) - roundUp4k(ee.Value.(*entry).value.size)
 		c.ll.MoveToFront(ee)
-		c.counterOverwrittenBytes.Add(float64(ee.Value.(*entry).value.sizeOnDisk))
 
+		// The same file may be added twice if it was indexed by a
+		// background scan before it was committed, in which case it
+		// must not be removed.
 		prevValue := ee.Value.(*entry).value
-		if c.onEvict != nil {
-			c.onEvict(key, prevValue)
+		if prevValue.pinned {
+			c.pinnedSize -= roundUp4k(prevValue.sizeOnDisk)
+		}
+		if prevValue != value {
+			c.counterOverwrittenBytes.Add(float64(prevValue.sizeOnDisk))
+			if c.onEvict != nil {
+				c.onEvict(key, prevValue)
+			}
 		}
 
 		ee.Value.(*entry).value = value
 	} else {
 		sizeDelta = roundedUpSizeOnDisk
-		if c.reservedSize+sizeDelta > c.maxSize {
-			return false
-		}
 		uncompressedSizeDelta = roundUp4k(value.size)
 		ele := c.ll.PushFront(&entry{key, value})
 		c.cache[key] = ele
 	}
 
+	if value.pinned {
+		c.pinnedSize += roundedUpSizeOnDisk
+	}
+
 	// Eviction. This is needed even if the key was already present, since the size of the
 	// value might have changed, pushing the total size over maxSize.
 	for c.currentSize+sizeDelta > c.maxSize {
-		ele := c.ll.Back()
-		if ele != nil {
-			c.removeElement(ele)
+		ele := c.evictionCandidate()
+		if ele == nil {
+			// Not reached, the space was checked above.
+			break
 		}
+		c.removeElement(ele)
 	}
 
 	c.currentSize += sizeDelta
@@ -166,6 +196,46 @@ func (c *SizedLRU) Add(key Key, value lruItem) (ok bool) {
 	return true
 }
 
+// AddBack adds a new item to the back of the eviction list, ie as the least
+// recently used item. Unlike Add, no other items are evicted to make room.
+// It returns false without modifying the cache if key is already present,
+// or if the item does not fit in the remaining space.
+func (c *SizedLRU) AddBack(key Key, value lruItem) (ok bool) {
+	if _, exists := c.cache[key]; exists {
+		return false
+	}
+
+	// currentSize includes the reserved space, so this never uses space
+	// which is reserved for incoming blobs.
+	roundedUpSizeOnDisk := roundUp4k(value.sizeOnDisk)
+	if c.currentSize+roundedUpSizeOnDisk > c.maxSize {
+		return false
+	}
+
+	ele := c.ll.PushBack(&entry{key, value})
+	c.cache[key] = ele
+
+	if value.pinned {
+		c.pinnedSize += roundedUpSizeOnDisk
+	}
+	c.currentSize += roundedUpSizeOnDisk
+	c.uncompressedSize += roundUp4k(value.size)
+
+	c.gaugeCacheSizeBytes.Set(float64(c.currentSize))
+	c.gaugeCacheLogicalBytes.Set(float64(c.uncompressedSize))
+	c.summaryCacheItemBytes.Observe(float64(roundedUpSizeOnDisk))
+
+	return true
+}
+
+// MoveToBack moves key to the back of the eviction list, if it is present
+// with the given value.
+func (c *SizedLRU) MoveToBack(key Key, value lruItem) {
+	if ele, ok := c.cache[key]; ok && ele.Value.(*entry).value == value {
+		c.ll.MoveToBack(ele)
+	}
+}
+
 // Get looks up a key in the cache
 func (c *SizedLRU) Get(key Key) (value lruItem, ok bool) {
 	if ele, hit := c.cache[key]; hit {
@@ -176,6 +246,16 @@ func (c *SizedLRU) Get(key Key) (value lruItem, ok bool) {
 	return
 }
 
+// Peek looks up a key in the cache, without updating its position in
+// the eviction list.
+func (c *SizedLRU) Peek(key Key) (value lruItem, ok bool) {
+	if ele, hit := c.cache[key]; hit {
+		return ele.Value.(*entry).value, true
+	}
+
+	return
+}
+
 // Remove removes a (key, value) from the cache
 func (c *SizedLRU) Remove(key Key) {
 	if ele, hit := c.cache[key]; hit {
@@ -185,6 +265,65 @@ func (c *SizedLRU) Remove(key Key) {
 	}
 }
 
+// EvictTo removes items from the back of the eviction list until the total
+// size of the cache is at most targetSize, or until there are no items left
+// to evict (reserved space and pinned items cannot be evicted). It returns the number of
+// items evicted and their total size on disk.
+func (c *SizedLRU) EvictTo(targetSize int64) (numItems int, numBytes int64) {
+	for c.currentSize > targetSize {
+		ele := c.evictionCandidate()
+		if ele == nil {
+			break
+		}
+
+		numBytes += ele.Value.(*entry).value.sizeOnDisk
+		numItems++
+		c.removeElement(ele)
+	}
+
+	c.gaugeCacheSizeBytes.Set(float64(c.currentSize))
+	c.gaugeCacheLogicalBytes.Set(float64(c.uncompressedSize))
+
+	return numItems, numBytes
+}
+
+// SetPinned marks the item with the given key as pinned or not. Pinned
+// items are never evicted to make space, but can still be removed
+// explicitly. It returns false if the key is not present.
+func (c *SizedLRU) SetPinned(key Key, pinned bool) bool {
+	ele, hit := c.cache[key]
+	if !hit {
+		return false
+	}
+
+	value := &ele.Value.(*entry).value
+	if value.pinned != pinned {
+		if pinned {
+			c.pinnedSize += roundUp4k(value.sizeOnDisk)
+		} else {
+			c.pinnedSize -= roundUp4k(value.sizeOnDisk)
+		}
+	}
+	value.pinned = pinned
+	return true
+}
+
+// evictionCandidate returns the least recently used element which is not
+// pinned, or nil if there is none. Pinned items which are found at the back
+// of the eviction list are moved to the front, so that they are not scanned
+// again by every eviction.
+func (c *SizedLRU) evictionCandidate() *list.Element {
+	for i := c.ll.Len(); i > 0; i-- {
+		ele := c.ll.Back()
+		if !ele.Value.(*entry).value.pinned {
+			return ele
+		}
+		c.ll.MoveToFront(ele)
+	}
+
+	return nil
+}
+
 // Len returns the number of items in the cache
 func (c *SizedLRU) Len() int {
 	return len(c.cache)
@@ -245,9 +384,11 @@ func (c *SizedLRU) Reserve(size int64) (bool, error) {
 
 	// Evict elements until we are able to reserve enough space.
 	for sumLargerThan(size, c.currentSize, c.maxSize) {
-		ele := c.ll.Back()
+		ele := c.evictionCandidate()
 		if ele != nil {
 			c.removeElement(ele)
+		} else if c.ll.Len() > 0 {
+			return false, fmt.Errorf("Unable to reserve space for blob (size: %d), the remaining items are pinned", size)
 		} else {
 			return false, errReservation // This should have been caught at the start.
 		}
@@ -258,6 +399,19 @@ func (c *SizedLRU) Reserve(size int64) (bool, error) {
 	return true, nil
 }
 
+// ReserveUpload is like Reserve, but fails if the total reserved size would
+// exceed maxReservedSize. This is used for client uploads, so that a burst of
+// large uploads cannot use all of the space which is available for
+// reservations, and starve proxy downloads.
+func (c *SizedLRU) ReserveUpload(size int64) (bool, error) {
+	if c.maxReservedSize > 0 && size > 0 && sumLargerThan(size, c.reservedSize, c.maxReservedSize) {
+		return false, fmt.Errorf("Unable to reserve space for blob (size: %d), %d bytes are already reserved for in-flight operations (limit: %d)",
+			size, c.reservedSize, c.maxReservedSize)
+	}
+
+	return c.Reserve(size)
+}
+
 func (c *SizedLRU) Unreserve(size int64) error {
 	if size == 0 {
 		return nil
@@ -286,7 +440,13 @@ func (c *SizedLRU) removeElement(e *list.Element) {
 	delete(c.cache, kv.key)
 	c.currentSize -= roundUp4k(kv.value.sizeOnDisk)
 	c.uncompressedSize -= roundUp4k(kv.value.size)
+	if kv.value.pinned {
+		c.pinnedSize -= roundUp4k(kv.value.sizeOnDisk)
+	}
 	c.counterEvictedBytes.Add(float64(kv.value.sizeOnDisk))
+	if c.recentEvictions != nil {
+		c.recentEvictions.inc()
+	}
 
 	if c.onEvict != nil {
 		c.onEvict(kv.key, kv.value)
@@ -4,6 +4,7 @@ import (
 	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func checkSizeAndNumItems(t *testing.T, lru SizedLRU, expSize int64, expNum int) {
@@ -99,6 +100,50 @@ func TestEviction(t *testing.T) {
 	}
 }
 
+func TestPeekDoesNotPromote(t *testing.T) {
+	var evictions []int
+	onEvict := func(key Key, value lruItem) {
+		evictions = append(evictions, key.(int))
+	}
+
+	lru := NewSizedLRU(2*BlockSize, onEvict, 0)
+
+	for i := 0; i < 2; i++ {
+		ok := lru.Add(i, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+		if !ok {
+			t.Fatalf("Add: failed adding %d", i)
+		}
+	}
+
+	// 0 is the least recently used item. Peek should not change that.
+	_, ok := lru.Peek(0)
+	if !ok {
+		t.Fatal("Peek: failed getting item")
+	}
+
+	ok = lru.Add(2, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 2")
+	}
+	if !reflect.DeepEqual(evictions, []int{0}) {
+		t.Fatalf("Expected evictions [0], found %v", evictions)
+	}
+
+	// Get should promote 1, so 2 is evicted next.
+	_, ok = lru.Get(1)
+	if !ok {
+		t.Fatal("Get: failed getting item")
+	}
+
+	ok = lru.Add(3, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 3")
+	}
+	if !reflect.DeepEqual(evictions, []int{0, 2}) {
+		t.Fatalf("Expected evictions [0 2], found %v", evictions)
+	}
+}
+
 func TestRejectBigItem(t *testing.T) {
 	// Bounded caches should reject big items
 	lru := NewSizedLRU(10, nil, 0)
@@ -192,6 +237,39 @@ func TestReserveOverflow(t *testing.T) {
 	}
 }
 
+func TestReserveUploadLimit(t *testing.T) {
+	lru := NewSizedLRU(100, nil, 0)
+	lru.maxReservedSize = 50
+
+	ok, err := lru.ReserveUpload(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("Should be able to reserve space below the limit")
+	}
+
+	ok, err = lru.ReserveUpload(20)
+	if ok || err == nil {
+		t.Fatal("Should not be able to reserve space beyond the limit")
+	}
+	if lru.ReservedSize() != 40 {
+		t.Fatalf("Expected reserved size 40, actual size %d", lru.ReservedSize())
+	}
+
+	// Other reservations can still use the remaining space.
+	ok, err = lru.Reserve(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("Should be able to reserve space for non-upload reservations")
+	}
+	if lru.ReservedSize() != 60 {
+		t.Fatalf("Expected reserved size 60, actual size %d", lru.ReservedSize())
+	}
+}
+
 func TestUnreserve(t *testing.T) {
 	var ok bool
 	var err error
@@ -261,3 +339,198 @@ func TestAddWithSpaceReserved(t *testing.T) {
 		t.Fatal("Expected to be able to add item with size 2")
 	}
 }
+
+func TestEvictTo(t *testing.T) {
+	var evictions []int
+	onEvict := func(key Key, value lruItem) {
+		evictions = append(evictions, key.(int))
+	}
+
+	lru := NewSizedLRU(4*BlockSize, onEvict, 0)
+
+	for i := 0; i < 4; i++ {
+		ok := lru.Add(i, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+		if !ok {
+			t.Fatalf("Add: failed adding %d", i)
+		}
+	}
+
+	numItems, numBytes := lru.EvictTo(2*BlockSize + 1)
+	if numItems != 2 || numBytes != 2*BlockSize {
+		t.Fatalf("Expected 2 items and %d bytes to be evicted, found %d and %d",
+			2*BlockSize, numItems, numBytes)
+	}
+	if !reflect.DeepEqual(evictions, []int{0, 1}) {
+		t.Fatalf("Expected evictions [0 1], found %v", evictions)
+	}
+	checkSizeAndNumItems(t, lru, 2*BlockSize, 2)
+
+	// Nothing to do if the cache is already small enough.
+	numItems, numBytes = lru.EvictTo(2 * BlockSize)
+	if numItems != 0 || numBytes != 0 {
+		t.Fatalf("Expected nothing to be evicted, found %d items and %d bytes",
+			numItems, numBytes)
+	}
+
+	// Reserved space cannot be evicted.
+	ok, err := lru.Reserve(BlockSize)
+	if !ok || err != nil {
+		t.Fatalf("Reserve: failed, %v", err)
+	}
+	numItems, _ = lru.EvictTo(0)
+	if numItems != 2 {
+		t.Fatalf("Expected 2 items to be evicted, found %d", numItems)
+	}
+	checkSizeAndNumItems(t, lru, BlockSize, 0)
+}
+
+func TestPinnedItemsAreNotEvicted(t *testing.T) {
+	var evictions []int
+	onEvict := func(key Key, value lruItem) {
+		evictions = append(evictions, key.(int))
+	}
+
+	lru := NewSizedLRU(3*BlockSize, onEvict, 0)
+
+	for i := 0; i < 3; i++ {
+		ok := lru.Add(i, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+		if !ok {
+			t.Fatalf("Add: failed adding %d", i)
+		}
+	}
+
+	if !lru.SetPinned(0, true) {
+		t.Fatal("SetPinned: expected item 0 to be found")
+	}
+	if lru.SetPinned(42, true) {
+		t.Fatal("SetPinned: unexpected item 42 found")
+	}
+
+	// The least recently used item is pinned, so the next one is evicted.
+	ok := lru.Add(3, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 3")
+	}
+	if !reflect.DeepEqual(evictions, []int{1}) {
+		t.Fatalf("Expected evictions [1], found %v", evictions)
+	}
+
+	numItems, _ := lru.EvictTo(0)
+	if numItems != 2 {
+		t.Fatalf("Expected 2 items to be evicted, found %d", numItems)
+	}
+	checkSizeAndNumItems(t, lru, BlockSize, 1)
+
+	// Only pinned items are left, so no more space can be reserved.
+	ok, err := lru.Reserve(3 * BlockSize)
+	if ok || err == nil {
+		t.Fatal("Reserve: expected failure when only pinned items are left")
+	}
+
+	lru.SetPinned(0, false)
+	numItems, _ = lru.EvictTo(0)
+	if numItems != 1 {
+		t.Fatalf("Expected the unpinned item to be evicted, found %d items", numItems)
+	}
+	checkSizeAndNumItems(t, lru, 0, 0)
+}
+
+func TestAddFailsWhenOnlyPinnedItemsAreLeft(t *testing.T) {
+	lru := NewSizedLRU(3*BlockSize, nil, 0)
+
+	for i := 0; i < 2; i++ {
+		ok := lru.Add(i, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+		if !ok {
+			t.Fatalf("Add: failed adding %d", i)
+		}
+		lru.SetPinned(i, true)
+	}
+
+	// There is room for one more unpinned block.
+	ok := lru.Add(2, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 2")
+	}
+
+	// Item 2 can be evicted, but that does not make enough space.
+	ok = lru.Add(3, lruItem{size: 2 * BlockSize, sizeOnDisk: 2 * BlockSize})
+	if ok {
+		t.Fatal("Add: expected failure when the pinned items do not leave enough space")
+	}
+	checkSizeAndNumItems(t, lru, 3*BlockSize, 3)
+
+	// A pinned item can grow only into the unpinned space.
+	ok = lru.Add(0, lruItem{size: 2 * BlockSize, sizeOnDisk: 2 * BlockSize, pinned: true})
+	if !ok {
+		t.Fatal("Add: failed replacing pinned item 0")
+	}
+	checkSizeAndNumItems(t, lru, 3*BlockSize, 2)
+	ok = lru.Add(1, lruItem{size: 2 * BlockSize, sizeOnDisk: 2 * BlockSize, pinned: true})
+	if ok {
+		t.Fatal("Add: expected failure when growing pinned item 1")
+	}
+	checkSizeAndNumItems(t, lru, 3*BlockSize, 2)
+
+	// Once unpinned, the items can be evicted again.
+	lru.SetPinned(0, false)
+	lru.SetPinned(1, false)
+	ok = lru.Add(3, lruItem{size: 2 * BlockSize, sizeOnDisk: 2 * BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 3 after unpinning")
+	}
+	checkSizeAndNumItems(t, lru, 3*BlockSize, 2)
+}
+
+func TestAddBack(t *testing.T) {
+	lru := NewSizedLRU(3*BlockSize, nil, 0)
+
+	ok := lru.Add(0, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("Add: failed adding 0")
+	}
+
+	ok = lru.AddBack(1, lruItem{size: BlockSize, sizeOnDisk: BlockSize})
+	if !ok {
+		t.Fatal("AddBack: failed adding 1")
+	}
+	if lru.ll.Back().Value.(*entry).key != 1 {
+		t.Fatal("AddBack: expected 1 to be the least recently used item")
+	}
+
+	if lru.AddBack(1, lruItem{size: BlockSize, sizeOnDisk: BlockSize}) {
+		t.Fatal("AddBack: expected failure for an existing key")
+	}
+
+	// The remaining space is reserved, and nothing is evicted.
+	ok, err := lru.Reserve(BlockSize)
+	if !ok || err != nil {
+		t.Fatalf("Reserve: failed, %v", err)
+	}
+	if lru.AddBack(2, lruItem{size: BlockSize, sizeOnDisk: BlockSize}) {
+		t.Fatal("AddBack: expected failure when the remaining space is reserved")
+	}
+	checkSizeAndNumItems(t, lru, 3*BlockSize, 2)
+}
+
+func TestHourlyCounter(t *testing.T) {
+	var h hourlyCounter
+
+	start := time.Unix(1700000000, 0)
+	h.add(start, 2)
+	h.add(start.Add(30*time.Minute), 3)
+
+	if total := h.totalAt(start.Add(59 * time.Minute)); total != 5 {
+		t.Errorf("Expected 5 events in the last hour, got %d", total)
+	}
+
+	// The first bucket has expired.
+	if total := h.totalAt(start.Add(61 * time.Minute)); total != 3 {
+		t.Errorf("Expected 3 events in the last hour, got %d", total)
+	}
+
+	// Reusing the first bucket's slot resets its count.
+	h.add(start.Add(60*time.Minute), 1)
+	if total := h.totalAt(start.Add(60 * time.Minute)); total != 4 {
+		t.Errorf("Expected 4 events in the last hour, got %d", total)
+	}
+}
@@ -88,8 +88,11 @@ func (m *metricsDecorator) GetZstd(ctx context.Context, hash string, size int64,
 	return rc, size, nil
 }
 
-func (m *metricsDecorator) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
-	ok, size := m.diskCache.Contains(ctx, kind, hash, size)
+func (m *metricsDecorator) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64, error) {
+	ok, size, err := m.diskCache.Contains(ctx, kind, hash, size)
+	if err != nil {
+		return ok, size, err
+	}
 
 	lbls := prometheus.Labels{"method": containsMethod, "kind": kind.String()}
 	if ok {
@@ -99,7 +102,7 @@ func (m *metricsDecorator) Contains(ctx context.Context, kind cache.EntryKind, h
 	}
 	m.counter.With(lbls).Inc()
 
-	return ok, size
+	return ok, size, nil
 }
 
 func (m *metricsDecorator) FindMissingCasBlobs(ctx context.Context, blobs []*pb.Digest) ([]*pb.Digest, error) {
@@ -2,7 +2,7 @@ package disk
 
 import (
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
 	"github.com/buchgr/bazel-remote/v2/cache/disk/casblob"
@@ -16,6 +16,10 @@ type Option func(*CacheConfig) error
 type CacheConfig struct {
 	diskCache *diskCache        // Assumed to be non-nil.
 	metrics   *metricsDecorator // May be nil.
+
+	// Used to set diskCache.zstd after all the options are applied.
+	zstdImpl    string
+	zstdOptions zstdimpl.EncoderOptions
 }
 
 func WithStorageMode(mode string) Option {
@@ -32,11 +36,73 @@ func WithStorageMode(mode string) Option {
 	}
 }
 
+// WithDirLayout sets how cache files are arranged in the cache dir. The
+// default "two-char-prefix" layout stores files in subdirectories named
+// after the first two characters of their hash, and the "flat" layout
+// stores them directly in the ac.v2/, cas.v2/ and raw.v2/ directories.
+func WithDirLayout(layout string) Option {
+	return func(c *CacheConfig) error {
+		switch layout {
+		case "two-char-prefix":
+			c.diskCache.flatLayout = false
+		case "flat":
+			c.diskCache.flatLayout = true
+		default:
+			return fmt.Errorf("Unsupported dir layout: %s", layout)
+		}
+		return nil
+	}
+}
+
 func WithZstdImplementation(impl string) Option {
 	return func(c *CacheConfig) error {
-		var err error
-		c.diskCache.zstd, err = zstdimpl.Get(impl)
-		return err
+		_, err := zstdimpl.Get(impl)
+		if err != nil {
+			return err
+		}
+
+		c.zstdImpl = impl
+		return nil
+	}
+}
+
+// WithZstdLongMode makes the zstd encoder use a large window, which
+// improves the compression ratio of large blobs with repetitive content
+// at the cost of higher CPU and memory usage.
+func WithZstdLongMode() Option {
+	return func(c *CacheConfig) error {
+		c.zstdOptions.LongMode = true
+		return nil
+	}
+}
+
+// WithCompressionBypass makes the cache compress a sample of up to
+// sampleSize bytes from the start of each new CAS blob, and store the blob
+// uncompressed if the sample does not compress well, eg because the blob
+// is already compressed. This has no effect unless the storage mode is
+// zstd.
+func WithCompressionBypass(sampleSize int) Option {
+	return func(c *CacheConfig) error {
+		if sampleSize <= 0 {
+			return fmt.Errorf("Invalid compression bypass sample size: %d", sampleSize)
+		}
+
+		c.diskCache.compressionBypassSampleSize = sampleSize
+		return nil
+	}
+}
+
+// WithZstdMaxSize makes the cache store new CAS blobs larger than size
+// bytes uncompressed, eg because large blobs are often already compressed
+// artifacts. This has no effect unless the storage mode is zstd.
+func WithZstdMaxSize(size int64) Option {
+	return func(c *CacheConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid zstd max size: %d", size)
+		}
+
+		c.diskCache.zstdMaxSize = size
+		return nil
 	}
 }
 
@@ -51,19 +117,72 @@ func WithMaxBlobSize(size int64) Option {
 	}
 }
 
+// WithProxyBackend sets the proxy backend for all kinds of items.
 func WithProxyBackend(proxy cache.Proxy) Option {
 	return func(c *CacheConfig) error {
-		if c.diskCache.proxy != nil && proxy != nil {
+		return c.setProxyBackend(proxy, cache.AC, cache.CAS, cache.RAW)
+	}
+}
+
+// WithACProxyBackend sets the proxy backend for AC (and RAW) items.
+func WithACProxyBackend(proxy cache.Proxy) Option {
+	return func(c *CacheConfig) error {
+		return c.setProxyBackend(proxy, cache.AC, cache.RAW)
+	}
+}
+
+// WithCASProxyBackend sets the proxy backend for CAS items.
+func WithCASProxyBackend(proxy cache.Proxy) Option {
+	return func(c *CacheConfig) error {
+		return c.setProxyBackend(proxy, cache.CAS)
+	}
+}
+
+// WithUncompressedCASProxy specifies that the CAS proxy backend stores
+// uncompressed blobs. If the storage mode is zstd, blobs are decompressed
+// before being uploaded to the proxy backend, and compressed after being
+// downloaded from it.
+func WithUncompressedCASProxy() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.uncompressedCASProxy = true
+		return nil
+	}
+}
+
+// WithNoProxyForAC specifies that AC (and RAW) items are only read from
+// the local disk, and never from the proxy backend. They are still
+// uploaded to the proxy backend. This avoids stale ActionResults from
+// eventually consistent proxy backends.
+func WithNoProxyForAC() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.noProxyForAC = true
+		return nil
+	}
+}
+
+func (c *CacheConfig) setProxyBackend(proxy cache.Proxy, kinds ...cache.EntryKind) error {
+	if proxy == nil {
+		return nil
+	}
+
+	for _, kind := range kinds {
+		if c.diskCache.proxies[kind] != nil {
 			return fmt.Errorf("Proxy backends may be set only once")
 		}
+	}
 
-		if proxy != nil {
-			c.diskCache.proxy = proxy
+	if c.diskCache.proxies == nil {
+		c.diskCache.proxies = make(map[cache.EntryKind]cache.Proxy)
+	}
+
+	for _, kind := range kinds {
+		c.diskCache.proxies[kind] = proxy
+		if kind == cache.CAS {
 			c.diskCache.spawnContainsQueueWorkers()
 		}
-
-		return nil
 	}
+
+	return nil
 }
 
 func WithProxyMaxBlobSize(maxProxyBlobSize int64) Option {
@@ -77,7 +196,403 @@ func WithProxyMaxBlobSize(maxProxyBlobSize int64) Option {
 	}
 }
 
-func WithAccessLogger(logger *log.Logger) Option {
+// WithMaxReservedFraction limits the space which can be reserved for
+// in-flight uploads to the given fraction of the cache size. Uploads which
+// would exceed this limit fail with an InsufficientStorage error, leaving
+// space for proxy downloads.
+func WithMaxReservedFraction(fraction float64) Option {
+	return func(c *CacheConfig) error {
+		if fraction <= 0 || fraction > 1 {
+			return fmt.Errorf("Invalid max reserved fraction: %v", fraction)
+		}
+
+		c.diskCache.maxReservedFraction = fraction
+		return nil
+	}
+}
+
+func WithMaxACValidationEntries(n int) Option {
+	return func(c *CacheConfig) error {
+		if n < 0 {
+			return fmt.Errorf("Invalid MaxACValidationEntries: %d", n)
+		}
+
+		c.diskCache.maxACValidationEntries = n
+		return nil
+	}
+}
+
+// WithACValidationConcurrency sets the maximum number of OutputDirectory
+// Tree blobs which are read at the same time when validating an
+// ActionResult's dependencies.
+func WithACValidationConcurrency(n int) Option {
+	return func(c *CacheConfig) error {
+		if n < 0 {
+			return fmt.Errorf("Invalid ACValidationConcurrency: %d", n)
+		}
+
+		c.diskCache.acValidationConcurrency = n
+		return nil
+	}
+}
+
+// WithRawDisabled disables the RAW keyspace, which is only used for HTTP
+// requests when ActionResult validation is disabled.
+func WithRawDisabled() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.rawDisabled = true
+		return nil
+	}
+}
+
+// WithACWriteOnce prevents existing AC entries from being replaced.
+// Attempts to store a different ActionResult under an existing key
+// fail, and attempts to store an identical ActionResult are no-ops.
+func WithACWriteOnce() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.acWriteOnce = true
+		return nil
+	}
+}
+
+// WithFsyncPolicy controls when new cache files are flushed to stable
+// storage. "always" syncs each file before it is added to the cache,
+// "never" leaves it to the OS, and "batch" coalesces the syncs of
+// concurrent writes.
+func WithFsyncPolicy(policy string) Option {
+	return func(c *CacheConfig) error {
+		sync, err := newSyncFunc(policy)
+		if err != nil {
+			return err
+		}
+		c.diskCache.syncFile = sync
+		return nil
+	}
+}
+
+// WithMaxTreeDepth limits the depth of OutputDirectory trees when
+// validating ActionResults. ActionResults with deeper trees are treated as
+// an error. The default of 0 means no limit.
+func WithMaxTreeDepth(depth int) Option {
+	return func(c *CacheConfig) error {
+		if depth < 0 {
+			return fmt.Errorf("Invalid MaxTreeDepth: %d", depth)
+		}
+
+		c.diskCache.maxTreeDepth = depth
+		return nil
+	}
+}
+
+// WithMaxConcurrentProxyDownloads limits the number of blobs which can be
+// downloaded from the proxy backend at the same time, independently of
+// local disk operations. The default of 0 means no limit.
+func WithMaxConcurrentProxyDownloads(n int) Option {
+	return func(c *CacheConfig) error {
+		if n < 0 {
+			return fmt.Errorf("Invalid max concurrent proxy downloads: %d", n)
+		}
+
+		if n > 0 {
+			c.diskCache.proxyDownloadSem = newPrioritySemaphore(int64(n))
+		}
+		return nil
+	}
+}
+
+// WithVerifyOnRead makes the given fraction (between 0 and 1) of complete,
+// uncompressed CAS reads check the data against its hash as it is streamed.
+// If the data is corrupt the read fails and the blob is removed from the
+// cache.
+func WithVerifyOnRead(rate float64) Option {
+	return func(c *CacheConfig) error {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("Invalid verify on read rate: %f", rate)
+		}
+
+		c.diskCache.verifyOnReadRate = rate
+		return nil
+	}
+}
+
+// WithStartupVerifySample makes the cache check the hashes of n randomly
+// chosen CAS blobs once the existing files have been loaded. Blobs which
+// fail are logged, and removed from the cache if evict is true.
+func WithStartupVerifySample(n int, evict bool) Option {
+	return func(c *CacheConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid startup verify sample size: %d", n)
+		}
+
+		c.diskCache.startupVerifySample = n
+		c.diskCache.startupVerifyEvict = evict
+		return nil
+	}
+}
+
+// WithBloomFilter enables an in-memory bloom filter of the keys in the
+// cache, which allows FindMissingBlobs to skip the LRU index lookup for
+// blobs which are definitely not present.
+func WithBloomFilter() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.bloomFilterEnabled = true
+		return nil
+	}
+}
+
+// WithReadOnly makes the cache serve the existing items without writing
+// to the cache directory, eg when it is on a read-only mount. Put fails,
+// and items are not read through from the proxy backend.
+func WithReadOnly() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.readOnly.Store(true)
+		return nil
+	}
+}
+
+// WithSynthesizedEmptyTree makes the canonical empty Tree blob, ie a Tree
+// with an empty root Directory, always available from the CAS even if it
+// was never uploaded, like the empty blob. This avoids spurious
+// ActionResult validation failures and FindMissingBlobs misses for
+// clients which reference the empty Tree without uploading it.
+func WithSynthesizedEmptyTree() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.synthesizeEmptyTree = true
+		return nil
+	}
+}
+
+// WithTombstoneTTL makes items which are removed by EvictTag, or because
+// they were found to be corrupt, unavailable from the proxy backend for
+// the given duration. This allows them to also be removed from the proxy
+// backend before they can be read through into the local cache again.
+func WithTombstoneTTL(ttl time.Duration) Option {
+	return func(c *CacheConfig) error {
+		if ttl <= 0 {
+			return fmt.Errorf("Invalid tombstone TTL: %s", ttl)
+		}
+
+		c.diskCache.tombstones = newTombstoneSet(ttl)
+		return nil
+	}
+}
+
+// WithEvictionTrash makes evicted files move to dir instead of being
+// removed immediately, so that they can be recovered manually after an
+// accidental eviction. Files are removed from dir once they have been
+// there for longer than ttl. Files in dir do not count towards the cache
+// size, and dir must be on the same filesystem as the cache dir.
+func WithEvictionTrash(dir string, ttl time.Duration) Option {
+	return func(c *CacheConfig) error {
+		if dir == "" {
+			return fmt.Errorf("Invalid empty eviction trash dir")
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("Invalid eviction trash TTL: %s", ttl)
+		}
+
+		c.diskCache.trashDir = dir
+		c.diskCache.trashTTL = ttl
+		return nil
+	}
+}
+
+// WithTempDir makes new cache files be written in dir, and moved to their
+// final path in the cache dir once they are complete. dir must be on the
+// same filesystem as the cache dir.
+func WithTempDir(dir string) Option {
+	return func(c *CacheConfig) error {
+		if dir == "" {
+			return fmt.Errorf("Invalid empty temp dir")
+		}
+
+		c.diskCache.tempDir = dir
+		return nil
+	}
+}
+
+// WithDiskWriteRetries makes writes to new cache files which fail with
+// one of the given errno names (eg "EAGAIN") be retried up to retries
+// times, with a short backoff.
+func WithDiskWriteRetries(retries int, errnoNames []string) Option {
+	return func(c *CacheConfig) error {
+		if retries < 0 {
+			return fmt.Errorf("Invalid number of disk write retries: %d", retries)
+		}
+
+		errnos, err := parseRetryableErrnos(errnoNames)
+		if err != nil {
+			return err
+		}
+
+		c.diskCache.diskWriteRetries = retries
+		c.diskCache.diskWriteRetryErrnos = errnos
+		return nil
+	}
+}
+
+// WithEvictionRemovalConcurrency limits the number of files which are
+// removed concurrently for each batch of evictions, eg those triggered by
+// a single upload.
+func WithEvictionRemovalConcurrency(n int) Option {
+	return func(c *CacheConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid eviction removal concurrency: %d", n)
+		}
+
+		c.diskCache.evictionRemovalConcurrency = n
+		return nil
+	}
+}
+
+// WithEventSink makes the cache notify sink when items are added to or
+// evicted from the cache.
+func WithEventSink(sink EventSink) Option {
+	return func(c *CacheConfig) error {
+		if sink == nil {
+			return fmt.Errorf("Invalid nil event sink")
+		}
+
+		c.diskCache.events = sink
+		return nil
+	}
+}
+
+// WithEncryptionKeyFile makes the cache encrypt CAS blobs on disk with
+// AES-GCM, using the hex-encoded 256 bit key in keyFile. Blobs written
+// without encryption can still be read. This requires the zstd storage
+// mode, and AC and RAW entries are not encrypted.
+func WithEncryptionKeyFile(keyFile string) Option {
+	return func(c *CacheConfig) error {
+		aead, err := loadEncryptionKey(keyFile)
+		if err != nil {
+			return err
+		}
+
+		c.diskCache.aead = aead
+		return nil
+	}
+}
+
+// WithPrefetchACOutputs makes successful GetValidatedActionResult calls
+// download the CAS blobs referenced by the ActionResult from the proxy
+// backend in the background, using numWorkers goroutines, so that
+// subsequent reads of those blobs are local cache hits. This has no
+// effect without a CAS proxy backend.
+func WithPrefetchACOutputs(numWorkers int) Option {
+	return func(c *CacheConfig) error {
+		if numWorkers <= 0 {
+			return fmt.Errorf("Invalid number of prefetch workers: %d", numWorkers)
+		}
+
+		c.diskCache.spawnPrefetchWorkers(numWorkers)
+		return nil
+	}
+}
+
+// WithServeDuringLoad makes New return without waiting for the existing
+// files in the cache directory to be loaded. They are added to the LRU
+// index in the background, most recently used first, and can be served
+// as soon as they have been indexed. Until then, requests for them are
+// treated as cache misses.
+func WithServeDuringLoad() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.serveDuringLoad = true
+		return nil
+	}
+}
+
+// WithKeepIncompleteFiles makes New leave files which were not completely
+// written, eg due to a crash during an upload, in the cache directory
+// instead of removing them. They are not added to the LRU index either way.
+func WithKeepIncompleteFiles() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.keepIncompleteFiles = true
+		return nil
+	}
+}
+
+// WithFailOnLRUInconsistency makes the server exit if an internal LRU
+// index invariant is violated, instead of dropping the affected entry and
+// continuing. This is intended for detecting bugs quickly in testing.
+func WithFailOnLRUInconsistency() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.failOnLRUInconsistency = true
+		return nil
+	}
+}
+
+// WithRawContentTypes makes Put store the content type given by
+// cache.WithContentType for RAW entries, which can then be looked up with
+// RawContentType. Content types are stored in small files alongside the
+// cache entries, and removed when the entries are evicted.
+func WithRawContentTypes() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.rawContentTypes = true
+		return nil
+	}
+}
+
+// WithMigrationBatchSize sets the number of directory entries which are
+// read at a time when migrating a cache directory from an old layout, to
+// bound memory usage when migrating huge directories.
+func WithMigrationBatchSize(n int) Option {
+	return func(c *CacheConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid migration batch size: %d", n)
+		}
+		c.diskCache.migrationBatchSize = n
+		return nil
+	}
+}
+
+// WithStrictProxyErrors makes Contains and FindMissingCasBlobs fail when
+// the proxy backend cannot be checked, eg due to network or authentication
+// failures, instead of reporting the blobs as missing. Items which the
+// proxy backend reports as not found are still cache misses.
+func WithStrictProxyErrors() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.strictProxyErrors = true
+		return nil
+	}
+}
+
+// WithProtectACDependencies makes Put move the CAS blobs referenced by new
+// ActionResults to the front of the LRU, so that they are less likely to
+// be evicted before the AC entries that refer to them.
+func WithProtectACDependencies() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.protectACDeps = true
+		return nil
+	}
+}
+
+// WithTags enables tagging AC and RAW entries with the tag of the context they
+// were uploaded with (see cache.WithTag), so that they can be evicted as a
+// group by EvictTag.
+func WithTags() Option {
+	return func(c *CacheConfig) error {
+		c.diskCache.tags = newTagIndex()
+		return nil
+	}
+}
+
+// WithZstdLevel sets the zstd compression level for CAS blobs, which must
+// be one of "fastest", "default", "better" or "best". Higher levels cost
+// more CPU on every Put, but blobs can be read regardless of the level
+// they were compressed with.
+func WithZstdLevel(level string) Option {
+	return func(c *CacheConfig) error {
+		if !zstdimpl.ValidLevel(level) {
+			return fmt.Errorf("Invalid zstd level: %s", level)
+		}
+
+		c.zstdOptions.Level = level
+		return nil
+	}
+}
+
+func WithAccessLogger(logger cache.Logger) Option {
 	return func(c *CacheConfig) error {
 		c.diskCache.accessLogger = logger
 		return nil
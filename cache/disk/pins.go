@@ -0,0 +1,139 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+// The directory, relative to the cache dir, which records the pinned
+// items. Each pinned item is represented by an empty file named
+// "<kind>.<hash>", so that pins survive restarts.
+const pinnedItemsDir = "pinned"
+
+func (c *diskCache) pinPath(key string) string {
+	kind, hash := splitLookupKey(key)
+	return filepath.Join(c.dir, pinnedItemsDir, kind+"."+hash)
+}
+
+// loadPins reads the lookup keys of the pinned items from the cache dir.
+// This must be called before the existing files are loaded.
+func (c *diskCache) loadPins() error {
+	c.pins = make(map[string]struct{})
+
+	des, err := os.ReadDir(filepath.Join(c.dir, pinnedItemsDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, de := range des {
+		kind, hash, ok := strings.Cut(de.Name(), ".")
+		if !ok {
+			continue
+		}
+		c.pins[kind+"/"+hash] = struct{}{}
+	}
+
+	return nil
+}
+
+// This must be called when the lock is held.
+func (c *diskCache) isPinned(key string) bool {
+	_, ok := c.pins[key]
+	return ok
+}
+
+// Pin marks the item with the given kind and hash as pinned, so that it
+// is never evicted to make space for other items. Pinned items can still
+// be removed explicitly, and are pinned again if they are re-added. It
+// returns false if the item is not in the cache.
+func (c *diskCache) Pin(kind cache.EntryKind, hash string) (bool, error) {
+	key := cache.LookupKey(kind, hash)
+
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+
+	c.mu.Lock()
+	_, found := c.lru.Peek(key)
+	pinned := c.isPinned(key)
+	c.unlock()
+
+	if !found {
+		return false, nil
+	}
+
+	if !pinned {
+		err := os.MkdirAll(filepath.Join(c.dir, pinnedItemsDir), os.ModePerm)
+		if err != nil {
+			return false, err
+		}
+
+		f, err := os.Create(c.pinPath(key))
+		if err != nil {
+			return false, err
+		}
+		err = f.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.pins[key] = struct{}{}
+
+	// The item might have been evicted while the pin file was created,
+	// in which case it is pinned again if it is re-added.
+	c.lru.SetPinned(key, true)
+	return true, nil
+}
+
+// Unpin removes the pin of the item with the given kind and hash, so that
+// it can be evicted again. It returns false if the item was not pinned.
+func (c *diskCache) Unpin(kind cache.EntryKind, hash string) (bool, error) {
+	key := cache.LookupKey(kind, hash)
+
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+
+	c.mu.Lock()
+	pinned := c.isPinned(key)
+	c.unlock()
+
+	if !pinned {
+		return false, nil
+	}
+
+	err := os.Remove(c.pinPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	delete(c.pins, key)
+	c.lru.SetPinned(key, false)
+	return true, nil
+}
+
+// Pins returns the sorted lookup keys of the pinned items, including any
+// which are not currently in the cache.
+func (c *diskCache) Pins() []string {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.pins))
+	for key := range c.pins {
+		keys = append(keys, key)
+	}
+	c.unlock()
+
+	sort.Strings(keys)
+	return keys
+}
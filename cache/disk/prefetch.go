@@ -0,0 +1,66 @@
+package disk
+
+import (
+	"context"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+)
+
+// The maximum number of CAS blobs waiting to be prefetched. Blobs are
+// dropped from the prefetch queue rather than blocking GetActionResult.
+const prefetchQueueSize = 10000
+
+// queuePrefetch adds the CAS blobs referenced by a validated ActionResult
+// to the prefetch queue, so that they are downloaded from the proxy
+// backend in the background. Blobs are dropped if the queue is full.
+func (c *diskCache) queuePrefetch(blobs []*pb.Digest) {
+	if c.proxies[cache.CAS] == nil {
+		return
+	}
+
+	for _, d := range blobs {
+		select {
+		case c.prefetchQueue <- d:
+		default:
+			c.accessLogger.Printf("PREFETCH %s DROPPED, queue full", d.Hash)
+			return
+		}
+	}
+}
+
+func (c *diskCache) prefetchWorker() {
+	for d := range c.prefetchQueue {
+		// Skip blobs which are already in the local cache, without
+		// affecting their LRU position.
+		c.mu.Lock()
+		item, exists := c.lruGet(cache.LookupKey(cache.CAS, d.Hash), true)
+		c.unlock()
+		if exists && !isSizeMismatch(d.SizeBytes, item.size) {
+			continue
+		}
+
+		rc, _, err := c.Get(context.Background(), cache.CAS, d.Hash, d.SizeBytes, 0)
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			c.accessLogger.Printf("PREFETCH %s %s", d.Hash, err)
+			continue
+		}
+		if rc == nil {
+			cache.LogSuccess(c.accessLogger, "PREFETCH %s NOT FOUND", d.Hash)
+			continue
+		}
+
+		cache.LogSuccess(c.accessLogger, "PREFETCH %s OK", d.Hash)
+	}
+}
+
+func (c *diskCache) spawnPrefetchWorkers(numWorkers int) {
+	c.prefetchQueue = make(chan *pb.Digest, prefetchQueueSize)
+	for i := 0; i < numWorkers; i++ {
+		go c.prefetchWorker()
+	}
+}
@@ -0,0 +1,81 @@
+package disk
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// prioritySemaphore limits the number of concurrent operations, like
+// semaphore.Weighted with a weight of 1 per operation, but waiters with
+// high priority acquire before waiters with low priority. Waiters with
+// the same priority acquire in FIFO order.
+type prioritySemaphore struct {
+	mu        sync.Mutex
+	available int64
+
+	// Queues of waiters, each represented by a channel which is closed
+	// when the waiter has acquired the semaphore.
+	high list.List
+	low  list.List
+}
+
+func newPrioritySemaphore(n int64) *prioritySemaphore {
+	return &prioritySemaphore{available: n}
+}
+
+// Acquire blocks until the semaphore is acquired or ctx is done. On
+// success it returns nil, and Release must be called later.
+func (s *prioritySemaphore) Acquire(ctx context.Context, highPriority bool) error {
+	s.mu.Lock()
+	if s.available > 0 && s.high.Len() == 0 && (highPriority || s.low.Len() == 0) {
+		s.available--
+		s.mu.Unlock()
+		return nil
+	}
+
+	queue := &s.low
+	if highPriority {
+		queue = &s.high
+	}
+	ready := make(chan struct{})
+	elem := queue.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// Acquired after ctx was done, give it back.
+			s.releaseLocked()
+		default:
+			queue.Remove(elem)
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Release releases the semaphore, handing it to the next waiter if any.
+func (s *prioritySemaphore) Release() {
+	s.mu.Lock()
+	s.releaseLocked()
+	s.mu.Unlock()
+}
+
+// This must be called when the lock is held.
+func (s *prioritySemaphore) releaseLocked() {
+	for _, queue := range []*list.List{&s.high, &s.low} {
+		front := queue.Front()
+		if front != nil {
+			queue.Remove(front)
+			close(front.Value.(chan struct{}))
+			return
+		}
+	}
+
+	s.available++
+}
@@ -0,0 +1,78 @@
+package disk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPrioritySemaphore(t *testing.T) {
+	ctx := context.Background()
+	s := newPrioritySemaphore(1)
+
+	err := s.Acquire(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue a low priority waiter, then a high priority waiter.
+	order := make(chan string, 2)
+	waitFor := func(name string, high bool) {
+		err := s.Acquire(ctx, high)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		order <- name
+		s.Release()
+	}
+
+	go waitFor("low", false)
+	waitForQueueLen(t, s, 0, 1)
+	go waitFor("high", true)
+	waitForQueueLen(t, s, 1, 1)
+
+	// A waiter whose context is cancelled leaves the queue.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancelled := make(chan error)
+	go func() { cancelled <- s.Acquire(cancelCtx, true) }()
+	waitForQueueLen(t, s, 2, 1)
+	cancel()
+	if err = <-cancelled; err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	waitForQueueLen(t, s, 1, 1)
+
+	s.Release()
+
+	if first := <-order; first != "high" {
+		t.Errorf("Expected the high priority waiter to acquire first, got %q", first)
+	}
+	if second := <-order; second != "low" {
+		t.Errorf("Expected the low priority waiter to acquire second, got %q", second)
+	}
+
+	// Both waiters have released, so the semaphore is available again.
+	err = s.Acquire(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForQueueLen(t *testing.T, s *prioritySemaphore, high int, low int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		h, l := s.high.Len(), s.low.Len()
+		s.mu.Unlock()
+		if h == high && l == low {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d high and %d low priority waiters, found %d and %d", high, low, h, l)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
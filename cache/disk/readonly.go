@@ -0,0 +1,43 @@
+package disk
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+var errReadOnly = &cache.Error{
+	Code: http.StatusForbidden,
+	Text: "The cache is in read-only mode",
+}
+
+// checkWritable returns an error if a file cannot be created in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-probe-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+
+	return os.Remove(name)
+}
+
+// checkReadOnlyFS switches the cache to read-only mode if err shows that
+// the cache directory is on a read-only filesystem, eg because it was
+// remounted read-only after disk errors. From then on, writes fail with
+// errReadOnly instead of retrying the filesystem for every request.
+func (c *diskCache) checkReadOnlyFS(err error) {
+	if !errors.Is(err, syscall.EROFS) {
+		return
+	}
+
+	if c.readOnly.CompareAndSwap(false, true) {
+		log.Printf("ERROR: the cache directory %s is on a read-only filesystem, only serving reads from now on: %v",
+			c.dir, err)
+	}
+}
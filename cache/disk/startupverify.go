@@ -0,0 +1,121 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk/casblob"
+)
+
+// sampleCASItems returns up to n randomly chosen CAS items from the index.
+func (c *diskCache) sampleCASItems(n int) ([]string, []lruItem) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	keys := make([]string, 0, n)
+	items := make([]lruItem, 0, n)
+	seen := 0
+
+	// Reservoir sampling, since the index is not randomly accessible.
+	for k, ele := range c.lru.cache {
+		key := k.(string)
+		kind, _ := splitLookupKey(key)
+		if kind != cache.CAS.String() {
+			continue
+		}
+
+		seen++
+		if len(keys) < n {
+			keys = append(keys, key)
+			items = append(items, ele.Value.(*entry).value)
+			continue
+		}
+
+		i := rand.Intn(seen)
+		if i < n {
+			keys[i] = key
+			items[i] = ele.Value.(*entry).value
+		}
+	}
+
+	return keys, items
+}
+
+// verifyStartupSample checks the hashes of up to n randomly chosen CAS
+// blobs, to detect gross corruption (eg after an unclean shutdown)
+// without reading the whole cache. Blobs which fail verification are
+// logged, and removed from the cache if startupVerifyEvict is set.
+func (c *diskCache) verifyStartupSample(n int) {
+	keys, items := c.sampleCASItems(n)
+	if len(keys) == 0 {
+		return
+	}
+
+	log.Printf("Verifying a sample of %d CAS blobs.", len(keys))
+
+	corrupt := 0
+	for i, key := range keys {
+		err := c.verifyCASItem(key, items[i])
+		if err == nil {
+			continue
+		}
+
+		if os.IsNotExist(err) {
+			// Evicted or replaced since it was sampled.
+			continue
+		}
+
+		corrupt++
+		if c.startupVerifyEvict {
+			log.Printf("Error: %v, removing it from the cache", err)
+			c.removeCorrupt(key, items[i])
+		} else {
+			log.Printf("Error: %v", err)
+		}
+	}
+
+	log.Printf("Finished verifying %d sampled CAS blobs, %d failed verification.",
+		len(keys), corrupt)
+}
+
+// verifyCASItem returns an error if the file for the CAS item with the
+// given key cannot be read, or if its contents do not match its hash.
+func (c *diskCache) verifyCASItem(key string, item lruItem) error {
+	_, hash := splitLookupKey(key)
+
+	f, err := os.Open(c.getElementPath(key, item))
+	if err != nil {
+		return err
+	}
+
+	var rc io.ReadCloser = f
+	if !item.legacy {
+		rc, err = casblob.GetUncompressedReadCloser(c.zstd, c.aead, f, hash, item.size, 0, -1)
+		if err != nil {
+			return fmt.Errorf("CAS blob %s could not be read: %w", hash, err)
+		}
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, rc)
+	if err != nil {
+		return fmt.Errorf("CAS blob %s could not be read: %w", hash, err)
+	}
+	if n != item.size {
+		return fmt.Errorf("CAS blob %s has size %d on disk, expected %d", hash, n, item.size)
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != hash {
+		return fmt.Errorf("CAS blob %s has hash %s on disk", hash, actual)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package disk
+
+// tagIndex maps tags to the lookup keys of the AC and RAW entries that were
+// uploaded with them, so that they can be evicted as a group. It is only
+// kept in memory, so tags are lost when bazel-remote restarts.
+//
+// tagIndex is not safe for concurrent use, callers must hold diskCache.mu.
+type tagIndex struct {
+	keys map[string]map[string]struct{} // Tag -> lookup keys.
+	tags map[string]string              // Lookup key -> tag.
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[string]struct{}),
+		tags: make(map[string]string),
+	}
+}
+
+// add records that key has the given tag, replacing any previous tag.
+func (t *tagIndex) add(key string, tag string) {
+	t.remove(key)
+
+	keys, ok := t.keys[tag]
+	if !ok {
+		keys = make(map[string]struct{})
+		t.keys[tag] = keys
+	}
+	keys[key] = struct{}{}
+	t.tags[key] = tag
+}
+
+// remove forgets the tag of key, if it has one.
+func (t *tagIndex) remove(key string) {
+	tag, ok := t.tags[key]
+	if !ok {
+		return
+	}
+	delete(t.tags, key)
+
+	keys := t.keys[tag]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(t.keys, tag)
+	}
+}
+
+// keysWithTag returns the lookup keys which have the given tag.
+func (t *tagIndex) keysWithTag(tag string) []string {
+	keys := make([]string, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,97 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/buchgr/bazel-remote/v2/utils/tempfile"
+)
+
+// createTempfile creates a new, incomplete file for an item whose path
+// without the random suffix is base. It returns the file, its random
+// suffix and the path that it must have when it is committed. If a temp
+// dir is configured the file is created there, otherwise it is created
+// at its final path.
+func (c *diskCache) createTempfile(base string, legacy bool) (*os.File, string, string, error) {
+	if c.tempDir == "" {
+		f, random, err := tfc.Create(base, legacy)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return f, random, f.Name(), nil
+	}
+
+	f, random, err := tfc.Create(filepath.Join(c.tempDir, filepath.Base(base)), legacy)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return f, random, tempfile.Name(base, random, legacy), nil
+}
+
+// moveToFinalPath moves a file which was created by createTempfile to
+// its final path, if it is not already there.
+func moveToFinalPath(tempPath string, finalPath string) error {
+	if tempPath == finalPath {
+		return nil
+	}
+	return os.Rename(tempPath, finalPath)
+}
+
+// prepareTempDir creates the temp dir if necessary, checks that files can
+// be renamed from it to the cache dir, and removes incomplete files which
+// were left behind by uploads that were interrupted by a restart.
+func (c *diskCache) prepareTempDir() error {
+	err := os.MkdirAll(c.tempDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(c.tempDir, ".rename-probe-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+
+	dest := filepath.Join(c.dir, filepath.Base(probe.Name()))
+	err = os.Rename(probe.Name(), dest)
+	if err != nil {
+		os.Remove(probe.Name())
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("The temp dir %s must be on the same filesystem as the cache dir %s",
+				c.tempDir, c.dir)
+		}
+		return err
+	}
+	os.Remove(dest)
+
+	des, err := os.ReadDir(c.tempDir)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, de := range des {
+		// Incomplete files have the setgid bit set, other files are
+		// not ours.
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode()&os.ModeSetgid == 0 {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(c.tempDir, de.Name()))
+		if err != nil {
+			log.Printf("Failed to remove incomplete file %s: %v", de.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d incomplete file(s) from the temp dir %s", removed, c.tempDir)
+	}
+
+	return nil
+}
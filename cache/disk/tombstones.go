@@ -0,0 +1,77 @@
+package disk
+
+import (
+	"sync"
+	"time"
+)
+
+// tombstoneSet records the lookup keys of items which were deliberately
+// removed from the cache, eg by EvictTag or because they were found to be
+// corrupt. While a key's tombstone has not expired, the item is not read
+// through from the proxy backend, so that it does not immediately reappear
+// in the cache before it has also been removed from the backend.
+//
+// tombstoneSet is safe for concurrent use.
+type tombstoneSet struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time // Lookup key -> expiry time.
+
+	// The number of tombstones at which the expired ones are next
+	// forgotten. This doubles with the number of unexpired tombstones,
+	// so that the cost of scanning is amortized over the adds.
+	pruneAt int
+}
+
+// The minimum number of tombstones before the expired ones are forgotten.
+const minTombstonePruneSize = 1024
+
+func newTombstoneSet(ttl time.Duration) *tombstoneSet {
+	return &tombstoneSet{
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+		pruneAt: minTombstonePruneSize,
+	}
+}
+
+// add records a tombstone for key, and forgets the expired tombstones
+// once enough of them have accumulated.
+func (t *tombstoneSet) add(key string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expires[key] = now.Add(t.ttl)
+
+	if len(t.expires) < t.pruneAt {
+		return
+	}
+
+	for k, expiry := range t.expires {
+		if now.After(expiry) {
+			delete(t.expires, k)
+		}
+	}
+
+	t.pruneAt = max(2*len(t.expires), minTombstonePruneSize)
+}
+
+// has returns true if key has an unexpired tombstone.
+func (t *tombstoneSet) has(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	expiry, ok := t.expires[key]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expiry) {
+		delete(t.expires, key)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,101 @@
+package disk
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The subdirectory of the trash dir which evicted files are moved to.
+// Only files in this subdirectory are ever purged, so that other files
+// in the trash dir are never removed.
+const trashSubdir = "bazel-remote-evicted"
+
+// How often files which have been in the trash dir for longer than the
+// trash TTL are purged.
+const trashPurgeInterval = time.Minute
+
+// moveToTrash moves the evicted cache file f into the trash subdir, at
+// the same path relative to the trash subdir as f is relative to the
+// cache dir, so that it can be recovered manually until it is purged. If the file
+// cannot be moved, it is removed instead.
+func (c *diskCache) moveToTrash(f string) {
+	if !c.acquireFileRemovalSem(f) {
+		return
+	}
+	defer c.fileRemovalSem.Release(1)
+
+	rel, err := filepath.Rel(c.dir, f)
+	if err != nil {
+		log.Printf("ERROR: failed to move evicted cache file %s to the trash dir: %v", f, err)
+		c.removeFileNow(f)
+		return
+	}
+
+	dest := filepath.Join(c.trashDir, trashSubdir, rel)
+	err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err == nil {
+		err = os.Rename(f, dest)
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to move evicted cache file %s to the trash dir: %v", f, err)
+		c.removeFileNow(f)
+		return
+	}
+
+	// The TTL counts from the time that the file was moved to the trash.
+	now := time.Now()
+	err = os.Chtimes(dest, now, now)
+	if err != nil {
+		log.Printf("ERROR: failed to update the modification time of %s: %v", dest, err)
+	}
+}
+
+// pollTrash purges expired files from the trash dir on a static interval.
+func (c *diskCache) pollTrash() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	for ; true; <-ticker.C {
+		c.purgeTrash()
+	}
+}
+
+// purgeTrash removes the files which were moved to the trash subdir more
+// than the trash TTL ago.
+func (c *diskCache) purgeTrash() {
+	cutoff := time.Now().Add(-c.trashTTL)
+	root := filepath.Join(c.trashDir, trashSubdir)
+
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if name == root && os.IsNotExist(err) {
+			return fs.SkipDir // Nothing has been evicted yet.
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().Before(cutoff) {
+			err = os.Remove(name)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("ERROR: failed to remove expired trash file: %s", name)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: failed to purge the trash dir %s: %v", root, err)
+	}
+}
@@ -0,0 +1,86 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// checkTreeDepth returns an error if tree contains directories nested more
+// than maxDepth levels deep (the root directory is at depth 1), or if a
+// directory refers to one of its ancestors.
+//
+// Children are matched with the DirectoryNodes that refer to them by the
+// digest of their deterministic serialization. DirectoryNodes which do not
+// match any of the children are ignored.
+func checkTreeDepth(tree *pb.Tree, maxDepth int) error {
+	children := make(map[string]*pb.Directory, len(tree.GetChildren()))
+	for _, child := range tree.GetChildren() {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(child)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		children[hex.EncodeToString(sum[:])] = child
+	}
+
+	// The height of each subtree that has been fully checked.
+	heights := make(map[string]int, len(children))
+
+	// The digests of the directories being checked, to detect cycles.
+	ancestors := make(map[string]struct{})
+
+	var height func(dir *pb.Directory, depth int) (int, error)
+	height = func(dir *pb.Directory, depth int) (int, error) {
+		h := 1
+
+		for _, node := range dir.GetDirectories() {
+			if node.GetDigest() == nil {
+				continue
+			}
+			hash := node.Digest.Hash
+
+			if _, found := ancestors[hash]; found {
+				return 0, fmt.Errorf("directory %s refers to one of its ancestors", hash)
+			}
+
+			childHeight, checked := heights[hash]
+			if !checked {
+				child, found := children[hash]
+				if !found {
+					continue
+				}
+
+				if depth+1 > maxDepth {
+					return 0, fmt.Errorf("directory tree exceeds the maximum depth of %d", maxDepth)
+				}
+
+				ancestors[hash] = struct{}{}
+				var err error
+				childHeight, err = height(child, depth+1)
+				delete(ancestors, hash)
+				if err != nil {
+					return 0, err
+				}
+				heights[hash] = childHeight
+			}
+
+			if depth+childHeight > maxDepth {
+				return 0, fmt.Errorf("directory tree exceeds the maximum depth of %d", maxDepth)
+			}
+
+			if childHeight+1 > h {
+				h = childHeight + 1
+			}
+		}
+
+		return h, nil
+	}
+
+	_, err := height(tree.GetRoot(), 1)
+	return err
+}
@@ -0,0 +1,82 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/rand"
+)
+
+// shouldVerifyRead returns true if a CAS read should be checked against
+// its hash. Only complete, uncompressed reads can be verified.
+func (c *diskCache) shouldVerifyRead(offset int64, limit int64, zstd bool) bool {
+	if c.verifyOnReadRate <= 0 || offset != 0 || limit >= 0 || zstd {
+		return false
+	}
+
+	return c.verifyOnReadRate >= 1 || rand.Float64() < c.verifyOnReadRate
+}
+
+// verifyingReader hashes the data as it is read from a CAS blob, and
+// returns an error instead of io.EOF if the data does not match the
+// expected hash.
+type verifyingReader struct {
+	io.ReadCloser
+	hasher hash.Hash
+
+	c    *diskCache
+	key  string
+	hash string
+	item lruItem
+}
+
+func (c *diskCache) newVerifyingReader(rc io.ReadCloser, key string, hash string, item lruItem) io.ReadCloser {
+	return &verifyingReader{
+		ReadCloser: rc,
+		hasher:     sha256.New(),
+		c:          c,
+		key:        key,
+		hash:       hash,
+		item:       item,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.hasher.Write(p[:n])
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	actual := hex.EncodeToString(r.hasher.Sum(nil))
+	if actual == r.hash {
+		return n, err
+	}
+
+	log.Printf("Error: CAS blob %s has hash %s on disk, removing it from the cache",
+		r.hash, actual)
+	r.c.removeCorrupt(r.key, r.item)
+
+	return n, fmt.Errorf("CAS blob %s failed verification", r.hash)
+}
+
+// removeCorrupt removes item from the cache, unless it has already been
+// replaced by another item with the same key.
+func (c *diskCache) removeCorrupt(key string, item lruItem) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	found, ok := c.lru.Peek(key)
+	if !ok || found.random != item.random || found.legacy != item.legacy {
+		return
+	}
+
+	c.lru.Remove(key)
+	if c.tombstones != nil {
+		c.tombstones.add(key)
+	}
+}
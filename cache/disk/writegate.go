@@ -0,0 +1,69 @@
+package disk
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+var errNotAcceptingWrites = &cache.Error{
+	Code: http.StatusServiceUnavailable,
+	Text: "The cache is shutting down, not accepting writes",
+}
+
+// writeGate keeps track of the in-flight Put calls, so that they can be
+// given time to finish during shutdown after new writes are refused.
+// The zero value accepts writes.
+type writeGate struct {
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// enter returns true and registers an in-flight write, which must be
+// finished by calling exit, unless the gate is closed.
+func (g *writeGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.pending.Add(1)
+	return true
+}
+
+func (g *writeGate) exit() {
+	g.pending.Done()
+}
+
+// close refuses new writes, and waits until the in-flight writes have
+// finished or ctx is done.
+func (g *writeGate) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopWrites makes new Put calls fail with HTTP 503 (UNAVAILABLE for gRPC),
+// and waits until the in-flight Put calls have finished or ctx is done.
+// This is used during shutdown, so that uploads which are nearly complete
+// can still be committed. Reads are unaffected.
+func (c *diskCache) StopWrites(ctx context.Context) error {
+	return c.writes.close(ctx)
+}
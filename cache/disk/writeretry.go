@@ -0,0 +1,97 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The errno values which are retried by default when writing new cache
+// files, if disk write retries are enabled.
+var DefaultDiskWriteRetryErrnos = []string{"EAGAIN"}
+
+// The errno values which may be configured as transient for disk writes.
+// EINTR is not included since os.File already retries it, and EIO is not
+// included since it can mean that previously written data was lost, so
+// retrying the write could leave a corrupt file behind.
+var retryableErrnos = map[string]syscall.Errno{
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"ESTALE":    syscall.ESTALE,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+}
+
+// The delay before the first retry of a failed write, which doubles for
+// each subsequent retry of the same write.
+const diskWriteRetryDelay = 10 * time.Millisecond
+
+func parseRetryableErrnos(names []string) ([]syscall.Errno, error) {
+	errnos := make([]syscall.Errno, 0, len(names))
+	for _, name := range names {
+		errno, ok := retryableErrnos[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported errno for disk write retries: %q", name)
+		}
+		errnos = append(errnos, errno)
+	}
+	return errnos, nil
+}
+
+// retryWriter writes to w, retrying writes that fail with one of errnos
+// up to retries times. Only the bytes which were not written by the
+// failed attempt are retried, so the file offset stays consistent.
+type retryWriter struct {
+	w       io.Writer
+	retries int
+	errnos  []syscall.Errno
+
+	// Called for each retry, may be nil.
+	onRetry func()
+}
+
+func (w *retryWriter) Write(p []byte) (int, error) {
+	written := 0
+	delay := diskWriteRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		n, err := w.w.Write(p[written:])
+		written += n
+		if err == nil || attempt >= w.retries || !w.retryable(err) {
+			return written, err
+		}
+
+		if w.onRetry != nil {
+			w.onRetry()
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *retryWriter) retryable(err error) bool {
+	for _, errno := range w.errnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileWriter returns the writer to use for writing new cache file f,
+// which retries transient errors if that is enabled.
+func (c *diskCache) fileWriter(f *os.File) io.Writer {
+	if c.diskWriteRetries <= 0 {
+		return f
+	}
+
+	return &retryWriter{
+		w:       f,
+		retries: c.diskWriteRetries,
+		errnos:  c.diskWriteRetryErrnos,
+		onRetry: c.counterDiskWriteRetries.Inc,
+	}
+}
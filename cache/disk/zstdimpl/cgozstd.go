@@ -4,6 +4,7 @@
 package zstdimpl
 
 import (
+	"bytes"
 	"io"
 	"runtime"
 	"sync"
@@ -11,12 +12,28 @@ import (
 	"github.com/valyala/gozstd"
 )
 
-const compressionLevel = 1
-
-type cgoZstd struct{}
+type cgoZstd struct {
+	level      int
+	windowLog  int
+	writerPool *sync.Pool
+}
 
 func init() {
-	register("cgo", cgoZstd{})
+	register("cgo", newCgoZstd)
+}
+
+func newCgoZstd(opts EncoderOptions) ZstdImpl {
+	level := levels[opts.level()]
+
+	if !opts.LongMode {
+		return cgoZstd{level: level, writerPool: writerPool}
+	}
+
+	return cgoZstd{
+		level:      level,
+		windowLog:  longModeWindowLog,
+		writerPool: newWriterPool(longModeWindowLog),
+	}
 }
 
 func (cgoZstd) GetDecoder(in io.ReadCloser) (io.ReadCloser, error) {
@@ -25,18 +42,37 @@ func (cgoZstd) GetDecoder(in io.ReadCloser) (io.ReadCloser, error) {
 	return &putReaderToPoolOnClose{r}, nil
 }
 
-func (cgoZstd) GetEncoder(out io.WriteCloser) (zstdEncoder, error) {
-	w := writerPool.Get().(*writerWrapper)
-	w.Reset(out, nil, compressionLevel)
-	return &putWriterToPoolOnClose{w}, nil
+func (z cgoZstd) GetEncoder(out io.WriteCloser) (zstdEncoder, error) {
+	w := z.writerPool.Get().(*writerWrapper)
+	w.Reset(out, nil, z.level)
+	return &putWriterToPoolOnClose{w, z.writerPool}, nil
 }
 
 func (cgoZstd) DecodeAll(in []byte) ([]byte, error) {
 	return gozstd.Decompress(nil, in)
 }
 
-func (cgoZstd) EncodeAll(in []byte) []byte {
-	return gozstd.CompressLevel(nil, in, compressionLevel)
+func (z cgoZstd) EncodeAll(in []byte) []byte {
+	if z.windowLog == 0 {
+		return gozstd.CompressLevel(nil, in, z.level)
+	}
+
+	// gozstd's one-shot API does not support setting the window log,
+	// so use a streaming encoder instead.
+	var buf bytes.Buffer
+	w := z.writerPool.Get().(*writerWrapper)
+	w.Reset(&buf, nil, z.level)
+	_, _ = w.Write(in) // Writes to a bytes.Buffer do not fail.
+	_ = w.Close()
+	z.writerPool.Put(w)
+	return buf.Bytes()
+}
+
+func (z cgoZstd) LongModeWindowSize() int {
+	if z.windowLog == 0 {
+		return 0
+	}
+	return 1 << z.windowLog
 }
 
 // -- Reader pool
@@ -68,16 +104,28 @@ func (r *putReaderToPoolOnClose) Close() error {
 }
 
 // -- Writer pool
-var writerPool = &sync.Pool{
-	New: newWriter,
+var writerPool = newWriterPool(gozstd.DefaultWindowLog)
+
+// Returns a pool of writers which use the given window log. The window log
+// is preserved when the writers are Reset.
+func newWriterPool(windowLog int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return newWriter(windowLog)
+		},
+	}
 }
 
 type writerWrapper struct {
 	*gozstd.Writer
 }
 
-func newWriter() interface{} {
-	w := &writerWrapper{gozstd.NewWriterLevel(nil, compressionLevel)}
+func newWriter(windowLog int) interface{} {
+	params := &gozstd.WriterParams{
+		CompressionLevel: levels["fastest"],
+		WindowLog:        windowLog,
+	}
+	w := &writerWrapper{gozstd.NewWriterParams(nil, params)}
 	runtime.SetFinalizer(w, releaseWriter)
 	return w
 }
@@ -88,10 +136,11 @@ func releaseWriter(w *writerWrapper) {
 
 type putWriterToPoolOnClose struct {
 	*writerWrapper
+	pool *sync.Pool
 }
 
 func (w putWriterToPoolOnClose) Close() error {
 	err := w.writerWrapper.Close()
-	writerPool.Put(w.writerWrapper)
+	w.pool.Put(w.writerWrapper)
 	return err
 }
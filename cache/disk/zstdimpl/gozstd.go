@@ -3,6 +3,7 @@ package zstdimpl
 import (
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/buchgr/bazel-remote/v2/utils/zstdpool"
 
@@ -21,21 +22,49 @@ var decoderPool = zstdpool.GetDecoderPool()
 var errDecoderPoolFail = errors.New("failed to get decoder from pool")
 var errEncoderPoolFail = errors.New("failed to get encoder from pool")
 
-type goZstd struct{}
+type goZstd struct {
+	encoder     *zstd.Encoder
+	encoderPool *sync.Pool
+	windowSize  int
+}
 
 func init() {
-	register("go", goZstd{})
+	register("go", newGoZstd)
+}
+
+func newGoZstd(opts EncoderOptions) ZstdImpl {
+	if !opts.LongMode && opts.level() == "fastest" {
+		return goZstd{encoder: encoder, encoderPool: encoderPool}
+	}
+
+	_, level := zstd.EncoderLevelFromString(opts.level())
+	eopts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	windowSize := 0
+	if opts.LongMode {
+		windowSize = 1 << longModeWindowLog
+		eopts = append(eopts, zstd.WithWindowSize(windowSize))
+	}
+
+	enc, _ := zstd.NewWriter(nil, eopts...)
+
+	return goZstd{
+		encoder: enc,
+		encoderPool: syncpool.NewEncoderPool(
+			append(eopts, zstd.WithEncoderConcurrency(1))...),
+		windowSize: windowSize,
+	}
 }
 
 // zstdEncoderWrapper is a zstdEncoder that embeds an encoder,
 // and on Close returns it to the pool
 type zstdEncoderWrapper struct {
 	*syncpool.EncoderWrapper
+	pool *sync.Pool
 }
 
 func (w *zstdEncoderWrapper) Close() error {
 	err := w.EncoderWrapper.Close()
-	encoderPool.Put(w.EncoderWrapper)
+	w.pool.Put(w.EncoderWrapper)
 	return err
 }
 
@@ -52,19 +81,23 @@ func (goZstd) GetDecoder(in io.ReadCloser) (io.ReadCloser, error) {
 	return dec.IOReadCloser(), nil
 }
 
-func (goZstd) GetEncoder(out io.WriteCloser) (zstdEncoder, error) {
-	enc, ok := encoderPool.Get().(*syncpool.EncoderWrapper)
+func (z goZstd) GetEncoder(out io.WriteCloser) (zstdEncoder, error) {
+	enc, ok := z.encoderPool.Get().(*syncpool.EncoderWrapper)
 	if !ok {
 		return nil, errEncoderPoolFail
 	}
 	enc.Reset(out)
-	return &zstdEncoderWrapper{enc}, nil
+	return &zstdEncoderWrapper{enc, z.encoderPool}, nil
 }
 
 func (goZstd) DecodeAll(in []byte) ([]byte, error) {
 	return decoder.DecodeAll(in, nil)
 }
 
-func (goZstd) EncodeAll(in []byte) []byte {
-	return encoder.EncodeAll(in, nil)
+func (z goZstd) EncodeAll(in []byte) []byte {
+	return z.encoder.EncodeAll(in, nil)
+}
+
+func (z goZstd) LongModeWindowSize() int {
+	return z.windowSize
 }
@@ -3,23 +3,86 @@ package zstdimpl
 import (
 	"fmt"
 	"io"
+	"sort"
 )
 
-var registry map[string]ZstdImpl
+// The window log used for encoding in long mode. This matches the default
+// for the zstd command line tool's --long flag, and is the largest window
+// which zstd decoders accept without being explicitly configured to allow
+// more memory usage.
+const longModeWindowLog = 27
 
-func register(implName string, impl ZstdImpl) {
+// The supported compression levels, mapped to the roughly equivalent
+// numeric zstd levels. These are the levels supported by the
+// github.com/klauspost/compress/zstd encoder.
+var levels = map[string]int{
+	"fastest": 1,
+	"default": 3,
+	"better":  7,
+	"best":    11,
+}
+
+// ValidLevel returns true if `level` is a supported compression level name,
+// ie one of "fastest", "default", "better" or "best".
+func ValidLevel(level string) bool {
+	_, ok := levels[level]
+	return ok
+}
+
+// EncoderOptions configure the zstd encoders used by a ZstdImpl. The zero
+// value gives the default settings.
+type EncoderOptions struct {
+	// If true, use a large window so that matches which are far apart can
+	// be found. This improves the compression ratio of large blobs with
+	// repetitive content, at the cost of more CPU and memory usage when
+	// compressing. Decompressing requires a larger buffer too.
+	LongMode bool
+
+	// The compression level, see ValidLevel. Higher levels give better
+	// compression ratios at the cost of more CPU usage when compressing.
+	// The empty string means "fastest". This does not affect decompression.
+	Level string
+}
+
+// Returns the compression level name, with the default filled in.
+func (o EncoderOptions) level() string {
+	if o.Level == "" {
+		return "fastest"
+	}
+	return o.Level
+}
+
+type factory func(EncoderOptions) ZstdImpl
+
+var registry map[string]factory
+
+func register(implName string, f factory) {
 	if registry == nil {
-		registry = make(map[string]ZstdImpl)
+		registry = make(map[string]factory)
 	}
-	registry[implName] = impl
+	registry[implName] = f
 }
 
+// Get returns the named ZstdImpl, with default encoder options.
 func Get(implName string) (ZstdImpl, error) {
-	impl, ok := registry[implName]
+	return GetWithOptions(implName, EncoderOptions{})
+}
+
+// GetWithOptions returns the named ZstdImpl, with the given encoder options.
+func GetWithOptions(implName string, opts EncoderOptions) (ZstdImpl, error) {
+	f, ok := registry[implName]
 	if !ok {
-		return nil, fmt.Errorf("Unrecognized ZSTD implementation: %s, supported: %s", implName, registry)
+		names := make([]string, 0, len(registry))
+		for name := range registry {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unrecognized ZSTD implementation: %s, supported: %v", implName, names)
 	}
-	return impl, nil
+	if !ValidLevel(opts.level()) {
+		return nil, fmt.Errorf("Unrecognized ZSTD compression level: %s", opts.Level)
+	}
+	return f(opts), nil
 }
 
 type ZstdImpl interface {
@@ -27,6 +90,11 @@ type ZstdImpl interface {
 	GetEncoder(out io.WriteCloser) (zstdEncoder, error)
 	DecodeAll(in []byte) ([]byte, error)
 	EncodeAll(in []byte) []byte
+
+	// LongModeWindowSize returns the encoders' window size in bytes if
+	// long mode is enabled, or 0 otherwise. The window only helps if
+	// EncodeAll is given inputs which are larger than the default window.
+	LongModeWindowSize() int
 }
 
 type zstdEncoder interface {
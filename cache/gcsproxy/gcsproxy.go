@@ -17,13 +17,21 @@ import (
 )
 
 // New creates a cache that proxies requests to Google Cloud Storage.
-func New(bucket string, useDefaultCredentials bool, jsonCredentialsFile string, storageMode string,
+// If transport is non-nil, it is used for requests instead of
+// http.DefaultTransport.
+func New(bucket string, useDefaultCredentials bool, jsonCredentialsFile string,
+	transport http.RoundTripper, storageMode string,
 	accessLogger cache.Logger, errorLogger cache.Logger, numUploaders, maxQueuedUploads int) (cache.Proxy, error) {
 	var remoteClient *http.Client
 	var err error
 
+	ctx := context.Background()
+	if transport != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+
 	if useDefaultCredentials {
-		remoteClient, err = google.DefaultClient(context.Background(),
+		remoteClient, err = google.DefaultClient(ctx,
 			"https://www.googleapis.com/auth/devstorage.read_write")
 		if err != nil {
 			return nil, err
@@ -34,14 +42,14 @@ func New(bucket string, useDefaultCredentials bool, jsonCredentialsFile string,
 			err = fmt.Errorf("Failed to read Google Credentials file '%s': %v", jsonCredentialsFile, err)
 			return nil, err
 		}
-		config, err := google.CredentialsFromJSON(context.Background(), jsonConfig,
+		config, err := google.CredentialsFromJSON(ctx, jsonConfig,
 			"https://www.googleapis.com/auth/devstorage.read_write")
 		if err != nil {
 			err = fmt.Errorf("The provided Google Credentials file '%s' couldn't be parsed: %v",
 				jsonCredentialsFile, err)
 			return nil, err
 		}
-		remoteClient = oauth2.NewClient(context.Background(), config.TokenSource)
+		remoteClient = oauth2.NewClient(ctx, config.TokenSource)
 	} else {
 		return nil, fmt.Errorf("For Google authentication one needs to specify one of default "+
 			"credentials or a json credentials file %v", useDefaultCredentials)
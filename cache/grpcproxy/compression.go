@@ -0,0 +1,53 @@
+package grpcproxy
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressingReader returns a reader of the zstd compressed data from r.
+// Closing the returned reader stops the compression goroutine.
+func compressingReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		enc, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(enc, r)
+		if err != nil {
+			enc.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(enc.Close())
+	}()
+
+	return pr
+}
+
+type decompressingReader struct {
+	*zstd.Decoder
+	rc io.ReadCloser
+}
+
+// decompressingReadCloser returns an io.ReadCloser of the decompressed
+// data from the zstd compressed rc, which also closes rc.
+func decompressingReadCloser(rc io.ReadCloser) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &decompressingReader{Decoder: dec, rc: rc}, nil
+}
+
+func (d *decompressingReader) Close() error {
+	d.Decoder.Close()
+	return d.rc.Close()
+}
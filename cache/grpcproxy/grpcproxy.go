@@ -15,6 +15,7 @@ import (
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
@@ -57,20 +58,30 @@ func NewGrpcClients(cc *grpc.ClientConn) *GrpcClients {
 }
 
 func (c *GrpcClients) CheckCapabilities(zstd bool) error {
-	resp, err := c.cap.GetCapabilities(context.Background(), &pb.GetCapabilitiesRequest{})
+	supportsZstd, err := c.CheckBackendCapabilities()
 	if err != nil {
 		return err
 	}
+	if zstd && !supportsZstd {
+		return errors.New("Compression required but the grpc proxy does not support it.")
+	}
+	return nil
+}
+
+// CheckBackendCapabilities returns an error if the backend cannot be used
+// as a proxy, and otherwise whether it supports zstd compressed blobs.
+func (c *GrpcClients) CheckBackendCapabilities() (supportsZstd bool, err error) {
+	resp, err := c.cap.GetCapabilities(context.Background(), &pb.GetCapabilitiesRequest{})
+	if err != nil {
+		return false, err
+	}
 	if !resp.CacheCapabilities.ActionCacheUpdateCapabilities.UpdateEnabled {
-		return errors.New("Proxy backend does not allow action cache updates")
+		return false, errors.New("Proxy backend does not allow action cache updates")
 	}
 	if !contains(resp.CacheCapabilities.DigestFunctions, pb.DigestFunction_SHA256) {
-		return errors.New("Proxy backend does not support sha256")
+		return false, errors.New("Proxy backend does not support sha256")
 	}
-	if zstd && !contains(resp.CacheCapabilities.SupportedCompressors, pb.Compressor_ZSTD) {
-		return errors.New("Compression required but the grpc proxy does not support it.")
-	}
-	return nil
+	return contains(resp.CacheCapabilities.SupportedCompressors, pb.Compressor_ZSTD), nil
 }
 
 type remoteGrpcProxyCache struct {
@@ -79,17 +90,35 @@ type remoteGrpcProxyCache struct {
 	accessLogger cache.Logger
 	errorLogger  cache.Logger
 	v2mode       bool
+
+	// If true, uncompressed CAS blobs are compressed with zstd when they
+	// are uploaded to the backend, and decompressed when downloaded.
+	compressTransfers bool
+
+	// Lowercase incoming gRPC metadata keys to forward to the backend.
+	forwardMetadata []string
 }
 
+// New returns a cache.Proxy which uses the given GrpcClients. The values
+// of incoming gRPC metadata keys listed in `forwardMetadata` are copied
+// to the corresponding backend requests. If `compressTransfers` is true
+// and storageMode is not "zstd", CAS blobs are compressed with zstd for
+// transfers to and from the backend, which must support it.
 func New(clients *GrpcClients, storageMode string,
 	accessLogger cache.Logger, errorLogger cache.Logger,
-	numUploaders, maxQueuedUploads int) cache.Proxy {
+	numUploaders, maxQueuedUploads int, forwardMetadata []string,
+	compressTransfers bool) cache.Proxy {
 
 	proxy := &remoteGrpcProxyCache{
-		clients:      clients,
-		accessLogger: accessLogger,
-		errorLogger:  errorLogger,
-		v2mode:       storageMode == "zstd",
+		clients:           clients,
+		accessLogger:      accessLogger,
+		errorLogger:       errorLogger,
+		v2mode:            storageMode == "zstd",
+		compressTransfers: compressTransfers && storageMode != "zstd",
+	}
+
+	for _, key := range forwardMetadata {
+		proxy.forwardMetadata = append(proxy.forwardMetadata, strings.ToLower(key))
 	}
 
 	proxy.uploadQueue = backendproxy.StartUploaders(proxy, numUploaders, maxQueuedUploads)
@@ -97,6 +126,45 @@ func New(clients *GrpcClients, storageMode string,
 	return proxy
 }
 
+// Return the subset of the incoming gRPC metadata in ctx that should be
+// forwarded to the backend, or nil if there is none.
+func (r *remoteGrpcProxyCache) forwardedMetadata(ctx context.Context) metadata.MD {
+	if len(r.forwardMetadata) == 0 {
+		return nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	var fwd metadata.MD
+	for _, key := range r.forwardMetadata {
+		values := md.Get(key)
+		if len(values) == 0 {
+			continue
+		}
+		if fwd == nil {
+			fwd = metadata.MD{}
+		}
+		fwd.Set(key, values...)
+	}
+
+	return fwd
+}
+
+// Return a context derived from ctx for use in backend requests, which
+// includes any forwarded metadata.
+func (r *remoteGrpcProxyCache) outgoingContext(ctx context.Context) context.Context {
+	fwd := r.forwardedMetadata(ctx)
+	if fwd == nil {
+		return ctx
+	}
+
+	out, _ := metadata.FromOutgoingContext(ctx)
+	return metadata.NewOutgoingContext(ctx, metadata.Join(out, fwd))
+}
+
 // Helper function for logging responses
 func logResponse(logger cache.Logger, method string, msg string, kind cache.EntryKind, hash string) {
 	logger.Printf("GRPC PROXY %s %s %s: %s", strings.ToUpper(method), strings.ToUpper(kind.String()), hash, msg)
@@ -105,6 +173,11 @@ func logResponse(logger cache.Logger, method string, msg string, kind cache.Entr
 func (r *remoteGrpcProxyCache) UploadFile(item backendproxy.UploadReq) {
 	defer item.Rc.Close()
 
+	ctx := context.Background()
+	if item.Metadata != nil {
+		ctx = metadata.NewOutgoingContext(ctx, item.Metadata)
+	}
+
 	switch item.Kind {
 	case cache.RAW:
 		// RAW cache entries are a special case of AC, used when --disable_http_ac_validation
@@ -141,33 +214,41 @@ func (r *remoteGrpcProxyCache) UploadFile(item backendproxy.UploadReq) {
 			ActionDigest: digest,
 			ActionResult: ar,
 		}
-		_, err = r.clients.ac.UpdateActionResult(context.Background(), req)
+		_, err = r.clients.ac.UpdateActionResult(ctx, req)
 		if err != nil {
 			logResponse(r.errorLogger, "Update", err.Error(), item.Kind, item.Hash)
 		}
 		return
 	case cache.CAS:
-		stream, err := r.clients.bs.Write(context.Background())
+		stream, err := r.clients.bs.Write(ctx)
 		if err != nil {
 			logResponse(r.errorLogger, "Write", err.Error(), item.Kind, item.Hash)
 			return
 		}
 
 		bufSize := item.SizeOnDisk
-		if bufSize > maxChunkSize {
+		if bufSize > maxChunkSize || r.compressTransfers {
+			// Compressed data is not necessarily smaller than the input.
 			bufSize = maxChunkSize
 		}
 		buf := make([]byte, bufSize)
 
+		var src io.Reader = item.Rc
+		if r.compressTransfers {
+			crc := compressingReader(item.Rc)
+			defer crc.Close()
+			src = crc
+		}
+
 		template := "uploads/%s/blobs/%s/%d"
-		if r.v2mode {
+		if r.v2mode || r.compressTransfers {
 			template = "uploads/%s/compressed-blobs/zstd/%s/%d"
 		}
 		resourceName := fmt.Sprintf(template, uuid.New().String(), item.Hash, item.LogicalSize)
 
 		firstIteration := true
 		for {
-			n, err := item.Rc.Read(buf)
+			n, err := src.Read(buf)
 			if err != nil && err != io.EOF {
 				logResponse(r.errorLogger, "Write", err.Error(), item.Kind, item.Hash)
 				err := stream.CloseSend()
@@ -219,6 +300,7 @@ func (r *remoteGrpcProxyCache) Put(ctx context.Context, kind cache.EntryKind, ha
 		SizeOnDisk:  sizeOnDisk,
 		Kind:        kind,
 		Rc:          rc,
+		Metadata:    r.forwardedMetadata(ctx),
 	}
 
 	select {
@@ -229,6 +311,9 @@ func (r *remoteGrpcProxyCache) Put(ctx context.Context, kind cache.EntryKind, ha
 	}
 }
 
+// Returned by fetchBlobDigest if the backend does not have the blob.
+var errBlobNotFound = errors.New("Not Found")
+
 func (r *remoteGrpcProxyCache) fetchBlobDigest(ctx context.Context, hash string) (*pb.Digest, error) {
 	decoded, err := hex.DecodeString(hash)
 	if err != nil {
@@ -249,7 +334,7 @@ func (r *remoteGrpcProxyCache) fetchBlobDigest(ctx context.Context, hash string)
 	}
 
 	if res.Status.GetCode() == int32(codes.NotFound) {
-		return nil, errors.New("Not Found")
+		return nil, errBlobNotFound
 	}
 	if res.Status.GetCode() != int32(codes.OK) {
 		return nil, errors.New(res.Status.Message)
@@ -258,6 +343,8 @@ func (r *remoteGrpcProxyCache) fetchBlobDigest(ctx context.Context, hash string)
 }
 
 func (r *remoteGrpcProxyCache) Get(ctx context.Context, kind cache.EntryKind, hash string, size int64) (io.ReadCloser, int64, error) {
+	ctx = r.outgoingContext(ctx)
+
 	switch kind {
 	case cache.RAW:
 		// RAW cache entries are a special case of AC, used when --disable_http_ac_validation
@@ -294,6 +381,10 @@ func (r *remoteGrpcProxyCache) Get(ctx context.Context, kind cache.EntryKind, ha
 		if size < 0 {
 			// We don't know the size, so send a FetchBlob request first to get the digest
 			digest, err := r.fetchBlobDigest(ctx, hash)
+			if err == errBlobNotFound {
+				logResponse(r.accessLogger, "Fetch", err.Error(), kind, hash)
+				return nil, -1, nil
+			}
 			if err != nil {
 				logResponse(r.errorLogger, "Fetch", err.Error(), kind, hash)
 				return nil, -1, err
@@ -302,7 +393,7 @@ func (r *remoteGrpcProxyCache) Get(ctx context.Context, kind cache.EntryKind, ha
 		}
 
 		template := "blobs/%s/%d"
-		if r.v2mode {
+		if r.v2mode || r.compressTransfers {
 			template = "compressed-blobs/zstd/%s/%d"
 		}
 		req := bs.ReadRequest{
@@ -315,13 +406,24 @@ func (r *remoteGrpcProxyCache) Get(ctx context.Context, kind cache.EntryKind, ha
 		}
 		logResponse(r.errorLogger, "Read", "Completed", kind, hash)
 		rc := StreamReadCloser[*bs.ReadResponse]{Stream: stream}
+		if r.compressTransfers {
+			drc, err := decompressingReadCloser(&rc)
+			if err != nil {
+				rc.Close()
+				logResponse(r.errorLogger, "Read", err.Error(), kind, hash)
+				return nil, -1, err
+			}
+			return drc, size, nil
+		}
 		return &rc, size, nil
 	default:
 		return nil, -1, fmt.Errorf("Unexpected kind %s", kind)
 	}
 }
 
-func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64) {
+func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, size int64) (bool, int64, error) {
+	ctx = r.outgoingContext(ctx)
+
 	switch kind {
 	case cache.RAW:
 		// RAW cache entries are a special case of AC, used when --disable_http_ac_validation
@@ -332,21 +434,30 @@ func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKin
 		// is to get the object and discard the result
 		// We don't expect this to ever be called anyways since it is not part of the grpc protocol
 		rc, size, err := r.Get(ctx, kind, hash, size)
-		rc.Close()
-		if err != nil || size < 0 {
-			return false, -1
+		if rc != nil {
+			rc.Close()
+		}
+		if err != nil {
+			return false, -1, err
 		}
-		return true, size
+		if rc == nil || size < 0 {
+			return false, -1, nil
+		}
+		return true, size, nil
 	case cache.CAS:
 		if size < 0 {
 			// If don't know the size, use the remote asset api to find the missing blob
 			digest, err := r.fetchBlobDigest(ctx, hash)
+			if err == errBlobNotFound {
+				logResponse(r.accessLogger, "Contains", "Not Found", kind, hash)
+				return false, -1, nil
+			}
 			if err != nil {
 				logResponse(r.errorLogger, "Contains", err.Error(), kind, hash)
-				return false, -1
+				return false, -1, err
 			}
 			logResponse(r.accessLogger, "Contains", "Success", kind, hash)
-			return true, digest.SizeBytes
+			return true, digest.SizeBytes, nil
 		}
 
 		// If we know the size, prefer using the remote execution api
@@ -359,16 +470,16 @@ func (r *remoteGrpcProxyCache) Contains(ctx context.Context, kind cache.EntryKin
 		res, err := r.clients.cas.FindMissingBlobs(ctx, req)
 		if err != nil {
 			logResponse(r.errorLogger, "Contains", err.Error(), kind, hash)
-			return false, -1
+			return false, -1, err
 		}
 		for range res.MissingBlobDigests {
 			logResponse(r.accessLogger, "Contains", "Not Found", kind, hash)
-			return false, -1
+			return false, -1, nil
 		}
 		logResponse(r.errorLogger, "Contains", "Success", kind, hash)
-		return true, size
+		return true, size, nil
 	default:
 		logResponse(r.errorLogger, "Contains", "Unexpected kind", kind, hash)
-		return false, -1
+		return false, -1, fmt.Errorf("Unexpected kind %s", kind)
 	}
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/proto"
 
@@ -44,7 +45,7 @@ func (p *testProxy) Contains(kind cache.EntryKind, hash string) bool {
 	return true
 }
 
-func newProxy(t *testing.T, dir string, storageMode string) *testProxy {
+func newProxy(t *testing.T, dir string, storageMode string, compressTransfers bool) *testProxy {
 	listener := bufconn.Listen(1024 * 1024)
 	srv := grpc.NewServer()
 	p := &testProxy{
@@ -75,7 +76,7 @@ func newProxy(t *testing.T, dir string, storageMode string) *testProxy {
 	if err != nil {
 		t.Fatal(err)
 	}
-	proxy := New(clients, storageMode, logger, logger, 100, 100)
+	proxy := New(clients, storageMode, logger, logger, 100, 100, nil, compressTransfers)
 	p.proxy = proxy
 
 	return p
@@ -256,8 +257,8 @@ func newFixture(t *testing.T, proxy cache.Proxy, storageMode string) *fixture {
 	}
 }
 
-func runTest(t *testing.T, storageMode string) {
-	proxyFixture := newProxy(t, testutils.TempDir(t), storageMode)
+func runTest(t *testing.T, storageMode string, compressTransfers bool) {
+	proxyFixture := newProxy(t, testutils.TempDir(t), storageMode, compressTransfers)
 	putFixture := newFixture(t, proxyFixture.proxy, storageMode)
 	getFixture := newFixture(t, proxyFixture.proxy, storageMode)
 	time.Sleep(time.Second)
@@ -309,11 +310,11 @@ func runTest(t *testing.T, storageMode string) {
 	}
 	time.Sleep(time.Second)
 
-	ok, size := putFixture.cache.Contains(context.Background(), cache.AC, arDigest.Hash, arDigest.SizeBytes)
+	ok, size, _ := putFixture.cache.Contains(context.Background(), cache.AC, arDigest.Hash, arDigest.SizeBytes)
 	if !ok || size != arDigest.SizeBytes {
 		t.Fatal("Cound not find action result in first server")
 	}
-	ok, size = putFixture.cache.Contains(context.Background(), cache.CAS, digest.Hash, digest.SizeBytes)
+	ok, size, _ = putFixture.cache.Contains(context.Background(), cache.CAS, digest.Hash, digest.SizeBytes)
 	if !ok || size != digest.SizeBytes {
 		t.Fatal("Cound not find blob in first server")
 	}
@@ -323,12 +324,21 @@ func runTest(t *testing.T, storageMode string) {
 	if !proxyFixture.Contains(cache.CAS, digest.Hash) {
 		t.Fatal("Cound not find blob in proxy")
 	}
+	if compressTransfers {
+		stored, err := os.ReadFile(filepath.Join(proxyFixture.dir, cache.CAS.DirName(), digest.Hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(stored, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+			t.Fatal("Expected a zstd compressed blob in proxy")
+		}
+	}
 
-	ok, size = getFixture.cache.Contains(context.Background(), cache.AC, arDigest.Hash, arDigest.SizeBytes)
+	ok, size, _ = getFixture.cache.Contains(context.Background(), cache.AC, arDigest.Hash, arDigest.SizeBytes)
 	if !ok || size != arDigest.SizeBytes {
 		t.Fatal("Second server could not find action result")
 	}
-	ok, size = getFixture.cache.Contains(context.Background(), cache.CAS, digest.Hash, digest.SizeBytes)
+	ok, size, _ = getFixture.cache.Contains(context.Background(), cache.CAS, digest.Hash, digest.SizeBytes)
 	if !ok || size != digest.SizeBytes {
 		t.Fatal("Second server could not find blob")
 	}
@@ -380,12 +390,50 @@ func runTest(t *testing.T, storageMode string) {
 	if len(received) != len(data) {
 		t.Fatal("Unexpected blob size")
 	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("Unexpected blob data")
+	}
 }
 
 func TestEverything(t *testing.T) {
-	runTest(t, "uncompressed")
+	runTest(t, "uncompressed", false)
 }
 
 func TestEverythingZstd(t *testing.T) {
-	runTest(t, "zstd")
+	runTest(t, "zstd", false)
+}
+
+func TestEverythingCompressedTransfers(t *testing.T) {
+	runTest(t, "uncompressed", true)
+}
+
+func TestForwardedMetadata(t *testing.T) {
+	r := &remoteGrpcProxyCache{forwardMetadata: []string{"authorization", "x-tenant"}}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"authorization", "Bearer token",
+		"x-tenant", "a",
+		"x-tenant", "b",
+		"x-other", "ignored",
+	))
+
+	out, ok := metadata.FromOutgoingContext(r.outgoingContext(ctx))
+	if !ok {
+		t.Fatal("Expected outgoing metadata")
+	}
+
+	expected := metadata.Pairs(
+		"authorization", "Bearer token",
+		"x-tenant", "a",
+		"x-tenant", "b",
+	)
+	if fmt.Sprint(out) != fmt.Sprint(expected) {
+		t.Fatalf("Expected outgoing metadata %v, got %v", expected, out)
+	}
+
+	// Nothing to forward.
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-other", "ignored"))
+	if r.forwardedMetadata(ctx) != nil {
+		t.Fatal("Expected no forwarded metadata")
+	}
 }
@@ -60,7 +60,7 @@ func (r *remoteHTTPProxyCache) UploadFile(item backendproxy.UploadReq) {
 
 	rsp, err := r.remote.Do(req)
 	if err == nil && rsp.StatusCode == http.StatusOK {
-		r.accessLogger.Printf("SKIP UPLOAD %s", item.Hash)
+		cache.LogSuccess(r.accessLogger, "SKIP UPLOAD %s", item.Hash)
 		item.Rc.Close()
 		return
 	}
@@ -132,6 +132,10 @@ func New(baseURL *url.URL, storageMode string, remote *http.Client,
 
 // Helper function for logging responses
 func logResponse(logger cache.Logger, method string, code int, url string) {
+	if code < http.StatusBadRequest || code == http.StatusNotFound {
+		cache.LogSuccess(logger, "HTTP %s %d %s", method, code, url)
+		return
+	}
 	logger.Printf("HTTP %s %d %s", method, code, url)
 }
 
@@ -220,26 +224,38 @@ func (r *remoteHTTPProxyCache) Get(ctx context.Context, kind cache.EntryKind, ha
 	return rsp.Body, sizeBytes, nil
 }
 
-func (r *remoteHTTPProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
+func (r *remoteHTTPProxyCache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 
 	url := r.requestURL(hash, kind)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err != nil {
-		return false, -1
+		return false, -1, err
 	}
 
 	rsp, err := r.remote.Do(req)
-	if err == nil && rsp.StatusCode == http.StatusOK {
-		if kind != cache.CAS || !r.v2mode {
-			return true, rsp.ContentLength
+	if err != nil {
+		return false, -1, err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return false, -1, nil
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return false, -1, &cache.Error{
+			Code: rsp.StatusCode,
+			Text: rsp.Status,
 		}
+	}
 
-		// We don't know the content size without reading the file header
-		// and that could be very costly for the backend server. So return
-		// "unknown size".
-		return true, -1
+	if kind != cache.CAS || !r.v2mode {
+		return true, rsp.ContentLength, nil
 	}
 
-	return false, -1
+	// We don't know the content size without reading the file header
+	// and that could be very costly for the backend server. So return
+	// "unknown size".
+	return true, -1, nil
 }
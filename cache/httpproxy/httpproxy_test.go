@@ -196,7 +196,7 @@ func TestEverything(t *testing.T) {
 		}
 
 		rc, err := casblob.GetUncompressedReadCloser(
-			zi, tmpfile2, int64(len(casData)), 0)
+			zi, nil, tmpfile2, hash, int64(len(casData)), 0, -1)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -218,7 +218,7 @@ func TestEverything(t *testing.T) {
 	var found bool
 	var size int64
 
-	found, size = diskCache.Contains(ctx, cache.AC, hash, int64(len(acData)))
+	found, size, _ = diskCache.Contains(ctx, cache.AC, hash, int64(len(acData)))
 	if !found {
 		t.Fatalf("Expected to find AC item %s", hash)
 	}
@@ -227,7 +227,7 @@ func TestEverything(t *testing.T) {
 			len(acData), size)
 	}
 
-	found, size = diskCache.Contains(ctx, cache.CAS, hash, int64(len(casData)))
+	found, size, _ = diskCache.Contains(ctx, cache.CAS, hash, int64(len(casData)))
 	if !found {
 		t.Fatalf("Expected to find CAS item %s", hash)
 	}
@@ -299,7 +299,7 @@ func TestEverything(t *testing.T) {
 
 	// Confirm that we can HEAD both values successfully.
 
-	found, size = diskCache.Contains(ctx, cache.AC, hash, int64(len(acData)))
+	found, size, _ = diskCache.Contains(ctx, cache.AC, hash, int64(len(acData)))
 	if !found {
 		t.Fatalf("Expected to find AC item %s", hash)
 	}
@@ -308,7 +308,7 @@ func TestEverything(t *testing.T) {
 			len(acData), size)
 	}
 
-	found, size = diskCache.Contains(ctx, cache.CAS, hash, int64(len(casData)))
+	found, size, _ = diskCache.Contains(ctx, cache.CAS, hash, int64(len(casData)))
 	if !found {
 		t.Fatalf("Expected to find CAS item %s", hash)
 	}
@@ -0,0 +1,147 @@
+package s3proxy
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// How often to log progress while restoring, in number of objects.
+const restoreProgressInterval = 1000
+
+var hashRegex = regexp.MustCompile("^[a-f0-9]{64}$")
+
+var errNotS3Proxy = errors.New("restoring requires an s3 proxy backend")
+
+// FetchFunc is called by Restore for each cache item found in the s3
+// bucket, and is expected to populate the local cache with that item.
+type FetchFunc func(ctx context.Context, kind cache.EntryKind, hash string) error
+
+// Restore lists all the cache items stored under the s3 prefix of `proxy`,
+// which must have been returned by New, and calls `fetch` for each of them
+// using at most `numWorkers` concurrent goroutines.
+//
+// Items that fail to be fetched are logged and skipped. Since items which
+// already exist in the local cache are expected to be cheap to fetch, an
+// interrupted restore can be resumed by running it again.
+func Restore(ctx context.Context, proxy cache.Proxy, numWorkers int, fetch FetchFunc) error {
+	c, ok := proxy.(*s3Cache)
+	if !ok {
+		return errNotS3Proxy
+	}
+
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	type item struct {
+		kind cache.EntryKind
+		hash string
+	}
+
+	items := make(chan item, numWorkers)
+
+	var numFetched, numFailed int64
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				err := fetch(ctx, it.kind, it.hash)
+				if err != nil {
+					atomic.AddInt64(&numFailed, 1)
+					c.errorLogger.Printf("S3 RESTORE %s/%s FAILED: %v", it.kind, it.hash, err)
+					continue
+				}
+
+				n := atomic.AddInt64(&numFetched, 1)
+				if n%restoreProgressInterval == 0 {
+					c.accessLogger.Printf("S3 restore: %d items restored so far", n)
+				}
+			}
+		}()
+	}
+
+	listPrefix := c.prefix
+	if listPrefix != "" && !strings.HasSuffix(listPrefix, "/") {
+		listPrefix += "/"
+	}
+
+	c.accessLogger.Printf("S3 restore: restoring from bucket %q with prefix %q", c.bucket, listPrefix)
+
+	var listErr error
+	objects := c.mcore.Client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{
+		Prefix:    listPrefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			listErr = obj.Err
+			c.errorLogger.Printf("S3 RESTORE LIST %s/%s FAILED: %v", c.bucket, listPrefix, listErr)
+			break
+		}
+
+		kind, hash, ok := parseObjectKey(c.prefix, obj.Key, c.v2mode)
+		if !ok {
+			continue
+		}
+
+		items <- item{kind: kind, hash: hash}
+	}
+
+	close(items)
+	wg.Wait()
+
+	c.accessLogger.Printf("S3 restore: finished, %d items restored, %d failed",
+		atomic.LoadInt64(&numFetched), atomic.LoadInt64(&numFailed))
+
+	return listErr
+}
+
+// Return the kind and hash of the cache item stored under the given object
+// key, and true if the key refers to a cache item. This is the inverse of
+// objectKeyV1 and objectKeyV2.
+func parseObjectKey(prefix string, key string, v2mode bool) (cache.EntryKind, string, bool) {
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		if !strings.HasPrefix(key, prefix) {
+			return 0, "", false
+		}
+		key = strings.TrimPrefix(key, prefix)
+	}
+
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 {
+		return 0, "", false
+	}
+
+	hash := parts[2]
+	if !hashRegex.MatchString(hash) || parts[1] != hash[:2] {
+		return 0, "", false
+	}
+
+	casDir := "cas"
+	if v2mode {
+		casDir = "cas.v2"
+	}
+
+	switch parts[0] {
+	case casDir:
+		return cache.CAS, hash, true
+	case "ac":
+		return cache.AC, hash, true
+	case "raw":
+		return cache.RAW, hash, true
+	}
+
+	return 0, "", false
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"path"
+	"strings"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
 	"github.com/buchgr/bazel-remote/v2/cache/disk/casblob"
@@ -27,9 +30,16 @@ type s3Cache struct {
 	errorLogger      cache.Logger
 	v2mode           bool
 	updateTimestamps bool
+	tagObjectsByKind bool
 	objectKey        func(hash string, kind cache.EntryKind) string
 }
 
+// KindTag is the name of the object tag which is set to the kind of
+// entry ("ac", "cas" or "raw") when uploading objects with tagging
+// enabled, so that bucket lifecycle rules can apply different expiry
+// rules to each kind.
+const KindTag = "bazel-remote-kind"
+
 var (
 	cacheHits = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "bazel_remote_s3_cache_hits",
@@ -54,8 +64,12 @@ func New(
 	Credentials *credentials.Credentials,
 	DisableSSL bool,
 	UpdateTimestamps bool,
+	TagObjectsByKind bool,
 	Region string,
 
+	// Used for requests if non-nil, instead of minio's default transport.
+	transport http.RoundTripper,
+
 	storageMode string, accessLogger cache.Logger,
 	errorLogger cache.Logger, numUploaders, maxQueuedUploads int) cache.Proxy {
 
@@ -71,10 +85,12 @@ func New(
 	// Initialize minio client with credentials
 	opts := &minio.Options{
 		Creds:        Credentials,
-		BucketLookup: BucketLookupType,
+		BucketLookup: bucketLookupForEndpoint(Endpoint, BucketLookupType),
 
 		Region: Region,
 		Secure: !DisableSSL,
+
+		Transport: transport,
 	}
 	minioCore, err = minio.NewCore(Endpoint, opts)
 	if err != nil {
@@ -94,6 +110,7 @@ func New(
 		errorLogger:      errorLogger,
 		v2mode:           storageMode == "zstd",
 		updateTimestamps: UpdateTimestamps,
+		tagObjectsByKind: TagObjectsByKind,
 	}
 
 	if c.v2mode {
@@ -111,6 +128,28 @@ func New(
 	return c
 }
 
+// bucketLookupForEndpoint returns the bucket lookup type to use for
+// endpoint. With BucketLookupAuto, endpoints which are IP addresses or
+// hostnames without dots (eg a local minio server) use path-style
+// lookups, since they cannot have per-bucket DNS names. Other endpoints
+// are left to minio's heuristic.
+func bucketLookupForEndpoint(endpoint string, lookup minio.BucketLookupType) minio.BucketLookupType {
+	if lookup != minio.BucketLookupAuto {
+		return lookup
+	}
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = strings.Trim(endpoint, "[]")
+	}
+
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return minio.BucketLookupPath
+	}
+
+	return lookup
+}
+
 func objectKeyV2(prefix string, hash string, kind cache.EntryKind) string {
 	var baseKey string
 	if kind == cache.CAS {
@@ -154,11 +193,7 @@ func (c *s3Cache) UploadFile(item backendproxy.UploadReq) {
 		item.SizeOnDisk,                   // objectSize
 		"",                                // md5base64
 		"",                                // sha256
-		minio.PutObjectOptions{
-			UserMetadata: map[string]string{
-				"Content-Type": "application/octet-stream",
-			},
-		}, // metadata
+		c.putObjectOptions(item.Kind),     // metadata
 	)
 
 	logResponse(c.accessLogger, "UPLOAD", c.bucket, c.objectKey(item.Hash, item.Kind), err)
@@ -166,6 +201,20 @@ func (c *s3Cache) UploadFile(item backendproxy.UploadReq) {
 	item.Rc.Close()
 }
 
+func (c *s3Cache) putObjectOptions(kind cache.EntryKind) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		UserMetadata: map[string]string{
+			"Content-Type": "application/octet-stream",
+		},
+	}
+
+	if c.tagObjectsByKind {
+		opts.UserTags = map[string]string{KindTag: kind.String()}
+	}
+
+	return opts
+}
+
 func (c *s3Cache) Put(ctx context.Context, kind cache.EntryKind, hash string, logicalSize int64, sizeOnDisk int64, rc io.ReadCloser) {
 	if c.uploadQueue == nil {
 		rc.Close()
@@ -236,25 +285,27 @@ func (c *s3Cache) Get(ctx context.Context, kind cache.EntryKind, hash string, _
 	return rc, info.Size, nil
 }
 
-func (c *s3Cache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64) {
-	size := int64(-1)
-	exists := false
-
+func (c *s3Cache) Contains(ctx context.Context, kind cache.EntryKind, hash string, _ int64) (bool, int64, error) {
 	s, err := c.mcore.StatObject(
 		ctx,
 		c.bucket,                  // bucketName
 		c.objectKey(hash, kind),   // objectName
 		minio.StatObjectOptions{}, // opts
 	)
-
-	exists = (err == nil)
 	if err != nil {
-		err = errNotFound
-	} else if kind != cache.CAS || !c.v2mode {
-		size = s.Size
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), errNotFound)
+			return false, -1, nil
+		}
+		logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), err)
+		return false, -1, err
 	}
 
-	logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), err)
+	logResponse(c.accessLogger, "CONTAINS", c.bucket, c.objectKey(hash, kind), nil)
+
+	if kind != cache.CAS || !c.v2mode {
+		return true, s.Size, nil
+	}
 
-	return exists, size
+	return true, -1, nil
 }
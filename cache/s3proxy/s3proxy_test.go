@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
+
+	"github.com/minio/minio-go/v7"
 )
 
 func TestObjectKey(t *testing.T) {
@@ -36,3 +38,92 @@ func TestObjectKey(t *testing.T) {
 		}
 	}
 }
+
+func TestParseObjectKey(t *testing.T) {
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	testCases := []struct {
+		prefix       string
+		v2mode       bool
+		kind         cache.EntryKind
+		expectedKind cache.EntryKind
+		expectedOk   bool
+	}{
+		{"", true, cache.CAS, cache.CAS, true},
+		{"", false, cache.CAS, cache.CAS, true},
+		{"foo/bar", true, cache.CAS, cache.CAS, true},
+		{"foo/bar", true, cache.AC, cache.AC, true},
+		{"foo/bar/", false, cache.RAW, cache.RAW, true},
+	}
+
+	for _, tc := range testCases {
+		var key string
+		if tc.v2mode {
+			key = objectKeyV2(tc.prefix, hash, tc.kind)
+		} else {
+			key = objectKeyV1(tc.prefix, hash, tc.kind)
+		}
+
+		kind, parsedHash, ok := parseObjectKey(tc.prefix, key, tc.v2mode)
+		if ok != tc.expectedOk || kind != tc.expectedKind || parsedHash != hash {
+			t.Errorf("parseObjectKey(%q, %q, %v) returned (%v, %q, %v)",
+				tc.prefix, key, tc.v2mode, kind, parsedHash, ok)
+		}
+	}
+
+	invalidKeys := []string{
+		"cas.v2/e3/" + hash[:10],
+		"cas.v2/ab/" + hash,
+		"other/cas.v2/e3/" + hash,
+		"cas/e3/" + hash, // Legacy format, but we are in v2 mode.
+		"cas.v2/e3/" + hash + "/extra",
+	}
+	for _, key := range invalidKeys {
+		_, _, ok := parseObjectKey("", key, true)
+		if ok {
+			t.Errorf("Expected parseObjectKey to reject %q", key)
+		}
+	}
+}
+
+func TestPutObjectOptionsKindTag(t *testing.T) {
+	c := &s3Cache{}
+	opts := c.putObjectOptions(cache.AC)
+	if len(opts.UserTags) != 0 {
+		t.Errorf("Expected no tags by default, got: %v", opts.UserTags)
+	}
+
+	c.tagObjectsByKind = true
+	for _, kind := range []cache.EntryKind{cache.AC, cache.CAS, cache.RAW} {
+		opts = c.putObjectOptions(kind)
+		if opts.UserTags[KindTag] != kind.String() {
+			t.Errorf("Expected %s tag %q, got: %v", KindTag, kind.String(), opts.UserTags)
+		}
+	}
+}
+
+func TestBucketLookupForEndpoint(t *testing.T) {
+	testCases := []struct {
+		endpoint string
+		lookup   minio.BucketLookupType
+		expected minio.BucketLookupType
+	}{
+		{"s3.amazonaws.com", minio.BucketLookupAuto, minio.BucketLookupAuto},
+		{"minio.internal.example.com:9000", minio.BucketLookupAuto, minio.BucketLookupAuto},
+		{"127.0.0.1:9000", minio.BucketLookupAuto, minio.BucketLookupPath},
+		{"10.1.2.3", minio.BucketLookupAuto, minio.BucketLookupPath},
+		{"[::1]:9000", minio.BucketLookupAuto, minio.BucketLookupPath},
+		{"minio:9000", minio.BucketLookupAuto, minio.BucketLookupPath},
+		{"localhost", minio.BucketLookupAuto, minio.BucketLookupPath},
+		{"minio:9000", minio.BucketLookupDNS, minio.BucketLookupDNS},
+		{"s3.amazonaws.com", minio.BucketLookupPath, minio.BucketLookupPath},
+	}
+
+	for _, tc := range testCases {
+		result := bucketLookupForEndpoint(tc.endpoint, tc.lookup)
+		if result != tc.expected {
+			t.Errorf("Unexpected bucket lookup type for %q with %v: got %v, expected %v",
+				tc.endpoint, tc.lookup, result, tc.expected)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -19,9 +20,14 @@ type AzBlobStorageConfig struct {
 	TenantID         string `yaml:"tenant_id"`
 	ClientID         string `yaml:"client_id"`
 	ClientSecret     string `yaml:"client_secret"`
+	ClientSecretFile string `yaml:"client_secret_file"`
 	CertPath         string `yaml:"cert_path"`
 	SharedKey        string `yaml:"shared_key"`
+	SharedKeyFile    string `yaml:"shared_key_file"`
 	UpdateTimestamps bool   `yaml:"update_timestamps"`
+
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
 }
 
 func (azblobc AzBlobStorageConfig) GetCredentials() (azcore.TokenCredential, error) {
@@ -10,14 +10,15 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
-	"github.com/buchgr/bazel-remote/v2/cache/azblobproxy"
-	"github.com/buchgr/bazel-remote/v2/cache/s3proxy"
+	"github.com/buchgr/bazel-remote/v2/cache/disk/zstdimpl"
 
 	"github.com/urfave/cli/v2"
 	yaml "gopkg.in/yaml.v3"
@@ -28,6 +29,9 @@ type GoogleCloudStorageConfig struct {
 	Bucket                string `yaml:"bucket"`
 	UseDefaultCredentials bool   `yaml:"use_default_credentials"`
 	JSONCredentialsFile   string `yaml:"json_credentials_file"`
+
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
 }
 
 // URLBackendConfig stores the configuration for a HTTP or GRPC proxy backend.
@@ -36,6 +40,42 @@ type URLBackendConfig struct {
 	CertFile string   `yaml:"cert_file"`
 	KeyFile  string   `yaml:"key_file"`
 	CaFile   string   `yaml:"ca_file"`
+
+	// A file containing the password to use with the username in BaseURL,
+	// so it does not need to be included in the url itself.
+	PasswordFile string `yaml:"password_file"`
+
+	// Incoming gRPC metadata keys to forward to the backend. Only
+	// supported by the grpc proxy.
+	ForwardMetadata []string `yaml:"forward_metadata"`
+
+	// The format of CAS blobs stored on the backend, see validStoreFormat.
+	// Only supported by the http proxy.
+	StoreFormat string `yaml:"store_format"`
+
+	// The compression to use for CAS transfers to and from the backend,
+	// see validGRPCCompression. Only supported by the grpc proxy.
+	Compression string `yaml:"compression"`
+
+	// The maximum time to wait when connecting to the backend, and for
+	// each request to complete, or zero for no limit.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+
+	// Set when CAS blobs are transferred uncompressed to and from the
+	// grpc proxy, after checking the backend's capabilities. This is not
+	// a config key.
+	UncompressedTransfers bool `yaml:"-"`
+}
+
+// ProxyBackendConfig stores the configuration of a proxy backend that is
+// used for only some kinds of cache items. Exactly one backend must be set.
+type ProxyBackendConfig struct {
+	S3CloudStorage     *S3CloudStorageConfig     `yaml:"s3_proxy,omitempty"`
+	AzBlobConfig       *AzBlobStorageConfig      `yaml:"azblob_proxy,omitempty"`
+	GoogleCloudStorage *GoogleCloudStorageConfig `yaml:"gcs_proxy,omitempty"`
+	HTTPBackend        *URLBackendConfig         `yaml:"http_proxy,omitempty"`
+	GRPCBackend        *URLBackendConfig         `yaml:"grpc_proxy,omitempty"`
 }
 
 type LDAPConfig struct {
@@ -43,19 +83,37 @@ type LDAPConfig struct {
 	BaseDN            string        `yaml:"base_dn"`
 	BindUser          string        `yaml:"bind_user"`
 	BindPassword      string        `yaml:"bind_password"`
+	BindPasswordFile  string        `yaml:"bind_password_file"`
 	UsernameAttribute string        `yaml:"username_attribute"`
 	GroupsQuery       string        `yaml:"groups_query"`
 	CacheTime         time.Duration `yaml:"cache_time"`
+	CacheMaxEntries   int           `yaml:"cache_max_entries"`
+}
+
+// EventsConfig configures the publishing of cache events to a message
+// queue. Only NATS is currently supported.
+type EventsConfig struct {
+	Type    string `yaml:"type"`
+	Address string `yaml:"address"`
+	Topic   string `yaml:"topic"`
 }
 
 func (c *URLBackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type Aux URLBackendConfig
+	// Anonymous fields are not inlined by default, and the url field
+	// needs to be parsed, so list all the fields explicitly.
 	aux := &struct {
-		URLStr string `yaml:"url"`
-		*Aux
-	}{
-		Aux: (*Aux)(c),
-	}
+		URLStr          string   `yaml:"url"`
+		CertFile        string   `yaml:"cert_file"`
+		KeyFile         string   `yaml:"key_file"`
+		CaFile          string   `yaml:"ca_file"`
+		ForwardMetadata []string `yaml:"forward_metadata"`
+		StoreFormat     string   `yaml:"store_format"`
+		PasswordFile    string   `yaml:"password_file"`
+		Compression     string   `yaml:"compression"`
+
+		ConnectTimeout time.Duration `yaml:"connect_timeout"`
+		RequestTimeout time.Duration `yaml:"request_timeout"`
+	}{}
 
 	if err := unmarshal(aux); err != nil {
 		return err
@@ -65,6 +123,15 @@ func (c *URLBackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) erro
 		return err
 	}
 	c.BaseURL = u
+	c.CertFile = aux.CertFile
+	c.KeyFile = aux.KeyFile
+	c.CaFile = aux.CaFile
+	c.ForwardMetadata = aux.ForwardMetadata
+	c.StoreFormat = aux.StoreFormat
+	c.PasswordFile = aux.PasswordFile
+	c.Compression = aux.Compression
+	c.ConnectTimeout = aux.ConnectTimeout
+	c.RequestTimeout = aux.RequestTimeout
 	return nil
 }
 
@@ -86,7 +153,21 @@ func (c *URLBackendConfig) validate(protocol string) error {
 	if c.CaFile != "" && c.BaseURL.Scheme != protocol+"s" {
 		return fmt.Errorf("When TLS is enabled, the %[1]s proxy backend protocol must be %[1]s", protocol)
 	}
-	return nil
+	if len(c.ForwardMetadata) > 0 && protocol != "grpc" {
+		return fmt.Errorf("The 'forward_metadata' field is not supported for '%s_proxy'", protocol)
+	}
+	if c.StoreFormat != "" && protocol != "http" {
+		return fmt.Errorf("The 'store_format' field is not supported for '%s_proxy'", protocol)
+	}
+	if c.Compression != "" {
+		if protocol != "grpc" {
+			return fmt.Errorf("The 'compression' field is not supported for '%s_proxy'", protocol)
+		}
+		if !validGRPCCompression(c.Compression) {
+			return fmt.Errorf("Invalid grpc_proxy.compression %q, must be one of \"zstd\" or \"identity\"", c.Compression)
+		}
+	}
+	return validateBackendTimeouts(protocol+"_proxy", c.ConnectTimeout, c.RequestTimeout)
 }
 
 // Config holds the top-level configuration for bazel-remote.
@@ -110,6 +191,8 @@ type Config struct {
 	GoogleCloudStorage          *GoogleCloudStorageConfig `yaml:"gcs_proxy,omitempty"`
 	HTTPBackend                 *URLBackendConfig         `yaml:"http_proxy,omitempty"`
 	GRPCBackend                 *URLBackendConfig         `yaml:"grpc_proxy,omitempty"`
+	ACProxy                     *ProxyBackendConfig       `yaml:"ac_proxy,omitempty"`
+	CASProxy                    *ProxyBackendConfig       `yaml:"cas_proxy,omitempty"`
 	NumUploaders                int                       `yaml:"num_uploaders"`
 	MaxQueuedUploads            int                       `yaml:"max_queued_uploads"`
 	IdleTimeout                 time.Duration             `yaml:"idle_timeout"`
@@ -122,16 +205,108 @@ type Config struct {
 	ExperimentalRemoteAssetAPI  bool                      `yaml:"experimental_remote_asset_api"`
 	HTTPReadTimeout             time.Duration             `yaml:"http_read_timeout"`
 	HTTPWriteTimeout            time.Duration             `yaml:"http_write_timeout"`
+	HTTPReadHeaderTimeout       time.Duration             `yaml:"http_read_header_timeout"`
+	HTTPIdleTimeout             time.Duration             `yaml:"http_idle_timeout"`
 	AccessLogLevel              string                    `yaml:"access_log_level"`
 	LogTimezone                 string                    `yaml:"log_timezone"`
 	MaxBlobSize                 int64                     `yaml:"max_blob_size"`
 	MaxProxyBlobSize            int64                     `yaml:"max_proxy_blob_size"`
+	RestoreFromS3               bool                      `yaml:"restore_from_s3"`
+	MaxACValidationEntries      int                       `yaml:"max_ac_validation_entries"`
+	DisableRAW                  bool                      `yaml:"disable_raw"`
+	ACWriteOnce                 bool                      `yaml:"ac_write_once"`
+	ZstdLongMode                bool                      `yaml:"zstd_long_mode"`
+	ZstdLevel                   string                    `yaml:"zstd_level"`
+	EnableAdminEndpoints        bool                      `yaml:"enable_admin_endpoints"`
+	ResumableUploadsDir         string                    `yaml:"resumable_uploads_dir"`
+	EnableAC                    bool                      `yaml:"enable_ac"`
+	EnableCAS                   bool                      `yaml:"enable_cas"`
+	EnableByteStream            bool                      `yaml:"enable_bytestream"`
+	EnableInstanceTags          bool                      `yaml:"enable_instance_tags"`
+	FsyncPolicy                 string                    `yaml:"fsync_policy"`
+	MaxTreeDepth                int                       `yaml:"max_tree_depth"`
+	ProtectACDependencies       bool                      `yaml:"protect_ac_dependencies"`
+	AccessLogSampleRate         float64                   `yaml:"access_log_sample_rate"`
+	VerifyOnRead                bool                      `yaml:"verify_on_read"`
+	VerifyOnReadSampleRate      float64                   `yaml:"verify_on_read_sample_rate"`
+	AllowedInstances            []string                  `yaml:"allowed_instances"`
+	DeniedInstances             []string                  `yaml:"denied_instances"`
+	MaxConcurrentProxyDownloads int                       `yaml:"max_concurrent_proxy_downloads"`
+	EnableBloomFilter           bool                      `yaml:"enable_bloom_filter"`
+	TombstoneTTL                time.Duration             `yaml:"tombstone_ttl"`
+	DirLayout                   string                    `yaml:"dir_layout"`
+	StrictACValidation          bool                      `yaml:"strict_ac_validation"`
+	LogClientIdentity           bool                      `yaml:"log_client_identity"`
+	PrefetchACOutputs           bool                      `yaml:"prefetch_ac_outputs"`
+	ServeDuringLoad             bool                      `yaml:"serve_during_load"`
+	MaxReservedFraction         float64                   `yaml:"max_reserved_fraction"`
+	EnableDeepHealthCheck       bool                      `yaml:"enable_deep_health_check"`
+	UnixSocketCleanup           bool                      `yaml:"unix_socket_cleanup"`
+	MaxConcurrentGetTree        int64                     `yaml:"max_concurrent_gettree"`
+	EvictionTrashDir            string                    `yaml:"eviction_trash_dir"`
+	EvictionTrashTTL            time.Duration             `yaml:"eviction_trash_ttl"`
+	ShutdownTimeout             time.Duration             `yaml:"shutdown_timeout"`
+	CompressionBypassSampleSize int                       `yaml:"compression_bypass_sample_size"`
+	Events                      *EventsConfig             `yaml:"events,omitempty"`
+	MaxBatchTotalSize           int64                     `yaml:"max_batch_total_size_bytes"`
+	SynthesizeEmptyTree         bool                      `yaml:"synthesize_empty_tree"`
+	ReadOnly                    bool                      `yaml:"read_only"`
+	MetricsNamespace            string                    `yaml:"metrics_namespace"`
+	DedupeBatchDigests          bool                      `yaml:"dedupe_batch_digests"`
+	EncryptionKeyFile           string                    `yaml:"encryption_key_file"`
+	MetricsDumpFile             string                    `yaml:"metrics_dump_file"`
+	MetricsDumpInterval         time.Duration             `yaml:"metrics_dump_interval"`
+	WriteSizeMismatchCode       string                    `yaml:"write_size_mismatch_code"`
+	GRPCHtpasswdFile            string                    `yaml:"grpc_htpasswd_file"`
+	MaxInlineSize               int64                     `yaml:"max_inline_size"`
+	MaxWritesPerConnection      int                       `yaml:"max_writes_per_connection"`
+	KeepIncompleteFiles         bool                      `yaml:"keep_incomplete_files"`
+	FailOnLRUInconsistency      bool                      `yaml:"fail_on_lru_inconsistency"`
+	HighPriorityClients         []string                  `yaml:"high_priority_clients"`
+	RawContentTypes             bool                      `yaml:"raw_content_types"`
+	MigrationBatchSize          int                       `yaml:"migration_batch_size"`
+	AllowedCIDRs                []string                  `yaml:"allowed_cidrs"`
+	BackpressureThreshold       float64                   `yaml:"backpressure_threshold"`
+	PreserveACExecutionMetadata bool                      `yaml:"preserve_ac_execution_metadata"`
+	AssetFetchRateLimit         float64                   `yaml:"asset_fetch_rate_limit"`
+	AssetFetchPerHostRateLimit  float64                   `yaml:"asset_fetch_per_host_rate_limit"`
+	MaxConcurrentAssetFetches   int64                     `yaml:"max_concurrent_asset_fetches"`
+	StrictProxyErrors           bool                      `yaml:"strict_proxy_errors"`
+	ACValidationConcurrency     int                       `yaml:"ac_validation_concurrency"`
+	NoProxyForAC                bool                      `yaml:"no_proxy_for_ac"`
+	ShutdownWriteWindow         time.Duration             `yaml:"shutdown_write_window"`
+	MaxGetTreeTotalBytes        int64                     `yaml:"max_gettree_total_bytes"`
+	TempDir                     string                    `yaml:"temp_dir"`
+	DiskWriteRetries            int                       `yaml:"disk_write_retries"`
+	DiskWriteRetryErrnos        []string                  `yaml:"disk_write_retry_errnos"`
+	MetricsAddress              string                    `yaml:"metrics_address"`
+	MetricsHtpasswdFile         string                    `yaml:"metrics_htpasswd_file"`
+	EvictionRemovalConcurrency  int                       `yaml:"eviction_removal_concurrency"`
+	MaxACInlineSize             int64                     `yaml:"max_ac_inline_size"`
+	StartupVerifySample         int                       `yaml:"startup_verify_sample"`
+	StartupVerifyEvict          bool                      `yaml:"startup_verify_evict"`
+	MinResponseCompressSize     int64                     `yaml:"min_response_compress_size"`
+	DrainProxyUploadsOnShutdown time.Duration             `yaml:"drain_proxy_uploads_on_shutdown"`
+	ZstdMaxSize                 int64                     `yaml:"zstd_max_size"`
+	TLSSessionTicketKeyFile     string                    `yaml:"tls_session_ticket_key_file"`
+	MaxACOutputFiles            int                       `yaml:"max_ac_output_files"`
+	MaxACOutputDirectories      int                       `yaml:"max_ac_output_directories"`
+	MaxACSymlinks               int                       `yaml:"max_ac_symlinks"`
+	ResumableUploadsMaxSize     int64                     `yaml:"resumable_uploads_max_size"`
+	ResumableUploadsTTL         time.Duration             `yaml:"resumable_uploads_ttl"`
 
 	// Fields that are created by combinations of the flags above.
-	ProxyBackend cache.Proxy
-	TLSConfig    *tls.Config
-	AccessLogger *log.Logger
-	ErrorLogger  *log.Logger
+	ProxyBackend    cache.Proxy
+	ACProxyBackend  cache.Proxy // Overrides ProxyBackend for AC items, if set.
+	CASProxyBackend cache.Proxy // Overrides ProxyBackend for CAS items, if set.
+
+	// True if the proxy backend used for CAS items stores uncompressed
+	// blobs, while the local cache stores compressed blobs.
+	UncompressedCASProxy bool
+	TLSConfig            *tls.Config
+	TLSSessionTicketKeys *SessionTicketKeys // Non-nil if TLSSessionTicketKeyFile is set.
+	AccessLogger         cache.Logger
+	ErrorLogger          *log.Logger
 }
 
 type YamlConfig struct {
@@ -150,6 +325,12 @@ type YamlConfig struct {
 
 const disabledGRPCListener = "none"
 
+// A valid prefix for prometheus metric names.
+var validMetricsNamespace = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// The default maximum number of cached LDAP authentication results.
+const defaultLDAPCacheMaxEntries = 10000
+
 var defaultDurationBuckets = []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320}
 
 // newFromArgs returns a validated Config with the specified values, and
@@ -180,10 +361,95 @@ func newFromArgs(dir string, maxSize int, storageMode string, zstdImplementation
 	experimentalRemoteAssetAPI bool,
 	httpReadTimeout time.Duration,
 	httpWriteTimeout time.Duration,
+	httpReadHeaderTimeout time.Duration,
+	httpIdleTimeout time.Duration,
 	accessLogLevel string,
 	logTimezone string,
 	maxBlobSize int64,
-	maxProxyBlobSize int64) (*Config, error) {
+	maxProxyBlobSize int64,
+	restoreFromS3 bool,
+	maxACValidationEntries int,
+	disableRAW bool,
+	acWriteOnce bool,
+	zstdLongMode bool,
+	zstdLevel string,
+	enableAdminEndpoints bool,
+	resumableUploadsDir string,
+	enableAC bool,
+	enableCAS bool,
+	enableByteStream bool,
+	enableInstanceTags bool,
+	fsyncPolicy string,
+	maxTreeDepth int,
+	protectACDependencies bool,
+	accessLogSampleRate float64,
+	verifyOnRead bool,
+	verifyOnReadSampleRate float64,
+	allowedInstances []string,
+	deniedInstances []string,
+	maxConcurrentProxyDownloads int,
+	enableBloomFilter bool,
+	tombstoneTTL time.Duration,
+	dirLayout string,
+	strictACValidation bool,
+	logClientIdentity bool,
+	prefetchACOutputs bool,
+	serveDuringLoad bool,
+	maxReservedFraction float64,
+	enableDeepHealthCheck bool,
+	unixSocketCleanup bool,
+	maxConcurrentGetTree int64,
+	evictionTrashDir string,
+	evictionTrashTTL time.Duration,
+	shutdownTimeout time.Duration,
+	compressionBypassSampleSize int,
+	events *EventsConfig,
+	maxBatchTotalSize int64,
+	synthesizeEmptyTree bool,
+	readOnly bool,
+	metricsNamespace string,
+	dedupeBatchDigests bool,
+	encryptionKeyFile string,
+	metricsDumpFile string,
+	metricsDumpInterval time.Duration,
+	writeSizeMismatchCode string,
+	grpcHtpasswdFile string,
+	maxInlineSize int64,
+	maxWritesPerConnection int,
+	keepIncompleteFiles bool,
+	failOnLRUInconsistency bool,
+	highPriorityClients []string,
+	rawContentTypes bool,
+	migrationBatchSize int,
+	allowedCIDRs []string,
+	backpressureThreshold float64,
+	preserveACExecutionMetadata bool,
+	assetFetchRateLimit float64,
+	assetFetchPerHostRateLimit float64,
+	maxConcurrentAssetFetches int64,
+	strictProxyErrors bool,
+	acValidationConcurrency int,
+	noProxyForAC bool,
+	shutdownWriteWindow time.Duration,
+	maxGetTreeTotalBytes int64,
+	tempDir string,
+	diskWriteRetries int,
+	diskWriteRetryErrnos []string,
+	metricsAddress string,
+	metricsHtpasswdFile string,
+	evictionRemovalConcurrency int,
+	maxACInlineSize int64,
+	startupVerifySample int,
+	startupVerifyEvict bool,
+	minResponseCompressSize int64,
+	drainProxyUploadsOnShutdown time.Duration,
+	zstdMaxSize int64,
+	tlsSessionTicketKeyFile string,
+	maxACOutputFiles int,
+	maxACOutputDirectories int,
+	maxACSymlinks int,
+	resumableUploadsMaxSize int64,
+	resumableUploadsTTL time.Duration) (*Config, error) {
 
 	c := Config{
 		HTTPAddress:                 httpAddress,
@@ -217,13 +483,103 @@ func newFromArgs(dir string, maxSize int, storageMode string, zstdImplementation
 		ExperimentalRemoteAssetAPI:  experimentalRemoteAssetAPI,
 		HTTPReadTimeout:             httpReadTimeout,
 		HTTPWriteTimeout:            httpWriteTimeout,
+		HTTPReadHeaderTimeout:       httpReadHeaderTimeout,
+		HTTPIdleTimeout:             httpIdleTimeout,
 		AccessLogLevel:              accessLogLevel,
 		LogTimezone:                 logTimezone,
 		MaxBlobSize:                 maxBlobSize,
 		MaxProxyBlobSize:            maxProxyBlobSize,
+		RestoreFromS3:               restoreFromS3,
+		MaxACValidationEntries:      maxACValidationEntries,
+		DisableRAW:                  disableRAW,
+		ACWriteOnce:                 acWriteOnce,
+		ZstdLongMode:                zstdLongMode,
+		ZstdLevel:                   zstdLevel,
+		EnableAdminEndpoints:        enableAdminEndpoints,
+		ResumableUploadsDir:         resumableUploadsDir,
+		EnableAC:                    enableAC,
+		EnableCAS:                   enableCAS,
+		EnableByteStream:            enableByteStream,
+		EnableInstanceTags:          enableInstanceTags,
+		FsyncPolicy:                 fsyncPolicy,
+		MaxTreeDepth:                maxTreeDepth,
+		ProtectACDependencies:       protectACDependencies,
+		AccessLogSampleRate:         accessLogSampleRate,
+		VerifyOnRead:                verifyOnRead,
+		VerifyOnReadSampleRate:      verifyOnReadSampleRate,
+		AllowedInstances:            allowedInstances,
+		DeniedInstances:             deniedInstances,
+		MaxConcurrentProxyDownloads: maxConcurrentProxyDownloads,
+		EnableBloomFilter:           enableBloomFilter,
+		TombstoneTTL:                tombstoneTTL,
+		DirLayout:                   dirLayout,
+		StrictACValidation:          strictACValidation,
+		LogClientIdentity:           logClientIdentity,
+		PrefetchACOutputs:           prefetchACOutputs,
+		ServeDuringLoad:             serveDuringLoad,
+		MaxReservedFraction:         maxReservedFraction,
+		EnableDeepHealthCheck:       enableDeepHealthCheck,
+		UnixSocketCleanup:           unixSocketCleanup,
+		MaxConcurrentGetTree:        maxConcurrentGetTree,
+		EvictionTrashDir:            evictionTrashDir,
+		EvictionTrashTTL:            evictionTrashTTL,
+		ShutdownTimeout:             shutdownTimeout,
+		CompressionBypassSampleSize: compressionBypassSampleSize,
+		Events:                      events,
+		MaxBatchTotalSize:           maxBatchTotalSize,
+		SynthesizeEmptyTree:         synthesizeEmptyTree,
+		ReadOnly:                    readOnly,
+		MetricsNamespace:            metricsNamespace,
+		DedupeBatchDigests:          dedupeBatchDigests,
+		EncryptionKeyFile:           encryptionKeyFile,
+		MetricsDumpFile:             metricsDumpFile,
+		MetricsDumpInterval:         metricsDumpInterval,
+		WriteSizeMismatchCode:       writeSizeMismatchCode,
+		GRPCHtpasswdFile:            grpcHtpasswdFile,
+		MaxInlineSize:               maxInlineSize,
+		MaxWritesPerConnection:      maxWritesPerConnection,
+		KeepIncompleteFiles:         keepIncompleteFiles,
+		FailOnLRUInconsistency:      failOnLRUInconsistency,
+		HighPriorityClients:         highPriorityClients,
+		RawContentTypes:             rawContentTypes,
+		MigrationBatchSize:          migrationBatchSize,
+		AllowedCIDRs:                allowedCIDRs,
+		BackpressureThreshold:       backpressureThreshold,
+		PreserveACExecutionMetadata: preserveACExecutionMetadata,
+		AssetFetchRateLimit:         assetFetchRateLimit,
+		AssetFetchPerHostRateLimit:  assetFetchPerHostRateLimit,
+		MaxConcurrentAssetFetches:   maxConcurrentAssetFetches,
+		StrictProxyErrors:           strictProxyErrors,
+		ACValidationConcurrency:     acValidationConcurrency,
+		NoProxyForAC:                noProxyForAC,
+		ShutdownWriteWindow:         shutdownWriteWindow,
+		MaxGetTreeTotalBytes:        maxGetTreeTotalBytes,
+		TempDir:                     tempDir,
+		DiskWriteRetries:            diskWriteRetries,
+		DiskWriteRetryErrnos:        diskWriteRetryErrnos,
+		MetricsAddress:              metricsAddress,
+		MetricsHtpasswdFile:         metricsHtpasswdFile,
+		EvictionRemovalConcurrency:  evictionRemovalConcurrency,
+		MaxACInlineSize:             maxACInlineSize,
+		StartupVerifySample:         startupVerifySample,
+		StartupVerifyEvict:          startupVerifyEvict,
+		MinResponseCompressSize:     minResponseCompressSize,
+		DrainProxyUploadsOnShutdown: drainProxyUploadsOnShutdown,
+		ZstdMaxSize:                 zstdMaxSize,
+		TLSSessionTicketKeyFile:     tlsSessionTicketKeyFile,
+		MaxACOutputFiles:            maxACOutputFiles,
+		MaxACOutputDirectories:      maxACOutputDirectories,
+		MaxACSymlinks:               maxACSymlinks,
+		ResumableUploadsMaxSize:     resumableUploadsMaxSize,
+		ResumableUploadsTTL:         resumableUploadsTTL,
 	}
 
-	err := validateConfig(&c)
+	err := c.readSecretFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateConfig(&c)
 	if err != nil {
 		return nil, err
 	}
@@ -251,16 +607,29 @@ func newFromYamlFile(path string) (*Config, error) {
 func NewFromYaml(data []byte) (*Config, error) {
 	yc := YamlConfig{
 		Config: Config{
-			StorageMode:            "zstd",
-			ZstdImplementation:     "go",
-			NumUploaders:           100,
-			MinTLSVersion:          "1.0",
-			MaxQueuedUploads:       1000000,
-			MaxBlobSize:            math.MaxInt64,
-			MaxProxyBlobSize:       math.MaxInt64,
-			MetricsDurationBuckets: defaultDurationBuckets,
-			AccessLogLevel:         "all",
-			LogTimezone:            "UTC",
+			StorageMode:             "zstd",
+			DirLayout:               "two-char-prefix",
+			ZstdImplementation:      "go",
+			ZstdLevel:               "fastest",
+			NumUploaders:            100,
+			MinTLSVersion:           "1.0",
+			MaxQueuedUploads:        1000000,
+			MaxBlobSize:             math.MaxInt64,
+			MaxProxyBlobSize:        math.MaxInt64,
+			MetricsDurationBuckets:  defaultDurationBuckets,
+			AccessLogLevel:          "all",
+			LogTimezone:             "UTC",
+			EnableAC:                true,
+			EnableCAS:               true,
+			EnableByteStream:        true,
+			FsyncPolicy:             "always",
+			VerifyOnReadSampleRate:  1,
+			EvictionTrashTTL:        time.Hour,
+			MetricsDumpInterval:     time.Minute,
+			WriteSizeMismatchCode:   "invalid_argument",
+			MaxInlineSize:           3 * 1024 * 1024,
+			ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+			ResumableUploadsTTL:     time.Hour,
 		},
 	}
 
@@ -286,6 +655,11 @@ func NewFromYaml(data []byte) (*Config, error) {
 		sort.Float64s(c.MetricsDurationBuckets)
 	}
 
+	err = c.readSecretFiles()
+	if err != nil {
+		return nil, err
+	}
+
 	err = validateConfig(&c)
 	if err != nil {
 		return nil, err
@@ -294,6 +668,15 @@ func NewFromYaml(data []byte) (*Config, error) {
 	return &c, nil
 }
 
+// isSubdir returns true if dir is the same as parent, or inside it.
+func isSubdir(dir string, parent string) bool {
+	rel, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(dir))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, "../"))
+}
+
 func validateConfig(c *Config) error {
 	if c.Dir == "" {
 		return errors.New("The 'dir' flag/key is required")
@@ -306,29 +689,37 @@ func validateConfig(c *Config) error {
 	if c.StorageMode != "zstd" && c.StorageMode != "uncompressed" {
 		return errors.New("storage_mode must be set to either \"zstd\" or \"uncompressed\"")
 	}
+
+	if c.DirLayout != "two-char-prefix" && c.DirLayout != "flat" {
+		return errors.New("The 'dir_layout' flag/key must be set to either \"two-char-prefix\" or \"flat\"")
+	}
+	if !zstdimpl.ValidLevel(c.ZstdLevel) {
+		return errors.New("zstd_level must be set to one of \"fastest\", \"default\", \"better\" or \"best\", got: " + c.ZstdLevel)
+	}
+
 	if c.ZstdImplementation != "go" && c.ZstdImplementation != "cgo" {
 		return errors.New("zstd_implementation must be set to either \"go\" or \"cgo\", got: " + c.ZstdImplementation)
 	}
 
-	proxyCount := 0
-	if c.S3CloudStorage != nil {
-		proxyCount++
-	}
-	if c.HTTPBackend != nil {
-		proxyCount++
+	if c.EncryptionKeyFile != "" && c.StorageMode != "zstd" {
+		return errors.New("The 'encryption_key_file' flag/key requires storage_mode zstd")
 	}
-	if c.GoogleCloudStorage != nil {
-		proxyCount++
+
+	defaultProxy := c.defaultProxyBackendConfig()
+	if defaultProxy.numBackends() > 1 {
+		return errors.New("At most one of the S3/GCS/HTTP proxy backends is allowed")
 	}
-	if c.AzBlobConfig != nil {
-		proxyCount++
+
+	if c.ACProxy != nil && c.ACProxy.numBackends() != 1 {
+		return errors.New("Exactly one proxy backend must be specified in 'ac_proxy'")
 	}
-	if c.GRPCBackend != nil {
-		proxyCount++
+
+	if c.CASProxy != nil && c.CASProxy.numBackends() != 1 {
+		return errors.New("Exactly one proxy backend must be specified in 'cas_proxy'")
 	}
 
-	if proxyCount > 1 {
-		return errors.New("At most one of the S3/GCS/HTTP proxy backends is allowed")
+	if c.ACProxy != nil && c.CASProxy != nil && defaultProxy.numBackends() > 0 {
+		return errors.New("A top-level proxy backend is unused when both 'ac_proxy' and 'cas_proxy' are specified")
 	}
 
 	var httpPort string
@@ -373,11 +764,27 @@ func validateConfig(c *Config) error {
 		return errors.New("Remote Asset API support depends on gRPC being enabled")
 	}
 
+	if c.MaxConcurrentAssetFetches < 0 {
+		return errors.New("The 'max_concurrent_asset_fetches' flag/key must be a non-negative integer")
+	}
+
+	if c.AssetFetchRateLimit < 0 {
+		return errors.New("The 'asset_fetch_rate_limit' flag/key must not be negative")
+	}
+
+	if c.AssetFetchPerHostRateLimit < 0 {
+		return errors.New("The 'asset_fetch_per_host_rate_limit' flag/key must not be negative")
+	}
+
 	if (c.TLSCertFile != "" && c.TLSKeyFile == "") || (c.TLSCertFile == "" && c.TLSKeyFile != "") {
 		return errors.New("When enabling TLS one must specify both " +
 			"'tls_key_file' and 'tls_cert_file'")
 	}
 
+	if c.TLSSessionTicketKeyFile != "" && c.TLSCertFile == "" {
+		return errors.New("The 'tls_session_ticket_key_file' flag/key requires 'tls_cert_file' and 'tls_key_file'")
+	}
+
 	if c.TLSCaFile != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
 		return errors.New("When enabling mTLS (authenticating client " +
 			"certificates) the server must have it's own 'tls_key_file' " +
@@ -388,73 +795,235 @@ func validateConfig(c *Config) error {
 		return errors.New("AllowUnauthenticatedReads setting is only available when authentication is enabled")
 	}
 
-	if c.MaxBlobSize <= 0 {
-		return errors.New("The 'max_blob_size' flag/key must be a positive integer")
+	if c.EnableAdminEndpoints && c.TLSCaFile == "" && c.HtpasswdFile == "" && c.LDAP == nil {
+		return errors.New("The 'enable_admin_endpoints' flag/key is only available when authentication is enabled")
 	}
 
-	if c.MaxProxyBlobSize <= 0 {
-		return errors.New("The 'max_proxy_blob_size' flag/key must be a positive integer")
+	if c.EnableDeepHealthCheck && c.TLSCaFile == "" && c.HtpasswdFile == "" && c.LDAP == nil {
+		return errors.New("The 'enable_deep_health_check' flag/key is only available when authentication is enabled")
 	}
 
-	if c.GoogleCloudStorage != nil && c.HTTPBackend != nil && c.S3CloudStorage != nil {
-		return errors.New("One can specify at most one proxying backend")
+	switch c.FsyncPolicy {
+	case "always", "never", "batch":
+	default:
+		return fmt.Errorf("The 'fsync_policy' flag/key must be one of \"always\", \"never\" or \"batch\", found: %q", c.FsyncPolicy)
 	}
 
-	if c.GoogleCloudStorage != nil {
-		if c.GoogleCloudStorage.Bucket == "" {
-			return errors.New("The 'bucket' field is required for 'gcs_proxy'")
-		}
+	if c.EnableInstanceTags && !c.EnableAdminEndpoints {
+		return errors.New("The 'enable_instance_tags' flag/key requires 'enable_admin_endpoints'")
 	}
 
-	if c.HTTPBackend != nil {
-		if err := c.HTTPBackend.validate("http"); err != nil {
-			return err
-		}
+	if c.MaxInlineSize < 0 {
+		return errors.New("The 'max_inline_size' flag/key must be a non-negative integer")
 	}
 
-	if c.GRPCBackend != nil {
-		if err := c.GRPCBackend.validate("grpc"); err != nil {
-			return err
-		}
+	if c.MaxACInlineSize < 0 {
+		return errors.New("The 'max_ac_inline_size' flag/key must be a non-negative integer")
 	}
 
-	if c.S3CloudStorage != nil {
-		if !s3proxy.IsValidAuthMethod(c.S3CloudStorage.AuthMethod) {
-			return fmt.Errorf("invalid s3.auth_method: %s", c.S3CloudStorage.AuthMethod)
-		}
+	if c.MaxACOutputFiles < 0 {
+		return errors.New("The 'max_ac_output_files' flag/key must be a non-negative integer")
+	}
 
-		if c.S3CloudStorage.KeyVersion != nil && *c.S3CloudStorage.KeyVersion != 2 {
-			return fmt.Errorf("s3.key_version (deprecated) must be 2, found %d", c.S3CloudStorage.KeyVersion)
+	if c.MaxACOutputDirectories < 0 {
+		return errors.New("The 'max_ac_output_directories' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxACSymlinks < 0 {
+		return errors.New("The 'max_ac_symlinks' flag/key must be a non-negative integer")
+	}
+
+	switch c.WriteSizeMismatchCode {
+	case "invalid_argument", "data_loss", "aborted", "unknown":
+	default:
+		return fmt.Errorf("The 'write_size_mismatch_code' flag/key must be one of \"invalid_argument\", \"data_loss\", \"aborted\" or \"unknown\", found: %q", c.WriteSizeMismatchCode)
+	}
+
+	if c.BackpressureThreshold < 0 || c.BackpressureThreshold >= 1 {
+		return errors.New("The 'backpressure_threshold' flag/key must be at least 0 and less than 1")
+	}
+
+	for _, cidr := range c.AllowedCIDRs {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("The 'allowed_cidrs' flag/key contains an invalid CIDR: %q", cidr)
 		}
+	}
 
-		if c.S3CloudStorage.BucketLookupType != "" && c.S3CloudStorage.BucketLookupType != "auto" &&
-			c.S3CloudStorage.BucketLookupType != "dns" && c.S3CloudStorage.BucketLookupType != "path" {
-			return fmt.Errorf("s3.bucket_lookup_type must be one of: \"auto\", \"dns\", \"path\" or empty/unspecified, found: \"%s\"",
-				c.S3CloudStorage.BucketLookupType)
+	if c.MetricsDumpFile != "" && c.MetricsDumpInterval <= 0 {
+		return errors.New("The 'metrics_dump_interval' flag/key must be set to a value > 0")
+	}
+
+	if c.MetricsNamespace != "" {
+		if !c.EnableEndpointMetrics {
+			return errors.New("The 'metrics_namespace' flag/key requires 'enable_endpoint_metrics'")
+		}
+		if !validMetricsNamespace.MatchString(c.MetricsNamespace) {
+			return fmt.Errorf("Invalid 'metrics_namespace' %q, it must start with a letter or underscore and contain only letters, digits and underscores", c.MetricsNamespace)
 		}
+	}
+
+	if c.MetricsAddress != "" && !c.EnableEndpointMetrics {
+		return errors.New("The 'metrics_address' flag/key requires 'enable_endpoint_metrics'")
+	}
+
+	if c.MetricsHtpasswdFile != "" && c.MetricsAddress == "" {
+		return errors.New("The 'metrics_htpasswd_file' flag/key requires 'metrics_address' to be set")
+	}
 
-		if c.S3CloudStorage.SignatureType != "" && c.S3CloudStorage.SignatureType != "v2" &&
-			c.S3CloudStorage.SignatureType != "v4" && c.S3CloudStorage.SignatureType != "v4streaming" &&
-			c.S3CloudStorage.SignatureType != "anonymous" {
-			return fmt.Errorf("s3.signature_type must be one of: \"v2\", \"v4\", \"v4streaming\", \"anonymous\" or empty/unspecified, found: \"%s\"",
-				c.S3CloudStorage.SignatureType)
+	if c.ResumableUploadsDir != "" {
+		if isSubdir(c.ResumableUploadsDir, c.Dir) || isSubdir(c.Dir, c.ResumableUploadsDir) {
+			return errors.New("The 'resumable_uploads_dir' flag/key must not be inside the cache directory or contain it")
+		}
+		if c.ResumableUploadsMaxSize < 0 {
+			return errors.New("The 'resumable_uploads_max_size' flag/key must be a non-negative integer")
+		}
+		if c.ResumableUploadsTTL < 0 {
+			return errors.New("The 'resumable_uploads_ttl' flag/key must not be negative")
 		}
 	}
 
-	if c.AzBlobConfig != nil {
-		if c.AzBlobConfig.StorageAccount == "" {
-			return errors.New("The 'storage_account' field is required for 'azblob_proxy'")
+	if c.TempDir != "" && isSubdir(c.TempDir, c.Dir) {
+		return errors.New("The 'temp_dir' flag/key must not be inside the cache directory")
+	}
+
+	if c.EvictionRemovalConcurrency < 0 {
+		return errors.New("The 'eviction_removal_concurrency' flag/key must be non-negative")
+	}
+
+	if c.DiskWriteRetries < 0 {
+		return errors.New("The 'disk_write_retries' flag/key must be non-negative")
+	}
+
+	if c.EvictionTrashDir != "" {
+		if isSubdir(c.EvictionTrashDir, c.Dir) || isSubdir(c.Dir, c.EvictionTrashDir) {
+			return errors.New("The 'eviction_trash_dir' flag/key must not be inside the cache directory or contain it")
 		}
+		if c.EvictionTrashTTL <= 0 {
+			return errors.New("The 'eviction_trash_ttl' flag/key must be a positive duration")
+		}
+	}
 
-		if c.AzBlobConfig.ContainerName == "" {
-			return errors.New("The 'container_name' field is required for 'azblob_proxy'")
+	if c.MaxBlobSize <= 0 {
+		return errors.New("The 'max_blob_size' flag/key must be a positive integer")
+	}
+
+	if c.MaxProxyBlobSize <= 0 {
+		return errors.New("The 'max_proxy_blob_size' flag/key must be a positive integer")
+	}
+
+	if c.DisableRAW && c.DisableHTTPACValidation {
+		return errors.New("The 'disable_raw' and 'disable_http_ac_validation' flags/keys cannot be used together")
+	}
+
+	if c.DisableRAW && c.RawContentTypes {
+		return errors.New("The 'disable_raw' and 'raw_content_types' flags/keys cannot be used together")
+	}
+
+	if c.MaxACValidationEntries < 0 {
+		return errors.New("The 'max_ac_validation_entries' flag/key must be a non-negative integer")
+	}
+
+	if c.ACValidationConcurrency < 0 {
+		return errors.New("The 'ac_validation_concurrency' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxTreeDepth < 0 {
+		return errors.New("The 'max_tree_depth' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxConcurrentGetTree < 0 {
+		return errors.New("The 'max_concurrent_gettree' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxGetTreeTotalBytes < 0 {
+		return errors.New("The 'max_gettree_total_bytes' flag/key must be a non-negative integer")
+	}
+
+	if c.MigrationBatchSize < 0 {
+		return errors.New("The 'migration_batch_size' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxWritesPerConnection < 0 {
+		return errors.New("The 'max_writes_per_connection' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxBatchTotalSize < 0 {
+		return errors.New("The 'max_batch_total_size_bytes' flag/key must be a non-negative integer")
+	}
+
+	if c.MinResponseCompressSize < 0 {
+		return errors.New("The 'min_response_compress_size' flag/key must be a non-negative integer")
+	}
+
+	if c.MaxConcurrentProxyDownloads < 0 {
+		return errors.New("The 'max_concurrent_proxy_downloads' flag/key must be a non-negative integer")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("The 'shutdown_timeout' flag/key must not be negative")
+	}
+
+	if c.ShutdownWriteWindow < 0 {
+		return errors.New("The 'shutdown_write_window' flag/key must not be negative")
+	}
+
+	if c.DrainProxyUploadsOnShutdown < 0 {
+		return errors.New("The 'drain_proxy_uploads_on_shutdown' flag/key must not be negative")
+	}
+
+	if c.CompressionBypassSampleSize < 0 {
+		return errors.New("The 'compression_bypass_sample_size' flag/key must be a non-negative integer")
+	}
+
+	if c.ZstdMaxSize < 0 {
+		return errors.New("The 'zstd_max_size' flag/key must be a non-negative integer")
+	}
+
+	if c.TombstoneTTL < 0 {
+		return errors.New("The 'tombstone_ttl' flag/key must not be negative")
+	}
+
+	if c.MaxReservedFraction < 0 || c.MaxReservedFraction > 1 {
+		return errors.New("The 'max_reserved_fraction' flag/key must be between 0 and 1")
+	}
+
+	if c.VerifyOnRead && (c.VerifyOnReadSampleRate <= 0 || c.VerifyOnReadSampleRate > 1) {
+		return errors.New("The 'verify_on_read_sample_rate' flag/key must be greater than 0 and at most 1")
+	}
+
+	if c.StartupVerifySample < 0 {
+		return errors.New("The 'startup_verify_sample' flag/key must be non-negative")
+	}
+
+	if c.StartupVerifyEvict && c.StartupVerifySample == 0 {
+		return errors.New("The 'startup_verify_evict' flag/key requires 'startup_verify_sample' to be set")
+	}
+
+	if err := defaultProxy.validate(c.proxyLocalStorageMode()); err != nil {
+		return err
+	}
+
+	if c.ACProxy != nil {
+		if err := c.ACProxy.validate(c.proxyLocalStorageMode()); err != nil {
+			return fmt.Errorf("Invalid 'ac_proxy': %w", err)
 		}
+	}
 
-		if !azblobproxy.IsValidAuthMethod(c.AzBlobConfig.AuthMethod) {
-			return fmt.Errorf("Invalid azblob.auth_method: %s", c.AzBlobConfig.AuthMethod)
+	if c.CASProxy != nil {
+		if err := c.CASProxy.validate(c.proxyLocalStorageMode()); err != nil {
+			return fmt.Errorf("Invalid 'cas_proxy': %w", err)
 		}
 	}
 
+	if c.PrefetchACOutputs && c.NumUploaders <= 0 {
+		return errors.New("The 'prefetch_ac_outputs' flag/key requires 'num_uploaders' to be greater than 0")
+	}
+
+	if c.RestoreFromS3 && c.S3CloudStorage == nil {
+		return errors.New("The 'restore_from_s3' flag/key requires an S3 proxy backend")
+	}
+
 	if c.MetricsDurationBuckets != nil {
 		duplicates := make(map[float64]bool)
 		for _, bucket := range c.MetricsDurationBuckets {
@@ -470,6 +1039,10 @@ func validateConfig(c *Config) error {
 		return errors.New("One can specify at most one authentication mechanism")
 	}
 
+	if c.GRPCHtpasswdFile != "" && c.HtpasswdFile == "" {
+		return errors.New("The 'grpc_htpasswd_file' flag/key requires 'htpasswd_file' to be set")
+	}
+
 	if c.LDAP != nil {
 		if c.LDAP.URL == "" {
 			return errors.New("The 'url' field is required for 'ldap'")
@@ -483,12 +1056,34 @@ func validateConfig(c *Config) error {
 		if c.LDAP.CacheTime <= 0 {
 			c.LDAP.CacheTime = 3600
 		}
+		if c.LDAP.CacheMaxEntries <= 0 {
+			c.LDAP.CacheMaxEntries = defaultLDAPCacheMaxEntries
+		}
+	}
+
+	if c.Events != nil {
+		if c.Events.Type == "" {
+			c.Events.Type = "nats"
+		}
+		if c.Events.Type != "nats" {
+			return fmt.Errorf("Unsupported 'events.type' %q, only \"nats\" is supported", c.Events.Type)
+		}
+		if c.Events.Address == "" {
+			return errors.New("The 'address' field is required for 'events'")
+		}
+		if c.Events.Topic == "" {
+			return errors.New("The 'topic' field is required for 'events'")
+		}
 	}
 
 	switch c.AccessLogLevel {
 	case "none", "all":
+	case "sampled":
+		if c.AccessLogSampleRate <= 0 || c.AccessLogSampleRate > 1 {
+			return errors.New("The 'access_log_sample_rate' flag/key must be greater than 0 and at most 1 when 'access_log_level' is \"sampled\"")
+		}
 	default:
-		return errors.New("'access_log_level' must be set to either \"none\" or \"all\"")
+		return errors.New("'access_log_level' must be set to either \"none\", \"sampled\" or \"all\"")
 	}
 
 	switch c.LogTimezone {
@@ -561,14 +1156,20 @@ func get(ctx *cli.Context) (*Config, error) {
 			AuthMethod:               ctx.String("s3.auth_method"),
 			AccessKeyID:              ctx.String("s3.access_key_id"),
 			SecretAccessKey:          ctx.String("s3.secret_access_key"),
+			SecretAccessKeyFile:      ctx.String("s3.secret_access_key_file"),
 			SessionToken:             ctx.String("s3.session_token"),
+			SessionTokenFile:         ctx.String("s3.session_token_file"),
 			SignatureType:            ctx.String("s3.signature_type"),
 			DisableSSL:               ctx.Bool("s3.disable_ssl"),
 			UpdateTimestamps:         ctx.Bool("s3.update_timestamps"),
+			TagObjectsByKind:         ctx.Bool("s3.tag_objects_by_kind"),
 			IAMRoleEndpoint:          ctx.String("s3.iam_role_endpoint"),
 			Region:                   ctx.String("s3.region"),
 			AWSProfile:               ctx.String("s3.aws_profile"),
 			AWSSharedCredentialsFile: ctx.String("s3.aws_shared_credentials_file"),
+			StoreFormat:              ctx.String("s3.store_format"),
+			ConnectTimeout:           ctx.Duration("s3.connect_timeout"),
+			RequestTimeout:           ctx.Duration("s3.request_timeout"),
 		}
 	}
 
@@ -579,10 +1180,14 @@ func get(ctx *cli.Context) (*Config, error) {
 			return nil, err
 		}
 		hc = &URLBackendConfig{
-			BaseURL:  u,
-			KeyFile:  ctx.String("http_proxy.key_file"),
-			CertFile: ctx.String("http_proxy.cert_file"),
-			CaFile:   ctx.String("http_proxy.ca_file"),
+			BaseURL:        u,
+			KeyFile:        ctx.String("http_proxy.key_file"),
+			CertFile:       ctx.String("http_proxy.cert_file"),
+			CaFile:         ctx.String("http_proxy.ca_file"),
+			StoreFormat:    ctx.String("http_proxy.store_format"),
+			PasswordFile:   ctx.String("http_proxy.password_file"),
+			ConnectTimeout: ctx.Duration("http_proxy.connect_timeout"),
+			RequestTimeout: ctx.Duration("http_proxy.request_timeout"),
 		}
 	}
 
@@ -594,10 +1199,15 @@ func get(ctx *cli.Context) (*Config, error) {
 		}
 
 		grpcb = &URLBackendConfig{
-			BaseURL:  u,
-			KeyFile:  ctx.String("grpc_proxy.key_file"),
-			CertFile: ctx.String("grpc_proxy.cert_file"),
-			CaFile:   ctx.String("grpc_proxy.ca_file"),
+			BaseURL:         u,
+			KeyFile:         ctx.String("grpc_proxy.key_file"),
+			CertFile:        ctx.String("grpc_proxy.cert_file"),
+			CaFile:          ctx.String("grpc_proxy.ca_file"),
+			ForwardMetadata: ctx.StringSlice("grpc_proxy.forward_metadata"),
+			PasswordFile:    ctx.String("grpc_proxy.password_file"),
+			Compression:     ctx.String("grpc_proxy.compression"),
+			ConnectTimeout:  ctx.Duration("grpc_proxy.connect_timeout"),
+			RequestTimeout:  ctx.Duration("grpc_proxy.request_timeout"),
 		}
 	}
 
@@ -607,6 +1217,8 @@ func get(ctx *cli.Context) (*Config, error) {
 			Bucket:                ctx.String("gcs_proxy.bucket"),
 			UseDefaultCredentials: ctx.Bool("gcs_proxy.use_default_credentials"),
 			JSONCredentialsFile:   ctx.String("gcs_proxy.json_credentials_file"),
+			ConnectTimeout:        ctx.Duration("gcs_proxy.connect_timeout"),
+			RequestTimeout:        ctx.Duration("gcs_proxy.request_timeout"),
 		}
 	}
 
@@ -620,9 +1232,13 @@ func get(ctx *cli.Context) (*Config, error) {
 			AuthMethod:       ctx.String("azblob.auth_method"),
 			ClientID:         ctx.String("azblob.client_id"),
 			ClientSecret:     ctx.String("azblob.client_secret"),
+			ClientSecretFile: ctx.String("azblob.client_secret_file"),
 			CertPath:         ctx.String("azblob.cert_path"),
 			SharedKey:        ctx.String("azblob.shared_key"),
+			SharedKeyFile:    ctx.String("azblob.shared_key_file"),
 			UpdateTimestamps: ctx.Bool("azblob.update_timestamps"),
+			ConnectTimeout:   ctx.Duration("azblob.connect_timeout"),
+			RequestTimeout:   ctx.Duration("azblob.request_timeout"),
 		}
 	}
 
@@ -633,9 +1249,20 @@ func get(ctx *cli.Context) (*Config, error) {
 			BaseDN:            ctx.String("ldap.base_dn"),
 			BindUser:          ctx.String("ldap.bind_user"),
 			BindPassword:      ctx.String("ldap.bind_password"),
+			BindPasswordFile:  ctx.String("ldap.bind_password_file"),
 			UsernameAttribute: ctx.String("ldap.username_attribute"),
 			GroupsQuery:       ctx.String("ldap.groups_query"),
 			CacheTime:         ctx.Duration("ldap.cache_time"),
+			CacheMaxEntries:   ctx.Int("ldap.cache_max_entries"),
+		}
+	}
+
+	var events *EventsConfig
+	if ctx.String("events.address") != "" {
+		events = &EventsConfig{
+			Type:    ctx.String("events.type"),
+			Address: ctx.String("events.address"),
+			Topic:   ctx.String("events.topic"),
 		}
 	}
 
@@ -670,9 +1297,94 @@ func get(ctx *cli.Context) (*Config, error) {
 		ctx.Bool("experimental_remote_asset_api"),
 		ctx.Duration("http_read_timeout"),
 		ctx.Duration("http_write_timeout"),
+		ctx.Duration("http_read_header_timeout"),
+		ctx.Duration("http_idle_timeout"),
 		ctx.String("access_log_level"),
 		ctx.String("log_timezone"),
 		ctx.Int64("max_blob_size"),
 		ctx.Int64("max_proxy_blob_size"),
+		ctx.Bool("restore_from_s3"),
+		ctx.Int("max_ac_validation_entries"),
+		ctx.Bool("disable_raw"),
+		ctx.Bool("ac_write_once"),
+		ctx.Bool("zstd_long_mode"),
+		ctx.String("zstd_level"),
+		ctx.Bool("enable_admin_endpoints"),
+		ctx.String("resumable_uploads_dir"),
+		ctx.Bool("enable_ac"),
+		ctx.Bool("enable_cas"),
+		ctx.Bool("enable_bytestream"),
+		ctx.Bool("enable_instance_tags"),
+		ctx.String("fsync_policy"),
+		ctx.Int("max_tree_depth"),
+		ctx.Bool("protect_ac_dependencies"),
+		ctx.Float64("access_log_sample_rate"),
+		ctx.Bool("verify_on_read"),
+		ctx.Float64("verify_on_read_sample_rate"),
+		ctx.StringSlice("allowed_instances"),
+		ctx.StringSlice("denied_instances"),
+		ctx.Int("max_concurrent_proxy_downloads"),
+		ctx.Bool("enable_bloom_filter"),
+		ctx.Duration("tombstone_ttl"),
+		ctx.String("dir_layout"),
+		ctx.Bool("strict_ac_validation"),
+		ctx.Bool("log_client_identity"),
+		ctx.Bool("prefetch_ac_outputs"),
+		ctx.Bool("serve_during_load"),
+		ctx.Float64("max_reserved_fraction"),
+		ctx.Bool("enable_deep_health_check"),
+		ctx.Bool("unix_socket_cleanup"),
+		ctx.Int64("max_concurrent_gettree"),
+		ctx.String("eviction_trash_dir"),
+		ctx.Duration("eviction_trash_ttl"),
+		ctx.Duration("shutdown_timeout"),
+		ctx.Int("compression_bypass_sample_size"),
+		events,
+		ctx.Int64("max_batch_total_size_bytes"),
+		ctx.Bool("synthesize_empty_tree"),
+		ctx.Bool("read_only"),
+		ctx.String("metrics_namespace"),
+		ctx.Bool("dedupe_batch_digests"),
+		ctx.String("encryption_key_file"),
+		ctx.String("metrics_dump_file"),
+		ctx.Duration("metrics_dump_interval"),
+		ctx.String("write_size_mismatch_code"),
+		ctx.String("grpc_htpasswd_file"),
+		ctx.Int64("max_inline_size"),
+		ctx.Int("max_writes_per_connection"),
+		ctx.Bool("keep_incomplete_files"),
+		ctx.Bool("fail_on_lru_inconsistency"),
+		ctx.StringSlice("high_priority_clients"),
+		ctx.Bool("raw_content_types"),
+		ctx.Int("migration_batch_size"),
+		ctx.StringSlice("allowed_cidrs"),
+		ctx.Float64("backpressure_threshold"),
+		ctx.Bool("preserve_ac_execution_metadata"),
+		ctx.Float64("asset_fetch_rate_limit"),
+		ctx.Float64("asset_fetch_per_host_rate_limit"),
+		ctx.Int64("max_concurrent_asset_fetches"),
+		ctx.Bool("strict_proxy_errors"),
+		ctx.Int("ac_validation_concurrency"),
+		ctx.Bool("no_proxy_for_ac"),
+		ctx.Duration("shutdown_write_window"),
+		ctx.Int64("max_gettree_total_bytes"),
+		ctx.String("temp_dir"),
+		ctx.Int("disk_write_retries"),
+		ctx.StringSlice("disk_write_retry_errnos"),
+		ctx.String("metrics_address"),
+		ctx.String("metrics_htpasswd_file"),
+		ctx.Int("eviction_removal_concurrency"),
+		ctx.Int64("max_ac_inline_size"),
+		ctx.Int("startup_verify_sample"),
+		ctx.Bool("startup_verify_evict"),
+		ctx.Int64("min_response_compress_size"),
+		ctx.Duration("drain_proxy_uploads_on_shutdown"),
+		ctx.Int64("zstd_max_size"),
+		ctx.String("tls_session_ticket_key_file"),
+		ctx.Int("max_ac_output_files"),
+		ctx.Int("max_ac_output_directories"),
+		ctx.Int("max_ac_symlinks"),
+		ctx.Int64("resumable_uploads_max_size"),
+		ctx.Duration("resumable_uploads_ttl"),
 	)
 }
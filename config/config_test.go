@@ -1,8 +1,20 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"math"
+	"math/big"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
@@ -27,6 +39,8 @@ enable_endpoint_metrics: true
 experimental_remote_asset_api: true
 http_read_timeout: 5s
 http_write_timeout: 10s
+http_read_header_timeout: 2s
+http_idle_timeout: 1m
 access_log_level: none
 log_timezone: local
 `
@@ -43,6 +57,19 @@ log_timezone: local
 		MaxSize:                     100,
 		StorageMode:                 "zstd",
 		ZstdImplementation:          "go",
+		ZstdLevel:                   "fastest",
+		EnableAC:                    true,
+		EnableCAS:                   true,
+		EnableByteStream:            true,
+		FsyncPolicy:                 "always",
+		DirLayout:                   "two-char-prefix",
+		VerifyOnReadSampleRate:      1,
+		EvictionTrashTTL:            time.Hour,
+		MetricsDumpInterval:         time.Minute,
+		WriteSizeMismatchCode:       "invalid_argument",
+		MaxInlineSize:               3 * 1024 * 1024,
+		ResumableUploadsMaxSize:     10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:         time.Hour,
 		HtpasswdFile:                "/opt/.htpasswd",
 		MinTLSVersion:               "1.0",
 		TLSCertFile:                 "/opt/tls.cert",
@@ -53,6 +80,8 @@ log_timezone: local
 		ExperimentalRemoteAssetAPI:  true,
 		HTTPReadTimeout:             5 * time.Second,
 		HTTPWriteTimeout:            10 * time.Second,
+		HTTPReadHeaderTimeout:       2 * time.Second,
+		HTTPIdleTimeout:             time.Minute,
 		NumUploaders:                100,
 		MaxQueuedUploads:            1000000,
 		MaxBlobSize:                 math.MaxInt64,
@@ -84,12 +113,25 @@ gcs_proxy:
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:        "localhost:8080",
-		GRPCAddress:        "localhost:9092",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             "localhost:8080",
+		GRPCAddress:             "localhost:9092",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 		GoogleCloudStorage: &GoogleCloudStorageConfig{
 			Bucket:                "gcs-bucket",
 			UseDefaultCredentials: false,
@@ -130,12 +172,25 @@ http_proxy:
 		t.Fatal(err)
 	}
 	expectedConfig := &Config{
-		HTTPAddress:        "localhost:8080",
-		GRPCAddress:        "localhost:9092",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             "localhost:8080",
+		GRPCAddress:             "localhost:9092",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 		HTTPBackend: &URLBackendConfig{
 			BaseURL: url,
 		},
@@ -203,11 +258,24 @@ s3_proxy:
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:        "localhost:8080",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             "localhost:8080",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 		S3CloudStorage: &S3CloudStorageConfig{
 			Endpoint:        "minio.example.com:9000",
 			Bucket:          "test-bucket",
@@ -251,11 +319,24 @@ ldap:
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:        "localhost:8080",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             "localhost:8080",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 		LDAP: &LDAPConfig{
 			URL:               "ldap://ldap.example.com",
 			BaseDN:            "OU=My Users,DC=example,DC=com",
@@ -264,6 +345,7 @@ ldap:
 			UsernameAttribute: "sAMAccountName",
 			GroupsQuery:       "(|(memberOf=CN=bazel-users,OU=Groups,OU=My Users,DC=example,DC=com)(memberOf=CN=other-users,OU=Groups2,OU=Alien Users,DC=foo,DC=org))",
 			CacheTime:         3600 * time.Second,
+			CacheMaxEntries:   10000,
 		},
 		NumUploaders:           100,
 		MinTLSVersion:          "1.0",
@@ -293,20 +375,33 @@ profile_address: :7070
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:            "localhost:1234",
-		Dir:                    "/opt/cache-dir",
-		MaxSize:                42,
-		StorageMode:            "zstd",
-		ZstdImplementation:     "go",
-		ProfileAddress:         ":7070",
-		NumUploaders:           100,
-		MinTLSVersion:          "1.0",
-		MaxQueuedUploads:       1000000,
-		MaxBlobSize:            math.MaxInt64,
-		MaxProxyBlobSize:       math.MaxInt64,
-		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
-		AccessLogLevel:         "all",
-		LogTimezone:            "UTC",
+		HTTPAddress:             "localhost:1234",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 42,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
+		ProfileAddress:          ":7070",
+		NumUploaders:            100,
+		MinTLSVersion:           "1.0",
+		MaxQueuedUploads:        1000000,
+		MaxBlobSize:             math.MaxInt64,
+		MaxProxyBlobSize:        math.MaxInt64,
+		MetricsDurationBuckets:  []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+		AccessLogLevel:          "all",
+		LogTimezone:             "UTC",
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -342,19 +437,32 @@ endpoint_metrics_duration_buckets: [.005, .1, 5]
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:            "localhost:1234",
-		Dir:                    "/opt/cache-dir",
-		MaxSize:                42,
-		StorageMode:            "zstd",
-		ZstdImplementation:     "go",
-		MinTLSVersion:          "1.0",
-		NumUploaders:           100,
-		MaxQueuedUploads:       1000000,
-		MaxBlobSize:            math.MaxInt64,
-		MaxProxyBlobSize:       math.MaxInt64,
-		MetricsDurationBuckets: []float64{0.005, 0.1, 5},
-		AccessLogLevel:         "all",
-		LogTimezone:            "UTC",
+		HTTPAddress:             "localhost:1234",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 42,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
+		MinTLSVersion:           "1.0",
+		NumUploaders:            100,
+		MaxQueuedUploads:        1000000,
+		MaxBlobSize:             math.MaxInt64,
+		MaxProxyBlobSize:        math.MaxInt64,
+		MetricsDurationBuckets:  []float64{0.005, 0.1, 5},
+		AccessLogLevel:          "all",
+		LogTimezone:             "UTC",
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -364,14 +472,27 @@ endpoint_metrics_duration_buckets: [.005, .1, 5]
 
 func TestMetricsDurationBucketsNoDuplicates(t *testing.T) {
 	testConfig := &Config{
-		HTTPAddress:            "localhost:8080",
-		MaxSize:                42,
-		MaxBlobSize:            200,
-		MaxProxyBlobSize:       math.MaxInt64,
-		Dir:                    "/opt/cache-dir",
-		StorageMode:            "uncompressed",
-		ZstdImplementation:     "go",
-		MetricsDurationBuckets: []float64{1, 2, 3, 3},
+		HTTPAddress:             "localhost:8080",
+		MaxSize:                 42,
+		MaxBlobSize:             200,
+		MaxProxyBlobSize:        math.MaxInt64,
+		Dir:                     "/opt/cache-dir",
+		StorageMode:             "uncompressed",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
+		MetricsDurationBuckets:  []float64{1, 2, 3, 3},
 	}
 	err := validateConfig(testConfig)
 	if err == nil {
@@ -444,12 +565,25 @@ storage_mode: gzip
 
 func TestHttpGrpcServerPortConflict(t *testing.T) {
 	testConfig := &Config{
-		HTTPAddress:        ":5000",
-		GRPCAddress:        ":5000",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             ":5000",
+		GRPCAddress:             ":5000",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 	}
 	err := validateConfig(testConfig)
 	if err == nil {
@@ -473,20 +607,33 @@ storage_mode: zstd
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:            "localhost:1234",
-		GRPCAddress:            "localhost:5678",
-		Dir:                    "/opt/cache-dir",
-		MaxSize:                42,
-		StorageMode:            "zstd",
-		ZstdImplementation:     "go",
-		NumUploaders:           100,
-		MinTLSVersion:          "1.0",
-		MaxQueuedUploads:       1000000,
-		MaxBlobSize:            math.MaxInt64,
-		MaxProxyBlobSize:       math.MaxInt64,
-		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
-		AccessLogLevel:         "all",
-		LogTimezone:            "UTC",
+		HTTPAddress:             "localhost:1234",
+		GRPCAddress:             "localhost:5678",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 42,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
+		NumUploaders:            100,
+		MinTLSVersion:           "1.0",
+		MaxQueuedUploads:        1000000,
+		MaxBlobSize:             math.MaxInt64,
+		MaxProxyBlobSize:        math.MaxInt64,
+		MetricsDurationBuckets:  []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+		AccessLogLevel:          "all",
+		LogTimezone:             "UTC",
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -507,20 +654,33 @@ storage_mode: zstd
 	}
 
 	expectedConfig := &Config{
-		HTTPAddress:            "unix:///tmp/http.sock",
-		GRPCAddress:            "unix:///tmp/grpc.sock",
-		Dir:                    "/opt/cache-dir",
-		MaxSize:                42,
-		StorageMode:            "zstd",
-		ZstdImplementation:     "go",
-		NumUploaders:           100,
-		MinTLSVersion:          "1.0",
-		MaxQueuedUploads:       1000000,
-		MaxBlobSize:            math.MaxInt64,
-		MaxProxyBlobSize:       math.MaxInt64,
-		MetricsDurationBuckets: []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
-		AccessLogLevel:         "all",
-		LogTimezone:            "UTC",
+		HTTPAddress:             "unix:///tmp/http.sock",
+		GRPCAddress:             "unix:///tmp/grpc.sock",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 42,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
+		NumUploaders:            100,
+		MinTLSVersion:           "1.0",
+		MaxQueuedUploads:        1000000,
+		MaxBlobSize:             math.MaxInt64,
+		MaxProxyBlobSize:        math.MaxInt64,
+		MetricsDurationBuckets:  []float64{.5, 1, 2.5, 5, 10, 20, 40, 80, 160, 320},
+		AccessLogLevel:          "all",
+		LogTimezone:             "UTC",
 	}
 
 	if !cmp.Equal(config, expectedConfig) {
@@ -530,11 +690,24 @@ storage_mode: zstd
 
 func TestSocketPathMissing(t *testing.T) {
 	testConfig := &Config{
-		HTTPAddress:        "unix://",
-		Dir:                "/opt/cache-dir",
-		MaxSize:            100,
-		StorageMode:        "zstd",
-		ZstdImplementation: "go",
+		HTTPAddress:             "unix://",
+		Dir:                     "/opt/cache-dir",
+		MaxSize:                 100,
+		StorageMode:             "zstd",
+		ZstdImplementation:      "go",
+		ZstdLevel:               "fastest",
+		EnableAC:                true,
+		EnableCAS:               true,
+		EnableByteStream:        true,
+		FsyncPolicy:             "always",
+		DirLayout:               "two-char-prefix",
+		VerifyOnReadSampleRate:  1,
+		EvictionTrashTTL:        time.Hour,
+		MetricsDumpInterval:     time.Minute,
+		WriteSizeMismatchCode:   "invalid_argument",
+		MaxInlineSize:           3 * 1024 * 1024,
+		ResumableUploadsMaxSize: 10 * 1024 * 1024 * 1024,
+		ResumableUploadsTTL:     time.Hour,
 	}
 	err := validateConfig(testConfig)
 	if err == nil {
@@ -544,3 +717,800 @@ func TestSocketPathMissing(t *testing.T) {
 		t.Fatal("Expected the error message to mention the missing 'http_address' key/flag")
 	}
 }
+
+func TestRestoreFromS3RequiresS3Proxy(t *testing.T) {
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+restore_from_s3: true
+`
+	_, err := NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error because no s3 proxy backend was specified")
+	}
+	if !strings.Contains(err.Error(), "'restore_from_s3'") {
+		t.Fatal("Expected the error message to mention the 'restore_from_s3' key/flag")
+	}
+}
+
+func TestInvalidZstdLevel(t *testing.T) {
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+zstd_level: ultra
+`
+	_, err := NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Fatal("Expected an error because of the invalid zstd_level")
+	}
+	if !strings.Contains(err.Error(), "zstd_level") {
+		t.Fatal("Expected the error message to mention zstd_level")
+	}
+}
+
+func TestValidPerKindProxyConfig(t *testing.T) {
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+ac_proxy:
+  http_proxy:
+    url: http://ac-cache.com:8080/cache
+gcs_proxy:
+  bucket: cas-bucket
+  use_default_credentials: true
+`
+	config, err := NewFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := url.Parse("http://ac-cache.com:8080/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedACProxy := &ProxyBackendConfig{
+		HTTPBackend: &URLBackendConfig{
+			BaseURL: url,
+		},
+	}
+	if !cmp.Equal(config.ACProxy, expectedACProxy) {
+		t.Fatalf("Expected '%+v' but got '%+v'", expectedACProxy, config.ACProxy)
+	}
+	if config.CASProxy != nil {
+		t.Fatalf("Expected no 'cas_proxy', got '%+v'", config.CASProxy)
+	}
+}
+
+func TestInvalidPerKindProxyConfig(t *testing.T) {
+	testCases := map[string]string{
+		"empty": `
+cas_proxy: {}
+`,
+		"multiple backends": `
+cas_proxy:
+  gcs_proxy:
+    bucket: cas-bucket
+  http_proxy:
+    url: http://cas-cache.com:8080/cache
+`,
+		"invalid backend": `
+ac_proxy:
+  gcs_proxy:
+    use_default_credentials: true
+`,
+		"unused default": `
+ac_proxy:
+  http_proxy:
+    url: http://ac-cache.com:8080/cache
+cas_proxy:
+  http_proxy:
+    url: http://cas-cache.com:8080/cache
+gcs_proxy:
+  bucket: unused-bucket
+`,
+	}
+
+	for name, proxyYaml := range testCases {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100` + proxyYaml
+
+		_, err := NewFromYaml([]byte(yaml))
+		if err == nil {
+			t.Errorf("Expected an error for the %q test case", name)
+		}
+	}
+}
+
+func TestProxyStoreFormat(t *testing.T) {
+	testCases := []struct {
+		yaml  string
+		valid bool
+	}{
+		{`
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  store_format: identity
+`, true},
+		{`
+storage_mode: uncompressed
+s3_proxy:
+  endpoint: minio.example.com:9000
+  bucket: test-bucket
+  auth_method: iam_role
+  store_format: identity
+`, true},
+		{`
+storage_mode: uncompressed
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  store_format: casblob-zstd
+`, false},
+		{`
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  store_format: gzip
+`, false},
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  store_format: identity
+`, false},
+	}
+
+	for _, tc := range testCases {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100` + tc.yaml
+
+		_, err := NewFromYaml([]byte(yaml))
+		if tc.valid && err != nil {
+			t.Errorf("Unexpected error for config %q: %v", tc.yaml, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected an error for config %q", tc.yaml)
+		}
+	}
+}
+
+func TestGRPCProxyCompression(t *testing.T) {
+	testCases := []struct {
+		yaml  string
+		valid bool
+	}{
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  compression: zstd
+`, true},
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  compression: identity
+`, true},
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  compression: gzip
+`, false},
+		{`
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  compression: zstd
+`, false},
+	}
+
+	for _, tc := range testCases {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100` + tc.yaml
+
+		_, err := NewFromYaml([]byte(yaml))
+		if tc.valid && err != nil {
+			t.Errorf("Unexpected error for config %q: %v", tc.yaml, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected an error for config %q", tc.yaml)
+		}
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	testCases := []struct {
+		yaml  string
+		valid bool
+	}{
+		{`
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  connect_timeout: 10s
+  request_timeout: 5m
+`, true},
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  request_timeout: 1m
+`, true},
+		{`
+s3_proxy:
+  endpoint: minio.example.com:9000
+  bucket: test-bucket
+  auth_method: iam_role
+  connect_timeout: 5s
+`, true},
+		{`
+gcs_proxy:
+  bucket: gcs-bucket
+  use_default_credentials: true
+  request_timeout: 30s
+`, true},
+		{`
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  connect_timeout: -1s
+`, false},
+		{`
+grpc_proxy:
+  url: grpc://remote-cache.com:9092
+  request_timeout: -1m
+`, false},
+		{`
+s3_proxy:
+  endpoint: minio.example.com:9000
+  bucket: test-bucket
+  auth_method: iam_role
+  request_timeout: -5s
+`, false},
+		{`
+gcs_proxy:
+  bucket: gcs-bucket
+  use_default_credentials: true
+  connect_timeout: -30s
+`, false},
+	}
+
+	for _, tc := range testCases {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100` + tc.yaml
+
+		_, err := NewFromYaml([]byte(yaml))
+		if tc.valid && err != nil {
+			t.Errorf("Unexpected error for config %q: %v", tc.yaml, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected an error for config %q", tc.yaml)
+		}
+	}
+
+	config, err := NewFromYaml([]byte(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+http_proxy:
+  url: http://remote-cache.com:8080/cache
+  connect_timeout: 10s
+  request_timeout: 5m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HTTPBackend.ConnectTimeout != 10*time.Second {
+		t.Errorf("Expected connect_timeout 10s, got %v", config.HTTPBackend.ConnectTimeout)
+	}
+	if config.HTTPBackend.RequestTimeout != 5*time.Minute {
+		t.Errorf("Expected request_timeout 5m, got %v", config.HTTPBackend.RequestTimeout)
+	}
+}
+
+func TestResumableUploadsDir(t *testing.T) {
+	tcs := map[string]bool{
+		"/opt/partial-uploads":         true,
+		"/opt/cache-dir-partial":       true,
+		"/opt/cache-dir":               false,
+		"/opt/cache-dir/":              false,
+		"/opt/cache-dir/partial":       false,
+		"/opt/cache-dir/../cache-dir/": false,
+		"/opt":                         false,
+		"/":                            false,
+	}
+
+	for dir, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+resumable_uploads_dir: %s
+`, dir)
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", dir, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for %q", dir)
+		}
+	}
+}
+
+func TestEvictionTrashDir(t *testing.T) {
+	tcs := map[string]bool{
+		"/opt/trash":            true,
+		"/opt/cache-dir-trash":  true,
+		"/opt/cache-dir":        false,
+		"/opt/cache-dir/trash":  false,
+		"/opt":                  false,
+		"/opt/cache-dir/../../": false,
+	}
+
+	for dir, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+eviction_trash_dir: %s
+`, dir)
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected %q to be valid, got: %v", dir, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for %q", dir)
+		}
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	secretFile := filepath.Join(dir, "secret")
+	err := os.WriteFile(secretFile, []byte("s3cr3t\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+s3_proxy:
+  endpoint: minio.example.com:9000
+  bucket: test-bucket
+  auth_method: access_key
+  access_key_id: EXAMPLE_ACCESS_KEY
+  secret_access_key_file: %[1]s
+ac_proxy:
+  http_proxy:
+    url: https://user@example.com/cache
+    password_file: %[1]s
+`, secretFile)
+
+	cfg, err := NewFromYaml([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.S3CloudStorage.SecretAccessKey != "s3cr3t" {
+		t.Errorf("Expected the s3 secret access key to be read from file, got %q",
+			cfg.S3CloudStorage.SecretAccessKey)
+	}
+
+	password, _ := cfg.ACProxy.HTTPBackend.BaseURL.User.Password()
+	if password != "s3cr3t" {
+		t.Errorf("Expected the http proxy password to be read from file, got %q",
+			password)
+	}
+
+	// The secret and its _file variant are mutually exclusive.
+	yaml = fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+htpasswd_file: /opt/.htpasswd
+ldap:
+  url: ldap://ldap.example.com
+  base_dn: OU=My Users,DC=example,DC=com
+  bind_password: hunter2
+  bind_password_file: %s
+`, secretFile)
+
+	_, err = NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Error("Expected an error when both ldap bind_password and bind_password_file are set")
+	}
+
+	yaml = `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+grpc_proxy:
+  url: grpc://example.com:9092
+  password_file: /does/not/exist
+`
+	_, err = NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Error("Expected an error for password_file without a username in the url")
+	}
+}
+
+func TestAccessLogSampleRate(t *testing.T) {
+	tcs := map[string]bool{
+		"0":    false,
+		"-0.5": false,
+		"0.01": true,
+		"1":    true,
+		"1.5":  false,
+	}
+
+	for rate, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+access_log_level: sampled
+access_log_sample_rate: %s
+`, rate)
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected sample rate %s to be valid, got: %v", rate, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for sample rate %s", rate)
+		}
+	}
+}
+
+func TestEventsConfig(t *testing.T) {
+	tcs := map[string]bool{
+		"address: localhost:4222\n  topic: cache.events":               true,
+		"type: nats\n  address: localhost:4222\n  topic: cache.events": true,
+		"type: kafka\n  address: localhost:9092\n  topic: events":      false,
+		"address: localhost:4222":                                      false,
+		"topic: cache.events":                                          false,
+	}
+
+	for events, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+events:
+  %s
+`, events)
+		cfg, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected events config %q to be valid, got: %v", events, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for events config %q", events)
+		}
+		if valid && err == nil && cfg.Events.Type != "nats" {
+			t.Errorf("Expected events type \"nats\", got %q", cfg.Events.Type)
+		}
+	}
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	tcs := map[string]bool{
+		"myteam":     true,
+		"_my_team_2": true,
+		"2team":      false,
+		"my-team":    false,
+	}
+
+	for namespace, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+enable_endpoint_metrics: true
+metrics_namespace: %s
+`, namespace)
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected metrics namespace %q to be valid, got: %v", namespace, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for metrics namespace %q", namespace)
+		}
+	}
+
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+metrics_namespace: myteam
+`
+	_, err := NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Error("Expected an error for metrics_namespace without enable_endpoint_metrics")
+	}
+}
+
+func TestEncryptionKeyFile(t *testing.T) {
+	tcs := map[string]bool{
+		"zstd":         true,
+		"uncompressed": false,
+	}
+
+	for storageMode, valid := range tcs {
+		yaml := fmt.Sprintf(`host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+storage_mode: %s
+encryption_key_file: /etc/bazel-remote/key
+`, storageMode)
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Expected encryption to be valid with storage mode %q, got: %v", storageMode, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for encryption with storage mode %q", storageMode)
+		}
+	}
+}
+
+func TestGRPCHtpasswdFile(t *testing.T) {
+	tcs := map[string]bool{
+		"htpasswd_file: /etc/bazel-remote/htpasswd\n": true,
+		"": false,
+	}
+
+	for extra, valid := range tcs {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+grpc_htpasswd_file: /etc/bazel-remote/grpc.htpasswd
+` + extra
+		c, err := NewFromYaml([]byte(yaml))
+		if valid {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.GRPCHtpasswdFile != "/etc/bazel-remote/grpc.htpasswd" {
+				t.Errorf("Unexpected grpc_htpasswd_file: %q", c.GRPCHtpasswdFile)
+			}
+		}
+		if !valid && err == nil {
+			t.Error("Expected an error for grpc_htpasswd_file without htpasswd_file")
+		}
+	}
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	tcs := map[string]bool{
+		"allowed_cidrs:\n  - 10.0.0.0/8\n  - fd00::/8\n": true,
+		"allowed_cidrs:\n  - 10.0.0.1\n":                 false,
+		"allowed_cidrs:\n  - not-a-cidr\n":               false,
+	}
+
+	for extra, valid := range tcs {
+		yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+` + extra
+		_, err := NewFromYaml([]byte(yaml))
+		if valid && err != nil {
+			t.Errorf("Unexpected error for %q: %v", extra, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("Expected an error for %q", extra)
+		}
+	}
+}
+
+func TestReadSessionTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	key1 := strings.Repeat("ab", 32)
+	key2 := strings.Repeat("cd", 32)
+
+	tcs := []struct {
+		contents string
+		numKeys  int
+	}{
+		{key1 + "\n", 1},
+		{key1 + "\n\n" + key2 + "\r\n", 2},
+		{"", 0},
+		{strings.Repeat("ab", 16) + "\n", 0},
+		{"not hex\n", 0},
+	}
+
+	for _, tc := range tcs {
+		file := filepath.Join(dir, "keys")
+		err := os.WriteFile(file, []byte(tc.contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := readSessionTicketKeys(file)
+		if tc.numKeys == 0 {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tc.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.contents, err)
+			continue
+		}
+		if len(keys) != tc.numKeys {
+			t.Errorf("Expected %d keys for %q, found %d", tc.numKeys, tc.contents, len(keys))
+		}
+		if keys[0][0] != 0xab {
+			t.Errorf("Expected the first key to be %s", key1)
+		}
+	}
+}
+
+func TestTLSSessionTicketKeyFileRequiresTLS(t *testing.T) {
+	yaml := `host: localhost
+port: 8080
+dir: /opt/cache-dir
+max_size: 100
+tls_session_ticket_key_file: /etc/bazel-remote/session_ticket_keys
+`
+	_, err := NewFromYaml([]byte(yaml))
+	if err == nil {
+		t.Error("Expected an error for tls_session_ticket_key_file without TLS")
+	}
+}
+
+// writeSelfSignedCert writes a certificate and key for "localhost" to dir,
+// and returns their paths and a pool which trusts the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certFile, keyFile, pool
+}
+
+func TestTLSSessionTicketKeyRotation(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tls.VersionName(version), func(t *testing.T) {
+			testTLSSessionTicketKeyRotation(t, version)
+		})
+	}
+}
+
+func testTLSSessionTicketKeyRotation(t *testing.T, version uint16) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeSelfSignedCert(t, dir)
+
+	keyFileName := filepath.Join(dir, "session_ticket_keys")
+	err := os.WriteFile(keyFileName, []byte(strings.Repeat("ab", 32)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		MinTLSVersion:           "1.2",
+		TLSCertFile:             certFile,
+		TLSKeyFile:              keyFile,
+		TLSSessionTicketKeyFile: keyFileName,
+	}
+	err = c.setTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the HTTP and gRPC servers, serve from a clone of the config.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", c.TLSConfig.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Send some data, so that the client also receives TLS 1.3
+			// session tickets, which are sent after the handshake.
+			_, _ = conn.Write([]byte("x"))
+			conn.Close()
+		}
+	}()
+
+	clientConfig := &tls.Config{
+		RootCAs:            pool,
+		ServerName:         "localhost",
+		MinVersion:         version,
+		MaxVersion:         version,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	// Returns true if the connection resumed a previous session.
+	connect := func() bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn.ConnectionState().DidResume
+	}
+
+	if connect() {
+		t.Fatal("Expected the first connection to do a full handshake")
+	}
+	if !connect() {
+		t.Fatal("Expected the second connection to resume the session")
+	}
+
+	// Replace the key, the client's session ticket is no longer valid.
+	err = os.WriteFile(keyFileName, []byte(strings.Repeat("cd", 32)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := c.TLSSessionTicketKeys.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("Expected the session ticket keys to change")
+	}
+
+	if connect() {
+		t.Fatal("Expected a full handshake after the session ticket key was rotated")
+	}
+	if !connect() {
+		t.Fatal("Expected a session ticket issued with the new key to be resumed")
+	}
+}
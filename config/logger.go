@@ -4,6 +4,8 @@ import (
 	"io"
 	"log"
 	"os"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
 )
 
 func (c *Config) setLogger() error {
@@ -20,11 +22,16 @@ func (c *Config) setLogger() error {
 
 	log.SetFlags(logFlags)
 
-	c.AccessLogger = log.New(os.Stdout, "", logFlags)
 	c.ErrorLogger = log.New(os.Stderr, "", logFlags)
 
-	if c.AccessLogLevel == "none" {
-		c.AccessLogger.SetOutput(io.Discard)
+	switch c.AccessLogLevel {
+	case "none":
+		c.AccessLogger = log.New(io.Discard, "", logFlags)
+	case "sampled":
+		c.AccessLogger = cache.NewSampledLogger(
+			log.New(os.Stdout, "", logFlags), c.AccessLogSampleRate)
+	default:
+		c.AccessLogger = log.New(os.Stdout, "", logFlags)
 	}
 
 	return nil
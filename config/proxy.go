@@ -5,10 +5,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 
+	"github.com/buchgr/bazel-remote/v2/cache"
 	"github.com/buchgr/bazel-remote/v2/cache/azblobproxy"
 	"github.com/buchgr/bazel-remote/v2/cache/gcsproxy"
 	"github.com/buchgr/bazel-remote/v2/cache/grpcproxy"
@@ -48,33 +51,236 @@ func getTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
 	return config, nil
 }
 
+// Return a ProxyBackendConfig for the top-level proxy backend fields,
+// which are used for all kinds of cache items by default.
+func (c *Config) defaultProxyBackendConfig() *ProxyBackendConfig {
+	return &ProxyBackendConfig{
+		S3CloudStorage:     c.S3CloudStorage,
+		AzBlobConfig:       c.AzBlobConfig,
+		GoogleCloudStorage: c.GoogleCloudStorage,
+		HTTPBackend:        c.HTTPBackend,
+		GRPCBackend:        c.GRPCBackend,
+	}
+}
+
+func (p *ProxyBackendConfig) numBackends() int {
+	n := 0
+	if p.S3CloudStorage != nil {
+		n++
+	}
+	if p.HTTPBackend != nil {
+		n++
+	}
+	if p.GoogleCloudStorage != nil {
+		n++
+	}
+	if p.AzBlobConfig != nil {
+		n++
+	}
+	if p.GRPCBackend != nil {
+		n++
+	}
+	return n
+}
+
+// Return true if `format` is a valid store_format value for a proxy backend
+// used with the given storage mode. The empty string means that the proxy
+// backend uses the same format as the local cache.
+func validStoreFormat(format string, storageMode string) bool {
+	switch format {
+	case "", "identity":
+		return true
+	case "casblob-zstd":
+		// We don't compress blobs before uploading them.
+		return storageMode == "zstd"
+	}
+	return false
+}
+
+// Return true if `compression` is a valid grpc_proxy.compression value.
+// The empty string means that CAS transfers are compressed only if the
+// local cache uses the zstd storage mode.
+func validGRPCCompression(compression string) bool {
+	switch compression {
+	case "", "zstd", "identity":
+		return true
+	}
+	return false
+}
+
+// Return the storage mode of the local cache, as seen by the proxy
+// backends. Encrypted CAS blobs are sent to the proxy backends in
+// uncompressed form, like a local cache with the uncompressed storage mode.
+func (c *Config) proxyLocalStorageMode() string {
+	if c.EncryptionKeyFile != "" {
+		return "uncompressed"
+	}
+	return c.StorageMode
+}
+
+// Return the proxy backend's storage mode, in the form expected by the
+// proxy implementations, given the local cache's storage mode.
+func (p *ProxyBackendConfig) storageMode(localStorageMode string) string {
+	var format string
+	if p.HTTPBackend != nil {
+		format = p.HTTPBackend.StoreFormat
+	} else if p.S3CloudStorage != nil {
+		format = p.S3CloudStorage.StoreFormat
+	} else if p.GRPCBackend != nil && p.GRPCBackend.UncompressedTransfers {
+		format = "identity"
+	}
+
+	if format == "identity" {
+		return "uncompressed"
+	}
+	return localStorageMode
+}
+
+func (p *ProxyBackendConfig) validate(storageMode string) error {
+	if p.HTTPBackend != nil && !validStoreFormat(p.HTTPBackend.StoreFormat, storageMode) {
+		return fmt.Errorf("Invalid http_proxy.store_format %q with storage_mode %q",
+			p.HTTPBackend.StoreFormat, storageMode)
+	}
+
+	if p.S3CloudStorage != nil && !validStoreFormat(p.S3CloudStorage.StoreFormat, storageMode) {
+		return fmt.Errorf("Invalid s3.store_format %q with storage_mode %q",
+			p.S3CloudStorage.StoreFormat, storageMode)
+	}
+
+	if p.GoogleCloudStorage != nil {
+		if p.GoogleCloudStorage.Bucket == "" {
+			return errors.New("The 'bucket' field is required for 'gcs_proxy'")
+		}
+
+		err := validateBackendTimeouts("gcs_proxy", p.GoogleCloudStorage.ConnectTimeout, p.GoogleCloudStorage.RequestTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.HTTPBackend != nil {
+		if err := p.HTTPBackend.validate("http"); err != nil {
+			return err
+		}
+	}
+
+	if p.GRPCBackend != nil {
+		if err := p.GRPCBackend.validate("grpc"); err != nil {
+			return err
+		}
+	}
+
+	if p.S3CloudStorage != nil {
+		if !s3proxy.IsValidAuthMethod(p.S3CloudStorage.AuthMethod) {
+			return fmt.Errorf("invalid s3.auth_method: %s", p.S3CloudStorage.AuthMethod)
+		}
+
+		if p.S3CloudStorage.KeyVersion != nil && *p.S3CloudStorage.KeyVersion != 2 {
+			return fmt.Errorf("s3.key_version (deprecated) must be 2, found %d", p.S3CloudStorage.KeyVersion)
+		}
+
+		if p.S3CloudStorage.BucketLookupType != "" && p.S3CloudStorage.BucketLookupType != "auto" &&
+			p.S3CloudStorage.BucketLookupType != "dns" && p.S3CloudStorage.BucketLookupType != "path" {
+			return fmt.Errorf("s3.bucket_lookup_type must be one of: \"auto\", \"dns\", \"path\" or empty/unspecified, found: \"%s\"",
+				p.S3CloudStorage.BucketLookupType)
+		}
+
+		if p.S3CloudStorage.SignatureType != "" && p.S3CloudStorage.SignatureType != "v2" &&
+			p.S3CloudStorage.SignatureType != "v4" && p.S3CloudStorage.SignatureType != "v4streaming" &&
+			p.S3CloudStorage.SignatureType != "anonymous" {
+			return fmt.Errorf("s3.signature_type must be one of: \"v2\", \"v4\", \"v4streaming\", \"anonymous\" or empty/unspecified, found: \"%s\"",
+				p.S3CloudStorage.SignatureType)
+		}
+
+		err := validateBackendTimeouts("s3", p.S3CloudStorage.ConnectTimeout, p.S3CloudStorage.RequestTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.AzBlobConfig != nil {
+		if p.AzBlobConfig.StorageAccount == "" {
+			return errors.New("The 'storage_account' field is required for 'azblob_proxy'")
+		}
+
+		if p.AzBlobConfig.ContainerName == "" {
+			return errors.New("The 'container_name' field is required for 'azblob_proxy'")
+		}
+
+		if !azblobproxy.IsValidAuthMethod(p.AzBlobConfig.AuthMethod) {
+			return fmt.Errorf("Invalid azblob.auth_method: %s", p.AzBlobConfig.AuthMethod)
+		}
+
+		err := validateBackendTimeouts("azblob", p.AzBlobConfig.ConnectTimeout, p.AzBlobConfig.RequestTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Config) setProxy() error {
-	if c.GoogleCloudStorage != nil {
-		proxyCache, err := gcsproxy.New(c.GoogleCloudStorage.Bucket,
-			c.GoogleCloudStorage.UseDefaultCredentials, c.GoogleCloudStorage.JSONCredentialsFile,
-			c.StorageMode, c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads)
+	var err error
+
+	c.ProxyBackend, err = c.newProxy(c.defaultProxyBackendConfig())
+	if err != nil {
+		return err
+	}
+
+	if c.ACProxy != nil {
+		c.ACProxyBackend, err = c.newProxy(c.ACProxy)
+		if err != nil {
+			return err
+		}
+	}
+
+	casProxy := c.defaultProxyBackendConfig()
+	if c.CASProxy != nil {
+		casProxy = c.CASProxy
+		c.CASProxyBackend, err = c.newProxy(c.CASProxy)
 		if err != nil {
 			return err
 		}
+	}
+
+	c.UncompressedCASProxy = casProxy.numBackends() > 0 &&
+		casProxy.storageMode(c.proxyLocalStorageMode()) != c.StorageMode
 
-		c.ProxyBackend = proxyCache
-		return nil
+	return nil
+}
+
+// Return a new proxy backend for the given configuration, or nil if
+// no backend is configured.
+func (c *Config) newProxy(p *ProxyBackendConfig) (cache.Proxy, error) {
+	storageMode := p.storageMode(c.proxyLocalStorageMode())
+
+	if p.GoogleCloudStorage != nil {
+		var transport http.RoundTripper
+		if p.GoogleCloudStorage.ConnectTimeout > 0 || p.GoogleCloudStorage.RequestTimeout > 0 {
+			transport = backendTransport(http.DefaultTransport.(*http.Transport).Clone(),
+				p.GoogleCloudStorage.ConnectTimeout, p.GoogleCloudStorage.RequestTimeout)
+		}
+
+		return gcsproxy.New(p.GoogleCloudStorage.Bucket,
+			p.GoogleCloudStorage.UseDefaultCredentials, p.GoogleCloudStorage.JSONCredentialsFile,
+			transport, c.proxyLocalStorageMode(), c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads)
 	}
 
-	if c.GRPCBackend != nil {
+	if p.GRPCBackend != nil {
 		var opts []grpc.DialOption
-		if c.GRPCBackend.BaseURL.Scheme == "grpcs" {
-			config, err := getTLSConfig(c.GRPCBackend.CertFile, c.GRPCBackend.KeyFile, c.GRPCBackend.CaFile)
+		if p.GRPCBackend.BaseURL.Scheme == "grpcs" {
+			config, err := getTLSConfig(p.GRPCBackend.CertFile, p.GRPCBackend.KeyFile, p.GRPCBackend.CaFile)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			creds := credentials.NewTLS(config)
 			opts = append(opts, grpc.WithTransportCredentials(creds))
 		} else {
 			opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 		}
-		if password, ok := c.GRPCBackend.BaseURL.User.Password(); ok {
-			username := c.GRPCBackend.BaseURL.User.Username()
+		if password, ok := p.GRPCBackend.BaseURL.User.Password(); ok {
+			username := p.GRPCBackend.BaseURL.User.Username()
 			auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
 			header := fmt.Sprintf("Basic %s", auth)
 			unaryAuth := func(ctx context.Context, method string, req, res interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
@@ -86,93 +292,129 @@ func (c *Config) setProxy() error {
 			opts = append(opts, grpc.WithChainUnaryInterceptor(unaryAuth), grpc.WithStreamInterceptor(streamAuth))
 		}
 
+		opts = append(opts, grpcBackendTimeoutOptions(p.GRPCBackend.ConnectTimeout, p.GRPCBackend.RequestTimeout)...)
+
 		metrics := grpc_prometheus.NewClientMetrics(func(o *prom.CounterOpts) { o.Namespace = "proxy" })
 		metrics.EnableClientHandlingTimeHistogram(func(o *prom.HistogramOpts) { o.Namespace = "proxy" })
 		err := prom.Register(metrics)
-		if err != nil {
-			return err
+		if are, ok := err.(prom.AlreadyRegisteredError); ok {
+			// Multiple grpc proxy backends share the same metrics.
+			metrics = are.ExistingCollector.(*grpc_prometheus.ClientMetrics)
+		} else if err != nil {
+			return nil, err
 		}
 		opts = append(opts, grpc.WithChainStreamInterceptor(metrics.StreamClientInterceptor()))
 		opts = append(opts, grpc.WithChainUnaryInterceptor(metrics.UnaryClientInterceptor()))
 
-		conn, err := grpc.NewClient(c.GRPCBackend.BaseURL.Host, opts...)
+		conn, err := grpc.NewClient(p.GRPCBackend.BaseURL.Host, opts...)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		clients := grpcproxy.NewGrpcClients(conn)
-		err = clients.CheckCapabilities(c.StorageMode == "zstd")
-		if err != nil {
-			return err
+		compression := p.GRPCBackend.Compression
+		if compression == "" {
+			err = clients.CheckCapabilities(c.proxyLocalStorageMode() == "zstd")
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			supportsZstd, err := clients.CheckBackendCapabilities()
+			if err != nil {
+				return nil, err
+			}
+			if compression == "zstd" && !supportsZstd {
+				log.Println("grpc proxy: the backend does not support zstd compression, using uncompressed transfers.")
+				compression = "identity"
+			}
 		}
-		proxy := grpcproxy.New(clients, c.StorageMode,
-			c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads)
+		// Blobs in a zstd storage mode cache are transcoded for
+		// uncompressed transfers, see UncompressedCASProxy.
+		p.GRPCBackend.UncompressedTransfers = compression == "identity"
 
-		c.ProxyBackend = proxy
+		return grpcproxy.New(clients, p.storageMode(c.proxyLocalStorageMode()),
+			c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads,
+			p.GRPCBackend.ForwardMetadata, compression == "zstd"), nil
 	}
 
-	if c.HTTPBackend != nil {
+	if p.HTTPBackend != nil {
 		httpClient := &http.Client{}
-		if c.HTTPBackend.BaseURL.Scheme == "https" {
-			config, err := getTLSConfig(c.HTTPBackend.CertFile, c.HTTPBackend.KeyFile, c.HTTPBackend.CaFile)
+		if p.HTTPBackend.BaseURL.Scheme == "https" {
+			config, err := getTLSConfig(p.HTTPBackend.CertFile, p.HTTPBackend.KeyFile, p.HTTPBackend.CaFile)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			tr := &http.Transport{TLSClientConfig: config}
-			httpClient.Transport = tr
+			httpClient.Transport = backendTransport(tr,
+				p.HTTPBackend.ConnectTimeout, p.HTTPBackend.RequestTimeout)
+		} else if p.HTTPBackend.ConnectTimeout > 0 || p.HTTPBackend.RequestTimeout > 0 {
+			httpClient.Transport = backendTransport(http.DefaultTransport.(*http.Transport).Clone(),
+				p.HTTPBackend.ConnectTimeout, p.HTTPBackend.RequestTimeout)
 		}
 
-		proxyCache, err := httpproxy.New(c.HTTPBackend.BaseURL, c.StorageMode,
+		return httpproxy.New(p.HTTPBackend.BaseURL, storageMode,
 			httpClient, c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads)
-		if err != nil {
-			return err
-		}
-
-		c.ProxyBackend = proxyCache
-		return nil
 	}
 
-	if c.S3CloudStorage != nil {
-		creds, err := c.S3CloudStorage.GetCredentials()
+	if p.S3CloudStorage != nil {
+		creds, err := p.S3CloudStorage.GetCredentials()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		bucketLookupType, err := parseBucketLookupType(c.S3CloudStorage.BucketLookupType)
+		bucketLookupType, err := parseBucketLookupType(p.S3CloudStorage.BucketLookupType)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		var transport http.RoundTripper
+		if p.S3CloudStorage.ConnectTimeout > 0 || p.S3CloudStorage.RequestTimeout > 0 {
+			tr, err := minio.DefaultTransport(!p.S3CloudStorage.DisableSSL)
+			if err != nil {
+				return nil, err
+			}
+			transport = backendTransport(tr,
+				p.S3CloudStorage.ConnectTimeout, p.S3CloudStorage.RequestTimeout)
 		}
-		c.ProxyBackend = s3proxy.New(
-			c.S3CloudStorage.Endpoint,
-			c.S3CloudStorage.Bucket,
+
+		return s3proxy.New(
+			p.S3CloudStorage.Endpoint,
+			p.S3CloudStorage.Bucket,
 			bucketLookupType,
-			c.S3CloudStorage.Prefix,
+			p.S3CloudStorage.Prefix,
 			creds,
-			c.S3CloudStorage.DisableSSL,
-			c.S3CloudStorage.UpdateTimestamps,
-			c.S3CloudStorage.Region,
-			c.StorageMode, c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads)
-		return nil
+			p.S3CloudStorage.DisableSSL,
+			p.S3CloudStorage.UpdateTimestamps,
+			p.S3CloudStorage.TagObjectsByKind,
+			p.S3CloudStorage.Region,
+			transport,
+			storageMode, c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads), nil
 	}
 
-	if c.AzBlobConfig != nil {
-		creds, err := c.AzBlobConfig.GetCredentials()
+	if p.AzBlobConfig != nil {
+		creds, err := p.AzBlobConfig.GetCredentials()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		c.ProxyBackend = azblobproxy.New(
-			c.AzBlobConfig.StorageAccount,
-			c.AzBlobConfig.ContainerName,
-			c.AzBlobConfig.Prefix,
+		var transport http.RoundTripper
+		if p.AzBlobConfig.ConnectTimeout > 0 || p.AzBlobConfig.RequestTimeout > 0 {
+			transport = backendTransport(http.DefaultTransport.(*http.Transport).Clone(),
+				p.AzBlobConfig.ConnectTimeout, p.AzBlobConfig.RequestTimeout)
+		}
+
+		return azblobproxy.New(
+			p.AzBlobConfig.StorageAccount,
+			p.AzBlobConfig.ContainerName,
+			p.AzBlobConfig.Prefix,
 			creds,
-			c.AzBlobConfig.SharedKey,
-			c.AzBlobConfig.UpdateTimestamps,
-			c.StorageMode, c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads,
-		)
-		return nil
+			p.AzBlobConfig.SharedKey,
+			p.AzBlobConfig.UpdateTimestamps,
+			transport,
+			c.proxyLocalStorageMode(), c.AccessLogger, c.ErrorLogger, c.NumUploaders, c.MaxQueuedUploads,
+		), nil
 	}
 
-	return nil
+	return nil, nil
 }
 
 func parseBucketLookupType(typeStr string) (minio.BucketLookupType, error) {
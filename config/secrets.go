@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// setSecretFromFile sets *secret to the contents of file, if file is
+// non-empty. This allows secrets to be provided eg via mounted kubernetes
+// secrets, instead of on the command line or in the config file. A single
+// trailing newline is removed from the file contents.
+func setSecretFromFile(secret *string, file string, key string) error {
+	if file == "" {
+		return nil
+	}
+
+	if *secret != "" {
+		return fmt.Errorf("The '%[1]s' and '%[1]s_file' flags/keys are mutually exclusive", key)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read '%s_file': %w", key, err)
+	}
+
+	s := strings.TrimSuffix(string(data), "\n")
+	*secret = strings.TrimSuffix(s, "\r")
+
+	return nil
+}
+
+func (c *S3CloudStorageConfig) readSecretFiles() error {
+	if c == nil {
+		return nil
+	}
+
+	err := setSecretFromFile(&c.SecretAccessKey, c.SecretAccessKeyFile, "s3.secret_access_key")
+	if err != nil {
+		return err
+	}
+
+	return setSecretFromFile(&c.SessionToken, c.SessionTokenFile, "s3.session_token")
+}
+
+func (c *AzBlobStorageConfig) readSecretFiles() error {
+	if c == nil {
+		return nil
+	}
+
+	err := setSecretFromFile(&c.ClientSecret, c.ClientSecretFile, "azblob.client_secret")
+	if err != nil {
+		return err
+	}
+
+	return setSecretFromFile(&c.SharedKey, c.SharedKeyFile, "azblob.shared_key")
+}
+
+func (c *LDAPConfig) readSecretFiles() error {
+	if c == nil {
+		return nil
+	}
+
+	return setSecretFromFile(&c.BindPassword, c.BindPasswordFile, "ldap.bind_password")
+}
+
+func (c *URLBackendConfig) readSecretFiles(protocol string) error {
+	if c == nil || c.PasswordFile == "" || c.BaseURL == nil {
+		return nil
+	}
+
+	if c.BaseURL.User == nil || c.BaseURL.User.Username() == "" {
+		return fmt.Errorf("The '%s_proxy.password_file' flag/key requires a username in the url", protocol)
+	}
+
+	password, _ := c.BaseURL.User.Password()
+	err := setSecretFromFile(&password, c.PasswordFile, protocol+"_proxy.password")
+	if err != nil {
+		return err
+	}
+
+	c.BaseURL.User = url.UserPassword(c.BaseURL.User.Username(), password)
+
+	return nil
+}
+
+func (p *ProxyBackendConfig) readSecretFiles() error {
+	if p == nil {
+		return nil
+	}
+
+	err := p.S3CloudStorage.readSecretFiles()
+	if err != nil {
+		return err
+	}
+
+	err = p.AzBlobConfig.readSecretFiles()
+	if err != nil {
+		return err
+	}
+
+	err = p.HTTPBackend.readSecretFiles("http")
+	if err != nil {
+		return err
+	}
+
+	return p.GRPCBackend.readSecretFiles("grpc")
+}
+
+// readSecretFiles populates secret fields from their corresponding "_file"
+// fields, if set.
+func (c *Config) readSecretFiles() error {
+	err := c.LDAP.readSecretFiles()
+	if err != nil {
+		return err
+	}
+
+	defaultProxy := c.defaultProxyBackendConfig()
+
+	err = defaultProxy.readSecretFiles()
+	if err != nil {
+		return err
+	}
+
+	err = c.ACProxy.readSecretFiles()
+	if err != nil {
+		return err
+	}
+
+	return c.CASProxy.readSecretFiles()
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+// validateBackendTimeouts checks the connect_timeout and request_timeout
+// values of the proxy backend with the given name.
+func validateBackendTimeouts(name string, connectTimeout time.Duration, requestTimeout time.Duration) error {
+	if connectTimeout < 0 {
+		return fmt.Errorf("The '%s.connect_timeout' flag/key must not be negative", name)
+	}
+
+	if requestTimeout < 0 {
+		return fmt.Errorf("The '%s.request_timeout' flag/key must not be negative", name)
+	}
+
+	return nil
+}
+
+// backendTransport returns tr with the given timeouts applied. If
+// connectTimeout is non-zero, it limits the time taken to establish new
+// connections. If requestTimeout is non-zero, it limits the time taken for
+// each request, including reading the response body.
+func backendTransport(tr *http.Transport, connectTimeout time.Duration, requestTimeout time.Duration) http.RoundTripper {
+	if connectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		tr.DialContext = dialer.DialContext
+	}
+
+	if requestTimeout <= 0 {
+		return tr
+	}
+
+	return &timeoutTransport{
+		RoundTripper: tr,
+		timeout:      requestTimeout,
+	}
+}
+
+// timeoutTransport is an http.RoundTripper which cancels requests that are
+// not complete after the given timeout.
+type timeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout also applies while the body is being read.
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// grpcBackendTimeoutOptions returns grpc.DialOptions which apply the given
+// timeouts to a gRPC proxy backend connection, similar to backendTransport.
+func grpcBackendTimeoutOptions(connectTimeout time.Duration, requestTimeout time.Duration) []grpc.DialOption {
+	var opts []grpc.DialOption
+
+	if connectTimeout > 0 {
+		opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: connectTimeout,
+		}))
+	}
+
+	if requestTimeout <= 0 {
+		return opts
+	}
+
+	unary := func(ctx context.Context, method string, req, res interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+		return invoker(ctx, method, req, res, cc, opts...)
+	}
+
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return &cancelOnFinishStream{ClientStream: cs, cancel: cancel}, nil
+	}
+
+	return append(opts, grpc.WithChainUnaryInterceptor(unary), grpc.WithChainStreamInterceptor(stream))
+}
+
+// cancelOnFinishStream releases the resources of a stream's timeout context
+// once the stream has finished, ie when RecvMsg returns an error (including
+// io.EOF).
+type cancelOnFinishStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (s *cancelOnFinishStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.cancel()
+	}
+	return err
+}
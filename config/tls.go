@@ -1,11 +1,17 @@
 package config
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func (c *Config) setTLSConfig() error {
@@ -55,7 +61,7 @@ func (c *Config) setTLSConfig() error {
 			MinVersion: minTLSVersion,
 		}
 
-		return nil
+		return c.setSessionTicketKeys()
 	}
 
 	if len(c.TLSCertFile) != 0 && len(c.TLSKeyFile) != 0 {
@@ -72,8 +78,154 @@ func (c *Config) setTLSConfig() error {
 			MinVersion:   minTLSVersion,
 		}
 
+		return c.setSessionTicketKeys()
+	}
+
+	return nil
+}
+
+// The interval at which the TLS session ticket key file is re-read, so
+// that the keys can be rotated without restarting the server.
+const sessionTicketKeysReloadInterval = time.Minute
+
+// readSessionTicketKeys returns the TLS session ticket keys in file, which
+// must contain one or more hex-encoded 256 bit keys, one per line. The
+// first key is used to encrypt new session tickets, and all of the keys
+// are used to decrypt session tickets.
+func readSessionTicketKeys(file string) ([][32]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read TLS session ticket key file: %w", err)
+	}
+
+	var keys [][32]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode TLS session ticket key in %s: %w", file, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Expected 256 bit TLS session ticket keys in %s, found %d bits",
+				file, len(key)*8)
+		}
+
+		keys = append(keys, [32]byte(key))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No TLS session ticket keys found in %s", file)
+	}
+
+	return keys, nil
+}
+
+// SessionTicketKeys holds the TLS session ticket keys from a key file,
+// which can be replaced while servers are using clones of the tls.Config
+// that they were installed in.
+type SessionTicketKeys struct {
+	file string
+
+	// A tls.Config which is only used for its session ticket keys.
+	keys atomic.Pointer[tls.Config]
+
+	// The keys in keys, only accessed by reload.
+	current [][32]byte
+}
+
+func newSessionTicketKeys(file string) (*SessionTicketKeys, error) {
+	k := &SessionTicketKeys{file: file}
+
+	_, err := k.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// install makes TLS servers which use cfg, or a clone of it, encrypt and
+// decrypt session tickets with the current keys in k.
+func (k *SessionTicketKeys) install(cfg *tls.Config) {
+	// tls.Config.Clone copies these hooks, but not the session ticket
+	// keys set with SetSessionTicketKeys, so the keys must be looked up
+	// on each use.
+	cfg.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return k.keys.Load().EncryptTicket(cs, ss)
+	}
+	cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return k.keys.Load().DecryptTicket(identity, cs)
+	}
+}
+
+// reload re-reads the key file, and starts using the keys in it. It
+// returns true if the keys changed.
+func (k *SessionTicketKeys) reload() (bool, error) {
+	keys, err := readSessionTicketKeys(k.file)
+	if err != nil {
+		return false, err
+	}
+
+	if sameSessionTicketKeys(keys, k.current) {
+		return false, nil
+	}
+
+	cfg := &tls.Config{}
+	cfg.SetSessionTicketKeys(keys)
+	k.keys.Store(cfg)
+	k.current = keys
+
+	return true, nil
+}
+
+// Watch periodically re-reads the key file, and starts using the keys in
+// it if they have changed. Errors are logged, and the previous keys are
+// kept. This does not return.
+func (k *SessionTicketKeys) Watch() {
+	ticker := time.NewTicker(sessionTicketKeysReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := k.reload()
+		if err != nil {
+			log.Printf("Failed to reload TLS session ticket keys: %v", err)
+			continue
+		}
+
+		if changed {
+			log.Printf("Reloaded %d TLS session ticket keys from %s", len(k.current), k.file)
+		}
+	}
+}
+
+func (c *Config) setSessionTicketKeys() error {
+	if c.TLSSessionTicketKeyFile == "" {
 		return nil
 	}
 
+	keys, err := newSessionTicketKeys(c.TLSSessionTicketKeyFile)
+	if err != nil {
+		return err
+	}
+
+	keys.install(c.TLSConfig)
+	c.TLSSessionTicketKeys = keys
+
 	return nil
 }
+
+func sameSessionTicketKeys(a [][32]byte, b [][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i][:], b[i][:]) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package ldap
 
 import (
+	"container/list"
 	"context"
 	"encoding/base64"
 	"fmt"
@@ -20,12 +21,18 @@ import (
 // requests don't DDoS the LDAP server.
 type Cache struct {
 	*auth.BasicAuth
-	m      sync.Map
 	config *config.LDAPConfig
+
+	// The cached results, bounded by config.CacheMaxEntries so that
+	// requests with many distinct usernames cannot use unbounded memory.
+	mu      sync.Mutex
+	entries map[[2]string]*list.Element
+	lru     *list.List // Most recently used entries are at the front.
 }
 
 type cacheEntry struct {
 	sync.Mutex
+	key [2]string
 	// Poor man's enum; nil pointer means uninitialized
 	authed *bool
 }
@@ -47,14 +54,50 @@ func New(config *config.LDAPConfig) (*Cache, error) {
 		BasicAuth: &auth.BasicAuth{
 			Realm: "Bazel remote cache",
 		},
+		entries: make(map[[2]string]*list.Element),
+		lru:     list.New(),
 	}, nil
 }
 
+// entry returns the cache entry for k, creating it if necessary, and
+// forgets the least recently used entry if there are too many.
+func (c *Cache) entry(k [2]string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele, ok := c.entries[k]; ok {
+		c.lru.MoveToFront(ele)
+		return ele.Value.(*cacheEntry)
+	}
+
+	ce := &cacheEntry{key: k}
+	c.entries[k] = c.lru.PushFront(ce)
+
+	if c.config.CacheMaxEntries > 0 && c.lru.Len() > c.config.CacheMaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	return ce
+}
+
+// forget removes ce from the cache, unless it has already been replaced.
+func (c *Cache) forget(ce *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, ok := c.entries[ce.key]
+	if ok && ele.Value.(*cacheEntry) == ce {
+		c.lru.Remove(ele)
+		delete(c.entries, ce.key)
+	}
+}
+
 // Either query LDAP for a result or retrieve it from the cache
 func (c *Cache) checkLdap(user, password string) bool {
 	k := [2]string{user, password}
-	v, _ := c.m.LoadOrStore(k, &cacheEntry{})
-	ce := v.(*cacheEntry)
+	ce := c.entry(k)
 	ce.Lock()
 	defer ce.Unlock()
 	if ce.authed != nil {
@@ -71,7 +114,7 @@ func (c *Cache) checkLdap(user, password string) bool {
 	}
 	go func() {
 		<-time.After(timeout)
-		c.m.Delete(k)
+		c.forget(ce)
 	}()
 
 	return authed
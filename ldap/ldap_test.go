@@ -0,0 +1,72 @@
+package ldap
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/buchgr/bazel-remote/v2/config"
+)
+
+func newTestCache(maxEntries int) *Cache {
+	return &Cache{
+		config:  &config.LDAPConfig{CacheMaxEntries: maxEntries},
+		entries: make(map[[2]string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	c := newTestCache(2)
+
+	a := c.entry([2]string{"a", "pw"})
+	if c.entry([2]string{"a", "pw"}) != a {
+		t.Fatal("Expected the existing entry to be returned")
+	}
+
+	b := c.entry([2]string{"b", "pw"})
+
+	// Using a moves it to the front, so b is forgotten to make room for c.
+	c.entry([2]string{"a", "pw"})
+	c.entry([2]string{"c", "pw"})
+
+	if len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Fatalf("Expected 2 entries, found %d (list: %d)", len(c.entries), c.lru.Len())
+	}
+	if _, ok := c.entries[[2]string{"b", "pw"}]; ok {
+		t.Fatal("Expected the least recently used entry to be forgotten")
+	}
+	if c.entry([2]string{"a", "pw"}) != a {
+		t.Fatal("Expected the recently used entry to be kept")
+	}
+
+	// The forgotten entry is replaced by a new one, which is not removed
+	// when the old entry expires.
+	b2 := c.entry([2]string{"b", "pw"})
+	if b2 == b {
+		t.Fatal("Expected a new entry for the forgotten key")
+	}
+	c.forget(b)
+	if _, ok := c.entries[[2]string{"b", "pw"}]; !ok {
+		t.Fatal("Expected the replacement entry to be kept")
+	}
+
+	c.forget(b2)
+	if _, ok := c.entries[[2]string{"b", "pw"}]; ok {
+		t.Fatal("Expected the entry to be forgotten")
+	}
+	if len(c.entries) != c.lru.Len() {
+		t.Fatalf("Expected the map and list to match, found %d and %d", len(c.entries), c.lru.Len())
+	}
+}
+
+func TestCacheEntriesUnbounded(t *testing.T) {
+	c := newTestCache(0)
+
+	for i := 0; i < 100; i++ {
+		c.entry([2]string{string(rune('a' + i)), "pw"})
+	}
+
+	if len(c.entries) != 100 {
+		t.Fatalf("Expected 100 entries, found %d", len(c.entries))
+	}
+}
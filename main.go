@@ -12,19 +12,29 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 
+	"github.com/buchgr/bazel-remote/v2/cache"
 	"github.com/buchgr/bazel-remote/v2/cache/disk"
+	"github.com/buchgr/bazel-remote/v2/cache/s3proxy"
 
 	"github.com/buchgr/bazel-remote/v2/config"
 	"github.com/buchgr/bazel-remote/v2/ldap"
 	"github.com/buchgr/bazel-remote/v2/server"
+	"github.com/buchgr/bazel-remote/v2/utils/backendproxy"
+	"github.com/buchgr/bazel-remote/v2/utils/events"
 	"github.com/buchgr/bazel-remote/v2/utils/flags"
 	"github.com/buchgr/bazel-remote/v2/utils/idle"
+	"github.com/buchgr/bazel-remote/v2/utils/ipfilter"
+	"github.com/buchgr/bazel-remote/v2/utils/metricsdump"
+	"github.com/buchgr/bazel-remote/v2/utils/metricsnamespace"
+	"github.com/buchgr/bazel-remote/v2/utils/metricsummary"
 	"github.com/buchgr/bazel-remote/v2/utils/rlimit"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	httpmetrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	middleware "github.com/slok/go-http-metrics/middleware"
@@ -60,6 +70,8 @@ func main() {
 }
 
 func run(ctx *cli.Context) error {
+	startTime := time.Now()
+
 	c, err := config.Get(ctx)
 	if err != nil {
 		fmt.Fprintf(ctx.App.Writer, "%v\n\n", err)
@@ -88,6 +100,11 @@ func run(ctx *cli.Context) error {
 
 	rlimit.Raise()
 
+	if c.TLSSessionTicketKeyFile != "" {
+		log.Println("Using TLS session ticket keys from", c.TLSSessionTicketKeyFile)
+		go c.TLSSessionTicketKeys.Watch()
+	}
+
 	grpcSem := semaphore.NewWeighted(1)
 	var grpcServer *grpc.Server
 
@@ -96,6 +113,10 @@ func run(ctx *cli.Context) error {
 
 	idleTimeoutChan := make(chan struct{}, 1)
 
+	// Receives the disk cache once it has been created, so that in-flight
+	// writes can be finished during shutdown.
+	diskCacheChan := make(chan disk.Cache, 1)
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -106,10 +127,26 @@ func run(ctx *cli.Context) error {
 			log.Println("Idle timeout reached, attempting graceful shutdown")
 		}
 
+		if c.ShutdownWriteWindow > 0 {
+			select {
+			case dc := <-diskCacheChan:
+				stopWrites(dc, c.ShutdownWriteWindow)
+			default:
+				// The disk cache is still loading, there are no writes.
+			}
+		}
+
 		go func() {
 			if !grpcSem.TryAcquire(1) {
 				if grpcServer != nil {
 					log.Println("Stopping gRPC server")
+					if c.ShutdownTimeout > 0 {
+						timer := time.AfterFunc(c.ShutdownTimeout, func() {
+							log.Printf("gRPC server did not stop within %s, closing all connections", c.ShutdownTimeout)
+							grpcServer.Stop()
+						})
+						defer timer.Stop()
+					}
 					grpcServer.GracefulStop()
 					log.Println("gRPC server stopped")
 				}
@@ -120,7 +157,17 @@ func run(ctx *cli.Context) error {
 			if !httpSem.TryAcquire(1) {
 				if httpServer != nil {
 					log.Println("Stopping HTTP server")
-					err := httpServer.Shutdown(context.Background())
+					ctx := context.Background()
+					if c.ShutdownTimeout > 0 {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithTimeout(ctx, c.ShutdownTimeout)
+						defer cancel()
+					}
+					err := httpServer.Shutdown(ctx)
+					if err == context.DeadlineExceeded {
+						log.Printf("HTTP server did not stop within %s, closing all connections", c.ShutdownTimeout)
+						err = httpServer.Close()
+					}
 					if err != nil {
 						log.Println("Error occurred while stopping HTTP server:", err)
 					} else {
@@ -132,19 +179,157 @@ func run(ctx *cli.Context) error {
 	}()
 
 	log.Println("Storage mode:", c.StorageMode)
+	log.Println("Directory layout:", c.DirLayout)
 	if c.StorageMode == "zstd" {
 		log.Println("Zstandard implementation:", c.ZstdImplementation)
+		log.Println("Zstandard compression level:", c.ZstdLevel)
+		if c.ZstdLongMode {
+			log.Println("Zstandard long mode enabled")
+		}
+		if c.CompressionBypassSampleSize > 0 {
+			log.Printf("Storing incompressible CAS blobs uncompressed, based on a %d byte sample",
+				c.CompressionBypassSampleSize)
+		}
+		if c.ZstdMaxSize > 0 {
+			log.Printf("Storing CAS blobs larger than %d bytes uncompressed", c.ZstdMaxSize)
+		}
 	}
 
 	opts := []disk.Option{
 		disk.WithStorageMode(c.StorageMode),
+		disk.WithDirLayout(c.DirLayout),
 		disk.WithZstdImplementation(c.ZstdImplementation),
+		disk.WithZstdLevel(c.ZstdLevel),
 		disk.WithMaxBlobSize(c.MaxBlobSize),
 		disk.WithProxyMaxBlobSize(c.MaxProxyBlobSize),
 		disk.WithAccessLogger(c.AccessLogger),
 	}
+	if c.MigrationBatchSize > 0 {
+		opts = append(opts, disk.WithMigrationBatchSize(c.MigrationBatchSize))
+	}
+	if c.ACProxyBackend != nil {
+		opts = append(opts, disk.WithACProxyBackend(c.ACProxyBackend))
+	}
+	if c.CASProxyBackend != nil {
+		opts = append(opts, disk.WithCASProxyBackend(c.CASProxyBackend))
+	}
+	if c.UncompressedCASProxy {
+		opts = append(opts, disk.WithUncompressedCASProxy())
+	}
+	if c.NoProxyForAC {
+		opts = append(opts, disk.WithNoProxyForAC())
+	}
 	if c.ProxyBackend != nil {
-		opts = append(opts, disk.WithProxyBackend(c.ProxyBackend))
+		// Only used for the kinds of items without a more specific proxy.
+		if c.ACProxyBackend == nil {
+			opts = append(opts, disk.WithACProxyBackend(c.ProxyBackend))
+		}
+		if c.CASProxyBackend == nil {
+			opts = append(opts, disk.WithCASProxyBackend(c.ProxyBackend))
+		}
+	}
+	if c.ZstdLongMode {
+		opts = append(opts, disk.WithZstdLongMode())
+	}
+	if c.CompressionBypassSampleSize > 0 {
+		opts = append(opts, disk.WithCompressionBypass(c.CompressionBypassSampleSize))
+	}
+	if c.ZstdMaxSize > 0 {
+		opts = append(opts, disk.WithZstdMaxSize(c.ZstdMaxSize))
+	}
+	if c.EncryptionKeyFile != "" {
+		log.Println("Encrypting CAS blobs on disk")
+		opts = append(opts, disk.WithEncryptionKeyFile(c.EncryptionKeyFile))
+	}
+	if c.ACWriteOnce {
+		opts = append(opts, disk.WithACWriteOnce())
+	}
+	if c.ProtectACDependencies {
+		opts = append(opts, disk.WithProtectACDependencies())
+	}
+	if c.MaxReservedFraction > 0 {
+		opts = append(opts, disk.WithMaxReservedFraction(c.MaxReservedFraction))
+	}
+	if c.ServeDuringLoad {
+		opts = append(opts, disk.WithServeDuringLoad())
+	}
+	if c.KeepIncompleteFiles {
+		opts = append(opts, disk.WithKeepIncompleteFiles())
+	}
+	if c.FailOnLRUInconsistency {
+		opts = append(opts, disk.WithFailOnLRUInconsistency())
+	}
+	if c.StrictProxyErrors {
+		opts = append(opts, disk.WithStrictProxyErrors())
+	}
+	if c.ReadOnly {
+		log.Println("Serving the existing cache items in read-only mode")
+		opts = append(opts, disk.WithReadOnly())
+	}
+	if c.PrefetchACOutputs {
+		opts = append(opts, disk.WithPrefetchACOutputs(c.NumUploaders))
+	}
+	if c.DisableRAW {
+		opts = append(opts, disk.WithRawDisabled())
+	}
+	if c.RawContentTypes {
+		opts = append(opts, disk.WithRawContentTypes())
+	}
+	if c.MaxACValidationEntries > 0 {
+		opts = append(opts, disk.WithMaxACValidationEntries(c.MaxACValidationEntries))
+	}
+	if c.ACValidationConcurrency > 1 {
+		opts = append(opts, disk.WithACValidationConcurrency(c.ACValidationConcurrency))
+	}
+	if c.MaxTreeDepth > 0 {
+		opts = append(opts, disk.WithMaxTreeDepth(c.MaxTreeDepth))
+	}
+	if c.MaxConcurrentProxyDownloads > 0 {
+		opts = append(opts, disk.WithMaxConcurrentProxyDownloads(c.MaxConcurrentProxyDownloads))
+	}
+	if c.TempDir != "" {
+		log.Printf("Writing new cache files in %s", c.TempDir)
+		opts = append(opts, disk.WithTempDir(c.TempDir))
+	}
+	if c.EvictionRemovalConcurrency > 0 {
+		opts = append(opts, disk.WithEvictionRemovalConcurrency(c.EvictionRemovalConcurrency))
+	}
+	if c.DiskWriteRetries > 0 {
+		errnos := c.DiskWriteRetryErrnos
+		if len(errnos) == 0 {
+			errnos = disk.DefaultDiskWriteRetryErrnos
+		}
+		log.Printf("Retrying disk writes up to %d times on %s", c.DiskWriteRetries, strings.Join(errnos, ", "))
+		opts = append(opts, disk.WithDiskWriteRetries(c.DiskWriteRetries, errnos))
+	}
+	if c.EvictionTrashDir != "" {
+		log.Printf("Moving evicted files to %s, and removing them after %s", c.EvictionTrashDir, c.EvictionTrashTTL)
+		opts = append(opts, disk.WithEvictionTrash(c.EvictionTrashDir, c.EvictionTrashTTL))
+	}
+	if c.Events != nil {
+		log.Printf("Publishing cache events to %s subject %q on %s", c.Events.Type, c.Events.Topic, c.Events.Address)
+		opts = append(opts, disk.WithEventSink(events.NewNATSPublisher(c.Events.Address, c.Events.Topic)))
+	}
+	if c.TombstoneTTL > 0 {
+		opts = append(opts, disk.WithTombstoneTTL(c.TombstoneTTL))
+	}
+	if c.VerifyOnRead {
+		opts = append(opts, disk.WithVerifyOnRead(c.VerifyOnReadSampleRate))
+	}
+	if c.StartupVerifySample > 0 {
+		opts = append(opts, disk.WithStartupVerifySample(c.StartupVerifySample, c.StartupVerifyEvict))
+	}
+	if c.EnableBloomFilter {
+		opts = append(opts, disk.WithBloomFilter())
+	}
+	if c.SynthesizeEmptyTree {
+		opts = append(opts, disk.WithSynthesizedEmptyTree())
+	}
+	if c.FsyncPolicy != "always" {
+		opts = append(opts, disk.WithFsyncPolicy(c.FsyncPolicy))
+	}
+	if c.EnableInstanceTags {
+		opts = append(opts, disk.WithTags())
 	}
 	if c.EnableEndpointMetrics {
 		opts = append(opts, disk.WithEndpointMetrics())
@@ -154,8 +339,28 @@ func run(ctx *cli.Context) error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	diskCacheChan <- diskCache
 	diskCache.RegisterMetrics()
 
+	if c.MetricsDumpFile != "" {
+		log.Printf("Writing metrics to %s every %s", c.MetricsDumpFile, c.MetricsDumpInterval)
+		metricsdump.Start(c.MetricsDumpFile, c.MetricsDumpInterval, metricsGatherer(c))
+	}
+
+	if c.RestoreFromS3 {
+		err = s3proxy.Restore(context.Background(), c.ProxyBackend, c.NumUploaders,
+			func(ctx context.Context, kind cache.EntryKind, hash string) error {
+				rc, _, err := diskCache.Get(ctx, kind, hash, -1, 0)
+				if rc != nil {
+					rc.Close()
+				}
+				return err
+			})
+		if err != nil {
+			log.Fatal("Failed to restore from s3:", err)
+		}
+	}
+
 	servers := new(errgroup.Group)
 
 	var htpasswdSecrets auth.SecretProvider
@@ -169,6 +374,12 @@ func run(ctx *cli.Context) error {
 	}
 	log.Println("Authentication:", authMode)
 
+	grpcHtpasswdSecrets := htpasswdSecrets
+	if c.GRPCHtpasswdFile != "" {
+		log.Println("gRPC htpasswd file:", c.GRPCHtpasswdFile)
+		grpcHtpasswdSecrets = auth.HtpasswdFileProvider(c.GRPCHtpasswdFile)
+	}
+
 	if authMode != "disabled" {
 		if c.AllowUnauthenticatedReads {
 			log.Println("Access mode: authentication required for writes, unauthenticated reads allowed")
@@ -182,14 +393,29 @@ func run(ctx *cli.Context) error {
 		idleTimer = idle.NewTimer(c.IdleTimeout, idleTimeoutChan)
 	}
 
+	var inflight *server.InflightRequests
+	if c.EnableEndpointMetrics {
+		inflight = server.NewInflightRequests()
+		inflight.RegisterMetrics()
+	}
+
 	acKeyManglingStatus := "disabled"
 	if c.EnableACKeyInstanceMangling {
 		acKeyManglingStatus = "enabled"
 	}
 	log.Println("Mangling non-empty instance names with AC keys:", acKeyManglingStatus)
 
+	var metricsServer *http.Server
+	if c.MetricsAddress != "" {
+		metricsServer = &http.Server{
+			Addr:              c.MetricsAddress,
+			ReadHeaderTimeout: c.HTTPReadHeaderTimeout,
+			IdleTimeout:       c.HTTPIdleTimeout,
+		}
+	}
+
 	servers.Go(func() error {
-		err := startHttpServer(c, &httpServer, htpasswdSecrets, idleTimer, httpSem, diskCache)
+		err := startHttpServer(c, &httpServer, metricsServer, htpasswdSecrets, idleTimer, inflight, httpSem, diskCache)
 		if err != nil {
 			log.Fatal("HTTP server returned fatal error:", err)
 		}
@@ -198,7 +424,7 @@ func run(ctx *cli.Context) error {
 
 	if c.GRPCAddress != "none" {
 		servers.Go(func() error {
-			err := startGrpcServer(c, &grpcServer, htpasswdSecrets, idleTimer, grpcSem, diskCache)
+			err := startGrpcServer(c, &grpcServer, grpcHtpasswdSecrets, idleTimer, inflight, grpcSem, diskCache)
 			if err != nil {
 				log.Fatal("gRPC server returned fatal error:", err)
 			}
@@ -221,28 +447,153 @@ func run(ctx *cli.Context) error {
 		idleTimer.Start()
 	}
 
-	return servers.Wait()
+	err = servers.Wait()
+
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	if c.DrainProxyUploadsOnShutdown > 0 {
+		drainProxyUploads(c.DrainProxyUploadsOnShutdown)
+	}
+
+	if c.UnixSocketCleanup {
+		for _, addr := range []string{c.HTTPAddress, c.GRPCAddress} {
+			if strings.HasPrefix(addr, "unix://") {
+				removeUnixSocket(addr[len("unix://"):])
+			}
+		}
+	}
+
+	if c.MetricsDumpFile != "" {
+		// Include the requests that were served during shutdown.
+		dumpErr := metricsdump.Write(c.MetricsDumpFile, metricsGatherer(c))
+		if dumpErr != nil {
+			log.Printf("Failed to write metrics to %s: %v", c.MetricsDumpFile, dumpErr)
+		}
+	}
+
+	logShutdownSummary(startTime, diskCache)
+	return err
+}
+
+// drainProxyUploads waits up to timeout for the queued uploads to the
+// proxy backend to finish.
+func drainProxyUploads(timeout time.Duration) {
+	log.Printf("Waiting up to %s for queued proxy uploads to finish", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := backendproxy.WaitForUploads(ctx)
+	if err != nil {
+		log.Printf("Queued proxy uploads did not finish within %s, dropping the remaining uploads", timeout)
+		return
+	}
+
+	log.Println("Queued proxy uploads finished")
+}
+
+// metricsGatherer returns the prometheus.Gatherer for the metrics that are
+// written to the metrics dump file.
+func metricsGatherer(c *config.Config) prometheus.Gatherer {
+	if c.MetricsNamespace != "" {
+		return metricsnamespace.NewGatherer(c.MetricsNamespace, prometheus.DefaultGatherer)
+	}
+	return prometheus.DefaultGatherer
+}
+
+// removeStaleUnixSocket removes the unix socket file at socketPath if
+// nothing is listening on it, eg because a previous bazel-remote process
+// crashed. It returns an error if the socket is in use, or if socketPath
+// exists but is not a socket.
+func removeStaleUnixSocket(socketPath string) error {
+	fi, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", socketPath)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", socketPath)
+	}
+
+	log.Println("Removing stale unix socket:", socketPath)
+	return os.Remove(socketPath)
+}
+
+// removeUnixSocket removes the unix socket file at socketPath after the
+// server that was listening on it has stopped, if it still exists.
+func removeUnixSocket(socketPath string) {
+	err := os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove unix socket:", err)
+	}
+}
+
+// stopWrites refuses new writes to diskCache, and waits up to window for
+// the in-flight writes to be committed, before the servers are stopped.
+func stopWrites(diskCache disk.Cache, window time.Duration) {
+	log.Printf("Refusing new writes, waiting up to %s for in-flight writes to finish", window)
+
+	ctx, cancel := context.WithTimeout(context.Background(), window)
+	defer cancel()
+
+	err := diskCache.StopWrites(ctx)
+	if err != nil {
+		log.Printf("In-flight writes did not finish within %s", window)
+		return
+	}
+	log.Println("In-flight writes finished")
+}
+
+// logShutdownSummary logs a single line summarizing the cache statistics
+// since startup.
+func logShutdownSummary(startTime time.Time, diskCache disk.Cache) {
+	summary, err := metricsummary.Gather(prometheus.DefaultGatherer)
+	if err != nil {
+		log.Println("Failed to gather metrics for the shutdown summary:", err)
+		return
+	}
+
+	totalSize, _, numItems, _ := diskCache.Stats()
+
+	log.Printf("Shutdown summary: uptime=%s %s current_size=%d current_items=%d",
+		time.Since(startTime).Round(time.Second), summary, totalSize, numItems)
 }
 
 func startHttpServer(c *config.Config, httpServer **http.Server,
-	htpasswdSecrets auth.SecretProvider, idleTimer *idle.Timer,
+	metricsServer *http.Server, htpasswdSecrets auth.SecretProvider, idleTimer *idle.Timer,
+	inflight *server.InflightRequests,
 	httpSem *semaphore.Weighted, diskCache disk.Cache) error {
 
 	mux := http.NewServeMux()
 	*httpServer = &http.Server{
-		Handler:      mux,
-		ReadTimeout:  c.HTTPReadTimeout,
-		TLSConfig:    c.TLSConfig,
-		WriteTimeout: c.HTTPWriteTimeout,
+		Handler:           mux,
+		ReadTimeout:       c.HTTPReadTimeout,
+		ReadHeaderTimeout: c.HTTPReadHeaderTimeout,
+		IdleTimeout:       c.HTTPIdleTimeout,
+		TLSConfig:         c.TLSConfig,
+		WriteTimeout:      c.HTTPWriteTimeout,
 	}
 
 	checkClientCertForReads := c.TLSCaFile != "" && !c.AllowUnauthenticatedReads
 	checkClientCertForWrites := c.TLSCaFile != ""
 	validateAC := !c.DisableHTTPACValidation
 	h := server.NewHTTPCache(diskCache, c.AccessLogger, c.ErrorLogger, validateAC,
-		c.EnableACKeyInstanceMangling, checkClientCertForReads, checkClientCertForWrites, gitCommit)
+		c.EnableACKeyInstanceMangling, checkClientCertForReads, checkClientCertForWrites,
+		c.LogClientIdentity, gitCommit)
 
-	cacheHandler := h.CacheHandler
+	// This must run after authentication, which sets the client identity.
+	cacheHandler := server.NewRequestPriority(c.HighPriorityClients).HTTPHandler(h.CacheHandler)
 	var ldapAuthenticator authenticator
 	var basicAuthenticator auth.BasicAuth
 	if c.HtpasswdFile != "" {
@@ -265,22 +616,26 @@ func startHttpServer(c *config.Config, httpServer **http.Server,
 	}
 
 	if c.IdleTimeout > 0 {
-		ch := cacheHandler // Avoid an infinite loop in the closure below.
-		cacheHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			idleTimer.ResetTimer()
-			ch(w, r)
-		})
+		cacheHandler = server.HTTPIdleTimerHandler(idleTimer, cacheHandler)
+	}
+
+	if inflight != nil {
+		cacheHandler = inflight.HTTPHandler(cacheHandler)
 	}
 
 	var statusHandler http.HandlerFunc = h.StatusPageHandler
+	var statsHandler http.HandlerFunc = h.StatsHandler
 
 	if !c.AllowUnauthenticatedReads {
 		if c.TLSCaFile != "" {
 			statusHandler = h.VerifyClientCertHandler(statusHandler).ServeHTTP
+			statsHandler = h.VerifyClientCertHandler(statsHandler).ServeHTTP
 		} else if c.HtpasswdFile != "" {
 			statusHandler = basicAuthWrapper(statusHandler, &basicAuthenticator)
+			statsHandler = basicAuthWrapper(statsHandler, &basicAuthenticator)
 		} else if c.LDAP != nil {
 			statusHandler = ldapAuthWrapper(statusHandler, ldapAuthenticator)
+			statsHandler = ldapAuthWrapper(statsHandler, ldapAuthenticator)
 		}
 	}
 
@@ -299,7 +654,14 @@ func startHttpServer(c *config.Config, httpServer **http.Server,
 			}),
 		})
 
-		middlewareHandler := middlewarestd.Handler("metrics", metricsMdlw, promhttp.Handler())
+		metricsHandler := promhttp.Handler()
+		if c.MetricsNamespace != "" {
+			log.Printf("Prefixing metric names with %s_", c.MetricsNamespace)
+			metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+				promhttp.HandlerFor(metricsnamespace.NewGatherer(c.MetricsNamespace, prometheus.DefaultGatherer), promhttp.HandlerOpts{}))
+		}
+
+		middlewareHandler := middlewarestd.Handler("metrics", metricsMdlw, metricsHandler)
 		if !c.AllowUnauthenticatedReads {
 			if c.TLSCaFile != "" {
 				middlewareHandler = h.VerifyClientCertHandler(middlewareHandler)
@@ -313,6 +675,12 @@ func startHttpServer(c *config.Config, httpServer **http.Server,
 
 		statusHandler = middlewarestd.Handler("status", metricsMdlw, http.HandlerFunc(h.StatusPageHandler)).ServeHTTP
 
+		if metricsServer != nil {
+			startMetricsServer(c, metricsServer,
+				middlewarestd.Handler("metrics", metricsMdlw, metricsHandler),
+				middlewarestd.Handler("status", metricsMdlw, http.HandlerFunc(h.StatusPageHandler)))
+		}
+
 		ch := cacheHandler // Avoid an infinite loop in the closure below.
 		cacheHandler = func(w http.ResponseWriter, r *http.Request) {
 			middlewarestd.Handler(r.Method, metricsMdlw, http.HandlerFunc(ch)).ServeHTTP(w, r)
@@ -326,18 +694,64 @@ func startHttpServer(c *config.Config, httpServer **http.Server,
 	}
 
 	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/api/stats", statsHandler)
 	mux.HandleFunc("/", cacheHandler)
 
+	// Unlike the other endpoints, the admin and deep health check endpoints
+	// always require authentication.
+	authenticatedHandler := func(handler http.HandlerFunc) http.Handler {
+		var wrapped http.Handler = handler
+		if c.TLSCaFile != "" {
+			wrapped = h.VerifyClientCertHandler(wrapped)
+		}
+		if c.HtpasswdFile != "" {
+			authenticator := auth.BasicAuth{Realm: c.HTTPAddress, Secrets: htpasswdSecrets}
+			wrapped = basicAuthWrapper(wrapped.ServeHTTP, &authenticator)
+		} else if c.LDAP != nil {
+			if ldapAuthenticator == nil {
+				var ldap_err error
+				if ldapAuthenticator, ldap_err = ldap.New(c.LDAP); ldap_err != nil {
+					log.Fatal("Failed to create LDAP connection: ", ldap_err)
+				}
+			}
+			wrapped = ldapAuthWrapper(wrapped.ServeHTTP, ldapAuthenticator)
+		}
+		return wrapped
+	}
+
+	if c.EnableAdminEndpoints {
+		log.Println("Admin endpoints: enabled")
+		mux.Handle("/admin/evict", authenticatedHandler(h.EvictHandler))
+		mux.Handle("/admin/pin", authenticatedHandler(h.PinHandler))
+		mux.Handle("/admin/pins", authenticatedHandler(h.PinsHandler))
+		if c.EnableInstanceTags {
+			mux.Handle("/admin/evict_tag", authenticatedHandler(h.EvictTagHandler))
+		}
+	}
+
+	if c.EnableDeepHealthCheck {
+		log.Println("Deep health check endpoint: enabled")
+		mux.Handle("/healthz/deep", authenticatedHandler(h.DeepHealthHandler))
+	}
+
 	var ln net.Listener
 	var err error
 	if strings.HasPrefix(c.HTTPAddress, "unix://") {
-		ln, err = net.Listen("unix", c.HTTPAddress[len("unix://"):])
+		socketPath := c.HTTPAddress[len("unix://"):]
+		if c.UnixSocketCleanup {
+			err = removeStaleUnixSocket(socketPath)
+			if err != nil {
+				log.Fatal("Failed to remove stale unix socket: ", err)
+			}
+		}
+		ln, err = net.Listen("unix", socketPath)
 	} else {
 		ln, err = net.Listen("tcp", c.HTTPAddress)
 	}
 	if err != nil {
 		log.Fatal(`Failed to listen on address: "`, c.HTTPAddress, `": `, err)
 	}
+	ln = filterListener(ln, c.AllowedCIDRs)
 
 	validateStatus := "disabled"
 	if validateAC {
@@ -376,8 +790,38 @@ func startHttpServer(c *config.Config, httpServer **http.Server,
 	return err
 }
 
+// startMetricsServer serves the /metrics and /status endpoints on
+// metricsServer, separately from the main HTTP server and without its
+// authentication.
+func startMetricsServer(c *config.Config, metricsServer *http.Server,
+	metricsHandler http.Handler, statusHandler http.Handler) {
+
+	if c.MetricsHtpasswdFile != "" {
+		authenticator := &auth.BasicAuth{
+			Realm:   c.MetricsAddress,
+			Secrets: auth.HtpasswdFileProvider(c.MetricsHtpasswdFile),
+		}
+		metricsHandler = basicAuthWrapper(metricsHandler.ServeHTTP, authenticator)
+		statusHandler = basicAuthWrapper(statusHandler.ServeHTTP, authenticator)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/status", statusHandler)
+	metricsServer.Handler = mux
+
+	go func() {
+		log.Printf("Starting HTTP server for metrics on address %s", c.MetricsAddress)
+		err := metricsServer.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(`Failed to listen on address: "`, c.MetricsAddress, `": `, err)
+		}
+	}()
+}
+
 func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 	htpasswdSecrets auth.SecretProvider, idleTimer *idle.Timer,
+	inflight *server.InflightRequests,
 	grpcSem *semaphore.Weighted, diskCache disk.Cache) error {
 
 	opts := []grpc.ServerOption{}
@@ -390,6 +834,11 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 		grpc_prometheus.EnableHandlingTimeHistogram(grpc_prometheus.WithHistogramBuckets(c.MetricsDurationBuckets))
 	}
 
+	if inflight != nil {
+		streamInterceptors = append(streamInterceptors, inflight.StreamServerInterceptor)
+		unaryInterceptors = append(unaryInterceptors, inflight.UnaryServerInterceptor)
+	}
+
 	if c.TLSConfig != nil {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(c.TLSConfig)))
 
@@ -407,6 +856,21 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 		unaryInterceptors = append(unaryInterceptors, gba.UnaryServerInterceptor)
 	}
 
+	rp := server.NewRequestPriority(c.HighPriorityClients)
+	streamInterceptors = append(streamInterceptors, rp.StreamServerInterceptor)
+	unaryInterceptors = append(unaryInterceptors, rp.UnaryServerInterceptor)
+
+	if c.MaxWritesPerConnection > 0 {
+		wl := server.NewGrpcWriteLimiter(c.MaxWritesPerConnection)
+		streamInterceptors = append(streamInterceptors, wl.StreamServerInterceptor)
+	}
+
+	if c.BackpressureThreshold > 0 {
+		bp := server.NewGrpcBackpressure(diskCache, c.BackpressureThreshold)
+		streamInterceptors = append(streamInterceptors, bp.StreamServerInterceptor)
+		unaryInterceptors = append(unaryInterceptors, bp.UnaryServerInterceptor)
+	}
+
 	if idleTimer != nil {
 		it := server.NewGrpcIdleTimer(idleTimer)
 		streamInterceptors = append(streamInterceptors, it.StreamServerInterceptor)
@@ -430,11 +894,83 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 	}
 	log.Println("experimental gRPC remote asset API:", remoteAssetStatus)
 
+	var grpcOpts []server.GRPCOption
+	if enableRemoteAssetAPI && c.MaxConcurrentAssetFetches > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxConcurrentAssetFetches(c.MaxConcurrentAssetFetches))
+	}
+	if enableRemoteAssetAPI && (c.AssetFetchRateLimit > 0 || c.AssetFetchPerHostRateLimit > 0) {
+		log.Printf("Asset fetch rate limits: %v/s in total, %v/s per host",
+			c.AssetFetchRateLimit, c.AssetFetchPerHostRateLimit)
+		grpcOpts = append(grpcOpts, server.WithAssetFetchRateLimit(
+			c.AssetFetchRateLimit, c.AssetFetchPerHostRateLimit))
+	}
+	if c.MaxTreeDepth > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxTreeDepth(c.MaxTreeDepth))
+	}
+	if c.MaxConcurrentGetTree > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxConcurrentGetTree(c.MaxConcurrentGetTree))
+	}
+	if c.MaxGetTreeTotalBytes > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxGetTreeTotalBytes(c.MaxGetTreeTotalBytes))
+	}
+	if c.MaxBatchTotalSize > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxBatchTotalSize(c.MaxBatchTotalSize))
+	}
+	if c.MinResponseCompressSize > 0 {
+		grpcOpts = append(grpcOpts, server.WithMinResponseCompressSize(c.MinResponseCompressSize))
+	}
+	grpcOpts = append(grpcOpts, server.WithMaxBlobSize(c.MaxBlobSize))
+	grpcOpts = append(grpcOpts, server.WithMaxInlineSize(c.MaxInlineSize))
+	if c.MaxACInlineSize > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxACInlineSize(c.MaxACInlineSize))
+	}
+	if c.MaxACOutputFiles > 0 || c.MaxACOutputDirectories > 0 || c.MaxACSymlinks > 0 {
+		grpcOpts = append(grpcOpts, server.WithMaxACOutputs(c.MaxACOutputFiles,
+			c.MaxACOutputDirectories, c.MaxACSymlinks))
+	}
+	if c.DedupeBatchDigests {
+		grpcOpts = append(grpcOpts, server.WithBatchDeduplication())
+	}
+	if c.StrictACValidation {
+		grpcOpts = append(grpcOpts, server.WithStrictACValidation())
+	}
+	if c.PreserveACExecutionMetadata {
+		grpcOpts = append(grpcOpts, server.WithPreserveACExecutionMetadata())
+	}
+	if c.LogClientIdentity {
+		grpcOpts = append(grpcOpts, server.WithClientIdentityLogging())
+	}
+	if len(c.AllowedInstances) > 0 || len(c.DeniedInstances) > 0 {
+		grpcOpts = append(grpcOpts,
+			server.WithInstanceFilter(c.AllowedInstances, c.DeniedInstances))
+	}
+	if !c.EnableAC || !c.EnableCAS || !c.EnableByteStream {
+		log.Printf("gRPC services enabled: ActionCache=%t ContentAddressableStorage=%t ByteStream=%t",
+			c.EnableAC, c.EnableCAS, c.EnableByteStream)
+		grpcOpts = append(grpcOpts,
+			server.WithEnabledServices(c.EnableAC, c.EnableCAS, c.EnableByteStream))
+	}
+	if c.ResumableUploadsDir != "" {
+		log.Println("gRPC resumable uploads directory:", c.ResumableUploadsDir)
+		grpcOpts = append(grpcOpts, server.WithResumableUploads(c.ResumableUploadsDir,
+			c.ResumableUploadsMaxSize, c.ResumableUploadsTTL))
+	}
+	if c.WriteSizeMismatchCode != "" {
+		grpcOpts = append(grpcOpts, server.WithWriteSizeMismatchCode(c.WriteSizeMismatchCode))
+	}
+
 	network := "tcp"
 	addr := c.GRPCAddress
 	if strings.HasPrefix(c.GRPCAddress, "unix://") {
 		network = "unix"
 		addr = c.GRPCAddress[len("unix://"):]
+
+		if c.UnixSocketCleanup {
+			err := removeStaleUnixSocket(addr)
+			if err != nil {
+				log.Fatal("Failed to remove stale unix socket: ", err)
+			}
+		}
 	}
 
 	*grpcServer = grpc.NewServer(opts...)
@@ -446,12 +982,34 @@ func startGrpcServer(c *config.Config, grpcServer **grpc.Server,
 
 	log.Println("Starting gRPC server on address", addr)
 
-	return server.ListenAndServeGRPC(*grpcServer,
-		network, addr,
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	listener = filterListener(listener, c.AllowedCIDRs)
+
+	return server.ServeGRPC(listener, *grpcServer,
 		validateAC,
 		c.EnableACKeyInstanceMangling,
 		enableRemoteAssetAPI,
-		diskCache, c.AccessLogger, c.ErrorLogger)
+		diskCache, c.AccessLogger, c.ErrorLogger,
+		grpcOpts...)
+}
+
+// filterListener returns a listener which only accepts TCP connections
+// from the allowed networks, or ln itself if allowedCIDRs is empty.
+func filterListener(ln net.Listener, allowedCIDRs []string) net.Listener {
+	if len(allowedCIDRs) == 0 {
+		return ln
+	}
+
+	allowed, err := ipfilter.ParseCIDRs(allowedCIDRs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Allowed client networks:", strings.Join(allowedCIDRs, ", "))
+
+	return ipfilter.NewListener(ln, allowed)
 }
 
 type authenticator interface {
@@ -462,11 +1020,21 @@ type authenticator interface {
 // A http.HandlerFunc wrapper which requires successful basic
 // authentication for all requests.
 func basicAuthWrapper(handler http.HandlerFunc, authenticator *auth.BasicAuth) http.HandlerFunc {
-	return auth.JustCheck(authenticator, handler)
+	return authenticator.Wrap(withClientIdentity(handler))
 }
 
 func ldapAuthWrapper(handler http.HandlerFunc, authenticator authenticator) http.HandlerFunc {
-	return auth.JustCheck(authenticator, handler)
+	return authenticator.Wrap(withClientIdentity(handler))
+}
+
+// Returns an auth.AuthenticatedHandlerFunc which records the authenticated
+// username in the request context, and then calls handler.
+func withClientIdentity(handler http.HandlerFunc) auth.AuthenticatedHandlerFunc {
+	return func(w http.ResponseWriter, ar *auth.AuthenticatedRequest) {
+		ar.Header.Set(auth.AuthUsernameHeader, ar.Username)
+		r := &ar.Request
+		handler(w, r.WithContext(server.WithClientIdentity(r.Context(), ar.Username)))
+	}
 }
 
 // A http.HandlerFunc wrapper which requires successful basic
@@ -481,8 +1049,8 @@ func unauthenticatedReadWrapper(handler http.HandlerFunc, secrets auth.SecretPro
 			return
 		}
 
-		if authenticator.CheckAuth(r) != "" {
-			handler(w, r)
+		if username := authenticator.CheckAuth(r); username != "" {
+			handler(w, r.WithContext(server.WithClientIdentity(r.Context(), username)))
 			return
 		}
 
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+
+	"google.golang.org/grpc"
+)
+
+type clientIdentityKey struct{}
+
+// WithClientIdentity returns a copy of ctx which records the authenticated
+// principal that made the request, eg a basic auth username or the common
+// name of a verified client certificate. This is used by the auth layer,
+// so that writes can be attributed to clients in the access log.
+func WithClientIdentity(ctx context.Context, identity string) context.Context {
+	if identity == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, clientIdentityKey{}, identity)
+}
+
+// ClientIdentity returns the identity recorded in ctx by
+// WithClientIdentity, or "" if there is none.
+func ClientIdentity(ctx context.Context) string {
+	identity, _ := ctx.Value(clientIdentityKey{}).(string)
+	return identity
+}
+
+// clientIdentitySuffix returns a suffix for access log lines which
+// identifies the client, or "" if there is no client identity in ctx.
+func clientIdentitySuffix(ctx context.Context) string {
+	identity := ClientIdentity(ctx)
+	if identity == "" {
+		return ""
+	}
+	return " client=" + identity
+}
+
+// certCommonName returns the common name of the client certificate
+// in state's first verified chain, or "" if there is none.
+func certCommonName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// identityServerStream is a grpc.ServerStream whose Context includes
+// the client identity.
+type identityServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func withStreamClientIdentity(ss grpc.ServerStream, identity string) grpc.ServerStream {
+	if identity == "" {
+		return ss
+	}
+	return &identityServerStream{
+		ServerStream: ss,
+		ctx:          WithClientIdentity(ss.Context(), identity),
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+	"github.com/buchgr/bazel-remote/v2/cache/disk"
+)
+
+// The minimum time between deep health check round-trips. Requests made
+// within this interval of the previous check return its result.
+const deepHealthCheckInterval = 5 * time.Second
+
+// The blob which is written to and read back from the CAS by deep health
+// checks.
+var deepHealthCanary = []byte("bazel-remote deep health check canary\n")
+
+// deepHealthCheck runs and rate limits round-trips through the cache.
+type deepHealthCheck struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	lastErr error
+}
+
+// check returns the result of the most recent round-trip through c,
+// running a new one if the previous result is too old.
+func (d *deepHealthCheck) check(c disk.Cache) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.lastRun.IsZero() && time.Since(d.lastRun) < deepHealthCheckInterval {
+		return d.lastErr
+	}
+
+	d.lastErr = canaryRoundTrip(c)
+	d.lastRun = time.Now()
+
+	return d.lastErr
+}
+
+// canaryRoundTrip writes the canary blob to the CAS, reads it back and
+// checks its contents, then removes it from the cache.
+func canaryRoundTrip(c disk.Cache) error {
+	ctx := context.Background()
+
+	hashBytes := sha256.Sum256(deepHealthCanary)
+	hash := hex.EncodeToString(hashBytes[:])
+	size := int64(len(deepHealthCanary))
+
+	err := c.Put(ctx, cache.CAS, hash, size, bytes.NewReader(deepHealthCanary))
+	if err != nil {
+		return fmt.Errorf("failed to write canary blob: %w", err)
+	}
+	defer c.Remove(cache.CAS, hash)
+
+	rc, _, err := c.Get(ctx, cache.CAS, hash, size, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read canary blob: %w", err)
+	}
+	if rc == nil {
+		return errors.New("canary blob not found after it was written")
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to read canary blob: %w", err)
+	}
+
+	if !bytes.Equal(data, deepHealthCanary) {
+		return errors.New("canary blob was corrupted")
+	}
+
+	return nil
+}
+
+// DeepHealthHandler verifies that the cache can store and retrieve data,
+// by writing a small blob to the CAS, reading it back and removing it.
+// It responds with 200 if the round-trip succeeded, and 503 otherwise.
+// Round-trips are rate limited, see deepHealthCheckInterval.
+func (h *httpCache) DeepHealthHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	err := h.deepHealth.check(h.cache)
+	if err != nil {
+		h.errorLogger.Printf("Deep health check failed: %s", err.Error())
+		http.Error(w, "Deep health check failed: "+err.Error(), http.StatusServiceUnavailable)
+		h.logResponse(http.StatusServiceUnavailable, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == http.MethodGet {
+		_, _ = w.Write([]byte("OK\n"))
+	}
+	h.logResponse(http.StatusOK, r)
+}
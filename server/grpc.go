@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
@@ -13,6 +16,7 @@ import (
 	_ "google.golang.org/grpc/encoding/gzip" // Register gzip support.
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
@@ -26,6 +30,8 @@ import (
 
 	_ "github.com/mostynb/go-grpc-compression/snappy" // Register snappy
 	_ "github.com/mostynb/go-grpc-compression/zstd"   // and zstd support.
+
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -41,6 +47,358 @@ type grpcServer struct {
 	errorLogger  cache.Logger
 	depsCheck    bool
 	mangleACKeys bool
+
+	// Nil unless resumable bytestream writes are enabled.
+	partialUploads *partialUploadStore
+
+	disableAC         bool
+	disableCAS        bool
+	disableByteStream bool
+
+	// The maximum depth of GetTree results, or 0 for no limit.
+	maxTreeDepth int
+
+	// Limits the number of concurrent GetTree calls, or nil for no limit.
+	getTreeSem *semaphore.Weighted
+
+	// The maximum total size of the Directory blobs in a GetTree
+	// response, or 0 for no limit.
+	maxGetTreeTotalBytes int64
+
+	// The maximum total size of the blobs in a BatchReadBlobs request,
+	// or 0 for no limit. This is advertised by GetCapabilities.
+	maxBatchTotalSize int64
+
+	// Bytestream writes of blobs larger than this are rejected, or 0 for
+	// no limit.
+	maxBlobSize int64
+
+	// BatchReadBlobs returns blobs smaller than this uncompressed, even
+	// if the client accepts compressed blobs.
+	minResponseCompressSize int64
+
+	// If true, duplicate digests in BatchReadBlobs and BatchUpdateBlobs
+	// requests are only processed once.
+	dedupeBatches bool
+
+	// If true, UpdateActionResult also checks inlined blobs against
+	// their digests.
+	strictACValidation bool
+
+	// If true, UpdateActionResult keeps client-supplied ExecutionMetadata
+	// as it is, instead of filling in the worker.
+	preserveACExecutionMetadata bool
+
+	// If non-nil, limits the rate of outbound asset fetches.
+	assetRateLimiter *assetRateLimiter
+
+	// Limits the number of concurrent outbound asset fetches, or nil for
+	// no limit.
+	assetFetchSem *semaphore.Weighted
+
+	// If true, access log lines for writes include the client identity.
+	logClientIdentity bool
+
+	// If non-empty, only these instance names are accepted.
+	allowedInstances map[string]struct{}
+
+	// Instance names which are always rejected.
+	deniedInstances map[string]struct{}
+
+	// The status code for bytestream writes which end before the amount
+	// of data in the resource name has been received.
+	sizeMismatchCode codes.Code
+
+	// The maximum total size of the blobs inlined in a GetActionResult
+	// response, or 0 to disable inlining.
+	maxInlineSize int64
+
+	// Inlined blobs larger than this are moved from ActionResults to the
+	// CAS by UpdateActionResult, or 0 to store them as they are.
+	maxACInlineSize int64
+
+	// The maximum numbers of outputs in ActionResults accepted by
+	// UpdateActionResult.
+	acOutputLimits validate.OutputLimits
+}
+
+// GRPCOption configures optional features of the gRPC server.
+type GRPCOption func(*grpcServer) error
+
+// WithEnabledServices controls which of the ActionCache,
+// ContentAddressableStorage and ByteStream services are registered.
+// RPCs for disabled services fail with Unimplemented.
+func WithEnabledServices(ac bool, cas bool, byteStream bool) GRPCOption {
+	return func(s *grpcServer) error {
+		s.disableAC = !ac
+		s.disableCAS = !cas
+		s.disableByteStream = !byteStream
+		return nil
+	}
+}
+
+// WithMaxTreeDepth makes GetTree fail with InvalidArgument for directory
+// trees that are nested more than depth levels deep.
+func WithMaxTreeDepth(depth int) GRPCOption {
+	return func(s *grpcServer) error {
+		s.maxTreeDepth = depth
+		return nil
+	}
+}
+
+// WithMaxConcurrentGetTree limits the number of GetTree calls which can
+// run at the same time, since each of them buffers a whole directory tree
+// in memory. GetTree calls beyond this limit fail with ResourceExhausted.
+func WithMaxConcurrentGetTree(n int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid max concurrent GetTree calls: %d", n)
+		}
+		s.getTreeSem = semaphore.NewWeighted(n)
+		return nil
+	}
+}
+
+// WithMaxGetTreeTotalBytes makes GetTree fail with ResourceExhausted once
+// the total size of the Directory blobs it has read exceeds size bytes.
+func WithMaxGetTreeTotalBytes(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid max GetTree total bytes: %d", size)
+		}
+		s.maxGetTreeTotalBytes = size
+		return nil
+	}
+}
+
+// WithMaxBatchTotalSize limits the total size of the blobs that can be
+// requested in a single BatchReadBlobs call, since the whole response is
+// buffered in memory. Larger batches fail with ResourceExhausted. The
+// limit is advertised to clients as max_batch_total_size_bytes, so that
+// they can split their requests.
+func WithMaxBatchTotalSize(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid max batch total size: %d", size)
+		}
+		s.maxBatchTotalSize = size
+		return nil
+	}
+}
+
+// WithMaxACInlineSize makes UpdateActionResult store inlined stdout,
+// stderr and output file contents larger than size bytes in the CAS, and
+// only keep their digests in the AC entry.
+func WithMaxACInlineSize(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid max AC inline size: %d", size)
+		}
+		s.maxACInlineSize = size
+		return nil
+	}
+}
+
+// WithMaxACOutputs makes UpdateActionResult reject ActionResults with
+// more than the given numbers of output files, output directories or
+// output symlinks. Zero means no limit.
+func WithMaxACOutputs(files int, directories int, symlinks int) GRPCOption {
+	return func(s *grpcServer) error {
+		if files < 0 || directories < 0 || symlinks < 0 {
+			return fmt.Errorf("Invalid max AC outputs: %d files, %d directories, %d symlinks",
+				files, directories, symlinks)
+		}
+		s.acOutputLimits = validate.OutputLimits{
+			MaxFiles:       files,
+			MaxDirectories: directories,
+			MaxSymlinks:    symlinks,
+		}
+		return nil
+	}
+}
+
+// WithMinResponseCompressSize makes BatchReadBlobs return blobs smaller
+// than size bytes uncompressed, even if the client accepts zstd.
+func WithMinResponseCompressSize(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid min response compress size: %d", size)
+		}
+		s.minResponseCompressSize = size
+		return nil
+	}
+}
+
+// WithMaxBlobSize makes bytestream writes with a declared size larger than
+// size bytes fail with InvalidArgument as soon as the resource name is
+// parsed, before any space is reserved in the cache.
+func WithMaxBlobSize(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size <= 0 {
+			return fmt.Errorf("Invalid max blob size: %d", size)
+		}
+		s.maxBlobSize = size
+		return nil
+	}
+}
+
+// WithMaxInlineSize sets the maximum total size of the stdout, stderr
+// and output file contents which are inlined in GetActionResult responses
+// when clients request them. Blobs which would exceed this limit are
+// returned by digest only. A size of 0 disables inlining.
+func WithMaxInlineSize(size int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if size < 0 {
+			return fmt.Errorf("Invalid max inline size: %d", size)
+		}
+		s.maxInlineSize = size
+		return nil
+	}
+}
+
+// WithBatchDeduplication makes BatchReadBlobs and BatchUpdateBlobs only
+// read or store each distinct digest in a request once. The response still
+// contains one entry for each digest in the request, in the same order.
+func WithBatchDeduplication() GRPCOption {
+	return func(s *grpcServer) error {
+		s.dedupeBatches = true
+		return nil
+	}
+}
+
+// WithStrictACValidation makes UpdateActionResult fail with
+// InvalidArgument if any inlined output file contents, stdout or stderr
+// do not match their digests.
+func WithStrictACValidation() GRPCOption {
+	return func(s *grpcServer) error {
+		s.strictACValidation = true
+		return nil
+	}
+}
+
+// WithPreserveACExecutionMetadata makes UpdateActionResult store the
+// ExecutionMetadata of ActionResults unchanged when the client supplies
+// it. By default the worker is set to the client's address if missing.
+func WithPreserveACExecutionMetadata() GRPCOption {
+	return func(s *grpcServer) error {
+		s.preserveACExecutionMetadata = true
+		return nil
+	}
+}
+
+// WithAssetFetchRateLimit limits the rate of outbound requests made by the
+// remote asset API's FetchBlob, to globalRate requests per second in total
+// and perHostRate requests per second to each host. A rate of 0 means no
+// limit. FetchBlob waits for the limit if possible, and otherwise fails
+// with RESOURCE_EXHAUSTED.
+func WithAssetFetchRateLimit(globalRate float64, perHostRate float64) GRPCOption {
+	return func(s *grpcServer) error {
+		if globalRate < 0 || perHostRate < 0 {
+			return fmt.Errorf("Invalid asset fetch rate limits: %v, %v", globalRate, perHostRate)
+		}
+		if globalRate > 0 || perHostRate > 0 {
+			s.assetRateLimiter = newAssetRateLimiter(globalRate, perHostRate)
+		}
+		return nil
+	}
+}
+
+// WithMaxConcurrentAssetFetches limits the number of outbound downloads
+// that the remote asset API's FetchBlob can make at the same time, since
+// each of them may buffer a whole blob in memory. FetchBlob calls which
+// need to download beyond this limit fail with ResourceExhausted.
+func WithMaxConcurrentAssetFetches(n int64) GRPCOption {
+	return func(s *grpcServer) error {
+		if n <= 0 {
+			return fmt.Errorf("Invalid max concurrent asset fetches: %d", n)
+		}
+		s.assetFetchSem = semaphore.NewWeighted(n)
+		return nil
+	}
+}
+
+// WithClientIdentityLogging makes access log lines for successful writes
+// include the identity of the authenticated client, if any.
+func WithClientIdentityLogging() GRPCOption {
+	return func(s *grpcServer) error {
+		s.logClientIdentity = true
+		return nil
+	}
+}
+
+// clientSuffix returns a suffix for write access log lines, which
+// identifies the client if client identity logging is enabled.
+func (s *grpcServer) clientSuffix(ctx context.Context) string {
+	if !s.logClientIdentity {
+		return ""
+	}
+	return clientIdentitySuffix(ctx)
+}
+
+// WithInstanceFilter makes requests for instance names which are not in
+// allowed (unless allowed is empty), or which are in denied, fail with
+// PermissionDenied.
+func WithInstanceFilter(allowed []string, denied []string) GRPCOption {
+	return func(s *grpcServer) error {
+		if len(allowed) > 0 {
+			s.allowedInstances = make(map[string]struct{}, len(allowed))
+			for _, instance := range allowed {
+				s.allowedInstances[instance] = struct{}{}
+			}
+		}
+
+		if len(denied) > 0 {
+			s.deniedInstances = make(map[string]struct{}, len(denied))
+			for _, instance := range denied {
+				s.deniedInstances[instance] = struct{}{}
+			}
+		}
+
+		return nil
+	}
+}
+
+// Status codes which can be used for bytestream writes with too little data,
+// see WithWriteSizeMismatchCode.
+var writeSizeMismatchCodes = map[string]codes.Code{
+	"invalid_argument": codes.InvalidArgument,
+	"data_loss":        codes.DataLoss,
+	"aborted":          codes.Aborted,
+	"unknown":          codes.Unknown,
+}
+
+// WithWriteSizeMismatchCode sets the status code returned when a bytestream
+// write finishes before the amount of data in the resource name has been
+// received, eg because the client truncated the upload. It must be one of
+// "invalid_argument" (the default), "data_loss", "aborted" or "unknown".
+func WithWriteSizeMismatchCode(code string) GRPCOption {
+	return func(s *grpcServer) error {
+		c, ok := writeSizeMismatchCodes[code]
+		if !ok {
+			return fmt.Errorf("Invalid write size mismatch code: %q", code)
+		}
+		s.sizeMismatchCode = c
+		return nil
+	}
+}
+
+// WithResumableUploads enables resumable bytestream writes. Data for
+// incomplete uploads is stored in dir, and removed on startup. Writes
+// fail if the incomplete uploads would exceed maxSize bytes in total,
+// and incomplete uploads which have not been written to for ttl are
+// removed. Zero values mean no limit.
+func WithResumableUploads(dir string, maxSize int64, ttl time.Duration) GRPCOption {
+	return func(s *grpcServer) error {
+		if maxSize < 0 || ttl < 0 {
+			return fmt.Errorf("Invalid resumable uploads limits: %d bytes, %s", maxSize, ttl)
+		}
+		p, err := newPartialUploadStore(dir, maxSize, ttl)
+		if err != nil {
+			return err
+		}
+		s.partialUploads = p
+		return nil
+	}
 }
 
 var readOnlyMethods = map[string]struct{}{
@@ -61,31 +419,47 @@ func ListenAndServeGRPC(
 	validateACDeps bool,
 	mangleACKeys bool,
 	enableRemoteAssetAPI bool,
-	c disk.Cache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger,
+	opts ...GRPCOption) error {
 
 	listener, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	return ServeGRPC(listener, srv, validateACDeps, mangleACKeys, enableRemoteAssetAPI, c, a, e)
+	return ServeGRPC(listener, srv, validateACDeps, mangleACKeys, enableRemoteAssetAPI, c, a, e, opts...)
 }
 
 func ServeGRPC(l net.Listener, srv *grpc.Server,
 	validateACDepsCheck bool,
 	mangleACKeys bool,
 	enableRemoteAssetAPI bool,
-	c disk.Cache, a cache.Logger, e cache.Logger) error {
+	c disk.Cache, a cache.Logger, e cache.Logger,
+	opts ...GRPCOption) error {
 
 	s := &grpcServer{
 		cache: c, accessLogger: a, errorLogger: e,
-		depsCheck:    validateACDepsCheck,
-		mangleACKeys: mangleACKeys,
+		depsCheck:        validateACDepsCheck,
+		mangleACKeys:     mangleACKeys,
+		sizeMismatchCode: codes.InvalidArgument,
+		maxInlineSize:    defaultMaxInlineSize,
+	}
+	for _, o := range opts {
+		err := o(s)
+		if err != nil {
+			return err
+		}
+	}
+	if !s.disableAC {
+		pb.RegisterActionCacheServer(srv, s)
 	}
-	pb.RegisterActionCacheServer(srv, s)
 	pb.RegisterCapabilitiesServer(srv, s)
-	pb.RegisterContentAddressableStorageServer(srv, s)
-	bytestream.RegisterByteStreamServer(srv, s)
+	if !s.disableCAS {
+		pb.RegisterContentAddressableStorageServer(srv, s)
+	}
+	if !s.disableByteStream {
+		bytestream.RegisterByteStreamServer(srv, s)
+	}
 	if enableRemoteAssetAPI {
 		asset.RegisterFetchServer(srv, s)
 	}
@@ -102,13 +476,18 @@ func ServeGRPC(l net.Listener, srv *grpc.Server,
 func (s *grpcServer) GetCapabilities(ctx context.Context,
 	req *pb.GetCapabilitiesRequest) (*pb.ServerCapabilities, error) {
 
-	// Instance name is currently ignored.
+	if req != nil {
+		err := s.checkInstance(req.InstanceName, "GRPC GETCAPABILITIES")
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	resp := pb.ServerCapabilities{
 		CacheCapabilities: &pb.CacheCapabilities{
 			DigestFunctions: []pb.DigestFunction_Value{pb.DigestFunction_SHA256},
 			ActionCacheUpdateCapabilities: &pb.ActionCacheUpdateCapabilities{
-				UpdateEnabled: true,
+				UpdateEnabled: !s.disableAC,
 			},
 			CachePriorityCapabilities: &pb.PriorityCapabilities{
 				Priorities: []*pb.PriorityCapabilities_PriorityRange{
@@ -118,7 +497,7 @@ func (s *grpcServer) GetCapabilities(ctx context.Context,
 					},
 				},
 			},
-			MaxBatchTotalSizeBytes:          0, // "no limit"
+			MaxBatchTotalSizeBytes:          s.maxBatchTotalSize, // 0 means "no limit"
 			SymlinkAbsolutePathStrategy:     pb.SymlinkAbsolutePathStrategy_ALLOWED,
 			SupportedCompressors:            []pb.Compressor_Value{pb.Compressor_ZSTD},
 			SupportedBatchUpdateCompressors: []pb.Compressor_Value{pb.Compressor_ZSTD},
@@ -127,11 +506,42 @@ func (s *grpcServer) GetCapabilities(ctx context.Context,
 		HighApiVersion: &semver.SemVer{Major: int32(2), Minor: int32(3)},
 	}
 
-	s.accessLogger.Printf("GRPC GETCAPABILITIES")
+	cache.LogSuccess(s.accessLogger, "GRPC GETCAPABILITIES")
 
 	return &resp, nil
 }
 
+// Return a PermissionDenied error if requests for `instance` are not
+// allowed.
+func (s *grpcServer) checkInstance(instance string, logPrefix string) error {
+	_, denied := s.deniedInstances[instance]
+	if !denied && s.allowedInstances != nil {
+		_, allowed := s.allowedInstances[instance]
+		denied = !allowed
+	}
+
+	if denied {
+		msg := fmt.Sprintf("Instance name not allowed: %q", instance)
+		s.accessLogger.Printf("%s: %s", logPrefix, msg)
+		return status.Error(codes.PermissionDenied, msg)
+	}
+
+	return nil
+}
+
+// checkDigestFunction returns an InvalidArgument error if df is not a
+// supported digest function. Requests which do not specify a digest
+// function are assumed to use SHA256.
+func (s *grpcServer) checkDigestFunction(df pb.DigestFunction_Value, logPrefix string) error {
+	if df == pb.DigestFunction_UNKNOWN || df == pb.DigestFunction_SHA256 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("Unsupported digest function: %s, only SHA256 is supported", df)
+	s.accessLogger.Printf("%s: %s", logPrefix, msg)
+	return status.Error(codes.InvalidArgument, msg)
+}
+
 // Return an error if `hash` is not a valid cache key.
 func (s *grpcServer) validateHash(hash string, size int64, logPrefix string) error {
 	if size == int64(0) {
@@ -173,12 +583,12 @@ func GRPCmTLSStreamServerInterceptor(allowUnauthenticatedReads bool) grpc.Stream
 			}
 		}
 
-		err := checkGRPCClientCert(ss.Context())
+		identity, err := checkGRPCClientCert(ss.Context())
 		if err != nil {
 			return err
 		}
 
-		return handler(srv, ss)
+		return handler(srv, withStreamClientIdentity(ss, identity))
 	}
 }
 
@@ -201,34 +611,35 @@ func GRPCmTLSUnaryServerInterceptor(allowUnauthenticatedReads bool) grpc.UnarySe
 			}
 		}
 
-		err := checkGRPCClientCert(ctx)
+		identity, err := checkGRPCClientCert(ctx)
 		if err != nil {
 			return nil, err
 		}
 
-		return handler(ctx, req)
+		return handler(WithClientIdentity(ctx, identity), req)
 	}
 }
 
 // Return a non-nil grpc error if a valid client certificate can't be
-// extracted from ctx. This is only used with mTLS authentication.
-func checkGRPCClientCert(ctx context.Context) error {
+// extracted from ctx, otherwise return the certificate's common name.
+// This is only used with mTLS authentication.
+func checkGRPCClientCert(ctx context.Context) (string, error) {
 
 	p, ok := peer.FromContext(ctx)
 	if !ok {
-		return status.Error(codes.Unauthenticated, "no peer found")
+		return "", status.Error(codes.Unauthenticated, "no peer found")
 	}
 
 	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
 	if !ok {
-		return status.Error(codes.Unauthenticated, "unrecognised peer transport credentials")
+		return "", status.Error(codes.Unauthenticated, "unrecognised peer transport credentials")
 	}
 
 	if len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
-		return status.Error(codes.Unauthenticated, "could not verify peer certificate")
+		return "", status.Error(codes.Unauthenticated, "could not verify peer certificate")
 	}
 
-	return nil
+	return certCommonName(&tlsInfo.State), nil
 }
 
 // Return a grpc code based on err, or fall back to returning
@@ -242,6 +653,39 @@ func gRPCErrCode(err error, dflt codes.Code) codes.Code {
 	if ok && cerr.Code == http.StatusBadRequest {
 		return codes.InvalidArgument
 	}
+	if ok && cerr.Code == http.StatusConflict {
+		return codes.AlreadyExists
+	}
+	if ok && cerr.Code == http.StatusForbidden {
+		return codes.PermissionDenied
+	}
+	if ok && cerr.Code == http.StatusServiceUnavailable {
+		return codes.Unavailable
+	}
 
 	return dflt
 }
+
+// Return a context derived from ctx which prevents cache lookups from
+// updating the LRU order, if the client requested this via gRPC metadata.
+// Otherwise return ctx unmodified.
+func noPromoteContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+
+	for _, v := range md.Get(strings.ToLower(cache.NoPromoteHeader)) {
+		if isTrue(v) {
+			return cache.WithNoPromote(ctx)
+		}
+	}
+
+	return ctx
+}
+
+// Return true if s is a valid boolean string with a true value.
+func isTrue(s string) bool {
+	b, err := strconv.ParseBool(s)
+	return err == nil && b
+}
@@ -39,7 +39,7 @@ const (
 	// gRPC by default rejects messages larger than 4M.
 	// Inline a little less than this, enough so we don't
 	// need to worry about serialization overhead.
-	maxInlineSize = 3 * 1024 * 1024 // 3M
+	defaultMaxInlineSize = 3 * 1024 * 1024 // 3M
 )
 
 // ActionCache interface:
@@ -49,6 +49,8 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 
 	logPrefix := "GRPC AC GET"
 
+	ctx = noPromoteContext(ctx)
+
 	if req == nil {
 		return nil, errNilGetActionResultRequest
 	}
@@ -57,11 +59,21 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 		return nil, errNilActionDigest
 	}
 
+	err := s.checkInstance(req.InstanceName, logPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(req.DigestFunction, logPrefix)
+	if err != nil {
+		return nil, err
+	}
+
 	if s.mangleACKeys {
 		req.ActionDigest.Hash = cache.TransformActionCacheKey(req.ActionDigest.Hash, req.InstanceName, s.accessLogger)
 	}
 
-	err := s.validateHash(req.ActionDigest.Hash, req.ActionDigest.SizeBytes, logPrefix)
+	err = s.validateHash(req.ActionDigest.Hash, req.ActionDigest.SizeBytes, logPrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +91,7 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 			return nil, status.Error(codes.Unknown, err.Error())
 		}
 		if rdr == nil || sizeBytes <= 0 {
-			s.accessLogger.Printf("%s %s %s", logPrefix, req.ActionDigest.Hash, "NOT FOUND")
+			cache.LogSuccess(s.accessLogger, "%s %s %s", logPrefix, req.ActionDigest.Hash, "NOT FOUND")
 			return nil, status.Error(codes.NotFound,
 				fmt.Sprintf("%s not found in AC", req.ActionDigest.Hash))
 		}
@@ -105,7 +117,7 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 
-		s.accessLogger.Printf("%s %s OK", logPrefix, req.ActionDigest.Hash)
+		cache.LogSuccess(s.accessLogger, "%s %s OK", logPrefix, req.ActionDigest.Hash)
 		return result, nil
 	}
 
@@ -116,7 +128,7 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 	}
 
 	if result == nil {
-		s.accessLogger.Printf("%s %s NOT FOUND", logPrefix, req.ActionDigest.Hash)
+		cache.LogSuccess(s.accessLogger, "%s %s NOT FOUND", logPrefix, req.ActionDigest.Hash)
 		return nil, status.Error(codes.NotFound,
 			fmt.Sprintf("%s not found in AC", req.ActionDigest.Hash))
 	}
@@ -152,17 +164,17 @@ func (s *grpcServer) GetActionResult(ctx context.Context,
 		}
 	}
 
-	s.accessLogger.Printf("GRPC AC GET %s OK", req.ActionDigest.Hash)
+	cache.LogSuccess(s.accessLogger, "GRPC AC GET %s OK", req.ActionDigest.Hash)
 
 	return result, nil
 }
 
 func (s *grpcServer) maybeInline(ctx context.Context, inline bool, slice *[]byte, digest **pb.Digest, inlinedSoFar *int64) error {
 
-	if (*inlinedSoFar + int64(len(*slice))) > maxInlineSize {
+	if (*inlinedSoFar + int64(len(*slice))) > s.maxInlineSize {
 		inline = false
 	} else if digest != nil && *digest != nil &&
-		(*inlinedSoFar+(*digest).SizeBytes) > maxInlineSize {
+		(*inlinedSoFar+(*digest).SizeBytes) > s.maxInlineSize {
 		inline = false
 	}
 
@@ -179,14 +191,15 @@ func (s *grpcServer) maybeInline(ctx context.Context, inline bool, slice *[]byte
 			}
 		}
 
-		found, _ := s.cache.Contains(ctx, cache.CAS, (*digest).Hash, (*digest).SizeBytes)
+		// If the proxy backend cannot be checked, store the blob anyway.
+		found, _, _ := s.cache.Contains(ctx, cache.CAS, (*digest).Hash, (*digest).SizeBytes)
 		if !found {
 			err := s.cache.Put(ctx, cache.CAS, (*digest).Hash, (*digest).SizeBytes,
 				bytes.NewReader(*slice))
 			if err != nil && err != io.EOF {
 				return err
 			}
-			s.accessLogger.Printf("GRPC CAS PUT %s OK", (*digest).Hash)
+			cache.LogSuccess(s.accessLogger, "GRPC CAS PUT %s OK", (*digest).Hash)
 		}
 
 		*slice = []byte{}
@@ -215,6 +228,41 @@ func (s *grpcServer) maybeInline(ctx context.Context, inline bool, slice *[]byte
 	return nil
 }
 
+// extractLargeInlineBlobs stores the inlined blobs in ar which are larger
+// than s.maxACInlineSize in the CAS, and replaces them with their digests,
+// so that they do not bloat the AC entry.
+func (s *grpcServer) extractLargeInlineBlobs(ctx context.Context, ar *pb.ActionResult) error {
+	var unused int64
+	extract := func(slice *[]byte, digest **pb.Digest) error {
+		if int64(len(*slice)) <= s.maxACInlineSize {
+			return nil
+		}
+		return s.maybeInline(ctx, false, slice, digest, &unused)
+	}
+
+	err := extract(&ar.StdoutRaw, &ar.StdoutDigest)
+	if err != nil {
+		return err
+	}
+
+	err = extract(&ar.StderrRaw, &ar.StderrDigest)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range ar.OutputFiles {
+		if f == nil {
+			continue
+		}
+		err = extract(&f.Contents, &f.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *grpcServer) UpdateActionResult(ctx context.Context,
 	req *pb.UpdateActionResultRequest) (*pb.ActionResult, error) {
 
@@ -228,11 +276,21 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 		return nil, errNilActionDigest
 	}
 
+	err := s.checkInstance(req.InstanceName, logPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(req.DigestFunction, logPrefix)
+	if err != nil {
+		return nil, err
+	}
+
 	if s.mangleACKeys {
 		req.ActionDigest.Hash = cache.TransformActionCacheKey(req.ActionDigest.Hash, req.InstanceName, s.accessLogger)
 	}
 
-	err := s.validateHash(req.ActionDigest.Hash, req.ActionDigest.SizeBytes, logPrefix)
+	err = s.validateHash(req.ActionDigest.Hash, req.ActionDigest.SizeBytes, logPrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -243,8 +301,33 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 		return nil, err
 	}
 
+	err = validate.OutputCounts(req.ActionResult, s.acOutputLimits)
+	if err != nil {
+		s.accessLogger.Printf("%s %s %s", logPrefix, req.ActionDigest.Hash, err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if s.strictACValidation {
+		err = validate.InlineBlobs(req.ActionResult)
+		if err != nil {
+			s.accessLogger.Printf("%s %s %s", logPrefix, req.ActionDigest.Hash, err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if s.maxACInlineSize > 0 {
+		err = s.extractLargeInlineBlobs(ctx, req.ActionResult)
+		if err != nil {
+			s.accessLogger.Printf("%s %s %s", logPrefix, req.ActionDigest.Hash, err)
+			code := gRPCErrCode(err, codes.Internal)
+			return nil, status.Error(code, err.Error())
+		}
+	}
+
 	// Ensure that the serialized ActionResult has non-zero length.
-	addWorkerMetadataGRPC(ctx, req.ActionResult)
+	if !s.preserveACExecutionMetadata || req.ActionResult.ExecutionMetadata == nil {
+		addWorkerMetadataGRPC(ctx, req.ActionResult)
+	}
 
 	data, err := proto.Marshal(req.ActionResult)
 	if err != nil {
@@ -258,6 +341,10 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 		return nil, errEmptyActionResult
 	}
 
+	if req.InstanceName != "" {
+		ctx = cache.WithTag(ctx, req.InstanceName)
+	}
+
 	err = s.cache.Put(ctx, cache.AC, req.ActionDigest.Hash,
 		int64(len(data)), bytes.NewReader(data))
 	if err != nil && err != io.EOF {
@@ -289,7 +376,7 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 				code := gRPCErrCode(err, codes.Internal)
 				return nil, status.Error(code, err.Error())
 			}
-			s.accessLogger.Printf("GRPC CAS PUT %s OK", f.Digest.Hash)
+			cache.LogSuccess(s.accessLogger, "GRPC CAS PUT %s OK%s", f.Digest.Hash, s.clientSuffix(ctx))
 		}
 	}
 
@@ -312,7 +399,7 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 			code := gRPCErrCode(err, codes.Internal)
 			return nil, status.Error(code, err.Error())
 		}
-		s.accessLogger.Printf("GRPC CAS PUT %s OK", hash)
+		cache.LogSuccess(s.accessLogger, "GRPC CAS PUT %s OK%s", hash, s.clientSuffix(ctx))
 	}
 
 	if len(req.ActionResult.StderrRaw) > 0 {
@@ -334,10 +421,10 @@ func (s *grpcServer) UpdateActionResult(ctx context.Context,
 			code := gRPCErrCode(err, codes.Internal)
 			return nil, status.Error(code, err.Error())
 		}
-		s.accessLogger.Printf("GRPC CAS PUT %s OK", hash)
+		cache.LogSuccess(s.accessLogger, "GRPC CAS PUT %s OK%s", hash, s.clientSuffix(ctx))
 	}
 
-	s.accessLogger.Printf("GRPC AC PUT %s OK", req.ActionDigest.Hash)
+	cache.LogSuccess(s.accessLogger, "GRPC AC PUT %s OK%s", req.ActionDigest.Hash, s.clientSuffix(ctx))
 
 	// Trivia: the RE API wants us to return the ActionResult from the
 	// request, in order to follow this standard method style guide:
@@ -6,6 +6,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"net/url"
@@ -56,6 +59,16 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 		return nil, errNilFetchBlobRequest
 	}
 
+	err := s.checkInstance(req.InstanceName, "GRPC ASSET FETCH")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(req.DigestFunction, "GRPC ASSET FETCH")
+	if err != nil {
+		return nil, err
+	}
+
 	headers := http.Header{}
 
 	for _, q := range req.GetQualifiers() {
@@ -90,7 +103,11 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 
 			sha256Str = hex.EncodeToString(decoded)
 
-			found, size := s.cache.Contains(ctx, cache.CAS, sha256Str, -1)
+			found, size, err := s.cache.Contains(ctx, cache.CAS, sha256Str, -1)
+			if err != nil {
+				s.accessLogger.Printf("GRPC ASSET FETCH %s %s", fetchRequestDetails(req), err)
+				return nil, grpc_status.Error(gRPCErrCode(err, codes.Internal), err.Error())
+			}
 			if !found {
 				continue
 			}
@@ -109,6 +126,9 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 				size = actualSize
 			}
 
+			cache.LogSuccess(s.accessLogger, "GRPC ASSET FETCH %s %s/%d CACHE HIT",
+				fetchRequestDetails(req), sha256Str, size)
+
 			return &asset.FetchBlobResponse{
 				Status: &status.Status{Code: int32(codes.OK)},
 				BlobDigest: &pb.Digest{
@@ -123,9 +143,23 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 
 	// See if we can download one of the URIs.
 
+	var mismatches []string
 	for _, uri := range req.GetUris() {
-		ok, actualHash, size := s.fetchItem(ctx, uri, headers, sha256Str)
+		ok, actualHash, size, err := s.fetchItem(ctx, uri, headers, sha256Str)
+		var mismatch *assetDigestMismatchError
+		if errors.As(err, &mismatch) {
+			s.errorLogger.Printf("GRPC ASSET FETCH %s", mismatch)
+			mismatches = append(mismatches, mismatch.Error())
+			continue
+		}
+		if err != nil {
+			s.accessLogger.Printf("GRPC ASSET FETCH %s %s", fetchRequestDetails(req), err)
+			return nil, err
+		}
 		if ok {
+			cache.LogSuccess(s.accessLogger, "GRPC ASSET FETCH %s %s/%d FETCHED uri=%q",
+				fetchRequestDetails(req), actualHash, size, uri)
+
 			return &asset.FetchBlobResponse{
 				Status: &status.Status{Code: int32(codes.OK)},
 				BlobDigest: &pb.Digest{
@@ -139,27 +173,107 @@ func (s *grpcServer) FetchBlob(ctx context.Context, req *asset.FetchBlobRequest)
 		// Not a simple file. Not yet handled...
 	}
 
+	if len(mismatches) > 0 {
+		// Don't report this as a successful cache miss.
+		s.accessLogger.Printf("GRPC ASSET FETCH %s DIGEST MISMATCH",
+			fetchRequestDetails(req))
+
+		return &asset.FetchBlobResponse{
+			Status: &status.Status{
+				Code:    int32(codes.NotFound),
+				Message: strings.Join(mismatches, "; "),
+			},
+		}, nil
+	}
+
+	cache.LogSuccess(s.accessLogger, "GRPC ASSET FETCH %s NOT FOUND",
+		fetchRequestDetails(req))
+
 	return &asset.FetchBlobResponse{
 		Status: &status.Status{Code: int32(codes.NotFound)},
 	}, nil
 }
 
-func (s *grpcServer) fetchItem(ctx context.Context, uri string, headers http.Header, expectedHash string) (bool, string, int64) {
+// fetchRequestDetails returns a description of the URIs and qualifiers of
+// a FetchBlobRequest for the access log. The values of http_header
+// qualifiers are omitted, since they might contain credentials.
+func fetchRequestDetails(req *asset.FetchBlobRequest) string {
+	qualifiers := make([]string, 0, len(req.GetQualifiers()))
+	for _, q := range req.GetQualifiers() {
+		if strings.HasPrefix(q.GetName(), "http_header:") {
+			qualifiers = append(qualifiers, q.GetName()+"=<redacted>")
+			continue
+		}
+		qualifiers = append(qualifiers, q.GetName()+"="+q.GetValue())
+	}
+
+	return fmt.Sprintf("uris=%q qualifiers=%q", req.GetUris(), qualifiers)
+}
+
+// assetDigestMismatchError is returned by fetchItem when the downloaded
+// data does not match the expected SHA256 hash.
+type assetDigestMismatchError struct {
+	uri      string
+	actual   string
+	expected string
+}
+
+func (e *assetDigestMismatchError) Error() string {
+	return fmt.Sprintf("data downloaded from %s has SHA256 hash %s, expected %s",
+		e.uri, e.actual, e.expected)
+}
+
+// hashingReader computes the SHA256 hash of the data read through it.
+type hashingReader struct {
+	r      io.Reader
+	hasher hash.Hash
+	eof    bool
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	_, _ = h.hasher.Write(p[:n])
+	if err == io.EOF {
+		h.eof = true
+	}
+	return n, err
+}
+
+// fetchItem tries to download uri and store it in the CAS. If expectedHash
+// is set, data which does not match it is not stored, and an
+// *assetDigestMismatchError is returned. Other errors are only returned if
+// the request should fail, rather than trying the next URI.
+func (s *grpcServer) fetchItem(ctx context.Context, uri string, headers http.Header, expectedHash string) (bool, string, int64, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
 		s.errorLogger.Printf("unable to parse URI: %s err: %v", uri, err)
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
 	}
 
 	if u.Scheme != "http" && u.Scheme != "https" {
 		s.errorLogger.Printf("unsupported URI: %s", uri)
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
+	}
+
+	if s.assetRateLimiter != nil {
+		err = s.assetRateLimiter.wait(ctx, u.Hostname())
+		if err != nil {
+			return false, "", int64(-1), err
+		}
+	}
+
+	if s.assetFetchSem != nil {
+		if !s.assetFetchSem.TryAcquire(1) {
+			return false, "", int64(-1), grpc_status.Error(codes.ResourceExhausted,
+				"Too many concurrent asset fetches, try again later")
+		}
+		defer s.assetFetchSem.Release(1)
 	}
 
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 	if err != nil {
 		s.errorLogger.Printf("failed to create http.Request: %s err: %v", uri, err)
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
 	}
 
 	req.Header = headers
@@ -167,14 +281,14 @@ func (s *grpcServer) fetchItem(ctx context.Context, uri string, headers http.Hea
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		s.errorLogger.Printf("failed to get URI: %s err: %v", uri, err)
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
 	}
 	defer resp.Body.Close()
 	rc := resp.Body
 
-	s.accessLogger.Printf("GRPC ASSET FETCH %s %s", uri, resp.Status)
+	cache.LogSuccess(s.accessLogger, "GRPC ASSET FETCH %s %s", uri, resp.Status)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
 	}
 
 	expectedSize := resp.ContentLength
@@ -184,7 +298,7 @@ func (s *grpcServer) fetchItem(ctx context.Context, uri string, headers http.Hea
 		data, err := io.ReadAll(resp.Body)
 		if err != nil {
 			s.errorLogger.Printf("failed to read data: %v", uri)
-			return false, "", int64(-1)
+			return false, "", int64(-1), nil
 		}
 
 		expectedSize = int64(len(data))
@@ -192,22 +306,32 @@ func (s *grpcServer) fetchItem(ctx context.Context, uri string, headers http.Hea
 		hashStr := hex.EncodeToString(hashBytes[:])
 
 		if expectedHash != "" && hashStr != expectedHash {
-			s.errorLogger.Printf("URI data has hash %s, expected %s",
-				hashStr, expectedHash)
-			return false, "", int64(-1)
+			return false, "", int64(-1), &assetDigestMismatchError{
+				uri: uri, actual: hashStr, expected: expectedHash,
+			}
 		}
 
 		expectedHash = hashStr
 		rc = io.NopCloser(bytes.NewReader(data))
 	}
 
-	err = s.cache.Put(ctx, cache.CAS, expectedHash, expectedSize, rc)
+	// The disk cache also checks the hash of CAS blobs when they are
+	// stored, but this lets us report mismatches clearly.
+	hr := &hashingReader{r: rc, hasher: sha256.New()}
+
+	err = s.cache.Put(ctx, cache.CAS, expectedHash, expectedSize, hr)
 	if err != nil && err != io.EOF {
+		actualHash := hex.EncodeToString(hr.hasher.Sum(nil))
+		if hr.eof && actualHash != expectedHash {
+			return false, "", int64(-1), &assetDigestMismatchError{
+				uri: uri, actual: actualHash, expected: expectedHash,
+			}
+		}
 		s.errorLogger.Printf("failed to Put %s: %v", expectedHash, err)
-		return false, "", int64(-1)
+		return false, "", int64(-1), nil
 	}
 
-	return true, expectedHash, expectedSize
+	return true, expectedHash, expectedSize, nil
 }
 
 func (s *grpcServer) FetchDirectory(context.Context, *asset.FetchDirectoryRequest) (*asset.FetchDirectoryResponse, error) {
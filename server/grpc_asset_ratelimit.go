@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The number of per-host token buckets to keep before idle ones are
+// dropped.
+const maxAssetFetchHosts = 1000
+
+// tokenBucket is a simple token bucket rate limiter, which allows bursts
+// of up to one second's worth of requests. It is not safe for concurrent
+// use, the caller must synchronize access.
+type tokenBucket struct {
+	rate   float64 // Tokens per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// wait returns how long the caller must wait before a token is available.
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full returns true if the bucket would be unchanged by being recreated.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// assetRateLimiter limits the rate of outbound asset fetches, both in
+// total and per target host.
+type assetRateLimiter struct {
+	globalRate  float64
+	perHostRate float64
+
+	mu     sync.Mutex
+	global *tokenBucket
+	hosts  map[string]*tokenBucket
+
+	now func() time.Time
+}
+
+func newAssetRateLimiter(globalRate float64, perHostRate float64) *assetRateLimiter {
+	return &assetRateLimiter{
+		globalRate:  globalRate,
+		perHostRate: perHostRate,
+		hosts:       make(map[string]*tokenBucket),
+		now:         time.Now,
+	}
+}
+
+// reserve takes a token from each of the relevant buckets if they all have
+// one available. Otherwise it returns how long to wait before trying again.
+func (l *assetRateLimiter) reserve(host string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	buckets := make([]*tokenBucket, 0, 2)
+
+	if l.perHostRate > 0 {
+		b, ok := l.hosts[host]
+		if !ok {
+			if len(l.hosts) >= maxAssetFetchHosts {
+				for h, hb := range l.hosts {
+					if hb.full(now) {
+						delete(l.hosts, h)
+					}
+				}
+			}
+			b = newTokenBucket(l.perHostRate, now)
+			l.hosts[host] = b
+		}
+		buckets = append(buckets, b)
+	}
+	if l.globalRate > 0 {
+		if l.global == nil {
+			l.global = newTokenBucket(l.globalRate, now)
+		}
+		buckets = append(buckets, l.global)
+	}
+
+	var maxWait time.Duration
+	for _, b := range buckets {
+		w := b.wait(now)
+		if w > maxWait {
+			maxWait = w
+		}
+	}
+	if maxWait > 0 {
+		return maxWait
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0
+}
+
+// wait blocks until an outbound fetch from host is allowed. It fails with
+// RESOURCE_EXHAUSTED if ctx's deadline would pass first, or if ctx is done.
+func (l *assetRateLimiter) wait(ctx context.Context, host string) error {
+	for {
+		w := l.reserve(host)
+		if w == 0 {
+			return nil
+		}
+
+		deadline, ok := ctx.Deadline()
+		if ok && l.now().Add(w).After(deadline) {
+			return status.Errorf(codes.ResourceExhausted,
+				"asset fetch rate limit exceeded for host %q", host)
+		}
+
+		t := time.NewTimer(w)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return status.Errorf(codes.ResourceExhausted,
+				"asset fetch rate limit exceeded for host %q", host)
+		case <-t.C:
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -9,12 +10,15 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	asset "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/asset/v1"
 	//pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
 
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/buchgr/bazel-remote/v2/cache"
 	testutils "github.com/buchgr/bazel-remote/v2/utils"
 )
 
@@ -63,6 +67,90 @@ func TestAssetFetchBlob(t *testing.T) {
 	}
 }
 
+func TestAssetFetchBlobDigestMismatch(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	ts := newTestGetServer()
+
+	_, otherHash := testutils.RandomDataAndHash(256)
+	otherHashBytes, err := hex.DecodeString(otherHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := asset.FetchBlobRequest{
+		Uris: []string{ts.srv.URL + "/" + ts.path},
+		Qualifiers: []*asset.Qualifier{
+			{
+				Name:  "checksum.sri",
+				Value: "sha256-" + base64.StdEncoding.EncodeToString(otherHashBytes),
+			},
+		},
+	}
+
+	resp, err := fixture.assetClient.FetchBlob(ctx, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status.GetCode() != int32(codes.NotFound) {
+		t.Fatalf("Expected NotFound, got: %v", resp.Status)
+	}
+	if !strings.Contains(resp.Status.GetMessage(), otherHash) {
+		t.Errorf("Expected the error message to mention the expected hash, got: %q",
+			resp.Status.GetMessage())
+	}
+
+	hexSha256 := strings.TrimSuffix(ts.path, ".tar.gz")
+	for _, hash := range []string{hexSha256, otherHash} {
+		found, _, _ := fixture.diskCache.Contains(ctx, cache.CAS, hash, -1)
+		if found {
+			t.Errorf("Expected %s not to be cached", hash)
+		}
+	}
+}
+
+func TestAssetFetchBlobMaxConcurrent(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxConcurrentAssetFetches(1))
+	defer os.Remove(fixture.tempdir)
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	errs := make(chan error)
+	go func() {
+		_, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+			Uris: []string{srv.URL + "/slow"},
+		})
+		errs <- err
+	}()
+	<-started
+
+	_, err := fixture.assetClient.FetchBlob(ctx, &asset.FetchBlobRequest{
+		Uris: []string{srv.URL + "/other"},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted, got: %v", err)
+	}
+
+	close(finish)
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 type testGetServer struct {
 	srv *httptest.Server
 
@@ -104,3 +192,57 @@ func newTestGetServer() *testGetServer {
 
 	return &ts
 }
+
+func TestFetchRequestDetails(t *testing.T) {
+	req := asset.FetchBlobRequest{
+		Uris: []string{"https://example.com/a.tar.gz"},
+		Qualifiers: []*asset.Qualifier{
+			{Name: "checksum.sri", Value: "sha256-abc"},
+			{Name: "http_header:Authorization", Value: "Bearer secret"},
+		},
+	}
+
+	details := fetchRequestDetails(&req)
+
+	expected := `uris=["https://example.com/a.tar.gz"] qualifiers=["checksum.sri=sha256-abc" "http_header:Authorization=<redacted>"]`
+	if details != expected {
+		t.Errorf("Expected %s, got %s", expected, details)
+	}
+	if strings.Contains(details, "secret") {
+		t.Error("http_header qualifier values should not be logged")
+	}
+}
+
+func TestAssetRateLimiter(t *testing.T) {
+	l := newAssetRateLimiter(4, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	if w := l.reserve("a.example.com"); w != 0 {
+		t.Fatalf("Expected the first fetch to be allowed, got wait %v", w)
+	}
+	if w := l.reserve("a.example.com"); w != time.Second {
+		t.Fatalf("Expected to wait 1s for the per-host limit, got %v", w)
+	}
+
+	for _, host := range []string{"b.example.com", "c.example.com", "d.example.com"} {
+		if w := l.reserve(host); w != 0 {
+			t.Fatalf("Expected a fetch from %s to be allowed, got wait %v", host, w)
+		}
+	}
+	if w := l.reserve("e.example.com"); w != 250*time.Millisecond {
+		t.Fatalf("Expected to wait 250ms for the global limit, got %v", w)
+	}
+
+	now = now.Add(time.Second)
+	if w := l.reserve("a.example.com"); w != 0 {
+		t.Fatalf("Expected a fetch to be allowed after waiting, got wait %v", w)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := l.wait(ctx, "a.example.com")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted, got: %v", err)
+	}
+}
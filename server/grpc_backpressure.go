@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/buchgr/bazel-remote/v2/cache/disk"
+)
+
+// LoadTrailer is the gRPC trailer key which is set to "high" when the
+// server is near capacity, so that load-aware clients can throttle their
+// requests or switch to another replica.
+const LoadTrailer = "x-bazel-remote-load"
+
+// GrpcBackpressure provides gRPC interceptors which add the LoadTrailer
+// trailer to responses when the fraction of the cache size that is
+// reserved for in-progress uploads exceeds a threshold. It does not change
+// the status of any responses.
+type GrpcBackpressure struct {
+	cache     disk.Cache
+	threshold float64
+}
+
+// NewGrpcBackpressure returns a GrpcBackpressure which reports high load
+// when more than threshold (between 0 and 1) of the cache's maximum size
+// is reserved.
+func NewGrpcBackpressure(c disk.Cache, threshold float64) *GrpcBackpressure {
+	return &GrpcBackpressure{cache: c, threshold: threshold}
+}
+
+func (b *GrpcBackpressure) highLoad() bool {
+	maxSize := b.cache.MaxSize()
+	if maxSize <= 0 {
+		return false
+	}
+
+	_, reservedSize, _, _ := b.cache.Stats()
+	return float64(reservedSize)/float64(maxSize) > b.threshold
+}
+
+func (b *GrpcBackpressure) trailer() metadata.MD {
+	if !b.highLoad() {
+		return nil
+	}
+	return metadata.Pairs(LoadTrailer, "high")
+}
+
+// StreamServerInterceptor returns a streaming server interceptor that
+// adds the load trailer when the server is near capacity.
+func (b *GrpcBackpressure) StreamServerInterceptor(srv interface{},
+	ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	err := handler(srv, ss)
+
+	md := b.trailer()
+	if md != nil {
+		ss.SetTrailer(md)
+	}
+
+	return err
+}
+
+// UnaryServerInterceptor returns a unary server interceptor that adds
+// the load trailer when the server is near capacity.
+func (b *GrpcBackpressure) UnaryServerInterceptor(ctx context.Context,
+	req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	resp, err := handler(ctx, req)
+
+	md := b.trailer()
+	if md != nil {
+		_ = grpc.SetTrailer(ctx, md)
+	}
+
+	return resp, err
+}
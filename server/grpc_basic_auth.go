@@ -66,7 +66,7 @@ func (b *GrpcBasicAuth) StreamServerInterceptor(srv interface{}, ss grpc.ServerS
 		return errAccessDenied
 	}
 
-	return handler(srv, ss)
+	return handler(srv, withStreamClientIdentity(ss, username))
 }
 
 // UnaryServerInterceptor verifies that each request can be authenticated
@@ -97,7 +97,7 @@ func (b *GrpcBasicAuth) UnaryServerInterceptor(ctx context.Context, req interfac
 		return nil, errAccessDenied
 	}
 
-	return handler(ctx, req)
+	return handler(WithClientIdentity(ctx, username), req)
 }
 
 func getLogin(ctx context.Context) (username, password string, err error) {
@@ -17,6 +17,8 @@ import (
 
 	"github.com/buchgr/bazel-remote/v2/utils/zstdpool"
 	syncpool "github.com/mostynb/zstdpool-syncpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
@@ -55,7 +57,7 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 
 	if size == 0 {
 		if cmp == casblob.Identity {
-			s.accessLogger.Printf("GRPC BYTESTREAM READ COMPLETED %s", req.ResourceName)
+			cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM READ COMPLETED %s", req.ResourceName)
 			return nil
 		}
 
@@ -66,7 +68,7 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 			s.accessLogger.Printf(msg)
 			return status.Error(codes.Unknown, msg)
 		}
-		s.accessLogger.Printf("GRPC BYTESTREAM READ COMPLETED %s", req.ResourceName)
+		cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM READ COMPLETED %s", req.ResourceName)
 		return nil
 	}
 
@@ -91,9 +93,6 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 			"Negative ReadLimit is out of range")
 	}
 
-	limitedSend := (req.ReadLimit != 0) && cmp == casblob.Identity
-	sendLimitRemaining := req.ReadLimit
-
 	if req.ReadOffset > size {
 		msg := fmt.Sprintf("ReadOffset %d larger than expected data size %d resource: %s",
 			req.ReadOffset, size, req.ResourceName)
@@ -104,10 +103,16 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 	var rc io.ReadCloser
 	var foundSize int64
 
+	ctx := noPromoteContext(resp.Context())
+	if req.ReadLimit > 0 {
+		// Avoid decompressing more of the blob than necessary.
+		ctx = cache.WithReadLimit(ctx, req.ReadLimit)
+	}
+
 	if cmp == casblob.Zstandard {
-		rc, foundSize, err = s.cache.GetZstd(resp.Context(), hash, size, req.ReadOffset)
+		rc, foundSize, err = s.cache.GetZstd(ctx, hash, size, req.ReadOffset)
 	} else {
-		rc, foundSize, err = s.cache.Get(resp.Context(), cache.CAS, hash, size, req.ReadOffset)
+		rc, foundSize, err = s.cache.Get(ctx, cache.CAS, hash, size, req.ReadOffset)
 	}
 
 	if rc != nil {
@@ -134,7 +139,15 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 		return status.Error(codes.Internal, msg)
 	}
 
+	var r io.Reader = rc
 	bufSize := size
+	if req.ReadLimit > 0 {
+		// Only send the requested range, [ReadOffset, ReadOffset+ReadLimit).
+		r = io.LimitReader(rc, req.ReadLimit)
+		if bufSize > req.ReadLimit {
+			bufSize = req.ReadLimit
+		}
+	}
 	if bufSize > maxChunkSize {
 		bufSize = maxChunkSize
 	}
@@ -143,21 +156,20 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 
 	var chunkResp bytestream.ReadResponse
 	for {
-		n, err := rc.Read(buf)
+		n, err := r.Read(buf)
 
 		if n > 0 {
-			if limitedSend {
-				if (sendLimitRemaining - int64(n)) < 0 {
-					msg := fmt.Sprintf("GRPC BYTESTREAM READ FAILED: %s READ LIMIT EXCEEDED", hash)
-					s.accessLogger.Printf(msg)
-					return status.Error(codes.OutOfRange, msg)
-				}
-				sendLimitRemaining -= int64(n)
-			}
-
 			chunkResp.Data = buf[:n]
 			sendErr := resp.Send(&chunkResp)
 			if sendErr != nil {
+				if resp.Context().Err() != nil {
+					// The client went away, this is not a server failure.
+					readCancellations.Inc()
+					msg := fmt.Sprintf("GRPC BYTESTREAM READ CANCELED BY CLIENT: %s", hash)
+					s.accessLogger.Printf(msg)
+					return status.Error(codes.Canceled, msg)
+				}
+
 				msg := fmt.Sprintf("GRPC BYTESTREAM READ FAILED TO SEND RESPONSE: %s %v", hash, sendErr)
 				s.accessLogger.Printf(msg)
 				return status.Error(codes.Unknown, msg)
@@ -165,7 +177,7 @@ func (s *grpcServer) Read(req *bytestream.ReadRequest,
 		}
 
 		if err == io.EOF {
-			s.accessLogger.Printf("GRPC BYTESTREAM READ COMPLETED %s",
+			cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM READ COMPLETED %s",
 				req.ResourceName)
 			return nil
 		}
@@ -186,28 +198,38 @@ func (s *grpcServer) parseReadResource(name string, errorPrefix string) (string,
 	// Or:
 	// [{instance_name}]/compressed-blobs/{compressor}/{uncompressed_hash}/{uncompressed_size}
 
-	// Instance_name is ignored in this bytestream implementation, so don't
-	// bother returning it. It is not allowed to contain "blobs" as a distinct
-	// path segment.
+	// Instance_name is only checked against the allowed/denied instances,
+	// so don't bother returning it. It is not allowed to contain "blobs" as
+	// a distinct path segment.
 
 	fields := strings.Split(name, "/")
 	var rem []string
+	var instance string
 	foundBlobs := false
 	foundCompressedBlobs := false
 	for i := range fields {
 		if fields[i] == "blobs" {
+			instance = strings.Join(fields[:i], "/")
 			rem = fields[i+1:]
 			foundBlobs = true
 			break
 		}
 
 		if fields[i] == "compressed-blobs" {
+			instance = strings.Join(fields[:i], "/")
 			rem = fields[i+1:]
 			foundCompressedBlobs = true
 			break
 		}
 	}
 
+	if foundBlobs || foundCompressedBlobs {
+		err := s.checkInstance(instance, errorPrefix)
+		if err != nil {
+			return "", 0, casblob.Identity, err
+		}
+	}
+
 	if foundBlobs {
 		if len(rem) != 2 {
 			msg := fmt.Sprintf("Unable to parse resource name: %s", name)
@@ -279,6 +301,21 @@ func (s *grpcServer) parseReadResource(name string, errorPrefix string) (string,
 	return hash, size, casblob.Zstandard, nil
 }
 
+// checkDeclaredSize returns an InvalidArgument error if size, from the
+// write resource name r, is larger than the max blob size. This rejects
+// such uploads before any space is reserved for them. Reads are not
+// checked, since the limit does not apply to preexisting blobs.
+func (s *grpcServer) checkDeclaredSize(size int64, r string, errorPrefix string) error {
+	if s.maxBlobSize <= 0 || size <= s.maxBlobSize {
+		return nil
+	}
+
+	msg := fmt.Sprintf("Declared size %d is larger than the max blob size %d, from %q",
+		size, s.maxBlobSize, r)
+	s.accessLogger.Printf("%s: %s", errorPrefix, msg)
+	return status.Error(codes.InvalidArgument, msg)
+}
+
 // Parse a WriteRequest.ResourceName, return the validated hash, size,
 // compression type and an optional error.
 func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.CompressionType, error) {
@@ -290,8 +327,10 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.Compre
 
 	fields := strings.Split(r, "/")
 	var rem []string
+	var instance string
 	for i := range fields {
 		if fields[i] == "uploads" {
+			instance = strings.Join(fields[:i], "/")
 			rem = fields[i+1:]
 			break
 		}
@@ -302,6 +341,11 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.Compre
 			status.Errorf(codes.InvalidArgument, "Unable to parse resource name: %s", r)
 	}
 
+	err := s.checkInstance(instance, "GRPC BYTESTREAM WRITE FAILED")
+	if err != nil {
+		return "", 0, casblob.Identity, err
+	}
+
 	// rem[0] should hold the uuid, which we don't use- ignore it.
 
 	if rem[1] == "blobs" {
@@ -317,6 +361,11 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.Compre
 				status.Errorf(codes.InvalidArgument, "Invalid size (must be non-negative): %d from %q", size, r)
 		}
 
+		err = s.checkDeclaredSize(size, r, "GRPC BYTESTREAM WRITE FAILED")
+		if err != nil {
+			return "", 0, casblob.Identity, err
+		}
+
 		err = s.validateHash(hash, size, "GRPC BYTESTREAM READ FAILED")
 		if err != nil {
 			return "", 0, casblob.Identity, err
@@ -343,6 +392,11 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.Compre
 			status.Errorf(codes.InvalidArgument, "Invalid size (must be non-negative): %d from %q", size, r)
 	}
 
+	err = s.checkDeclaredSize(size, r, "GRPC BYTESTREAM WRITE FAILED")
+	if err != nil {
+		return "", 0, casblob.Zstandard, err
+	}
+
 	hash := rem[3]
 	err = s.validateHash(hash, size, "GRPC BYTESTREAM READ FAILED")
 	if err != nil {
@@ -355,8 +409,31 @@ func (s *grpcServer) parseWriteResource(r string) (string, int64, casblob.Compre
 var errWriteOffset error = errors.New("bytestream writes from non-zero offsets are unsupported")
 var errDecoderPoolFail error = errors.New("failed to get DecoderWrapper from pool")
 
+var readCancellations = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "bazel_remote_bytestream_read_client_cancellations_total",
+	Help: "The number of bytestream reads that were stopped because the client disconnected or canceled the request",
+})
+
+var writeSizeMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bazel_remote_bytestream_write_size_mismatches_total",
+	Help: "The number of bytestream writes with more (long) or less (short) data than the size in the resource name, by reason",
+}, []string{"reason"})
+
+// writeSizeMismatchErr returns the error for a bytestream write which
+// finished after `committed` bytes, when `size` bytes were expected.
+func (s *grpcServer) writeSizeMismatchErr(committed int64, size int64) error {
+	writeSizeMismatches.WithLabelValues("short").Inc()
+	msg := fmt.Sprintf("Unexpected amount of data read: %d expected: %d",
+		committed, size)
+	return status.Error(s.sizeMismatchCode, msg)
+}
+
 func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 
+	if s.partialUploads != nil {
+		return s.resumableWrite(srv)
+	}
+
 	var resp bytestream.WriteResponse
 	pr, pw := io.Pipe()
 
@@ -375,9 +452,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 			req, err := srv.Recv()
 			if err == io.EOF {
 				if cmp == casblob.Identity && resp.CommittedSize != size {
-					msg := fmt.Sprintf("Unexpected amount of data read: %d expected: %d",
-						resp.CommittedSize, size)
-					recvResult <- status.Error(codes.Unknown, msg)
+					recvResult <- s.writeSizeMismatchErr(resp.CommittedSize, size)
 					return
 				}
 
@@ -408,7 +483,8 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 					return
 				}
 
-				exists, _ := s.cache.Contains(srv.Context(), cache.CAS, hash, size)
+				// If the proxy backend cannot be checked, write the blob anyway.
+				exists, _, _ := s.cache.Contains(srv.Context(), cache.CAS, hash, size)
 				if exists {
 					// Blob already exists, return without writing anything.
 					if cmp == casblob.Identity {
@@ -469,6 +545,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 			resp.CommittedSize += int64(n)
 
 			if cmp == casblob.Identity && resp.CommittedSize > size {
+				writeSizeMismatches.WithLabelValues("long").Inc()
 				msg := fmt.Sprintf("Client sent more than %d data! %d", size, resp.CommittedSize)
 				recvResult <- status.Error(codes.OutOfRange, msg)
 				return
@@ -478,9 +555,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 			// EOF at the start of each loop.
 			if req.FinishWrite {
 				if cmp == casblob.Identity && resp.CommittedSize != size {
-					msg := fmt.Sprintf("Unexpected amount of data read: %d expected: %d",
-						resp.CommittedSize, size)
-					recvResult <- status.Error(codes.Unknown, msg)
+					recvResult <- s.writeSizeMismatchErr(resp.CommittedSize, size)
 					return
 				}
 
@@ -527,7 +602,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 		}
 
 		if err == io.EOF {
-			s.accessLogger.Printf("GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
+			cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
 
 			err = srv.SendAndClose(&resp)
 			if err != nil {
@@ -556,7 +631,7 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 
 	err := <-putResult
 	if err == io.EOF {
-		s.accessLogger.Printf("GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
+		cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
 
 		err = srv.SendAndClose(&resp)
 		if err != nil {
@@ -580,7 +655,164 @@ func (s *grpcServer) Write(srv bytestream.ByteStream_WriteServer) error {
 		return status.Error(codes.Unknown, msg)
 	}
 
-	s.accessLogger.Printf("GRPC BYTESTREAM WRITE COMPLETED: %s", resourceName)
+	cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM WRITE COMPLETED: %s%s", resourceName,
+		s.clientSuffix(srv.Context()))
+	return nil
+}
+
+// resumableWrite is like Write, but persists the data it receives in
+// s.partialUploads so that an interrupted upload can be resumed by a
+// later Write with a non-zero WriteOffset. The blob is only added to the
+// cache once all of its data has been received.
+func (s *grpcServer) resumableWrite(srv bytestream.ByteStream_WriteServer) error {
+	req, err := srv.Recv()
+	if err == io.EOF {
+		msg := "Empty write request"
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	resourceName := req.ResourceName
+	if resourceName == "" {
+		msg := "Empty resource name"
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+
+	hash, size, cmp, err := s.parseWriteResource(resourceName)
+	if err != nil {
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", err)
+		return err
+	}
+
+	var resp bytestream.WriteResponse
+
+	// If the proxy backend cannot be checked, write the blob anyway.
+	exists, _, _ := s.cache.Contains(srv.Context(), cache.CAS, hash, size)
+	if exists {
+		// Blob already exists, return without writing anything.
+		s.partialUploads.remove(resourceName)
+		if cmp == casblob.Identity {
+			resp.CommittedSize = size
+		} else {
+			resp.CommittedSize = -1
+		}
+
+		cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM SKIPPED WRITE: %s", resourceName)
+		err = srv.SendAndClose(&resp)
+		if err != nil {
+			msg := fmt.Sprintf("GRPC BYTESTREAM SKIPPED WRITE FAILED: %s %v", resourceName, err)
+			s.accessLogger.Printf(msg)
+			return status.Error(codes.Internal, msg)
+		}
+		return nil
+	}
+
+	f, err := s.partialUploads.open(resourceName, req.WriteOffset)
+	if err != nil {
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s %s", resourceName, err)
+		return err
+	}
+	defer s.partialUploads.release(resourceName, f)
+
+	resp.CommittedSize = req.WriteOffset
+
+	for {
+		if req.ResourceName != "" && resourceName != req.ResourceName {
+			msg := fmt.Sprintf("Resource name changed in a single Write %v -> %v",
+				resourceName, req.ResourceName)
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", msg)
+			return status.Error(codes.InvalidArgument, msg)
+		}
+
+		n, err := s.partialUploads.write(resourceName, f, req.Data)
+		if err != nil {
+			msg := fmt.Sprintf("GRPC BYTESTREAM WRITE FAILED: %s %s", resourceName,
+				status.Convert(err).Message())
+			s.accessLogger.Printf(msg)
+			return status.Error(status.Code(err), msg)
+		}
+		resp.CommittedSize += int64(n)
+
+		if cmp == casblob.Identity && resp.CommittedSize > size {
+			writeSizeMismatches.WithLabelValues("long").Inc()
+			s.partialUploads.remove(resourceName)
+			msg := fmt.Sprintf("Client sent more than %d data! %d", size, resp.CommittedSize)
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s %s", resourceName, msg)
+			return status.Error(codes.OutOfRange, msg)
+		}
+
+		if req.FinishWrite {
+			break
+		}
+
+		req, err = srv.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep the data received so far, so the client can resume.
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE INTERRUPTED: %s after %d bytes",
+				resourceName, resp.CommittedSize)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if cmp == casblob.Identity && resp.CommittedSize != size {
+		err = s.writeSizeMismatchErr(resp.CommittedSize, size)
+		s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s %s", resourceName, err)
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		msg := fmt.Sprintf("GRPC BYTESTREAM WRITE FAILED: %s %v", resourceName, err)
+		s.accessLogger.Printf(msg)
+		return status.Error(codes.Internal, msg)
+	}
+
+	var r io.Reader = f
+	if cmp == casblob.Zstandard {
+		dec, ok := decoderPool.Get().(*syncpool.DecoderWrapper)
+		if !ok {
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", errDecoderPoolFail)
+			return errDecoderPoolFail
+		}
+		err = dec.Reset(f)
+		if err != nil {
+			s.accessLogger.Printf("GRPC BYTESTREAM WRITE FAILED: %s", err)
+			return err
+		}
+		rc := dec.IOReadCloser()
+		defer rc.Close()
+		r = rc
+	}
+
+	err = s.cache.Put(srv.Context(), cache.CAS, hash, size, r)
+
+	// The upload is complete, successful or not, so the partial data is
+	// no longer useful.
+	s.partialUploads.remove(resourceName)
+
+	if err != nil {
+		msg := fmt.Sprintf("GRPC BYTESTREAM WRITE FAILED: %s Cache Put failed: %v", resourceName, err)
+		s.accessLogger.Printf(msg)
+		code := gRPCErrCode(err, codes.Internal)
+		return status.Error(code, msg)
+	}
+
+	err = srv.SendAndClose(&resp)
+	if err != nil {
+		msg := fmt.Sprintf("GRPC BYTESTREAM WRITE FAILED: %s %v", resourceName, err)
+		s.accessLogger.Printf(msg)
+		return status.Error(codes.Unknown, msg)
+	}
+
+	cache.LogSuccess(s.accessLogger, "GRPC BYTESTREAM WRITE COMPLETED: %s%s", resourceName,
+		s.clientSuffix(srv.Context()))
 	return nil
 }
 
@@ -595,13 +827,20 @@ func (s *grpcServer) QueryWriteStatus(ctx context.Context, req *bytestream.Query
 		return nil, err
 	}
 
-	// We don't support partial writes, so the status will either be fully written
-	// and complete, or 0 written and incomplete.
+	// Unless resumable writes are enabled, the status will either be fully
+	// written and complete, or 0 written and incomplete.
 
-	exists, _ := s.cache.Contains(ctx, cache.CAS, hash, size)
+	exists, _, err := s.cache.Contains(ctx, cache.CAS, hash, size)
+	if err != nil {
+		return nil, status.Error(gRPCErrCode(err, codes.Internal), err.Error())
+	}
 
 	if !exists {
-		return &bytestream.QueryWriteStatusResponse{CommittedSize: 0, Complete: false}, nil
+		var committed int64
+		if s.partialUploads != nil {
+			committed = s.partialUploads.committedSize(req.ResourceName)
+		}
+		return &bytestream.QueryWriteStatusResponse{CommittedSize: committed, Complete: false}, nil
 	}
 
 	return &bytestream.QueryWriteStatusResponse{CommittedSize: size, Complete: true}, nil
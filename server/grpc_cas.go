@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/genproto/googleapis/rpc/code"
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc/codes"
@@ -35,6 +38,23 @@ var (
 		"expected a non-nil *BatchReadBlobsRequest")
 )
 
+var unsupportedCompressorRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bazel_remote_unsupported_compressor_requests_total",
+	Help: "The number of blobs uploaded with a compressor that is not supported, by compressor",
+}, []string{"compressor"})
+
+var batchDuplicateDigests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bazel_remote_batch_duplicate_digests_total",
+	Help: "The number of duplicate digests in BatchReadBlobs and BatchUpdateBlobs requests which were only processed once, by method",
+}, []string{"method"})
+
+// batchDigestKey identifies a blob within a batch request, when
+// deduplicating batches.
+type batchDigestKey struct {
+	hash string
+	size int64
+}
+
 // ContentAddressableStorageServer interface:
 
 func (s *grpcServer) FindMissingBlobs(ctx context.Context,
@@ -45,6 +65,17 @@ func (s *grpcServer) FindMissingBlobs(ctx context.Context,
 	}
 
 	errorPrefix := "GRPC CAS HEAD"
+
+	err := s.checkInstance(req.InstanceName, errorPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(req.DigestFunction, errorPrefix)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, digest := range req.BlobDigests {
 
 		if digest == nil {
@@ -57,7 +88,7 @@ func (s *grpcServer) FindMissingBlobs(ctx context.Context,
 		}
 	}
 
-	missingBlobs, err := s.cache.FindMissingCasBlobs(ctx, req.BlobDigests)
+	missingBlobs, err := s.cache.FindMissingCasBlobs(noPromoteContext(ctx), req.BlobDigests)
 	if err != nil {
 		return nil, err
 	}
@@ -72,11 +103,28 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 		return nil, errNilBatchUpdateBlobsRequest
 	}
 
+	err := s.checkInstance(in.InstanceName, "GRPC CAS PUT")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(in.DigestFunction, "GRPC CAS PUT")
+	if err != nil {
+		return nil, err
+	}
+
 	resp := pb.BatchUpdateBlobsResponse{
 		Responses: make([]*pb.BatchUpdateBlobsResponse_Response,
 			0, len(in.Requests)),
 	}
 
+	// Digests which have already been stored by this request, if
+	// deduplication is enabled.
+	var stored map[batchDigestKey]struct{}
+	if s.dedupeBatches {
+		stored = make(map[batchDigestKey]struct{}, len(in.Requests))
+	}
+
 	errorPrefix := "GRPC CAS PUT"
 	for _, req := range in.Requests {
 		// TODO: consider fanning-out goroutines here.
@@ -103,9 +151,19 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 		}
 		resp.Responses = append(resp.Responses, &rr)
 
+		// Only skip blobs which were stored successfully, in case an
+		// earlier occurrence had invalid data.
+		key := batchDigestKey{hash: req.Digest.Hash, size: req.Digest.SizeBytes}
+		if _, found := stored[key]; found {
+			batchDuplicateDigests.WithLabelValues("BatchUpdateBlobs").Inc()
+			continue
+		}
+
 		if req.Compressor != pb.Compressor_IDENTITY && req.Compressor != pb.Compressor_ZSTD {
 			s.errorLogger.Printf("%s %s UNSUPPORTED COMPRESSOR: %s", errorPrefix, req.Digest.Hash, req.Compressor)
-			rr.Status.Code = int32(gRPCErrCode(err, codes.InvalidArgument))
+			unsupportedCompressorRequests.WithLabelValues(req.Compressor.String()).Inc()
+			rr.Status.Code = int32(codes.InvalidArgument)
+			rr.Status.Message = fmt.Sprintf("unsupported compressor: %s", req.Compressor)
 			continue
 		}
 
@@ -126,7 +184,11 @@ func (s *grpcServer) BatchUpdateBlobs(ctx context.Context,
 			continue
 		}
 
-		s.accessLogger.Printf("GRPC CAS PUT %s OK", req.Digest.Hash)
+		cache.LogSuccess(s.accessLogger, "GRPC CAS PUT %s OK%s", req.Digest.Hash, s.clientSuffix(ctx))
+
+		if stored != nil {
+			stored[key] = struct{}{}
+		}
 	}
 
 	return &resp, nil
@@ -176,13 +238,18 @@ func (s *grpcServer) getBlobResponse(ctx context.Context, digest *pb.Digest, all
 	var data []byte
 	var err error
 
+	// Compressing small blobs costs more than it saves.
+	if digest.SizeBytes < s.minResponseCompressSize {
+		allowZstd = false
+	}
+
 	if allowZstd {
 		rc, foundSize, err := s.cache.GetZstd(ctx, digest.Hash, digest.SizeBytes, 0)
 		if rc != nil {
 			defer rc.Close()
 		}
 		if rc == nil || foundSize != digest.SizeBytes {
-			s.accessLogger.Printf("GRPC CAS GET %s NOT FOUND", digest.Hash)
+			cache.LogSuccess(s.accessLogger, "GRPC CAS GET %s NOT FOUND", digest.Hash)
 			r.Status = &status.Status{Code: int32(code.Code_NOT_FOUND)}
 			return &r
 		}
@@ -208,7 +275,7 @@ func (s *grpcServer) getBlobResponse(ctx context.Context, digest *pb.Digest, all
 
 	data, err = s.getBlobData(ctx, digest.Hash, digest.SizeBytes)
 	if err == errBlobNotFound {
-		s.accessLogger.Printf("GRPC CAS GET %s NOT FOUND", digest.Hash)
+		cache.LogSuccess(s.accessLogger, "GRPC CAS GET %s NOT FOUND", digest.Hash)
 		r.Status = &status.Status{Code: int32(code.Code_NOT_FOUND)}
 		return &r
 	}
@@ -223,7 +290,7 @@ func (s *grpcServer) getBlobResponse(ctx context.Context, digest *pb.Digest, all
 	r.Data = data
 	r.Compressor = pb.Compressor_IDENTITY
 
-	s.accessLogger.Printf("GRPC CAS GET %s OK", digest.Hash)
+	cache.LogSuccess(s.accessLogger, "GRPC CAS GET %s OK", digest.Hash)
 	r.Status = &status.Status{Code: int32(codes.OK)}
 	return &r
 }
@@ -235,6 +302,18 @@ func (s *grpcServer) BatchReadBlobs(ctx context.Context,
 		return nil, errNilBatchReadBlobsRequest
 	}
 
+	err := s.checkInstance(in.InstanceName, "GRPC CAS GET")
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkDigestFunction(in.DigestFunction, "GRPC CAS GET")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = noPromoteContext(ctx)
+
 	resp := pb.BatchReadBlobsResponse{
 		Responses: make([]*pb.BatchReadBlobsResponse_Response,
 			0, len(in.Digests)),
@@ -248,7 +327,15 @@ func (s *grpcServer) BatchReadBlobs(ctx context.Context,
 		}
 	}
 
+	// Responses for digests which have already been read by this
+	// request, if deduplication is enabled.
+	var seen map[batchDigestKey]*pb.BatchReadBlobsResponse_Response
+	if s.dedupeBatches {
+		seen = make(map[batchDigestKey]*pb.BatchReadBlobsResponse_Response, len(in.Digests))
+	}
+
 	errorPrefix := "GRPC CAS GET"
+	var totalSize int64
 	for _, digest := range in.Digests {
 		// TODO: consider fanning-out goroutines here.
 
@@ -260,7 +347,32 @@ func (s *grpcServer) BatchReadBlobs(ctx context.Context,
 		if err != nil {
 			return nil, err
 		}
-		resp.Responses = append(resp.Responses, s.getBlobResponse(ctx, digest, allowZstd))
+
+		// Check the limit before reading each blob, so that an
+		// oversized batch is rejected without buffering it.
+		totalSize += digest.SizeBytes
+		if s.maxBatchTotalSize > 0 && totalSize > s.maxBatchTotalSize {
+			s.accessLogger.Printf("%s BATCH TOO LARGE: more than %d bytes requested, limit is %d",
+				errorPrefix, totalSize, s.maxBatchTotalSize)
+			return nil, grpc_status.Errorf(codes.ResourceExhausted,
+				"The total size of the requested blobs exceeds the limit of %d bytes, use smaller batches or ByteStream reads",
+				s.maxBatchTotalSize)
+		}
+
+		key := batchDigestKey{hash: digest.Hash, size: digest.SizeBytes}
+		if r, found := seen[key]; found {
+			// The same response message can be sent more than once.
+			batchDuplicateDigests.WithLabelValues("BatchReadBlobs").Inc()
+			resp.Responses = append(resp.Responses, r)
+			continue
+		}
+
+		r := s.getBlobResponse(ctx, digest, allowZstd)
+		resp.Responses = append(resp.Responses, r)
+
+		if seen != nil {
+			seen[key] = r
+		}
 	}
 
 	return &resp, nil
@@ -282,14 +394,35 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 		return errNilDigest
 	}
 
-	err := s.validateHash(in.RootDigest.Hash, in.RootDigest.SizeBytes, errorPrefix)
+	err := s.checkInstance(in.InstanceName, errorPrefix)
 	if err != nil {
 		return err
 	}
 
-	data, err := s.getBlobData(stream.Context(), in.RootDigest.Hash, in.RootDigest.SizeBytes)
+	err = s.checkDigestFunction(in.DigestFunction, errorPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = s.validateHash(in.RootDigest.Hash, in.RootDigest.SizeBytes, errorPrefix)
+	if err != nil {
+		return err
+	}
+
+	if s.getTreeSem != nil {
+		if !s.getTreeSem.TryAcquire(1) {
+			s.accessLogger.Printf("%s %s TOO MANY CONCURRENT REQUESTS", errorPrefix, in.RootDigest.Hash)
+			return grpc_status.Error(codes.ResourceExhausted,
+				"Too many concurrent GetTree requests, try again later")
+		}
+		defer s.getTreeSem.Release(1)
+	}
+
+	ctx := noPromoteContext(stream.Context())
+
+	data, err := s.getBlobData(ctx, in.RootDigest.Hash, in.RootDigest.SizeBytes)
 	if err == errBlobNotFound {
-		s.accessLogger.Printf("GRPC CAS GETTREEREQUEST %s NOT FOUND",
+		cache.LogSuccess(s.accessLogger, "GRPC CAS GETTREEREQUEST %s NOT FOUND",
 			in.RootDigest.Hash)
 		return grpc_status.Error(codes.NotFound, "Item not found")
 	}
@@ -298,6 +431,12 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 		return grpc_status.Error(codes.Unknown, err.Error())
 	}
 
+	var totalBytes int64
+	err = s.addGetTreeBytes(&totalBytes, len(data), errorPrefix)
+	if err != nil {
+		return err
+	}
+
 	dir := pb.Directory{}
 	err = proto.Unmarshal(data, &dir)
 	if err != nil {
@@ -305,7 +444,8 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 		return grpc_status.Error(codes.DataLoss, err.Error())
 	}
 
-	err = s.fillDirectories(stream.Context(), &resp, &dir, errorPrefix)
+	ancestors := map[string]struct{}{in.RootDigest.Hash: {}}
+	err = s.fillDirectories(ctx, &resp, &dir, 1, ancestors, &totalBytes, errorPrefix)
 	if err != nil {
 		return err
 	}
@@ -317,13 +457,29 @@ func (s *grpcServer) GetTree(in *pb.GetTreeRequest,
 	// TODO: if resp is too large, split it up and call Send multiple times,
 	// with resp.NextPageToken set for all but the last Send call?
 
-	s.accessLogger.Printf("GRPC GETTREEREQUEST %s OK", in.RootDigest.Hash)
+	cache.LogSuccess(s.accessLogger, "GRPC GETTREEREQUEST %s OK", in.RootDigest.Hash)
+	return nil
+}
+
+// addGetTreeBytes adds n to the total size of the Directory blobs read by
+// a GetTree call, and returns ResourceExhausted if that exceeds the limit.
+func (s *grpcServer) addGetTreeBytes(totalBytes *int64, n int, errorPrefix string) error {
+	*totalBytes += int64(n)
+	if s.maxGetTreeTotalBytes > 0 && *totalBytes > s.maxGetTreeTotalBytes {
+		msg := fmt.Sprintf("Directory tree exceeds the maximum total size of %d bytes",
+			s.maxGetTreeTotalBytes)
+		s.accessLogger.Printf("%s %s", errorPrefix, msg)
+		return grpc_status.Error(codes.ResourceExhausted, msg)
+	}
 	return nil
 }
 
 // Attempt to populate `resp`. Return errors for invalid requests, but
-// otherwise attempt to return as many blobs as possible.
-func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeResponse, dir *pb.Directory, errorPrefix string) error {
+// otherwise attempt to return as many blobs as possible. `dir` is at the
+// given depth (the root is at depth 1), `ancestors` contains the digests
+// of the directories above it, and `totalBytes` is the total size of the
+// Directory blobs which have been read so far.
+func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeResponse, dir *pb.Directory, depth int, ancestors map[string]struct{}, totalBytes *int64, errorPrefix string) error {
 
 	// Add this dir.
 	resp.Directories = append(resp.Directories, dir)
@@ -336,9 +492,23 @@ func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeRespon
 			return err
 		}
 
+		if _, found := ancestors[dirNode.Digest.Hash]; found {
+			msg := fmt.Sprintf("Directory %s refers to one of its ancestors",
+				dirNode.Digest.Hash)
+			s.accessLogger.Printf("%s %s", errorPrefix, msg)
+			return grpc_status.Error(codes.InvalidArgument, msg)
+		}
+
+		if s.maxTreeDepth > 0 && depth >= s.maxTreeDepth {
+			msg := fmt.Sprintf("Directory tree exceeds the maximum depth of %d",
+				s.maxTreeDepth)
+			s.accessLogger.Printf("%s %s", errorPrefix, msg)
+			return grpc_status.Error(codes.InvalidArgument, msg)
+		}
+
 		data, err := s.getBlobData(ctx, dirNode.Digest.Hash, dirNode.Digest.SizeBytes)
 		if err == errBlobNotFound {
-			s.accessLogger.Printf("GRPC GETTREEREQUEST BLOB %s NOT FOUND",
+			cache.LogSuccess(s.accessLogger, "GRPC GETTREEREQUEST BLOB %s NOT FOUND",
 				dirNode.Digest.Hash)
 			continue
 		}
@@ -347,6 +517,11 @@ func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeRespon
 			continue
 		}
 
+		err = s.addGetTreeBytes(totalBytes, len(data), errorPrefix)
+		if err != nil {
+			return err
+		}
+
 		dirMsg := pb.Directory{}
 		err = proto.Unmarshal(data, &dirMsg)
 		if err != nil {
@@ -354,10 +529,12 @@ func (s *grpcServer) fillDirectories(ctx context.Context, resp *pb.GetTreeRespon
 			continue
 		}
 
-		s.accessLogger.Printf("GRPC GETTREEREQUEST BLOB %s ADDED OK",
+		cache.LogSuccess(s.accessLogger, "GRPC GETTREEREQUEST BLOB %s ADDED OK",
 			dirNode.Digest.Hash)
 
-		err = s.fillDirectories(ctx, resp, &dirMsg, errorPrefix)
+		ancestors[dirNode.Digest.Hash] = struct{}{}
+		err = s.fillDirectories(ctx, resp, &dirMsg, depth+1, ancestors, totalBytes, errorPrefix)
+		delete(ancestors, dirNode.Digest.Hash)
 		if err != nil {
 			return err
 		}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"strings"
 
 	"google.golang.org/grpc"
 
@@ -9,7 +10,8 @@ import (
 )
 
 // GrpcIdleTimer wraps an idle.Timer, and provides gRPC interceptors that
-// reset the given idle.Timer at the start of each gRPC request.
+// reset the given idle.Timer at the start of each gRPC request, except for
+// health checks.
 type GrpcIdleTimer struct {
 	idleTimer *idle.Timer
 }
@@ -25,7 +27,9 @@ func (t *GrpcIdleTimer) StreamServerInterceptor(srv interface{},
 	ss grpc.ServerStream, info *grpc.StreamServerInfo,
 	handler grpc.StreamHandler) error {
 
-	t.idleTimer.ResetTimer()
+	if resetsIdleTimer(info.FullMethod) {
+		t.idleTimer.ResetTimer()
+	}
 	return handler(srv, ss)
 }
 
@@ -35,6 +39,16 @@ func (t *GrpcIdleTimer) UnaryServerInterceptor(ctx context.Context,
 	req interface{}, info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler) (interface{}, error) {
 
-	t.idleTimer.ResetTimer()
+	if resetsIdleTimer(info.FullMethod) {
+		t.idleTimer.ResetTimer()
+	}
 	return handler(ctx, req)
 }
+
+// Return true if calls to the given gRPC method should count as activity
+// for the idle timer. Health checks are excluded, since they are typically
+// made periodically by orchestration systems, which would otherwise keep
+// the server alive forever.
+func resetsIdleTimer(fullMethod string) bool {
+	return !strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/")
+}
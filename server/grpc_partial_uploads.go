@@ -0,0 +1,312 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The name prefix of the files created by partialUploadStore. Other files
+// in the partial uploads dir are never modified or removed.
+const partialUploadPrefix = "partial-"
+
+// How often partial uploads are checked for expiry.
+const partialUploadsCleanupInterval = time.Minute
+
+// partialUploadStore persists the data received so far for incomplete
+// bytestream writes, so that clients can resume interrupted uploads from
+// a non-zero WriteOffset instead of starting over.
+//
+// Partial uploads are keyed by their full upload resource name, which
+// includes the client-chosen upload uuid.
+type partialUploadStore struct {
+	dir string
+
+	// The maximum total size of the partial uploads, or 0 for no limit.
+	maxSize int64
+
+	// Partial uploads which have not been written to for this long are
+	// removed, unless this is 0.
+	ttl time.Duration
+
+	mu     sync.Mutex
+	active map[string]struct{}           // Paths with an ongoing Write.
+	files  map[string]*partialUploadFile // Partial uploads, by path.
+	size   int64                         // The total size of files.
+}
+
+type partialUploadFile struct {
+	size     int64
+	modified time.Time
+}
+
+// newPartialUploadStore returns a partialUploadStore which keeps its
+// files in dir. Any partial uploads left over from a previous run are
+// removed, other files in dir are left alone.
+func newPartialUploadStore(dir string, maxSize int64, ttl time.Duration) (*partialUploadStore, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create partial uploads dir %q: %w", dir, err)
+	}
+
+	err = removeStalePartialUploads(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to clear partial uploads dir %q: %w", dir, err)
+	}
+
+	p := &partialUploadStore{
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		active:  make(map[string]struct{}),
+		files:   make(map[string]*partialUploadFile),
+	}
+
+	if ttl > 0 {
+		go p.expireLoop()
+	}
+
+	return p, nil
+}
+
+// isPartialUploadName returns true if name is the name of a file that
+// was created by partialUploadStore.
+func isPartialUploadName(name string) bool {
+	hash, ok := strings.CutPrefix(name, partialUploadPrefix)
+	if !ok || len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func removeStalePartialUploads(dir string) error {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, de := range des {
+		if !de.Type().IsRegular() || !isPartialUploadName(de.Name()) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(dir, de.Name()))
+		if err != nil {
+			log.Printf("Failed to remove partial upload %s: %v", de.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d partial upload(s) from %s", removed, dir)
+	}
+
+	return nil
+}
+
+func (p *partialUploadStore) path(resourceName string) string {
+	sum := sha256.Sum256([]byte(resourceName))
+	return filepath.Join(p.dir, partialUploadPrefix+hex.EncodeToString(sum[:]))
+}
+
+// committedSize returns the number of bytes that have been persisted for
+// the given upload, or 0 if there is no partial upload.
+func (p *partialUploadStore) committedSize(resourceName string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pf, ok := p.files[p.path(resourceName)]
+	if !ok {
+		return 0
+	}
+	return pf.size
+}
+
+// open returns a file for the given upload, positioned at offset and
+// ready for appending. offset must not be larger than the number of bytes
+// already committed. Callers must call release when they are done.
+func (p *partialUploadStore) open(resourceName string, offset int64) (*os.File, error) {
+	path := p.path(resourceName)
+
+	p.mu.Lock()
+	_, busy := p.active[path]
+	if !busy {
+		p.active[path] = struct{}{}
+	}
+	p.mu.Unlock()
+
+	if busy {
+		return nil, status.Errorf(codes.Aborted,
+			"Another Write is in progress for %s", resourceName)
+	}
+
+	f, err := p.openAt(path, offset)
+	if err != nil {
+		p.release(resourceName, nil)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (p *partialUploadStore) openAt(path string, offset int64) (*os.File, error) {
+	committed := int64(0)
+	p.mu.Lock()
+	if pf, ok := p.files[path]; ok {
+		committed = pf.size
+	}
+	p.mu.Unlock()
+
+	if offset > committed {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"WriteOffset %d is larger than the committed size %d",
+			offset, committed)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Discard anything after offset, the client will resend it.
+	err = f.Truncate(offset)
+	if err != nil {
+		f.Close()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = f.Seek(offset, 0)
+	if err != nil {
+		f.Close()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	p.mu.Lock()
+	pf, ok := p.files[path]
+	if !ok {
+		pf = &partialUploadFile{}
+		p.files[path] = pf
+	}
+	p.size -= pf.size - offset
+	pf.size = offset
+	pf.modified = time.Now()
+	p.mu.Unlock()
+
+	return f, nil
+}
+
+// write appends data to f, which must have been returned by open for
+// resourceName. It fails with ResourceExhausted if this would make the
+// partial uploads larger than the maximum size.
+func (p *partialUploadStore) write(resourceName string, f *os.File, data []byte) (int, error) {
+	path := p.path(resourceName)
+	n := int64(len(data))
+
+	p.mu.Lock()
+	if p.maxSize > 0 && p.size+n > p.maxSize {
+		p.mu.Unlock()
+		return 0, status.Errorf(codes.ResourceExhausted,
+			"Partial uploads would exceed their maximum size of %d bytes", p.maxSize)
+	}
+	pf, ok := p.files[path]
+	if !ok {
+		// Removed by a concurrent request which found the blob in the
+		// cache.
+		pf = &partialUploadFile{}
+		p.files[path] = pf
+	}
+	pf.size += n
+	pf.modified = time.Now()
+	p.size += n
+	p.mu.Unlock()
+
+	written, err := f.Write(data)
+	if int64(written) < n {
+		p.mu.Lock()
+		pf.size -= n - int64(written)
+		p.size -= n - int64(written)
+		p.mu.Unlock()
+	}
+	if err != nil {
+		return written, status.Error(codes.Internal, err.Error())
+	}
+
+	return written, nil
+}
+
+// release closes f (if non-nil) and allows new Writes for resourceName.
+func (p *partialUploadStore) release(resourceName string, f *os.File) {
+	if f != nil {
+		_ = f.Close()
+	}
+
+	p.mu.Lock()
+	delete(p.active, p.path(resourceName))
+	p.mu.Unlock()
+}
+
+// remove deletes any persisted data for the given upload.
+func (p *partialUploadStore) remove(resourceName string) {
+	path := p.path(resourceName)
+
+	p.mu.Lock()
+	p.forget(path)
+	p.mu.Unlock()
+
+	_ = os.Remove(path)
+}
+
+// This must be called when the lock is held.
+func (p *partialUploadStore) forget(path string) {
+	pf, ok := p.files[path]
+	if !ok {
+		return
+	}
+	p.size -= pf.size
+	delete(p.files, path)
+}
+
+func (p *partialUploadStore) expireLoop() {
+	ticker := time.NewTicker(partialUploadsCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.expire(time.Now().Add(-p.ttl))
+	}
+}
+
+// expire removes the partial uploads which have not been written to
+// since cutoff, and which do not have an ongoing Write.
+func (p *partialUploadStore) expire(cutoff time.Time) {
+	var expired []string
+
+	p.mu.Lock()
+	for path, pf := range p.files {
+		if _, busy := p.active[path]; busy || pf.modified.After(cutoff) {
+			continue
+		}
+		p.forget(path)
+		expired = append(expired, path)
+	}
+
+	// Remove the files before unlocking, so that a new Write for the same
+	// upload does not have its file removed.
+	for _, path := range expired {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove expired partial upload %s: %v", path, err)
+		}
+	}
+	p.mu.Unlock()
+}
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,11 +21,14 @@ import (
 
 	"github.com/google/uuid"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 
@@ -33,6 +38,9 @@ import (
 	testutils "github.com/buchgr/bazel-remote/v2/utils"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"golang.org/x/sync/semaphore"
 )
 
 type badDigest struct {
@@ -70,7 +78,7 @@ func grpcTestSetup(t *testing.T) (tc grpcTestFixture) {
 	return grpcTestSetupInternal(t, false)
 }
 
-func grpcTestSetupInternal(t *testing.T, mangleACKeys bool) (tc grpcTestFixture) {
+func grpcTestSetupInternal(t *testing.T, mangleACKeys bool, opts ...GRPCOption) (tc grpcTestFixture) {
 	dir, err := os.MkdirTemp("", "bazel-remote-grpc-tests-"+t.Name())
 	if err != nil {
 		t.Fatal("Failed to create grpc test temp dir", err)
@@ -105,7 +113,8 @@ func grpcTestSetupInternal(t *testing.T, mangleACKeys bool) (tc grpcTestFixture)
 			validateAC,
 			mangleACKeys,
 			enableRemoteAssetAPI,
-			diskCache, accessLogger, errorLogger)
+			diskCache, accessLogger, errorLogger,
+			opts...)
 		if err2 != nil {
 			fmt.Println(err2)
 			os.Exit(1)
@@ -396,6 +405,65 @@ func TestGrpcCasEmptySha256(t *testing.T) {
 	}
 }
 
+func TestGrpcCasZeroSizeNonEmptyHash(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	_, hash := testutils.RandomDataAndHash(16)
+
+	// A zero-size digest with a non-empty hash is invalid.
+	_, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{{
+			Digest: &pb.Digest{Hash: hash, SizeBytes: 0},
+			Data:   []byte{},
+		}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got: %v", err)
+	}
+
+	// So is a non-empty hash with no data.
+	resp, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{{
+			Digest: &pb.Digest{Hash: hash, SizeBytes: 16},
+			Data:   []byte{},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Responses) != 1 {
+		t.Fatalf("Expected 1 response, got %d", len(resp.Responses))
+	}
+	if codes.Code(resp.Responses[0].Status.Code) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got: %v", resp.Responses[0].Status)
+	}
+
+	// The same applies to bytestream writes.
+	bswc, err := fixture.bsClient.Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bswc.Send(&bytestream.WriteRequest{
+		ResourceName: fmt.Sprintf("uploads/%s/blobs/%s/0", uuid.New().String(), hash),
+		FinishWrite:  true,
+	})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	_, err = bswc.CloseAndRecv()
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got: %v", err)
+	}
+
+	found, _, _ := fixture.diskCache.Contains(ctx, cache.CAS, hash, 0)
+	if found {
+		t.Fatal("Expected the blob not to be stored")
+	}
+}
+
 func TestGrpcAcRequestInlinedBlobs(t *testing.T) {
 	t.Parallel()
 
@@ -603,6 +671,163 @@ func TestGrpcAcRequestInlinedBlobs(t *testing.T) {
 	}
 }
 
+func TestGrpcAcMaxInlineSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxInlineSize(150))
+	defer os.Remove(fixture.tempdir)
+
+	stdoutRaw, stdoutHash := testutils.RandomDataAndHash(100)
+	stderrRaw, stderrHash := testutils.RandomDataAndHash(100)
+
+	ar := pb.ActionResult{
+		StdoutRaw:    stdoutRaw,
+		StdoutDigest: &pb.Digest{Hash: stdoutHash, SizeBytes: 100},
+		StderrRaw:    stderrRaw,
+		StderrDigest: &pb.Digest{Hash: stderrHash, SizeBytes: 100},
+	}
+	_, actionDigest := testutils.RandomDataAndDigest(42)
+
+	_, err := fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		ActionDigest: &actionDigest,
+		ActionResult: &ar,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fixture.acClient.GetActionResult(ctx, &pb.GetActionResultRequest{
+		ActionDigest: &actionDigest,
+		InlineStdout: true,
+		InlineStderr: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first blob fits within the limit.
+	if !bytes.Equal(result.StdoutRaw, stdoutRaw) {
+		t.Error("Expected stdout to be inlined")
+	}
+	if len(result.StderrRaw) != 0 {
+		t.Error("Expected stderr not to be inlined")
+	}
+	if result.StderrDigest.GetHash() != stderrHash {
+		t.Errorf("Expected stderr digest %s, got %v", stderrHash, result.StderrDigest)
+	}
+}
+
+func TestGrpcAcMaxACInlineSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxACInlineSize(64))
+	defer os.Remove(fixture.tempdir)
+
+	largeContents, largeHash := testutils.RandomDataAndHash(100)
+	smallContents, smallHash := testutils.RandomDataAndHash(10)
+
+	ar := pb.ActionResult{
+		OutputFiles: []*pb.OutputFile{
+			{
+				Path:     "large",
+				Contents: largeContents,
+				Digest:   &pb.Digest{Hash: largeHash, SizeBytes: 100},
+			},
+			{
+				Path:     "small",
+				Contents: smallContents,
+				Digest:   &pb.Digest{Hash: smallHash, SizeBytes: 10},
+			},
+		},
+	}
+	_, actionDigest := testutils.RandomDataAndDigest(42)
+
+	_, err := fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		ActionDigest: &actionDigest,
+		ActionResult: &ar,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := fixture.diskCache.Get(ctx, cache.AC, actionDigest.Hash, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == nil {
+		t.Fatal("Expected the AC entry to be stored")
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored pb.ActionResult
+	err = proto.Unmarshal(data, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := stored.OutputFiles[0]
+	if len(large.Contents) != 0 {
+		t.Error("Expected the large output file not to be inlined in the AC entry")
+	}
+	if large.Digest.GetHash() != largeHash || large.Digest.GetSizeBytes() != 100 {
+		t.Errorf("Expected digest %s/100 for the large output file, got %v", largeHash, large.Digest)
+	}
+	if !bytes.Equal(stored.OutputFiles[1].Contents, smallContents) {
+		t.Error("Expected the small output file to stay inlined in the AC entry")
+	}
+
+	found, _, err := fixture.diskCache.Contains(ctx, cache.CAS, largeHash, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("Expected the large output file to be stored in the CAS")
+	}
+}
+
+func TestGrpcAcMaxOutputs(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxACOutputs(0, 0, 2))
+	defer os.Remove(fixture.tempdir)
+
+	symlinks := func(n int) []*pb.OutputSymlink {
+		s := make([]*pb.OutputSymlink, 0, n)
+		for i := 0; i < n; i++ {
+			s = append(s, &pb.OutputSymlink{
+				Path:   fmt.Sprintf("link%d", i),
+				Target: "target",
+			})
+		}
+		return s
+	}
+
+	_, actionDigest := testutils.RandomDataAndDigest(42)
+
+	_, err := fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		ActionDigest: &actionDigest,
+		ActionResult: &pb.ActionResult{OutputSymlinks: symlinks(2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+		ActionDigest: &actionDigest,
+		ActionResult: &pb.ActionResult{
+			OutputSymlinks:     symlinks(2),
+			OutputFileSymlinks: symlinks(1),
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected %s for too many symlinks, got %v", codes.InvalidArgument, err)
+	}
+}
+
 func TestGrpcByteStreamDeadline(t *testing.T) {
 	t.Parallel()
 
@@ -1041,6 +1266,59 @@ func TestGrpcByteStreamEmptyLastWrite(t *testing.T) {
 	}
 }
 
+func TestGrpcByteStreamWriteSizeMismatch(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		opts     []GRPCOption
+		expected codes.Code
+	}{
+		{nil, codes.InvalidArgument},
+		{[]GRPCOption{WithWriteSizeMismatchCode("data_loss")}, codes.DataLoss},
+	}
+
+	for _, tc := range testCases {
+		fixture := grpcTestSetupInternal(t, false, tc.opts...)
+		defer os.Remove(fixture.tempdir)
+
+		before := testutil.ToFloat64(writeSizeMismatches.WithLabelValues("short"))
+
+		testBlob, testBlobHash := testutils.RandomDataAndHash(64)
+		bswc, err := fixture.bsClient.Write(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Declare the full size, but only send half of the blob.
+		err = bswc.Send(&bytestream.WriteRequest{
+			ResourceName: fmt.Sprintf("uploads/%s/blobs/%s/%d",
+				uuid.New().String(), testBlobHash, len(testBlob)),
+			Data:        testBlob[:len(testBlob)/2],
+			FinishWrite: true,
+		})
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+
+		_, err = bswc.CloseAndRecv()
+		if status.Code(err) != tc.expected {
+			t.Fatalf("Expected %s for a truncated write, got: %v", tc.expected, err)
+		}
+
+		if testutil.ToFloat64(writeSizeMismatches.WithLabelValues("short")) <= before {
+			t.Error("Expected the short write to be counted")
+		}
+	}
+}
+
+func TestWithWriteSizeMismatchCodeInvalid(t *testing.T) {
+	s := &grpcServer{}
+	err := WithWriteSizeMismatchCode("not_found")(s)
+	if err == nil {
+		t.Fatal("Expected an error for an unsupported status code")
+	}
+}
+
 func TestGrpcByteStreamZstdWrite(t *testing.T) {
 	t.Parallel()
 
@@ -1141,6 +1419,116 @@ func TestGrpcByteStreamZstdWrite(t *testing.T) {
 	}
 }
 
+func TestGrpcByteStreamReadRange(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	// Span several casblob chunks.
+	testBlob, testBlobHash := testutils.RandomDataAndHash(3*1024*1024 + 100)
+	err := fixture.diskCache.Put(ctx, cache.CAS, testBlobHash, int64(len(testBlob)), bytes.NewReader(testBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		offset int64
+		limit  int64
+	}{
+		{0, 10},
+		{1000, 2 * 1024 * 1024},
+		{1024*1024 + 5, 1024 * 1024},
+		{int64(len(testBlob)) - 50, 1000},
+		{500, 0},
+	}
+
+	for _, tc := range tcs {
+		bsrc, err := fixture.bsClient.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: fmt.Sprintf("instance/blobs/%s/%d", testBlobHash, len(testBlob)),
+			ReadOffset:   tc.offset,
+			ReadLimit:    tc.limit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var received []byte
+		for {
+			resp, err := bsrc.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, resp.Data...)
+		}
+
+		end := int64(len(testBlob))
+		if tc.limit > 0 && tc.offset+tc.limit < end {
+			end = tc.offset + tc.limit
+		}
+		if !bytes.Equal(received, testBlob[tc.offset:end]) {
+			t.Errorf("Unexpected data for offset %d limit %d: got %d bytes, expected %d",
+				tc.offset, tc.limit, len(received), end-tc.offset)
+		}
+	}
+}
+
+// disconnectedReadServer is a bytestream read stream whose client has
+// gone away.
+type disconnectedReadServer struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *disconnectedReadServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *disconnectedReadServer) Send(*bytestream.ReadResponse) error {
+	return status.Error(codes.Unavailable, "transport is closing")
+}
+
+func TestGrpcByteStreamReadClientDisconnect(t *testing.T) {
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	testBlob, testBlobHash := testutils.RandomDataAndHash(1024)
+	err := fixture.diskCache.Put(ctx, cache.CAS, testBlobHash, int64(len(testBlob)), bytes.NewReader(testBlob))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &grpcServer{
+		cache:        fixture.diskCache,
+		accessLogger: testutils.NewSilentLogger(),
+		errorLogger:  testutils.NewSilentLogger(),
+	}
+	req := &bytestream.ReadRequest{
+		ResourceName: fmt.Sprintf("instance/blobs/%s/%d", testBlobHash, len(testBlob)),
+	}
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	before := testutil.ToFloat64(readCancellations)
+	err = s.Read(req, &disconnectedReadServer{ctx: canceledCtx})
+	if status.Code(err) != codes.Canceled {
+		t.Fatal("Expected Canceled for a client that went away, got:", err)
+	}
+	if testutil.ToFloat64(readCancellations) != before+1 {
+		t.Fatal("Expected the cancellation to be counted")
+	}
+
+	// Send failures while the client is still there are real errors.
+	err = s.Read(req, &disconnectedReadServer{ctx: ctx})
+	if status.Code(err) != codes.Unknown {
+		t.Fatal("Expected Unknown for a send failure, got:", err)
+	}
+}
+
 func TestGrpcByteStreamInvalidReadLimit(t *testing.T) {
 	t.Parallel()
 
@@ -1370,62 +1758,372 @@ func TestGrpcByteStreamQueryWriteStatus(t *testing.T) {
 	}
 }
 
-func TestGrpcCasBasics(t *testing.T) {
+func TestGrpcByteStreamResumableWrite(t *testing.T) {
 	t.Parallel()
 
-	fixture := grpcTestSetup(t)
+	partialDir, err := os.MkdirTemp("", "bazel-remote-partial-uploads-"+t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(partialDir)
+
+	fixture := grpcTestSetupInternal(t, false, WithResumableUploads(partialDir, 0, 0))
 	defer os.Remove(fixture.tempdir)
 
-	testBlob, testBlobHash := testutils.RandomDataAndHash(256)
-	testBlobDigest := pb.Digest{
-		Hash:      testBlobHash,
-		SizeBytes: int64(len(testBlob)),
-	}
+	testBlob, testBlobHash := testutils.RandomDataAndHash(2000)
+	half := int64(len(testBlob) / 2)
 
-	missingReq := pb.FindMissingBlobsRequest{
-		BlobDigests: []*pb.Digest{&testBlobDigest},
-	}
+	resourceName := fmt.Sprintf(
+		"instance/uploads/%s/blobs/%s/%d",
+		uuid.New().String(),
+		testBlobHash,
+		len(testBlob),
+	)
 
-	// FindMissingBlobs, expect cache miss.
+	// Send the first half, then give up without finishing the write.
 
-	missingResp, err := fixture.casClient.FindMissingBlobs(ctx, &missingReq)
+	bswc, err := fixture.bsClient.Write(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(missingResp.MissingBlobDigests) != 1 {
-		t.Fatal("Expected 1 missing blob, found",
-			len(missingResp.MissingBlobDigests))
+	err = bswc.Send(&bytestream.WriteRequest{
+		ResourceName: resourceName,
+		Data:         testBlob[:half],
+		WriteOffset:  0,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// BatchUpdateBlobs.
-
-	upReq := pb.BatchUpdateBlobsRequest{}
-	r := pb.BatchUpdateBlobsRequest_Request{
-		Digest: &testBlobDigest,
-		Data:   testBlob,
+	_, err = bswc.CloseAndRecv()
+	if err == nil {
+		t.Fatal("Expected an incomplete write to fail")
 	}
-	upReq.Requests = append(upReq.Requests, &r)
-	upResp, err := fixture.casClient.BatchUpdateBlobs(ctx, &upReq)
+
+	req := &bytestream.QueryWriteStatusRequest{ResourceName: resourceName}
+	resp, err := fixture.bsClient.QueryWriteStatus(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if len(upResp.GetResponses()) != 1 {
-		t.Fatal("Expected 1 response, found",
-			len(upResp.GetResponses()))
+	if resp.CommittedSize != half {
+		t.Fatalf("Expected CommittedSize == %d, got: %d", half, resp.CommittedSize)
 	}
-	if upResp.Responses[0].Digest.Hash != testBlobDigest.Hash ||
-		upResp.Responses[0].Digest.SizeBytes != testBlobDigest.SizeBytes {
-		t.Fatal("Blobs did not match")
+	if resp.Complete {
+		t.Fatal("Expected incomplete response")
 	}
 
-	// FindMissingBlobsRequest again, expect cache hit.
+	// Resuming from beyond the committed size should fail.
 
-	missingResp, err = fixture.casClient.FindMissingBlobs(ctx, &missingReq)
+	bswc, err = fixture.bsClient.Write(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(missingResp.MissingBlobDigests) != 0 {
+	err = bswc.Send(&bytestream.WriteRequest{
+		ResourceName: resourceName,
+		Data:         testBlob[half+1:],
+		WriteOffset:  half + 1,
+		FinishWrite:  true,
+	})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	_, err = bswc.CloseAndRecv()
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got: %v", err)
+	}
+
+	// Resume from the committed size.
+
+	bswc, err = fixture.bsClient.Write(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bswc.Send(&bytestream.WriteRequest{
+		ResourceName: resourceName,
+		Data:         testBlob[half:],
+		WriteOffset:  half,
+		FinishWrite:  true,
+	})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	wr, err := bswc.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wr.CommittedSize != int64(len(testBlob)) {
+		t.Fatalf("Expected CommittedSize == %d, got: %d", len(testBlob), wr.CommittedSize)
+	}
+
+	resp, err = fixture.bsClient.QueryWriteStatus(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CommittedSize != int64(len(testBlob)) || !resp.Complete {
+		t.Fatalf("Expected a complete write of %d bytes, got: %d %v",
+			len(testBlob), resp.CommittedSize, resp.Complete)
+	}
+
+	rc, _, err := fixture.diskCache.Get(ctx, cache.CAS, testBlobHash, int64(len(testBlob)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testBlob) {
+		t.Fatal("Resumed blob differs from the original")
+	}
+}
+
+func TestPartialUploadStoreStartup(t *testing.T) {
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, partialUploadPrefix+strings.Repeat("ab", sha256.Size))
+	unrelated := []string{
+		filepath.Join(dir, "unrelated"),
+		filepath.Join(dir, partialUploadPrefix+"unrelated"),
+	}
+	for _, f := range append(unrelated, stale) {
+		err := os.WriteFile(f, []byte("data"), 0664)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := newPartialUploadStore(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(stale)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the stale partial upload to be removed, got: %v", err)
+	}
+	for _, f := range unrelated {
+		_, err = os.Stat(f)
+		if err != nil {
+			t.Errorf("Expected %s to be left alone, got: %v", f, err)
+		}
+	}
+}
+
+func TestPartialUploadStoreLimits(t *testing.T) {
+	p, err := newPartialUploadStore(t.TempDir(), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := p.open("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.write("foo", f, make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.write("foo", f, make([]byte, 8))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted, got: %v", err)
+	}
+	p.release("foo", f)
+
+	if p.committedSize("foo") != 8 {
+		t.Fatalf("Expected 8 committed bytes, got %d", p.committedSize("foo"))
+	}
+
+	// Uploads with an ongoing Write are not expired.
+	f, err = p.open("bar", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.release("bar", f)
+
+	p.expire(time.Now().Add(time.Hour))
+
+	if p.committedSize("foo") != 0 {
+		t.Error("Expected the idle partial upload to be expired")
+	}
+	_, err = os.Stat(p.path("foo"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the expired partial upload to be removed, got: %v", err)
+	}
+	_, err = os.Stat(p.path("bar"))
+	if err != nil {
+		t.Errorf("Expected the active partial upload to be kept, got: %v", err)
+	}
+
+	// The expired data no longer counts towards the limit.
+	_, err = p.write("bar", f, make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrpcDisabledServices(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithEnabledServices(false, true, false))
+	defer os.Remove(fixture.tempdir)
+
+	_, err := fixture.acClient.GetActionResult(ctx, &pb.GetActionResultRequest{
+		ActionDigest: &pb.Digest{Hash: emptySha256, SizeBytes: 0},
+	})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected Unimplemented from the disabled ActionCache service, got: %v", err)
+	}
+
+	rc, err := fixture.bsClient.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: fmt.Sprintf("blobs/%s/0", emptySha256),
+	})
+	if err == nil {
+		_, err = rc.Recv()
+	}
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected Unimplemented from the disabled ByteStream service, got: %v", err)
+	}
+
+	_, err = fixture.casClient.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+		BlobDigests: []*pb.Digest{{Hash: emptySha256, SizeBytes: 0}},
+	})
+	if err != nil {
+		t.Fatal("Expected the ContentAddressableStorage service to be enabled:", err)
+	}
+}
+
+func TestGrpcInstanceFilter(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false,
+		WithInstanceFilter([]string{"", "allowed", "denied"}, []string{"denied"}))
+	defer os.Remove(fixture.tempdir)
+
+	tcs := map[string]codes.Code{
+		"":        codes.OK,
+		"allowed": codes.OK,
+		"denied":  codes.PermissionDenied,
+		"typo":    codes.PermissionDenied,
+	}
+
+	for instance, expected := range tcs {
+		_, err := fixture.acClient.GetActionResult(ctx, &pb.GetActionResultRequest{
+			InstanceName: instance,
+			ActionDigest: &pb.Digest{Hash: emptySha256, SizeBytes: 0},
+		})
+		code := status.Code(err)
+		if code == codes.NotFound {
+			code = codes.OK
+		}
+		if code != expected {
+			t.Errorf("Expected %v from GetActionResult for %q, got: %v", expected, instance, err)
+		}
+
+		_, err = fixture.casClient.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+			InstanceName: instance,
+			BlobDigests:  []*pb.Digest{{Hash: emptySha256, SizeBytes: 0}},
+		})
+		if status.Code(err) != expected {
+			t.Errorf("Expected %v from FindMissingBlobs for %q, got: %v", expected, instance, err)
+		}
+
+		resourceName := fmt.Sprintf("blobs/%s/0", emptySha256)
+		if instance != "" {
+			resourceName = instance + "/" + resourceName
+		}
+		rc, err := fixture.bsClient.Read(ctx, &bytestream.ReadRequest{
+			ResourceName: resourceName,
+		})
+		if err == nil {
+			_, err = rc.Recv()
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if status.Code(err) != expected {
+			t.Errorf("Expected %v from bytestream Read for %q, got: %v", expected, instance, err)
+		}
+
+		data, hash := testutils.RandomDataAndHash(16)
+		resourceName = fmt.Sprintf("uploads/%s/blobs/%s/%d", uuid.New().String(), hash, len(data))
+		if instance != "" {
+			resourceName = instance + "/" + resourceName
+		}
+		bswc, err := fixture.bsClient.Write(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bswc.Send(&bytestream.WriteRequest{
+			ResourceName: resourceName,
+			Data:         data,
+			FinishWrite:  true,
+		})
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		_, err = bswc.CloseAndRecv()
+		if status.Code(err) != expected {
+			t.Errorf("Expected %v from bytestream Write for %q, got: %v", expected, instance, err)
+		}
+	}
+}
+
+func TestGrpcCasBasics(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	testBlob, testBlobHash := testutils.RandomDataAndHash(256)
+	testBlobDigest := pb.Digest{
+		Hash:      testBlobHash,
+		SizeBytes: int64(len(testBlob)),
+	}
+
+	missingReq := pb.FindMissingBlobsRequest{
+		BlobDigests: []*pb.Digest{&testBlobDigest},
+	}
+
+	// FindMissingBlobs, expect cache miss.
+
+	missingResp, err := fixture.casClient.FindMissingBlobs(ctx, &missingReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missingResp.MissingBlobDigests) != 1 {
+		t.Fatal("Expected 1 missing blob, found",
+			len(missingResp.MissingBlobDigests))
+	}
+
+	// BatchUpdateBlobs.
+
+	upReq := pb.BatchUpdateBlobsRequest{}
+	r := pb.BatchUpdateBlobsRequest_Request{
+		Digest: &testBlobDigest,
+		Data:   testBlob,
+	}
+	upReq.Requests = append(upReq.Requests, &r)
+	upResp, err := fixture.casClient.BatchUpdateBlobs(ctx, &upReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(upResp.GetResponses()) != 1 {
+		t.Fatal("Expected 1 response, found",
+			len(upResp.GetResponses()))
+	}
+	if upResp.Responses[0].Digest.Hash != testBlobDigest.Hash ||
+		upResp.Responses[0].Digest.SizeBytes != testBlobDigest.SizeBytes {
+		t.Fatal("Blobs did not match")
+	}
+
+	// FindMissingBlobsRequest again, expect cache hit.
+
+	missingResp, err = fixture.casClient.FindMissingBlobs(ctx, &missingReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missingResp.MissingBlobDigests) != 0 {
 		t.Fatal("Expected 0 missing blob, found",
 			len(missingResp.MissingBlobDigests))
 	}
@@ -2431,6 +3129,35 @@ func TestParseWriteResource(t *testing.T) {
 	}
 }
 
+func TestParseWriteResourceMaxBlobSize(t *testing.T) {
+	s := &grpcServer{
+		accessLogger: testutils.NewSilentLogger(),
+		errorLogger:  testutils.NewSilentLogger(),
+	}
+	err := WithMaxBlobSize(100)(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := "0123456789012345678901234567890123456789012345678901234567890123"
+
+	_, _, _, err = s.parseWriteResource("uploads/pretenduuid/blobs/" + hash + "/100")
+	if err != nil {
+		t.Fatal("Expected a blob of the max size to be accepted:", err)
+	}
+
+	for _, name := range []string{
+		"uploads/pretenduuid/blobs/" + hash + "/101",
+		"uploads/pretenduuid/blobs/" + hash + "/9223372036854775807",
+		"uploads/pretenduuid/compressed-blobs/zstd/" + hash + "/9223372036854775807",
+	} {
+		_, _, _, err = s.parseWriteResource(name)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for %q, got: %v", name, err)
+		}
+	}
+}
+
 func TestCompressedBatchReadsAndWrites(t *testing.T) {
 	t.Parallel()
 
@@ -2544,3 +3271,648 @@ func TestHealthCheck(t *testing.T) {
 		t.Fatalf("Expected health check to return SERVING status, got: %s", resp.Status.String())
 	}
 }
+
+func TestIdleTimerSkipsHealthChecks(t *testing.T) {
+	if resetsIdleTimer(grpcHealthServiceName) {
+		t.Errorf("Expected health checks to not reset the idle timer")
+	}
+
+	if !resetsIdleTimer("/build.bazel.remote.execution.v2.ActionCache/GetActionResult") {
+		t.Errorf("Expected GetActionResult to reset the idle timer")
+	}
+}
+
+func TestGrpcWriteLimiter(t *testing.T) {
+	l := NewGrpcWriteLimiter(1)
+
+	streamFrom := func(addr string) grpc.ServerStream {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &identityServerStream{ctx: peer.NewContext(ctx, &peer.Peer{Addr: tcpAddr})}
+	}
+	writeInfo := &grpc.StreamServerInfo{FullMethod: bytestreamWriteMethod}
+	readInfo := &grpc.StreamServerInfo{FullMethod: "/google.bytestream.ByteStream/Read"}
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	blockingHandler := func(srv interface{}, ss grpc.ServerStream) error {
+		close(started)
+		<-finish
+		return nil
+	}
+	noopHandler := func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	}
+
+	errs := make(chan error)
+	go func() {
+		errs <- l.StreamServerInterceptor(nil, streamFrom("127.0.0.1:1000"), writeInfo, blockingHandler)
+	}()
+	<-started
+
+	err := l.StreamServerInterceptor(nil, streamFrom("127.0.0.1:1000"), writeInfo, noopHandler)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted for a second write on the same connection, got: %v", err)
+	}
+
+	err = l.StreamServerInterceptor(nil, streamFrom("127.0.0.1:1000"), readInfo, noopHandler)
+	if err != nil {
+		t.Errorf("Expected reads to be unaffected, got: %v", err)
+	}
+
+	err = l.StreamServerInterceptor(nil, streamFrom("127.0.0.1:1001"), writeInfo, noopHandler)
+	if err != nil {
+		t.Errorf("Expected a write on another connection to succeed, got: %v", err)
+	}
+
+	close(finish)
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.StreamServerInterceptor(nil, streamFrom("127.0.0.1:1000"), writeInfo, noopHandler)
+	if err != nil {
+		t.Errorf("Expected a write to succeed after the first one finished, got: %v", err)
+	}
+}
+
+func TestGrpcCasBatchUpdateBlobsUnsupportedCompressor(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	goodData := []byte("good blob")
+	goodHash := sha256.Sum256(goodData)
+	badData := []byte("deflated blob")
+	badHash := sha256.Sum256(badData)
+
+	before := testutil.ToFloat64(unsupportedCompressorRequests.WithLabelValues("DEFLATE"))
+
+	resp, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{
+				Digest: &pb.Digest{
+					Hash:      hex.EncodeToString(badHash[:]),
+					SizeBytes: int64(len(badData)),
+				},
+				Data:       badData,
+				Compressor: pb.Compressor_DEFLATE,
+			},
+			{
+				Digest: &pb.Digest{
+					Hash:      hex.EncodeToString(goodHash[:]),
+					SizeBytes: int64(len(goodData)),
+				},
+				Data: goodData,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(resp.Responses))
+	}
+
+	badStatus := resp.Responses[0].Status
+	if codes.Code(badStatus.Code) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for the unsupported compressor, got %s",
+			codes.Code(badStatus.Code))
+	}
+	if badStatus.Message != "unsupported compressor: DEFLATE" {
+		t.Errorf("Unexpected status message: %q", badStatus.Message)
+	}
+
+	// The rest of the batch should be unaffected.
+	if codes.Code(resp.Responses[1].Status.Code) != codes.OK {
+		t.Errorf("Expected OK for the uncompressed blob, got %s",
+			codes.Code(resp.Responses[1].Status.Code))
+	}
+
+	after := testutil.ToFloat64(unsupportedCompressorRequests.WithLabelValues("DEFLATE"))
+	if after != before+1 {
+		t.Errorf("Expected the unsupported compressor metric to be incremented, got %v -> %v",
+			before, after)
+	}
+}
+
+func TestGrpcStrictACValidation(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithStrictACValidation())
+	defer os.Remove(fixture.tempdir)
+
+	data := []byte("some inlined contents")
+	hash := sha256.Sum256(data)
+	digest := &pb.Digest{
+		Hash:      hex.EncodeToString(hash[:]),
+		SizeBytes: int64(len(data)),
+	}
+
+	update := func(contents []byte) error {
+		arData := append([]byte("action "), contents...)
+		arHash := sha256.Sum256(arData)
+		_, err := fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+			ActionDigest: &pb.Digest{
+				Hash:      hex.EncodeToString(arHash[:]),
+				SizeBytes: int64(len(arData)),
+			},
+			ActionResult: &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{
+					Path:     "foo/bar",
+					Digest:   digest,
+					Contents: contents,
+				}},
+			},
+		})
+		return err
+	}
+
+	err := update(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same length, different contents.
+	err = update([]byte("other inlined content!"[:len(data)]))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for mismatched contents, got: %v", err)
+	}
+
+	err = update(data[1:])
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for contents with the wrong length, got: %v", err)
+	}
+}
+
+func TestGrpcPreserveACExecutionMetadata(t *testing.T) {
+	t.Parallel()
+
+	for _, preserve := range []bool{false, true} {
+		var opts []GRPCOption
+		if preserve {
+			opts = append(opts, WithPreserveACExecutionMetadata())
+		}
+		fixture := grpcTestSetupInternal(t, false, opts...)
+		defer os.Remove(fixture.tempdir)
+
+		arData := []byte("action")
+		arHash := sha256.Sum256(arData)
+		actionDigest := &pb.Digest{
+			Hash:      hex.EncodeToString(arHash[:]),
+			SizeBytes: int64(len(arData)),
+		}
+
+		_, err := fixture.acClient.UpdateActionResult(ctx, &pb.UpdateActionResultRequest{
+			ActionDigest: actionDigest,
+			ActionResult: &pb.ActionResult{
+				ExitCode: 1,
+				ExecutionMetadata: &pb.ExecutedActionMetadata{
+					QueuedTimestamp: timestamppb.New(time.Unix(1000, 0)),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ar, err := fixture.acClient.GetActionResult(ctx, &pb.GetActionResultRequest{
+			ActionDigest: actionDigest,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ar.ExecutionMetadata.GetQueuedTimestamp().GetSeconds() != 1000 {
+			t.Errorf("Expected the queued timestamp to be kept, got %v",
+				ar.ExecutionMetadata.GetQueuedTimestamp())
+		}
+
+		expectedWorker := "bufconn"
+		if preserve {
+			expectedWorker = ""
+		}
+		if ar.ExecutionMetadata.GetWorker() != expectedWorker {
+			t.Errorf("Expected worker %q with preserve=%v, got %q",
+				expectedWorker, preserve, ar.ExecutionMetadata.GetWorker())
+		}
+	}
+}
+
+func TestGrpcCasTreeMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxTreeDepth(3))
+	defer os.Remove(fixture.tempdir)
+
+	// Create a chain of 4 nested directories, uploading each of them.
+
+	var digests []*pb.Digest
+	child := &pb.Directory{}
+	for i := 0; i < 4; i++ {
+		data, err := proto.Marshal(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(data)
+		digest := &pb.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		}
+
+		_, err = fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+			Requests: []*pb.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: data}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+
+		child = &pb.Directory{
+			Directories: []*pb.DirectoryNode{{Name: fmt.Sprintf("d%d", i), Digest: digest}},
+		}
+	}
+
+	getTree := func(root *pb.Digest) (*pb.GetTreeResponse, error) {
+		resp, err := fixture.casClient.GetTree(ctx, &pb.GetTreeRequest{RootDigest: root})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Recv()
+	}
+
+	// digests[2] is the root of a tree with 3 levels.
+	tResp, err := getTree(digests[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tResp.Directories) != 3 {
+		t.Fatalf("Expected 3 directories, got %d", len(tResp.Directories))
+	}
+
+	// digests[3] is the root of a tree with 4 levels.
+	_, err = getTree(digests[3])
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for a tree that is too deep, got: %v", err)
+	}
+}
+
+func TestGrpcCasTreeMaxTotalBytes(t *testing.T) {
+	t.Parallel()
+
+	// Create a chain of 4 nested directories.
+
+	var digests []*pb.Digest
+	var blobs [][]byte
+	child := &pb.Directory{}
+	for i := 0; i < 4; i++ {
+		data, err := proto.Marshal(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(data)
+		digest := &pb.Digest{
+			Hash:      hex.EncodeToString(hash[:]),
+			SizeBytes: int64(len(data)),
+		}
+		digests = append(digests, digest)
+		blobs = append(blobs, data)
+
+		child = &pb.Directory{
+			Directories: []*pb.DirectoryNode{{Name: fmt.Sprintf("d%d", i), Digest: digest}},
+		}
+	}
+
+	// Allow the tree rooted at digests[2], but not the one at digests[3].
+	limit := digests[0].SizeBytes + digests[1].SizeBytes + digests[2].SizeBytes
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxGetTreeTotalBytes(limit))
+	defer os.Remove(fixture.tempdir)
+
+	for i, digest := range digests {
+		_, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+			Requests: []*pb.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: blobs[i]}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getTree := func(root *pb.Digest) (*pb.GetTreeResponse, error) {
+		resp, err := fixture.casClient.GetTree(ctx, &pb.GetTreeRequest{RootDigest: root})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Recv()
+	}
+
+	tResp, err := getTree(digests[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tResp.Directories) != 3 {
+		t.Fatalf("Expected 3 directories, got %d", len(tResp.Directories))
+	}
+
+	_, err = getTree(digests[3])
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted for a tree that is too large, got: %v", err)
+	}
+}
+
+func TestGrpcCasTreeMaxConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var sem *semaphore.Weighted
+	captureSem := func(s *grpcServer) error {
+		sem = s.getTreeSem
+		return nil
+	}
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxConcurrentGetTree(1), captureSem)
+	defer os.Remove(fixture.tempdir)
+
+	data, err := proto.Marshal(&pb.Directory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	digest := &pb.Digest{
+		Hash:      hex.EncodeToString(hash[:]),
+		SizeBytes: int64(len(data)),
+	}
+
+	getTree := func() error {
+		resp, err := fixture.casClient.GetTree(ctx, &pb.GetTreeRequest{RootDigest: digest})
+		if err != nil {
+			return err
+		}
+		_, err = resp.Recv()
+		return err
+	}
+
+	err = getTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a GetTree call that is in progress.
+	if !sem.TryAcquire(1) {
+		t.Fatal("Expected the GetTree semaphore to be available")
+	}
+
+	err = getTree()
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted while another GetTree call is running, got: %v", err)
+	}
+
+	sem.Release(1)
+
+	err = getTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrpcBatchReadBlobsMinResponseCompressSize(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithMinResponseCompressSize(1024))
+	defer os.Remove(fixture.tempdir)
+
+	smallBlob, smallHash := testutils.RandomDataAndHash(100)
+	largeBlob, largeHash := testutils.RandomDataAndHash(4096)
+	smallDigest := pb.Digest{Hash: smallHash, SizeBytes: int64(len(smallBlob))}
+	largeDigest := pb.Digest{Hash: largeHash, SizeBytes: int64(len(largeBlob))}
+
+	_, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{Digest: &smallDigest, Data: smallBlob},
+			{Digest: &largeDigest, Data: largeBlob},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fixture.casClient.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		AcceptableCompressors: []pb.Compressor_Value{pb.Compressor_ZSTD},
+		Digests:               []*pb.Digest{&smallDigest, &largeDigest},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(resp.Responses))
+	}
+
+	small := resp.Responses[0]
+	if small.Compressor != pb.Compressor_IDENTITY || !bytes.Equal(small.Data, smallBlob) {
+		t.Errorf("Expected the small blob to be returned uncompressed, got compressor %v", small.Compressor)
+	}
+
+	if resp.Responses[1].Compressor != pb.Compressor_ZSTD {
+		t.Errorf("Expected the large blob to be returned zstd compressed, got compressor %v",
+			resp.Responses[1].Compressor)
+	}
+}
+
+func TestGrpcBatchReadBlobsMaxTotalSize(t *testing.T) {
+	t.Parallel()
+
+	var srv *grpcServer
+	captureServer := func(s *grpcServer) error {
+		srv = s
+		return nil
+	}
+
+	fixture := grpcTestSetupInternal(t, false, WithMaxBatchTotalSize(100), captureServer)
+	defer os.Remove(fixture.tempdir)
+
+	var digests []*pb.Digest
+	var requests []*pb.BatchUpdateBlobsRequest_Request
+	for i := 0; i < 3; i++ {
+		data, hash := testutils.RandomDataAndHash(40)
+		digest := &pb.Digest{Hash: hash, SizeBytes: int64(len(data))}
+		digests = append(digests, digest)
+		requests = append(requests, &pb.BatchUpdateBlobsRequest_Request{
+			Digest: digest,
+			Data:   data,
+		})
+	}
+
+	_, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: requests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caps, err := srv.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.CacheCapabilities.MaxBatchTotalSizeBytes != 100 {
+		t.Fatalf("Expected max_batch_total_size_bytes 100, got %d",
+			caps.CacheCapabilities.MaxBatchTotalSizeBytes)
+	}
+
+	// Two blobs fit within the limit.
+	resp, err := fixture.casClient.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		Digests: digests[:2],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(resp.Responses))
+	}
+
+	// Three do not.
+	_, err = fixture.casClient.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		Digests: digests,
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted, got: %v", err)
+	}
+}
+
+func TestGrpcBatchDeduplication(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetupInternal(t, false, WithBatchDeduplication())
+	defer os.Remove(fixture.tempdir)
+
+	dataA, hashA := testutils.RandomDataAndHash(32)
+	dataB, hashB := testutils.RandomDataAndHash(32)
+	digestA := &pb.Digest{Hash: hashA, SizeBytes: int64(len(dataA))}
+	digestB := &pb.Digest{Hash: hashB, SizeBytes: int64(len(dataB))}
+
+	upResp, err := fixture.casClient.BatchUpdateBlobs(ctx, &pb.BatchUpdateBlobsRequest{
+		Requests: []*pb.BatchUpdateBlobsRequest_Request{
+			{Digest: digestA, Data: dataA},
+			{Digest: digestB, Data: dataB},
+			{Digest: digestA, Data: dataA},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upResp.Responses) != 3 {
+		t.Fatalf("Expected 3 responses, got %d", len(upResp.Responses))
+	}
+	for i, hash := range []string{hashA, hashB, hashA} {
+		r := upResp.Responses[i]
+		if r.Digest.Hash != hash || r.Status.Code != int32(codes.OK) {
+			t.Errorf("Unexpected response %d: %v", i, r)
+		}
+	}
+
+	readResp, err := fixture.casClient.BatchReadBlobs(ctx, &pb.BatchReadBlobsRequest{
+		Digests: []*pb.Digest{digestA, digestA, digestB, digestA},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readResp.Responses) != 4 {
+		t.Fatalf("Expected 4 responses, got %d", len(readResp.Responses))
+	}
+	for i, data := range [][]byte{dataA, dataA, dataB, dataA} {
+		r := readResp.Responses[i]
+		if r.Status.GetCode() != int32(codes.OK) || !bytes.Equal(r.Data, data) {
+			t.Errorf("Unexpected response %d: %v", i, r)
+		}
+	}
+
+	if n := testutil.ToFloat64(batchDuplicateDigests.WithLabelValues("BatchUpdateBlobs")); n != 1 {
+		t.Errorf("Expected 1 deduplicated upload, got %v", n)
+	}
+	if n := testutil.ToFloat64(batchDuplicateDigests.WithLabelValues("BatchReadBlobs")); n != 2 {
+		t.Errorf("Expected 2 deduplicated reads, got %v", n)
+	}
+}
+
+func TestGrpcDigestFunction(t *testing.T) {
+	t.Parallel()
+
+	fixture := grpcTestSetup(t)
+	defer os.Remove(fixture.tempdir)
+
+	_, err := fixture.casClient.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+		DigestFunction: pb.DigestFunction_SHA256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fixture.casClient.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{
+		DigestFunction: pb.DigestFunction_BLAKE3,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an unsupported digest function, got: %v", err)
+	}
+
+	_, err = fixture.acClient.GetActionResult(ctx, &pb.GetActionResultRequest{
+		ActionDigest:   &pb.Digest{Hash: emptySha256},
+		DigestFunction: pb.DigestFunction_SHA1,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for an unsupported digest function, got: %v", err)
+	}
+}
+
+type reservedSizeCache struct {
+	disk.Cache
+	reservedSize int64
+}
+
+func (c *reservedSizeCache) MaxSize() int64 {
+	return 1000
+}
+
+func (c *reservedSizeCache) Stats() (int64, int64, int, int64) {
+	return 0, c.reservedSize, 0, 0
+}
+
+type trailerServerStream struct {
+	grpc.ServerStream
+	trailer metadata.MD
+}
+
+func (s *trailerServerStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func TestGrpcBackpressure(t *testing.T) {
+	c := &reservedSizeCache{}
+	b := NewGrpcBackpressure(c, 0.5)
+
+	noopHandler := func(srv interface{}, ss grpc.ServerStream) error {
+		return nil
+	}
+
+	for reservedSize, expectHigh := range map[int64]bool{0: false, 500: false, 501: true} {
+		c.reservedSize = reservedSize
+
+		ss := &trailerServerStream{}
+		err := b.StreamServerInterceptor(nil, ss, &grpc.StreamServerInfo{}, noopHandler)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := ss.trailer.Get(LoadTrailer)
+		if expectHigh && (len(values) != 1 || values[0] != "high") {
+			t.Errorf("Expected a %s trailer with %d bytes reserved, got: %v",
+				LoadTrailer, reservedSize, ss.trailer)
+		}
+		if !expectHigh && len(values) != 0 {
+			t.Errorf("Expected no %s trailer with %d bytes reserved, got: %v",
+				LoadTrailer, reservedSize, ss.trailer)
+		}
+	}
+}
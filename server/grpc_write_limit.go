@@ -0,0 +1,79 @@
+package server
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const bytestreamWriteMethod = "/google.bytestream.ByteStream/Write"
+
+// GrpcWriteLimiter provides a gRPC stream interceptor that limits the
+// number of concurrent bytestream Write calls from each connection, so
+// that a single client cannot tie up the server with a very large number
+// of uploads. Connections are identified by their remote address.
+type GrpcWriteLimiter struct {
+	maxWrites int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// NewGrpcWriteLimiter returns a GrpcWriteLimiter that allows at most
+// maxWrites concurrent bytestream Write calls per connection.
+func NewGrpcWriteLimiter(maxWrites int) *GrpcWriteLimiter {
+	return &GrpcWriteLimiter{
+		maxWrites: maxWrites,
+		active:    make(map[string]int),
+	}
+}
+
+// StreamServerInterceptor returns a streaming server interceptor that
+// fails bytestream Write calls with RESOURCE_EXHAUSTED if the connection
+// already has the maximum number of Write calls in progress.
+func (l *GrpcWriteLimiter) StreamServerInterceptor(srv interface{},
+	ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	if info.FullMethod != bytestreamWriteMethod {
+		return handler(srv, ss)
+	}
+
+	p, ok := peer.FromContext(ss.Context())
+	if !ok || p.Addr == nil {
+		return handler(srv, ss)
+	}
+	key := p.Addr.String()
+
+	if !l.acquire(key) {
+		return status.Errorf(codes.ResourceExhausted,
+			"too many concurrent writes on this connection (max %d)", l.maxWrites)
+	}
+	defer l.release(key)
+
+	return handler(srv, ss)
+}
+
+func (l *GrpcWriteLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key] >= l.maxWrites {
+		return false
+	}
+	l.active[key]++
+	return true
+}
+
+func (l *GrpcWriteLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active[key]--
+	if l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
@@ -35,6 +35,12 @@ var decoder, _ = zstd.NewReader(nil) // TODO: raise WithDecoderConcurrency ?
 type HTTPCache interface {
 	CacheHandler(w http.ResponseWriter, r *http.Request)
 	StatusPageHandler(w http.ResponseWriter, r *http.Request)
+	StatsHandler(w http.ResponseWriter, r *http.Request)
+	EvictHandler(w http.ResponseWriter, r *http.Request)
+	EvictTagHandler(w http.ResponseWriter, r *http.Request)
+	PinHandler(w http.ResponseWriter, r *http.Request)
+	PinsHandler(w http.ResponseWriter, r *http.Request)
+	DeepHealthHandler(w http.ResponseWriter, r *http.Request)
 	VerifyClientCertHandler(wrapMe http.Handler) http.Handler
 }
 
@@ -47,6 +53,36 @@ type httpCache struct {
 	gitCommit                string
 	checkClientCertForReads  bool
 	checkClientCertForWrites bool
+	logClientIdentity        bool
+	deepHealth               deepHealthCheck
+}
+
+type evictResponseData struct {
+	EvictedItems int   `json:"evicted_items"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+	CurrSize     int64 `json:"curr_size"`
+}
+
+type pinResponseData struct {
+	Key    string `json:"key"`
+	Pinned bool   `json:"pinned"`
+}
+
+type pinsResponseData struct {
+	Pins []string `json:"pins"`
+}
+
+var sha256Hash = regexp.MustCompile("^[a-f0-9]{64}$")
+
+// statsData is the response of the /api/stats endpoint. Unlike the status
+// page, this has a stable schema which is intended to be consumed by other
+// tools.
+type statsData struct {
+	TotalSize   int64   `json:"total_size"`
+	MaxSize     int64   `json:"max_size"`
+	NumItems    int     `json:"num_items"`
+	HitRate1h   float64 `json:"hit_rate_1h"`
+	Evictions1h int64   `json:"evictions_1h"`
 }
 
 type statusPageData struct {
@@ -64,7 +100,7 @@ type statusPageData struct {
 // accessLogger will print one line for each HTTP request to stdout.
 // errorLogger will print unexpected server errors. Inexistent files and malformed URLs will not
 // be reported.
-func NewHTTPCache(cache disk.Cache, accessLogger cache.Logger, errorLogger cache.Logger, validateAC bool, mangleACKeys bool, checkClientCertForReads bool, checkClientCertForWrites bool, commit string) HTTPCache {
+func NewHTTPCache(cache disk.Cache, accessLogger cache.Logger, errorLogger cache.Logger, validateAC bool, mangleACKeys bool, checkClientCertForReads bool, checkClientCertForWrites bool, logClientIdentity bool, commit string) HTTPCache {
 
 	_, _, numItems, _ := cache.Stats()
 
@@ -78,6 +114,7 @@ func NewHTTPCache(cache disk.Cache, accessLogger cache.Logger, errorLogger cache
 		mangleACKeys:             mangleACKeys,
 		checkClientCertForReads:  checkClientCertForReads,
 		checkClientCertForWrites: checkClientCertForWrites,
+		logClientIdentity:        logClientIdentity,
 	}
 
 	if commit != "{STABLE_GIT_COMMIT}" {
@@ -199,7 +236,17 @@ func (h *httpCache) logResponse(code int, r *http.Request) {
 	if err != nil {
 		clientAddress = r.RemoteAddr
 	}
-	h.accessLogger.Printf("%4s %d %15s %s", r.Method, code, clientAddress, r.URL.Path)
+
+	var client string
+	if h.logClientIdentity && r.Method == http.MethodPut {
+		client = clientIdentitySuffix(r.Context())
+	}
+
+	if code < http.StatusBadRequest || code == http.StatusNotFound {
+		cache.LogSuccess(h.accessLogger, "%4s %d %15s %s%s", r.Method, code, clientAddress, r.URL.Path, client)
+		return
+	}
+	h.accessLogger.Printf("%4s %d %15s %s%s", r.Method, code, clientAddress, r.URL.Path, client)
 }
 
 func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
@@ -216,6 +263,14 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		hash = cache.TransformActionCacheKey(hash, instance, h.accessLogger)
 	}
 
+	if isTrue(r.Header.Get(cache.NoPromoteHeader)) {
+		r = r.WithContext(cache.WithNoPromote(r.Context()))
+	}
+
+	if instance != "" {
+		r = r.WithContext(cache.WithTag(r.Context(), instance))
+	}
+
 	switch m := r.Method; m {
 	case http.MethodGet:
 		if h.checkClientCertForReads && !h.hasValidClientCert(w, r) {
@@ -224,6 +279,27 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Clients can ask for the zstd stream itself as the response body,
+		// rather than as a Content-Encoding which HTTP libraries tend to
+		// decode transparently.
+		zstdBody := false
+		switch compressor := r.URL.Query().Get("compressor"); compressor {
+		case "", "identity":
+		case "zstd":
+			if kind != cache.CAS {
+				http.Error(w, "The compressor query parameter is only supported for CAS blobs",
+					http.StatusBadRequest)
+				h.logResponse(http.StatusBadRequest, r)
+				return
+			}
+			zstdBody = true
+		default:
+			http.Error(w, fmt.Sprintf("Unsupported compressor: %q", html.EscapeString(compressor)),
+				http.StatusBadRequest)
+			h.logResponse(http.StatusBadRequest, r)
+			return
+		}
+
 		if h.validateAC && kind == cache.AC {
 			h.handleGetValidAC(w, r, hash)
 			return
@@ -233,7 +309,7 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		var sizeBytes int64
 
 		zstdCompressed := false
-		if kind == cache.CAS && strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+		if zstdBody || (kind == cache.CAS && strings.Contains(r.Header.Get("Accept-Encoding"), "zstd")) {
 			rdr, sizeBytes, err = h.cache.GetZstd(r.Context(), hash, -1, 0)
 			zstdCompressed = true
 		} else {
@@ -256,13 +332,24 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer rdr.Close()
 
-		w.Header().Set("Content-Type", "application/octet-stream")
-		if zstdCompressed {
-			// TODO: calculate Content-Length for compressed blobs too
-			// (unless compressing on the fly).
-			w.Header().Set("Content-Encoding", "zstd")
+		if zstdBody {
+			// The body is the zstd stream itself, of unknown length.
+			w.Header().Set("Content-Type", "application/zstd")
 		} else {
-			w.Header().Set("Content-Length", strconv.FormatInt(sizeBytes, 10))
+			contentType := "application/octet-stream"
+			if kind == cache.RAW {
+				if ct := h.cache.RawContentType(hash); ct != "" {
+					contentType = ct
+				}
+			}
+			w.Header().Set("Content-Type", contentType)
+			if zstdCompressed {
+				// TODO: calculate Content-Length for compressed blobs too
+				// (unless compressing on the fly).
+				w.Header().Set("Content-Encoding", "zstd")
+			} else {
+				w.Header().Set("Content-Length", strconv.FormatInt(sizeBytes, 10))
+			}
 		}
 
 		_, err := io.Copy(w, rdr)
@@ -276,10 +363,13 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 		h.logResponse(http.StatusOK, r)
 
 	case http.MethodPut:
-		if h.checkClientCertForWrites && !h.hasValidClientCert(w, r) {
-			http.Error(w, "Authentication required for write access", http.StatusUnauthorized)
-			h.logResponse(http.StatusUnauthorized, r)
-			return
+		if h.checkClientCertForWrites {
+			if !h.hasValidClientCert(w, r) {
+				http.Error(w, "Authentication required for write access", http.StatusUnauthorized)
+				h.logResponse(http.StatusUnauthorized, r)
+				return
+			}
+			r = r.WithContext(WithClientIdentity(r.Context(), certCommonName(r.TLS)))
 		}
 
 		contentLength := r.ContentLength
@@ -414,7 +504,12 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 			rdr = rc
 		}
 
-		err := h.cache.Put(r.Context(), kind, hash, contentLength, rdr)
+		ctx := r.Context()
+		if kind == cache.RAW {
+			ctx = cache.WithContentType(ctx, r.Header.Get("Content-Type"))
+		}
+
+		err := h.cache.Put(ctx, kind, hash, contentLength, rdr)
 		if err != nil {
 			var msg string
 			if cerr, ok := err.(*cache.Error); ok {
@@ -443,7 +538,20 @@ func (h *httpCache) CacheHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Unvalidated path:
 
-		ok, size := h.cache.Contains(r.Context(), kind, hash, -1)
+		if isTrue(r.Header.Get(cache.LocalOnlyHeader)) {
+			r = r.WithContext(cache.WithLocalOnly(r.Context()))
+		}
+
+		ok, size, err := h.cache.Contains(r.Context(), kind, hash, -1)
+		if err != nil {
+			if e, ok := err.(*cache.Error); ok {
+				http.Error(w, e.Error(), e.Code)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			h.errorLogger.Printf("HEAD %s: %s", path(kind, hash), err)
+			return
+		}
 		if !ok {
 			http.Error(w, "Not found", http.StatusNotFound)
 			h.logResponse(http.StatusNotFound, r)
@@ -517,6 +625,219 @@ func (h *httpCache) StatusPageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// StatsHandler reports cache statistics as JSON, including the fraction of
+// reads that were cache hits and the number of evictions in the last hour.
+func (h *httpCache) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	totalSize, _, numItems, _ := h.cache.Stats()
+	hits, misses, evictions := h.cache.RecentStats()
+
+	var hitRate float64
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	err := enc.Encode(statsData{
+		TotalSize:   totalSize,
+		MaxSize:     h.cache.MaxSize(),
+		NumItems:    numItems,
+		HitRate1h:   hitRate,
+		Evictions1h: evictions,
+	})
+	if err != nil {
+		h.errorLogger.Printf("Failed to encode stats json: %s", err.Error())
+	}
+}
+
+// Evict least recently used items until the size of the cache is at most
+// the number of bytes given by the "target_bytes" query parameter, and
+// report how much was evicted.
+func (h *httpCache) EvictHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	targetSize, err := strconv.ParseInt(r.URL.Query().Get("target_bytes"), 10, 64)
+	if err != nil || targetSize < 0 {
+		http.Error(w, "The target_bytes query parameter must be a non-negative integer",
+			http.StatusBadRequest)
+		h.logResponse(http.StatusBadRequest, r)
+		return
+	}
+
+	numItems, numBytes := h.cache.EvictTo(targetSize)
+	totalSize, _, _, _ := h.cache.Stats()
+
+	h.errorLogger.Printf("Manual eviction to %d bytes removed %d items (%d bytes)",
+		targetSize, numItems, numBytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	err = enc.Encode(evictResponseData{
+		EvictedItems: numItems,
+		EvictedBytes: numBytes,
+		CurrSize:     totalSize,
+	})
+	if err != nil {
+		h.errorLogger.Printf("Failed to encode eviction json: %s", err.Error())
+	}
+	h.logResponse(http.StatusOK, r)
+}
+
+// EvictTagHandler evicts all the AC entries that were uploaded with the
+// instance name given by the "tag" query parameter, and reports what was
+// evicted in the same format as EvictHandler.
+func (h *httpCache) EvictTagHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		http.Error(w, "The tag query parameter must not be empty",
+			http.StatusBadRequest)
+		h.logResponse(http.StatusBadRequest, r)
+		return
+	}
+
+	numItems, numBytes := h.cache.EvictTag(tag)
+	totalSize, _, _, _ := h.cache.Stats()
+
+	h.errorLogger.Printf("Manual eviction of tag %q removed %d items (%d bytes)",
+		tag, numItems, numBytes)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	err := enc.Encode(evictResponseData{
+		EvictedItems: numItems,
+		EvictedBytes: numBytes,
+		CurrSize:     totalSize,
+	})
+	if err != nil {
+		h.errorLogger.Printf("Failed to encode eviction json: %s", err.Error())
+	}
+	h.logResponse(http.StatusOK, r)
+}
+
+// PinHandler pins (POST) or unpins (DELETE) the item given by the "kind"
+// ("ac", "cas" or "raw", default "cas") and "hash" query parameters.
+// Pinned items are never evicted to make space for other items.
+func (h *httpCache) PinHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	var kind cache.EntryKind
+	switch r.URL.Query().Get("kind") {
+	case "", "cas":
+		kind = cache.CAS
+	case "ac":
+		kind = cache.AC
+	case "raw":
+		kind = cache.RAW
+	default:
+		http.Error(w, "The kind query parameter must be one of ac, cas or raw",
+			http.StatusBadRequest)
+		h.logResponse(http.StatusBadRequest, r)
+		return
+	}
+
+	hash := r.URL.Query().Get("hash")
+	if !sha256Hash.MatchString(hash) {
+		http.Error(w, "The hash query parameter must be a SHA256 hash in hex",
+			http.StatusBadRequest)
+		h.logResponse(http.StatusBadRequest, r)
+		return
+	}
+
+	pinned := r.Method == http.MethodPost
+	var found bool
+	var err error
+	if pinned {
+		found, err = h.cache.Pin(kind, hash)
+	} else {
+		found, err = h.cache.Unpin(kind, hash)
+	}
+	if err != nil {
+		h.errorLogger.Printf("Failed to update pin of %s: %s", cache.LookupKey(kind, hash), err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.logResponse(http.StatusInternalServerError, r)
+		return
+	}
+	if !found {
+		http.Error(w, "Not found", http.StatusNotFound)
+		h.logResponse(http.StatusNotFound, r)
+		return
+	}
+
+	if pinned {
+		h.errorLogger.Printf("Pinned %s", cache.LookupKey(kind, hash))
+	} else {
+		h.errorLogger.Printf("Unpinned %s", cache.LookupKey(kind, hash))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	err = enc.Encode(pinResponseData{
+		Key:    cache.LookupKey(kind, hash),
+		Pinned: pinned,
+	})
+	if err != nil {
+		h.errorLogger.Printf("Failed to encode pin json: %s", err.Error())
+	}
+	h.logResponse(http.StatusOK, r)
+}
+
+// PinsHandler lists the lookup keys ("<kind>/<hash>") of the pinned items.
+func (h *httpCache) PinsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+		h.logResponse(http.StatusMethodNotAllowed, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	err := enc.Encode(pinsResponseData{Pins: h.cache.Pins()})
+	if err != nil {
+		h.errorLogger.Printf("Failed to encode pins json: %s", err.Error())
+	}
+	h.logResponse(http.StatusOK, r)
+}
+
 func path(kind cache.EntryKind, hash string) string {
 	return fmt.Sprintf("/%s/%s", kind, hash)
 }
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/buchgr/bazel-remote/v2/utils/idle"
+)
+
+// HTTPIdleTimerHandler returns an http.HandlerFunc that resets the given
+// idle.Timer before calling `wrapped`, but only for requests whose URL
+// refers to a cache item. Other requests, eg for health checks that happen
+// to be served by the same handler, do not keep the server alive.
+func HTTPIdleTimerHandler(idleTimer *idle.Timer, wrapped http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isCacheRequestPath(r.URL.Path) {
+			idleTimer.ResetTimer()
+		}
+		wrapped(w, r)
+	}
+}
+
+// Return true if `path` refers to an AC or CAS item.
+func isCacheRequestPath(path string) bool {
+	_, _, _, err := parseRequestURL(path, true)
+	return err == nil
+}
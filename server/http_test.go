@@ -8,10 +8,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 
@@ -20,6 +22,9 @@ import (
 	"github.com/buchgr/bazel-remote/v2/utils"
 
 	pb "github.com/buchgr/bazel-remote/v2/genproto/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -38,7 +43,7 @@ func TestDownloadFile(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
@@ -85,6 +90,54 @@ func TestDownloadFile(t *testing.T) {
 	}
 }
 
+func TestDownloadZstdBody(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	c, err := disk.New(cacheDir, 10*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+	handler := http.HandlerFunc(h.CacheHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("PUT", "/cas/"+hash, bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for PUT, got %d", http.StatusOK, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/cas/"+hash+"?compressor=zstd", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/zstd" {
+		t.Errorf("Expected Content-Type application/zstd, got %q", ct)
+	}
+	if ce := rr.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", ce)
+	}
+
+	uncompressed, err := decoder.DecodeAll(rr.Body.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(uncompressed, data) {
+		t.Error("Decompressed response body differs from the uploaded blob")
+	}
+
+	for _, url := range []string{"/cas/" + hash + "?compressor=gzip", "/ac/" + hash + "?compressor=zstd"} {
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, url, rr.Code)
+		}
+	}
+}
+
 func TestUploadFilesConcurrently(t *testing.T) {
 	cacheDir := testutils.TempDir(t)
 	defer os.RemoveAll(cacheDir)
@@ -106,7 +159,7 @@ func TestUploadFilesConcurrently(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 	handler := http.HandlerFunc(h.CacheHandler)
 
 	var wg sync.WaitGroup
@@ -170,7 +223,7 @@ func TestUploadSameFileConcurrently(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 	handler := http.HandlerFunc(h.CacheHandler)
 
 	var wg sync.WaitGroup
@@ -211,7 +264,7 @@ func TestUploadCorruptedFile(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
 	handler.ServeHTTP(rr, r)
@@ -255,7 +308,7 @@ func TestUploadEmptyActionResult(t *testing.T) {
 	mangle := false
 	checkClientCertForReads := false
 	checkClientCertForWrites := false
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, mangle, checkClientCertForReads, checkClientCertForWrites, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, mangle, checkClientCertForReads, checkClientCertForWrites, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
 	handler.ServeHTTP(rr, r)
@@ -317,7 +370,7 @@ func testEmptyBlobAvailable(t *testing.T, method string) {
 	mangle := false
 	checkClientCertForReads := false
 	checkClientCertForWrites := false
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, mangle, checkClientCertForReads, checkClientCertForWrites, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), validate, mangle, checkClientCertForReads, checkClientCertForWrites, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.CacheHandler)
 	handler.ServeHTTP(rr, r)
@@ -340,7 +393,7 @@ func TestStatusPage(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(h.StatusPageHandler)
 	handler.ServeHTTP(rr, r)
@@ -484,7 +537,7 @@ func TestRemoteReturnsNotFound(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	h := NewHTTPCache(emptyCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, "")
+	h := NewHTTPCache(emptyCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
 	// create a fake http.Request
 	_, hash := testutils.RandomDataAndHash(1024)
 	url, _ := url.Parse(fmt.Sprintf("http://localhost:8080/ac/%s", hash))
@@ -522,7 +575,7 @@ func TestManglingACKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	h := NewHTTPCache(diskCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), false, true, false, false, "")
+	h := NewHTTPCache(diskCache, testutils.NewSilentLogger(), testutils.NewSilentLogger(), false, true, false, false, false, "")
 	// create a fake http.Request
 	data, hash := testutils.RandomDataAndHash(blobSize)
 	err = diskCache.Put(context.Background(), cache.RAW, hash, int64(len(data)), bytes.NewReader(data))
@@ -563,3 +616,405 @@ func TestManglingACKeys(t *testing.T) {
 		t.Errorf("Wrong status code, expected %d, got %d", http.StatusNotFound, statusCode)
 	}
 }
+
+func TestIsCacheRequestPath(t *testing.T) {
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	testCases := map[string]bool{
+		"/cas/" + hash:         true,
+		"/ac/" + hash:          true,
+		"/foo/bar/cas/" + hash: true,
+		"/metrics":             false,
+		"/status":              false,
+		"/":                    false,
+		"/cas/notavalidhash":   false,
+	}
+
+	for path, expected := range testCases {
+		if isCacheRequestPath(path) != expected {
+			t.Errorf("Expected isCacheRequestPath(%q) to be %v", path, expected)
+		}
+	}
+}
+
+func TestEvictHandler(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 8*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		data, hash := testutils.RandomDataAndHash(100)
+		err = c.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+	handler := http.HandlerFunc(h.EvictHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/evict?target_bytes=0", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d for GET request, got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/evict?target_bytes=-1", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for invalid target, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	target := 2 * disk.BlockSize
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", fmt.Sprintf("/admin/evict?target_bytes=%d", target), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var data evictResponseData
+	err = json.Unmarshal(rr.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.EvictedItems != 2 {
+		t.Errorf("Expected 2 items to be evicted, got %d", data.EvictedItems)
+	}
+	if data.CurrSize > int64(target) {
+		t.Errorf("Expected the cache size to be at most %d, got %d", target, data.CurrSize)
+	}
+
+	_, _, numItems, _ := c.Stats()
+	if numItems != 2 {
+		t.Errorf("Expected 2 items to remain in the cache, found %d", numItems)
+	}
+}
+
+func TestPinHandler(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 8*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, pinnedHash := testutils.RandomDataAndHash(100)
+	err = c.Put(context.Background(), cache.CAS, pinnedHash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+	handler := http.HandlerFunc(h.PinHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/pin?hash="+pinnedHash, nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d for GET request, got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/pin?hash=abc", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for invalid hash, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	_, missingHash := testutils.RandomDataAndHash(100)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/pin?hash="+missingHash, nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d for missing item, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/pin?kind=cas&hash="+pinnedHash, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// Pins are stored in the cache dir, so they survive restarts.
+	c, err = disk.New(cacheDir, 8*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(h.PinsHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/pins", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var pins pinsResponseData
+	err = json.Unmarshal(rr.Body.Bytes(), &pins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPin := cache.LookupKey(cache.CAS, pinnedHash)
+	if len(pins.Pins) != 1 || pins.Pins[0] != expectedPin {
+		t.Fatalf("Expected pins [%s], got %v", expectedPin, pins.Pins)
+	}
+
+	numItems, _ := c.EvictTo(0)
+	if numItems != 0 {
+		t.Fatalf("Expected the pinned item not to be evicted, %d items were evicted", numItems)
+	}
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(h.PinHandler).ServeHTTP(rr, httptest.NewRequest("DELETE", "/admin/pin?hash="+pinnedHash, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	numItems, _ = c.EvictTo(0)
+	if numItems != 1 {
+		t.Fatalf("Expected the unpinned item to be evicted, %d items were evicted", numItems)
+	}
+	if len(c.Pins()) != 0 {
+		t.Fatalf("Expected no pins, found %v", c.Pins())
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 8*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, hash := testutils.RandomDataAndHash(100)
+	err = c.Put(context.Background(), cache.CAS, hash, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One hit and three misses.
+	rc, _, err := c.Get(context.Background(), cache.CAS, hash, int64(len(data)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	for i := 0; i < 3; i++ {
+		_, missingHash := testutils.RandomDataAndHash(100)
+		_, _, err = c.Get(context.Background(), cache.CAS, missingHash, 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+	handler := http.HandlerFunc(h.StatsHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/stats", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	var stats statsData
+	err = json.Unmarshal(rr.Body.Bytes(), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.NumItems != 1 {
+		t.Errorf("Expected 1 item, got %d", stats.NumItems)
+	}
+	if stats.MaxSize != 8*disk.BlockSize {
+		t.Errorf("Expected max size %d, got %d", 8*disk.BlockSize, stats.MaxSize)
+	}
+	if stats.HitRate1h != 0.25 {
+		t.Errorf("Expected hit rate 0.25, got %v", stats.HitRate1h)
+	}
+	if stats.Evictions1h != 0 {
+		t.Errorf("Expected no evictions, got %d", stats.Evictions1h)
+	}
+}
+
+func TestDeepHealthHandler(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 8*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), true, false, false, false, false, "")
+	handler := http.HandlerFunc(h.DeepHealthHandler)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/healthz/deep", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d for POST request, got %d", http.StatusMethodNotAllowed, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz/deep", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// The canary blob should not be left in the cache.
+	_, _, numItems, _ := c.Stats()
+	if numItems != 0 {
+		t.Errorf("Expected the cache to be empty, found %d items", numItems)
+	}
+}
+
+func TestInflightRequests(t *testing.T) {
+	inflight := NewInflightRequests()
+
+	gaugeValue := func(method string) float64 {
+		var m dto.Metric
+		err := inflight.gauge.WithLabelValues(method).Write(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	var during float64
+	handler := inflight.HTTPHandler(func(w http.ResponseWriter, r *http.Request) {
+		during = gaugeValue(http.MethodGet)
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cas/"+emptySha256, nil))
+
+	if during != 1 {
+		t.Errorf("Expected 1 GET request in flight while handling, got %f", during)
+	}
+	if after := gaugeValue(http.MethodGet); after != 0 {
+		t.Errorf("Expected 0 GET requests in flight after handling, got %f", after)
+	}
+
+	// Arbitrary client-chosen methods share a single label.
+	handler = inflight.HTTPHandler(func(w http.ResponseWriter, r *http.Request) {
+		during = gaugeValue("other")
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("BREW", "/cas/"+emptySha256, nil))
+
+	if during != 1 {
+		t.Errorf("Expected 1 other request in flight while handling, got %f", during)
+	}
+	if n := testutil.CollectAndCount(inflight.gauge); n != 2 {
+		t.Errorf("Expected 2 in-flight time series, got %d", n)
+	}
+
+	fullMethod := "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs"
+	_, err := inflight.UnaryServerInterceptor(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: fullMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			during = gaugeValue("FindMissingBlobs")
+			return nil, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if during != 1 {
+		t.Errorf("Expected 1 FindMissingBlobs request in flight while handling, got %f", during)
+	}
+	if after := gaugeValue("FindMissingBlobs"); after != 0 {
+		t.Errorf("Expected 0 FindMissingBlobs requests in flight after handling, got %f", after)
+	}
+}
+
+func TestLogClientIdentity(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 10*disk.BlockSize, disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logBuf bytes.Buffer
+	accessLogger := log.New(&logBuf, "", 0)
+
+	h := NewHTTPCache(c, accessLogger, testutils.NewSilentLogger(), true, false, false, false, true, "")
+	handler := http.HandlerFunc(h.CacheHandler)
+
+	data, hash := testutils.RandomDataAndHash(1024)
+
+	pr := httptest.NewRequest("PUT", "/cas/"+hash, bytes.NewReader(data))
+	pr = pr.WithContext(WithClientIdentity(pr.Context(), "alice"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, pr)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	gr := httptest.NewRequest("GET", "/cas/"+hash, nil)
+	gr = gr.WithContext(WithClientIdentity(gr.Context(), "alice"))
+	handler.ServeHTTP(httptest.NewRecorder(), gr)
+
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 access log lines, got %q", lines)
+	}
+
+	if !strings.HasPrefix(lines[0], "PUT 200") || !strings.HasSuffix(lines[0], " client=alice") {
+		t.Errorf("Expected the PUT log line to include the client identity, got %q", lines[0])
+	}
+
+	if strings.Contains(lines[1], "client=") {
+		t.Errorf("Expected the GET log line not to include the client identity, got %q", lines[1])
+	}
+}
+
+func TestRawContentTypes(t *testing.T) {
+	cacheDir := testutils.TempDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	c, err := disk.New(cacheDir, 1024*disk.BlockSize,
+		disk.WithRawContentTypes(),
+		disk.WithAccessLogger(testutils.NewSilentLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHTTPCache(c, testutils.NewSilentLogger(), testutils.NewSilentLogger(), false, false, false, false, false, "")
+
+	data, hash := testutils.RandomDataAndHash(64)
+
+	put := httptest.NewRequest(http.MethodPut, "/ac/"+hash, bytes.NewReader(data))
+	put.Header.Set("Content-Type", "text/html; charset=utf-8")
+	rr := httptest.NewRecorder()
+	h.CacheHandler(rr, put)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected PUT to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.CacheHandler(rr, httptest.NewRequest(http.MethodGet, "/ac/"+hash, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected GET to succeed, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Expected the stored content type, got %q", ct)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Error("Unexpected response body")
+	}
+
+	// Overwriting the entry without a content type removes the old one.
+	rr = httptest.NewRecorder()
+	h.CacheHandler(rr, httptest.NewRequest(http.MethodPut, "/ac/"+hash, bytes.NewReader(data)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected PUT to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.CacheHandler(rr, httptest.NewRequest(http.MethodGet, "/ac/"+hash, nil))
+	if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Expected application/octet-stream, got %q", ct)
+	}
+}
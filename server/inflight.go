@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+// InflightRequests tracks the number of gRPC and HTTP requests which are
+// currently being handled, by method. gRPC requests are labelled with the
+// name of the gRPC method (eg "FindMissingBlobs"), and HTTP requests with
+// the HTTP method (eg "GET"), or "other" for methods which are not served.
+type InflightRequests struct {
+	gauge *prometheus.GaugeVec
+}
+
+// NewInflightRequests returns a new InflightRequests, whose metrics must be
+// registered with RegisterMetrics.
+func NewInflightRequests() *InflightRequests {
+	return &InflightRequests{
+		gauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bazel_remote_inflight_requests",
+			Help: "The number of requests currently being handled, by method",
+		}, []string{"method"}),
+	}
+}
+
+// RegisterMetrics registers the in-flight request gauge with the default
+// prometheus registry.
+func (i *InflightRequests) RegisterMetrics() {
+	prometheus.MustRegister(i.gauge)
+}
+
+// StreamServerInterceptor returns a streaming server interceptor that
+// counts the request as in-flight until the handler returns.
+func (i *InflightRequests) StreamServerInterceptor(srv interface{},
+	ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	g := i.gauge.WithLabelValues(grpcMethodName(info.FullMethod))
+	g.Inc()
+	defer g.Dec()
+
+	return handler(srv, ss)
+}
+
+// UnaryServerInterceptor returns a unary server interceptor that counts
+// the request as in-flight until the handler returns.
+func (i *InflightRequests) UnaryServerInterceptor(ctx context.Context,
+	req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	g := i.gauge.WithLabelValues(grpcMethodName(info.FullMethod))
+	g.Inc()
+	defer g.Dec()
+
+	return handler(ctx, req)
+}
+
+// grpcMethodName returns the method name from a full gRPC method
+// string, eg "FindMissingBlobs" from
+// "/build.bazel.remote.execution.v2.ContentAddressableStorage/FindMissingBlobs".
+func grpcMethodName(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// httpMethodLabel returns the label for an HTTP request method. The method
+// is chosen by the client, so unexpected methods share a single label to
+// bound the number of time series.
+func httpMethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// HTTPHandler returns an http.HandlerFunc that counts each request as
+// in-flight while `wrapped` handles it.
+func (i *InflightRequests) HTTPHandler(wrapped http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g := i.gauge.WithLabelValues(httpMethodLabel(r.Method))
+		g.Inc()
+		defer g.Dec()
+
+		wrapped(w, r)
+	}
+}
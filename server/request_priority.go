@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/buchgr/bazel-remote/v2/cache"
+)
+
+// RequestPriority marks requests as high priority, so that they are
+// scheduled first when they need to wait for a limited resource. Requests
+// are high priority if they set the cache.PriorityHeader header (or gRPC
+// metadata key) to "high", or if they were made by one of the configured
+// high priority clients. Its interceptors and HTTP handler must run after
+// authentication, so that the client identity is available.
+type RequestPriority struct {
+	highPriorityClients map[string]struct{}
+}
+
+// NewRequestPriority returns a new RequestPriority, which treats requests
+// from the given client identities (eg basic auth usernames or client
+// certificate common names) as high priority.
+func NewRequestPriority(highPriorityClients []string) *RequestPriority {
+	p := &RequestPriority{
+		highPriorityClients: make(map[string]struct{}, len(highPriorityClients)),
+	}
+	for _, client := range highPriorityClients {
+		p.highPriorityClients[client] = struct{}{}
+	}
+	return p
+}
+
+func (p *RequestPriority) isHighPriority(ctx context.Context, priority string) bool {
+	if strings.EqualFold(priority, "high") {
+		return true
+	}
+
+	return p.isHighPriorityClient(ClientIdentity(ctx))
+}
+
+func (p *RequestPriority) isHighPriorityClient(identity string) bool {
+	if identity == "" {
+		return false
+	}
+	_, ok := p.highPriorityClients[identity]
+	return ok
+}
+
+func (p *RequestPriority) grpcContext(ctx context.Context) context.Context {
+	var priority string
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		values := md.Get(strings.ToLower(cache.PriorityHeader))
+		if len(values) > 0 {
+			priority = values[0]
+		}
+	}
+
+	if p.isHighPriority(ctx, priority) {
+		return cache.WithHighPriority(ctx)
+	}
+	return ctx
+}
+
+// StreamServerInterceptor returns a streaming server interceptor that
+// marks high priority requests.
+func (p *RequestPriority) StreamServerInterceptor(srv interface{},
+	ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	ctx := p.grpcContext(ss.Context())
+	if ctx != ss.Context() {
+		ss = &identityServerStream{ServerStream: ss, ctx: ctx}
+	}
+	return handler(srv, ss)
+}
+
+// UnaryServerInterceptor returns a unary server interceptor that marks
+// high priority requests.
+func (p *RequestPriority) UnaryServerInterceptor(ctx context.Context,
+	req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	return handler(p.grpcContext(ctx), req)
+}
+
+// HTTPHandler returns an http.HandlerFunc that marks high priority
+// requests before `wrapped` handles them.
+func (p *RequestPriority) HTTPHandler(wrapped http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Client certificates are verified by the HTTP cache handler,
+		// so the identity is not in the request context yet.
+		if p.isHighPriority(r.Context(), r.Header.Get(cache.PriorityHeader)) ||
+			p.isHighPriorityClient(certCommonName(r.TLS)) {
+			r = r.WithContext(cache.WithHighPriority(r.Context()))
+		}
+		wrapped(w, r)
+	}
+}
@@ -1,7 +1,9 @@
 package backendproxy
 
 import (
+	"context"
 	"io"
+	"sync"
 
 	"github.com/buchgr/bazel-remote/v2/cache"
 )
@@ -12,26 +14,111 @@ type UploadReq struct {
 	SizeOnDisk  int64
 	Kind        cache.EntryKind
 	Rc          io.ReadCloser
+
+	// Optional request metadata to send to the backend, used by
+	// proxies which forward incoming gRPC metadata.
+	Metadata map[string][]string
+
+	// If non-nil, this is not an upload but a marker used by
+	// WaitForUploads.
+	barrier *barrier
 }
 
 type Uploader interface {
 	UploadFile(item UploadReq)
 }
 
+// An upload queue and the number of goroutines which read from it.
+type uploadQueue struct {
+	ch           chan UploadReq
+	numUploaders int
+}
+
+var (
+	queuesMu sync.Mutex
+	queues   []uploadQueue
+)
+
 func StartUploaders(u Uploader, numUploaders int, maxQueuedUploads int) chan UploadReq {
 	if maxQueuedUploads <= 0 || numUploaders <= 0 {
 		return nil
 	}
 
-	uploadQueue := make(chan UploadReq, maxQueuedUploads)
+	ch := make(chan UploadReq, maxQueuedUploads)
 
 	for i := 0; i < numUploaders; i++ {
 		go func() {
-			for item := range uploadQueue {
+			for item := range ch {
+				if item.barrier != nil {
+					item.barrier.wait()
+					continue
+				}
 				u.UploadFile(item)
 			}
 		}()
 	}
 
-	return uploadQueue
+	queuesMu.Lock()
+	queues = append(queues, uploadQueue{ch: ch, numUploaders: numUploaders})
+	queuesMu.Unlock()
+
+	return ch
+}
+
+// A barrier is queued once for each uploader goroutine. Each uploader
+// blocks when it reaches the barrier, so once all of them have reached it
+// every upload which was queued before the barrier has finished.
+type barrier struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (b *barrier) wait() {
+	b.arrived <- struct{}{}
+	<-b.release
+}
+
+// WaitForUploads waits until all of the uploads which are queued by the
+// proxy backends have finished, or until ctx is done. Uploads which are
+// queued while this is waiting may not be waited for.
+func WaitForUploads(ctx context.Context) error {
+	queuesMu.Lock()
+	qs := append([]uploadQueue(nil), queues...)
+	queuesMu.Unlock()
+
+	for _, q := range qs {
+		err := q.drain(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (q uploadQueue) drain(ctx context.Context) error {
+	b := &barrier{
+		arrived: make(chan struct{}, q.numUploaders),
+		release: make(chan struct{}),
+	}
+	// Let the uploaders continue, even if ctx is done first.
+	defer close(b.release)
+
+	for i := 0; i < q.numUploaders; i++ {
+		select {
+		case q.ch <- UploadReq{barrier: b}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for i := 0; i < q.numUploaders; i++ {
+		select {
+		case <-b.arrived:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
 }
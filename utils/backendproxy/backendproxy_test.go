@@ -0,0 +1,56 @@
+package backendproxy_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buchgr/bazel-remote/v2/utils/backendproxy"
+)
+
+type slowUploader struct {
+	delay    time.Duration
+	uploaded int32
+}
+
+func (u *slowUploader) UploadFile(item backendproxy.UploadReq) {
+	time.Sleep(u.delay)
+	atomic.AddInt32(&u.uploaded, 1)
+}
+
+func TestWaitForUploads(t *testing.T) {
+	u := &slowUploader{delay: 50 * time.Millisecond}
+	ch := backendproxy.StartUploaders(u, 2, 10)
+
+	for i := 0; i < 6; i++ {
+		ch <- backendproxy.UploadReq{Hash: "foo"}
+	}
+
+	err := backendproxy.WaitForUploads(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := atomic.LoadInt32(&u.uploaded)
+	if uploaded != 6 {
+		t.Fatalf("Expected 6 finished uploads, found %d", uploaded)
+	}
+}
+
+func TestWaitForUploadsTimeout(t *testing.T) {
+	u := &slowUploader{delay: time.Second}
+	ch := backendproxy.StartUploaders(u, 1, 10)
+
+	for i := 0; i < 3; i++ {
+		ch <- backendproxy.UploadReq{Hash: "foo"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := backendproxy.WaitForUploads(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package events publishes cache events, such as new items being added to
+// the cache, as JSON messages to a NATS server. Publishing is best-effort:
+// events are queued in memory and dropped if the queue is full or the
+// server is unavailable, so that cache operations are never blocked.
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// The maximum number of events waiting to be published.
+	queueSize = 10000
+
+	dialTimeout    = 5 * time.Second
+	writeTimeout   = 5 * time.Second
+	reconnectDelay = 5 * time.Second
+)
+
+var failedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bazel_remote_events_failed_total",
+	Help: "The number of cache events which could not be published, by reason",
+}, []string{"reason"})
+
+// Event is the JSON message published for each cache event.
+type Event struct {
+	Event     string    `json:"event"` // "put" or "evict".
+	Kind      string    `json:"kind"`  // "ac", "cas" or "raw".
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NATSPublisher publishes events to a subject on a NATS server, using the
+// NATS text protocol. It implements disk.EventSink.
+type NATSPublisher struct {
+	address string
+	subject string
+
+	queue chan Event
+
+	// Protects writes to conn, which are made both when publishing
+	// events and when replying to the server's PINGs.
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewNATSPublisher returns a NATSPublisher which publishes events to
+// subject on the NATS server at address (host:port). The connection is
+// established in the background, and re-established if it fails.
+func NewNATSPublisher(address string, subject string) *NATSPublisher {
+	p := &NATSPublisher{
+		address: address,
+		subject: subject,
+		queue:   make(chan Event, queueSize),
+	}
+
+	for _, reason := range []string{"dropped", "unavailable", "publish_error"} {
+		failedEvents.WithLabelValues(reason).Add(0)
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Put queues a "put" event, and does not block.
+func (p *NATSPublisher) Put(kind string, hash string, size int64) {
+	p.enqueue("put", kind, hash, size)
+}
+
+// Evict queues an "evict" event, and does not block.
+func (p *NATSPublisher) Evict(kind string, hash string, size int64) {
+	p.enqueue("evict", kind, hash, size)
+}
+
+func (p *NATSPublisher) enqueue(event string, kind string, hash string, size int64) {
+	e := Event{
+		Event:     event,
+		Kind:      kind,
+		Hash:      hash,
+		Size:      size,
+		Timestamp: time.Now().UTC(),
+	}
+
+	select {
+	case p.queue <- e:
+	default:
+		failedEvents.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (p *NATSPublisher) run() {
+	var lastAttempt time.Time
+
+	for e := range p.queue {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Failed to marshal cache event: %v", err)
+			failedEvents.WithLabelValues("publish_error").Inc()
+			continue
+		}
+
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+
+		if conn == nil {
+			// Don't retry for every event while the server is down.
+			if time.Since(lastAttempt) < reconnectDelay {
+				failedEvents.WithLabelValues("unavailable").Inc()
+				continue
+			}
+			lastAttempt = time.Now()
+
+			conn, err = p.connect()
+			if err != nil {
+				log.Printf("Failed to connect to NATS server %s: %v", p.address, err)
+				failedEvents.WithLabelValues("unavailable").Inc()
+				continue
+			}
+		}
+
+		err = p.write(conn, fmt.Sprintf("PUB %s %d\r\n%s\r\n", p.subject, len(payload), payload))
+		if err != nil {
+			log.Printf("Failed to publish cache event to NATS server %s: %v", p.address, err)
+			failedEvents.WithLabelValues("publish_error").Inc()
+			p.disconnect(conn)
+		}
+	}
+}
+
+// connect establishes a new connection to the NATS server, and starts
+// a goroutine which handles messages from the server.
+func (p *NATSPublisher) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server sends an INFO message as soon as the client connects.
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected message from server: %q", strings.TrimSpace(line))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	err = p.write(conn, `CONNECT {"verbose":false,"pedantic":false,"name":"bazel-remote"}`+"\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+
+	go p.readLoop(conn, r)
+
+	return conn, nil
+}
+
+// readLoop replies to the server's PINGs, so that the connection is kept
+// alive, and logs errors reported by the server.
+func (p *NATSPublisher) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			p.disconnect(conn)
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			err = p.write(conn, "PONG\r\n")
+			if err != nil {
+				p.disconnect(conn)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server %s reported an error: %s", p.address, line)
+		}
+	}
+}
+
+func (p *NATSPublisher) write(conn net.Conn, msg string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write([]byte(msg))
+	return err
+}
+
+// disconnect closes conn, and forgets it if it is the current connection,
+// so that the next event triggers a reconnection.
+func (p *NATSPublisher) disconnect(conn net.Conn) {
+	conn.Close()
+
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.mu.Unlock()
+}
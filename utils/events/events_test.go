@@ -0,0 +1,102 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type message struct {
+		subject string
+		payload []byte
+	}
+	received := make(chan message, 10)
+
+	// A minimal NATS server, which accepts a single client.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+		conn.Write([]byte("PING\r\n"))
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) != 3 || fields[0] != "PUB" {
+				continue
+			}
+
+			size, err := strconv.Atoi(fields[2])
+			if err != nil {
+				t.Error("Invalid PUB size:", line)
+				return
+			}
+
+			payload := make([]byte, size+2) // Including the trailing \r\n.
+			_, err = io.ReadFull(r, payload)
+			if err != nil {
+				return
+			}
+
+			received <- message{subject: fields[1], payload: payload[:size]}
+		}
+	}()
+
+	p := NewNATSPublisher(ln.Addr().String(), "cache.events")
+	p.Put("cas", "0123abcd", 42)
+	p.Evict("ac", "4567ef01", 7)
+
+	expected := []Event{
+		{Event: "put", Kind: "cas", Hash: "0123abcd", Size: 42},
+		{Event: "evict", Kind: "ac", Hash: "4567ef01", Size: 7},
+	}
+
+	for _, exp := range expected {
+		var msg message
+		select {
+		case msg = <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for event", exp.Event)
+		}
+
+		if msg.subject != "cache.events" {
+			t.Errorf("Expected subject %q, got %q", "cache.events", msg.subject)
+		}
+
+		var e Event
+		err = json.Unmarshal(msg.payload, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e.Timestamp.IsZero() {
+			t.Error("Expected a timestamp in event", string(msg.payload))
+		}
+		e.Timestamp = time.Time{}
+
+		if e != exp {
+			t.Errorf("Expected event %+v, got %+v", exp, e)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buchgr/bazel-remote/v2/cache/azblobproxy"
 	"github.com/buchgr/bazel-remote/v2/cache/s3proxy"
@@ -47,12 +48,53 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "Which format to store CAS blobs in. Must be one of \"zstd\" or \"uncompressed\".",
 			EnvVars: []string{"BAZEL_REMOTE_STORAGE_MODE"},
 		},
+		&cli.StringFlag{
+			Name:    "dir_layout",
+			Value:   "two-char-prefix",
+			Usage:   "How to arrange cache files in the cache dir. Must be one of \"two-char-prefix\", which uses 256 subdirectories per keyspace named after the first two characters of the hash, or \"flat\", which stores the files directly in the ac.v2, cas.v2 and raw.v2 directories. The flat layout may perform better on some network or object store backed filesystems. Existing cache dirs must be emptied before changing the layout.",
+			EnvVars: []string{"BAZEL_REMOTE_DIR_LAYOUT"},
+		},
+		&cli.IntFlag{
+			Name:        "migration_batch_size",
+			Usage:       "The number of directory entries to read at a time when migrating a cache directory from an old directory structure at startup. Smaller values reduce the peak memory usage when migrating huge caches.",
+			DefaultText: "10000",
+			EnvVars:     []string{"BAZEL_REMOTE_MIGRATION_BATCH_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:        "serve_during_load",
+			Usage:       "Whether to start serving requests before the existing files in the cache directory have been loaded. Files are loaded in the background, most recently used first, and requests for files which have not been loaded yet are treated as cache misses.",
+			DefaultText: "false, ie wait for existing files to be loaded",
+			EnvVars:     []string{"BAZEL_REMOTE_SERVE_DURING_LOAD"},
+		},
+		&cli.BoolFlag{
+			Name:        "keep_incomplete_files",
+			Usage:       "Whether to leave files which were not completely written, eg due to a crash during an upload, in the cache directory on startup. Such files are never served, and by default they are removed when the cache directory is loaded.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_KEEP_INCOMPLETE_FILES"},
+		},
+		&cli.BoolFlag{
+			Name:        "fail_on_lru_inconsistency",
+			Usage:       "Whether to exit if an internal inconsistency is detected in the disk cache LRU index, eg reserved space which cannot be released. By default the affected entry is dropped from the index, the bazel_remote_lru_inconsistency_total metric is incremented, and the server continues. This is intended for detecting bugs quickly in testing.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_FAIL_ON_LRU_INCONSISTENCY"},
+		},
+		&cli.BoolFlag{
+			Name:        "read_only",
+			Usage:       "Whether to serve the existing items in the cache directory without writing to it, eg if it is on a read-only mount. Uploads are rejected, and items are not read through from a proxy backend. Otherwise bazel-remote fails to start if the cache directory is not writable, and switches to read-only mode if writes fail because the filesystem has become read-only.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_READ_ONLY"},
+		},
 		&cli.StringFlag{
 			Name:    "zstd_implementation",
 			Value:   "go",
 			Usage:   "ZSTD implementation to use. Must be one of \"go\" or \"cgo\".",
 			EnvVars: []string{"BAZEL_REMOTE_ZSTD_IMPLEMENTATION"},
 		},
+		&cli.StringFlag{
+			Name:    "encryption_key_file",
+			Usage:   "Path to a file containing a hex-encoded 256 bit AES key, used to encrypt CAS blobs on disk with AES-GCM. Requires --storage_mode zstd. CAS blobs which were stored before encryption was enabled can still be read. AC and RAW entries are not encrypted, and proxy backends receive uncompressed, unencrypted blobs.",
+			EnvVars: []string{"BAZEL_REMOTE_ENCRYPTION_KEY_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "http_address",
 			Usage:   "Address specification for the HTTP server listener, formatted either as [host]:port for TCP or unix://path.sock for Unix domain sockets.",
@@ -76,6 +118,17 @@ func GetCliFlags() []cli.Flag {
 				"Set to 'none' to disable.",
 			EnvVars: []string{"BAZEL_REMOTE_GRPC_ADDRESS"},
 		},
+		&cli.BoolFlag{
+			Name:        "unix_socket_cleanup",
+			Usage:       "Whether to remove stale unix socket files left behind by a previous process before listening on unix:// addresses, and to remove the socket files on shutdown. A socket file is only removed at startup if nothing accepts connections on it.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_UNIX_SOCKET_CLEANUP"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allowed_cidrs",
+			Usage:   "A comma separated list of CIDRs, eg 10.0.0.0/8,192.168.1.0/24, which clients must connect from. Connections to the HTTP and gRPC listeners from other addresses are closed before TLS negotiation and authentication. If unset, connections from all addresses are allowed. Unix domain socket listeners are not affected.",
+			EnvVars: []string{"BAZEL_REMOTE_ALLOWED_CIDRS"},
+		},
 		&cli.IntFlag{
 			Name:    "grpc_port",
 			Value:   9092,
@@ -118,12 +171,32 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "0s, ie disabled",
 			EnvVars:     []string{"BAZEL_REMOTE_HTTP_WRITE_TIMEOUT"},
 		},
+		&cli.DurationFlag{
+			Name:        "http_read_header_timeout",
+			Value:       0,
+			Usage:       "The amount of time allowed to read HTTP request headers, to limit connections which stall before sending a complete request (does not apply to the proxy backends or the profiling endpoint)",
+			DefaultText: "0s, ie use http_read_timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_READ_HEADER_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "http_idle_timeout",
+			Value:       0,
+			Usage:       "The maximum amount of time to wait for the next request on an idle HTTP keep-alive connection (does not apply to the proxy backends or the profiling endpoint). This is unrelated to idle_timeout",
+			DefaultText: "0s, ie use http_read_timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_IDLE_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "htpasswd_file",
 			Value:   "",
 			Usage:   "Path to a .htpasswd file. This flag is optional. Please read https://httpd.apache.org/docs/2.4/programs/htpasswd.html.",
 			EnvVars: []string{"BAZEL_REMOTE_HTPASSWD_FILE"},
 		},
+		&cli.StringFlag{
+			Name:    "grpc_htpasswd_file",
+			Value:   "",
+			Usage:   "Path to a .htpasswd file to use for the gRPC server instead of --htpasswd_file, so that HTTP and gRPC clients can have separate credentials. Requires --htpasswd_file.",
+			EnvVars: []string{"BAZEL_REMOTE_GRPC_HTPASSWD_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "min_tls_version",
 			Value:   "1.0",
@@ -148,6 +221,12 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "Path to a pem encoded key file.",
 			EnvVars: []string{"BAZEL_REMOTE_TLS_KEY_FILE"},
 		},
+		&cli.StringFlag{
+			Name:    "tls_session_ticket_key_file",
+			Value:   "",
+			Usage:   "Path to a file containing one or more hex-encoded 256 bit TLS session ticket keys, one per line. The first key is used to encrypt new session tickets, and all of them are used to decrypt session tickets. Sharing this file between replicas lets clients resume TLS sessions with any of them. The file is re-read every minute, so the keys can be rotated. Requires --tls_cert_file and --tls_key_file.",
+			EnvVars: []string{"BAZEL_REMOTE_TLS_SESSION_TICKET_KEY_FILE"},
+		},
 		&cli.BoolFlag{
 			Name:        "allow_unauthenticated_reads",
 			Value:       false,
@@ -158,10 +237,31 @@ func GetCliFlags() []cli.Flag {
 		&cli.DurationFlag{
 			Name:        "idle_timeout",
 			Value:       0,
-			Usage:       "The maximum period of having received no request after which the server will shut itself down.",
+			Usage:       "The maximum period of having received no cache request after which the server will shut itself down. Requests for metrics, status and health checks are not counted.",
 			DefaultText: "0s, ie disabled",
 			EnvVars:     []string{"BAZEL_REMOTE_IDLE_TIMEOUT"},
 		},
+		&cli.DurationFlag{
+			Name:        "shutdown_timeout",
+			Value:       0,
+			Usage:       "The maximum time to wait for in-flight requests to finish during a graceful shutdown, after which the remaining connections are closed.",
+			DefaultText: "0s, ie wait indefinitely",
+			EnvVars:     []string{"BAZEL_REMOTE_SHUTDOWN_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "shutdown_write_window",
+			Value:       0,
+			Usage:       "The maximum time to wait for in-flight uploads to be committed during a graceful shutdown, before the servers are stopped. New uploads are refused with HTTP 503 or UNAVAILABLE during this time, but reads are still served. This is separate from --shutdown_timeout, which applies afterwards.",
+			DefaultText: "0s, ie uploads are not given extra time",
+			EnvVars:     []string{"BAZEL_REMOTE_SHUTDOWN_WRITE_WINDOW"},
+		},
+		&cli.DurationFlag{
+			Name:        "drain_proxy_uploads_on_shutdown",
+			Value:       0,
+			Usage:       "The maximum time to wait for queued uploads to the proxy backend to finish during a graceful shutdown, after the servers have stopped. Otherwise queued uploads are dropped on shutdown, which loses recently written blobs if the local disk is ephemeral.",
+			DefaultText: "0s, ie queued uploads are dropped",
+			EnvVars:     []string{"BAZEL_REMOTE_DRAIN_PROXY_UPLOADS_ON_SHUTDOWN"},
+		},
 		&cli.IntFlag{
 			Name:    "max_queued_uploads",
 			Value:   1000000,
@@ -182,6 +282,24 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: strconv.FormatInt(math.MaxInt64, 10),
 			EnvVars:     []string{"BAZEL_REMOTE_MAX_PROXY_BLOB_SIZE"},
 		},
+		&cli.BoolFlag{
+			Name:        "strict_proxy_errors",
+			Usage:       "Whether to fail HTTP HEAD requests and gRPC FindMissingBlobs calls with HTTP 503 or UNAVAILABLE when the proxy backend cannot be checked, eg due to network errors, authentication failures or 5xx responses, instead of reporting a cache miss. Items which the proxy backend reports as not found are still cache misses.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_STRICT_PROXY_ERRORS"},
+		},
+		&cli.BoolFlag{
+			Name:        "no_proxy_for_ac",
+			Usage:       "Whether to only read ActionCache entries from the local disk, and never from the proxy backend. ActionCache entries are still uploaded to the proxy backend, and CAS blobs are still read from it. This avoids stale ActionResults from eventually consistent proxy backends.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_NO_PROXY_FOR_AC"},
+		},
+		&cli.Float64Flag{
+			Name:        "max_reserved_fraction",
+			Usage:       "If greater than 0, limit the space reserved for in-flight uploads to this fraction of max_size. Uploads beyond this limit fail with an InsufficientStorage error instead of contending for space, leaving room for proxy downloads.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_RESERVED_FRACTION"},
+		},
 		&cli.IntFlag{
 			Name:    "num_uploaders",
 			Value:   100,
@@ -194,6 +312,26 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The base URL to use for the experimental grpc proxy backend, e.g. grpc://localhost:9090 or grpcs://example.com:7070. Note that this requires a backend with remote asset API support if you want http client requests to work.",
 			EnvVars: []string{"BAZEL_REMOTE_GRPC_PROXY_URL"},
 		},
+		&cli.StringFlag{
+			Name:    "grpc_proxy.password_file",
+			Value:   "",
+			Usage:   "Path to a file containing the password to use with the username in grpc_proxy.url, as an alternative to including the password in the url.",
+			EnvVars: []string{"BAZEL_REMOTE_GRPC_PROXY_PASSWORD_FILE"},
+		},
+		&cli.DurationFlag{
+			Name:        "grpc_proxy.connect_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed to establish a connection to the gRPC proxy backend.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_GRPC_PROXY_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "grpc_proxy.request_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed for each request to the gRPC proxy backend, including reading the response.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_GRPC_PROXY_REQUEST_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "grpc_proxy.key_file",
 			Value:   "",
@@ -212,12 +350,43 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "Path to a certificate autority used to validate the grpc proxy backend certificate.",
 			EnvVars: []string{"BAZEL_REMOTE_GRPC_PROXY_CA_FILE"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "grpc_proxy.forward_metadata",
+			Usage:   "A comma separated list of incoming gRPC metadata keys whose values should be forwarded to the grpc proxy backend, eg for authentication with a backend that does its own access control.",
+			EnvVars: []string{"BAZEL_REMOTE_GRPC_PROXY_FORWARD_METADATA"},
+		},
+		&cli.StringFlag{
+			Name:    "grpc_proxy.compression",
+			Value:   "",
+			Usage:   "The compression to use for CAS transfers to and from the grpc proxy backend: \"zstd\" to use zstd compressed-blobs if the backend supports it, falling back to uncompressed transfers otherwise, or \"identity\" to always transfer uncompressed blobs. If unset, zstd is used only when the storage_mode is zstd.",
+			EnvVars: []string{"BAZEL_REMOTE_GRPC_PROXY_COMPRESSION"},
+		},
 		&cli.StringFlag{
 			Name:    "http_proxy.url",
 			Value:   "",
 			Usage:   "The base URL to use for a http proxy backend.",
 			EnvVars: []string{"BAZEL_REMOTE_HTTP_PROXY_URL"},
 		},
+		&cli.StringFlag{
+			Name:    "http_proxy.password_file",
+			Value:   "",
+			Usage:   "Path to a file containing the password to use with the username in http_proxy.url, as an alternative to including the password in the url.",
+			EnvVars: []string{"BAZEL_REMOTE_HTTP_PROXY_PASSWORD_FILE"},
+		},
+		&cli.DurationFlag{
+			Name:        "http_proxy.connect_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed to establish a connection to the HTTP proxy backend.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_PROXY_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "http_proxy.request_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed for each request to the HTTP proxy backend, including reading the response.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_HTTP_PROXY_REQUEST_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "http_proxy.key_file",
 			Value:   "",
@@ -236,6 +405,12 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "Path to a certificate autority used to validate the http proxy backend certificate.",
 			EnvVars: []string{"BAZEL_REMOTE_HTTP_PROXY_CA_FILE"},
 		},
+		&cli.StringFlag{
+			Name:    "http_proxy.store_format",
+			Value:   "",
+			Usage:   "The format to store CAS blobs in on the http proxy backend. Must be one of \"casblob-zstd\" or \"identity\". The default is to use the same format as --storage_mode. Use \"identity\" if the backend is shared with tools that expect uncompressed blobs, blobs are then decompressed before upload and compressed after download.",
+			EnvVars: []string{"BAZEL_REMOTE_HTTP_PROXY_STORE_FORMAT"},
+		},
 		&cli.StringFlag{
 			Name:    "gcs_proxy.bucket",
 			Value:   "",
@@ -254,6 +429,20 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "Path to a JSON file that contains Google credentials for the Google Cloud Storage proxy backend.",
 			EnvVars: []string{"BAZEL_REMOTE_GCS_JSON_CREDENTIALS_FILE"},
 		},
+		&cli.DurationFlag{
+			Name:        "gcs_proxy.connect_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed to establish a connection to the GCS proxy backend.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_GCS_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "gcs_proxy.request_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed for each request to the GCS proxy backend, including reading the response.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_GCS_REQUEST_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "ldap.url",
 			Value:   "",
@@ -279,6 +468,12 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The password of the bind user.",
 			EnvVars: []string{"BAZEL_REMOTE_LDAP_BIND_PASSWORD"},
 		},
+		&cli.StringFlag{
+			Name:    "ldap.bind_password_file",
+			Value:   "",
+			Usage:   "Path to a file containing the password of the bind user. Mutually exclusive with ldap.bind_password.",
+			EnvVars: []string{"BAZEL_REMOTE_LDAP_BIND_PASSWORD_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "ldap.username_attribute",
 			Value:   "uid",
@@ -296,6 +491,30 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The amount of time to cache a successful authentication in seconds.",
 			EnvVars: []string{"BAZEL_REMOTE_LDAP_CACHE_TIME"},
 		},
+		&cli.IntFlag{
+			Name:    "ldap.cache_max_entries",
+			Value:   10000,
+			Usage:   "The maximum number of LDAP authentication results to cache. The least recently used results are forgotten when this limit is reached.",
+			EnvVars: []string{"BAZEL_REMOTE_LDAP_CACHE_MAX_ENTRIES"},
+		},
+		&cli.StringFlag{
+			Name:    "events.type",
+			Value:   "nats",
+			Usage:   "The type of message queue to publish cache events to. Only \"nats\" is currently supported.",
+			EnvVars: []string{"BAZEL_REMOTE_EVENTS_TYPE"},
+		},
+		&cli.StringFlag{
+			Name:    "events.address",
+			Value:   "",
+			Usage:   "The host:port address of the message queue server to publish cache events to. If set, a JSON message is published on a best-effort basis for each item added to or evicted from the cache.",
+			EnvVars: []string{"BAZEL_REMOTE_EVENTS_ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:    "events.topic",
+			Value:   "",
+			Usage:   "The NATS subject to publish cache events to. Required if events.address is set.",
+			EnvVars: []string{"BAZEL_REMOTE_EVENTS_TOPIC"},
+		},
 		&cli.StringFlag{
 			Name:    "s3.endpoint",
 			Value:   "",
@@ -311,7 +530,7 @@ func GetCliFlags() []cli.Flag {
 		&cli.StringFlag{
 			Name:    "s3.bucket_lookup_type",
 			Value:   "auto",
-			Usage:   "The S3/minio bucket lookup type to use when using S3 proxy backend. Allowed values: auto, dns, path.",
+			Usage:   "The S3/minio bucket lookup type to use when using S3 proxy backend. Allowed values: auto, dns, path. With auto, path-style lookups are used for endpoints which are IP addresses or hostnames without dots.",
 			EnvVars: []string{"BAZEL_REMOTE_S3_BUCKET_LOOKUP_TYPE"},
 		},
 		&cli.StringFlag{
@@ -338,12 +557,24 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The S3/minio secret access key to use when using S3 proxy backend. " + s3AuthMsg(s3proxy.AuthMethodAccessKey),
 			EnvVars: []string{"BAZEL_REMOTE_S3_SECRET_ACCESS_KEY"},
 		},
+		&cli.StringFlag{
+			Name:    "s3.secret_access_key_file",
+			Value:   "",
+			Usage:   "Path to a file containing the S3/minio secret access key. Mutually exclusive with s3.secret_access_key. " + s3AuthMsg(s3proxy.AuthMethodAccessKey),
+			EnvVars: []string{"BAZEL_REMOTE_S3_SECRET_ACCESS_KEY_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "s3.session_token",
 			Value:   "",
 			Usage:   "The S3/minio session token to use when using S3 proxy backend. Optional. " + s3AuthMsg(s3proxy.AuthMethodAccessKey),
 			EnvVars: []string{"BAZEL_REMOTE_S3_SESSION_TOKEN"},
 		},
+		&cli.StringFlag{
+			Name:    "s3.session_token_file",
+			Value:   "",
+			Usage:   "Path to a file containing the S3/minio session token. Mutually exclusive with s3.session_token. " + s3AuthMsg(s3proxy.AuthMethodAccessKey),
+			EnvVars: []string{"BAZEL_REMOTE_S3_SESSION_TOKEN_FILE"},
+		},
 		&cli.StringFlag{
 			Name:        "s3.signature_type",
 			Usage:       "Which type of s3 signature to use when using S3 proxy backend. Only applies when using the s3 access_key auth method. Allowed values: v2, v4, v4streaming, anonymous.",
@@ -374,6 +605,12 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "false",
 			EnvVars:     []string{"BAZEL_REMOTE_S3_UPDATE_TIMESTAMPS"},
 		},
+		&cli.BoolFlag{
+			Name:        "s3.tag_objects_by_kind",
+			Usage:       "Whether to tag uploaded objects with bazel-remote-kind set to the kind of entry (\"ac\", \"cas\" or \"raw\"), so that bucket lifecycle rules can apply different expiry rules to each kind.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_S3_TAG_OBJECTS_BY_KIND"},
+		},
 		&cli.StringFlag{
 			Name:    "s3.iam_role_endpoint",
 			Value:   "",
@@ -386,6 +623,26 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The AWS region. Required when not specifying S3/minio access keys.",
 			EnvVars: []string{"BAZEL_REMOTE_S3_REGION"},
 		},
+		&cli.StringFlag{
+			Name:    "s3.store_format",
+			Value:   "",
+			Usage:   "The format to store CAS blobs in on the s3 proxy backend. Must be one of \"casblob-zstd\" or \"identity\". The default is to use the same format as --storage_mode. Use \"identity\" if the backend is shared with tools that expect uncompressed blobs, blobs are then decompressed before upload and compressed after download.",
+			EnvVars: []string{"BAZEL_REMOTE_S3_STORE_FORMAT"},
+		},
+		&cli.DurationFlag{
+			Name:        "s3.connect_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed to establish a connection to the S3 proxy backend.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_S3_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "s3.request_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed for each request to the S3 proxy backend, including reading the response.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_S3_REQUEST_TIMEOUT"},
+		},
 		&cli.IntFlag{
 			Name:        "s3.key_version",
 			Usage:       "DEPRECATED. Key version 2 now is the only supported value. This flag will be removed.",
@@ -423,6 +680,20 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "false",
 			EnvVars:     []string{"BAZEL_REMOTE_AZBLOB_UPDATE_TIMESTAMPS"},
 		},
+		&cli.DurationFlag{
+			Name:        "azblob.connect_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed to establish a connection to the Azure blob storage proxy backend.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_AZBLOB_CONNECT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:        "azblob.request_timeout",
+			Value:       0,
+			Usage:       "The maximum time allowed for each request to the Azure blob storage proxy backend, including reading the response.",
+			DefaultText: "0s, ie no timeout",
+			EnvVars:     []string{"BAZEL_REMOTE_AZBLOB_REQUEST_TIMEOUT"},
+		},
 		&cli.StringFlag{
 			Name:    "azblob.auth_method",
 			Value:   "",
@@ -435,6 +706,12 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The Azure blob storage account access key to use when using azblob proxy backend. " + azBlobAuthMsg(azblobproxy.AuthMethodSharedKey),
 			EnvVars: []string{"BAZEL_REMOTE_AZBLOB_SHARED_KEY", "AZURE_STORAGE_ACCOUNT_KEY"},
 		},
+		&cli.StringFlag{
+			Name:    "azblob.shared_key_file",
+			Value:   "",
+			Usage:   "Path to a file containing the Azure blob storage account access key. Mutually exclusive with azblob.shared_key. " + azBlobAuthMsg(azblobproxy.AuthMethodSharedKey),
+			EnvVars: []string{"BAZEL_REMOTE_AZBLOB_SHARED_KEY_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "azblob.client_id",
 			Value:   "",
@@ -447,6 +724,12 @@ func GetCliFlags() []cli.Flag {
 			Usage:   "The Azure blob storage client secret key to use when using azblob proxy backend. " + azBlobAuthMsg(azblobproxy.AuthMethodClientSecret),
 			EnvVars: []string{"BAZEL_REMOTE_AZBLOB_SECRET_CLIENT_SECRET", "AZURE_CLIENT_SECRET"},
 		},
+		&cli.StringFlag{
+			Name:    "azblob.client_secret_file",
+			Value:   "",
+			Usage:   "Path to a file containing the Azure blob storage client secret key. Mutually exclusive with azblob.client_secret. " + azBlobAuthMsg(azblobproxy.AuthMethodClientSecret),
+			EnvVars: []string{"BAZEL_REMOTE_AZBLOB_CLIENT_SECRET_FILE"},
+		},
 		&cli.StringFlag{
 			Name:    "azblob.cert_path",
 			Value:   "",
@@ -465,6 +748,18 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "false, ie enable ActionCache dependency checks",
 			EnvVars:     []string{"BAZEL_REMOTE_DISABLE_GRPS_AC_DEPS_CHECK"},
 		},
+		&cli.BoolFlag{
+			Name:        "strict_ac_validation",
+			Usage:       "Whether to also check that the inlined output file contents, stdout and stderr of ActionResults uploaded with gRPC UpdateActionResult requests match their digests. Mismatches are rejected with InvalidArgument.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_STRICT_AC_VALIDATION"},
+		},
+		&cli.BoolFlag{
+			Name:        "preserve_ac_execution_metadata",
+			Usage:       "Whether to store the ExecutionMetadata of ActionResults uploaded with gRPC UpdateActionResult requests as supplied by the client. By default, the worker field is set to the client's address if it is empty. ActionResults without ExecutionMetadata always get the worker filled in.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_PRESERVE_AC_EXECUTION_METADATA"},
+		},
 		&cli.BoolFlag{
 			Name:        "enable_ac_key_instance_mangling",
 			Usage:       "Whether to enable mangling ActionCache keys with non-empty instance names.",
@@ -473,7 +768,7 @@ func GetCliFlags() []cli.Flag {
 		},
 		&cli.BoolFlag{
 			Name:        "enable_endpoint_metrics",
-			Usage:       "Whether to enable metrics for each HTTP/gRPC endpoint.",
+			Usage:       "Whether to enable metrics for each HTTP/gRPC endpoint, including the number of requests in flight.",
 			DefaultText: "false, ie disable metrics",
 			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_ENDPOINT_METRICS"},
 		},
@@ -483,19 +778,79 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "false, ie no prefix",
 			EnvVars:     []string{"BAZEL_REMOTE_HTTP_METRICS_PREFIX"},
 		},
+		&cli.StringFlag{
+			Name:    "metrics_namespace",
+			Value:   "",
+			Usage:   "If set, prefix the names of all metrics served by the /metrics endpoint with this namespace and an underscore, eg to avoid collisions with other services. Requires enable_endpoint_metrics.",
+			EnvVars: []string{"BAZEL_REMOTE_METRICS_NAMESPACE"},
+		},
+		&cli.StringFlag{
+			Name:    "metrics_address",
+			Value:   "",
+			Usage:   "If set, also serve the /metrics and /status endpoints on a separate plain HTTP listener at this [host]:port address, without the authentication of the main HTTP server, eg for prometheus scrapers that do not have cache credentials. Requires enable_endpoint_metrics.",
+			EnvVars: []string{"BAZEL_REMOTE_METRICS_ADDRESS"},
+		},
+		&cli.StringFlag{
+			Name:    "metrics_htpasswd_file",
+			Value:   "",
+			Usage:   "Path to a .htpasswd file that is used to authenticate requests to the metrics_address listener with basic authentication. If unset, that listener does not require authentication.",
+			EnvVars: []string{"BAZEL_REMOTE_METRICS_HTPASSWD_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "metrics_dump_file",
+			Value:   "",
+			Usage:   "If set, periodically write the current values of all metrics to this file in the prometheus text format, eg for environments without a prometheus server. The file is replaced atomically.",
+			EnvVars: []string{"BAZEL_REMOTE_METRICS_DUMP_FILE"},
+		},
+		&cli.DurationFlag{
+			Name:    "metrics_dump_interval",
+			Value:   time.Minute,
+			Usage:   "How often to write metrics to the metrics_dump_file.",
+			EnvVars: []string{"BAZEL_REMOTE_METRICS_DUMP_INTERVAL"},
+		},
 		&cli.BoolFlag{
 			Name:        "experimental_remote_asset_api",
 			Usage:       "Whether to enable the experimental remote asset API implementation.",
 			DefaultText: "false, ie disable remote asset API",
 			EnvVars:     []string{"BAZEL_REMOTE_EXPERIMENTAL_REMOTE_ASSET_API"},
 		},
+		&cli.Float64Flag{
+			Name:        "asset_fetch_rate_limit",
+			Usage:       "The maximum number of outbound requests per second made by the experimental remote asset API. Fetches wait for the limit, or fail with RESOURCE_EXHAUSTED if they would exceed their deadline.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_RATE_LIMIT"},
+		},
+		&cli.Float64Flag{
+			Name:        "asset_fetch_per_host_rate_limit",
+			Usage:       "The maximum number of outbound requests per second made by the experimental remote asset API to each host. Fetches wait for the limit, or fail with RESOURCE_EXHAUSTED if they would exceed their deadline.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_ASSET_FETCH_PER_HOST_RATE_LIMIT"},
+		},
+		&cli.Int64Flag{
+			Name:        "max_concurrent_asset_fetches",
+			Usage:       "The maximum number of outbound downloads that the experimental remote asset API makes at the same time. Each download may buffer a whole blob in memory. Fetches beyond this limit fail with RESOURCE_EXHAUSTED.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_CONCURRENT_ASSET_FETCHES"},
+		},
 		&cli.StringFlag{
 			Name:        "access_log_level",
-			Usage:       "The access logger verbosity level. If supplied, must be one of \"none\" or \"all\".",
+			Usage:       "The access logger verbosity level. If supplied, must be one of \"none\", \"sampled\" or \"all\". With \"sampled\", only a fraction of successful requests are logged, see access_log_sample_rate. Errors are always logged.",
 			Value:       "all",
 			DefaultText: "all, ie enable full access logging",
 			EnvVars:     []string{"BAZEL_REMOTE_ACCESS_LOG_LEVEL"},
 		},
+		&cli.Float64Flag{
+			Name:    "access_log_sample_rate",
+			Value:   0,
+			Usage:   "The fraction of successful requests to log, between 0 and 1, when access_log_level is \"sampled\".",
+			EnvVars: []string{"BAZEL_REMOTE_ACCESS_LOG_SAMPLE_RATE"},
+		},
+		&cli.BoolFlag{
+			Name:        "log_client_identity",
+			Usage:       "Whether to include the identity of the authenticated client (the basic auth username, or the common name of the mTLS client certificate) in access log lines for writes.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_LOG_CLIENT_IDENTITY"},
+		},
 		&cli.StringFlag{
 			Name:        "log_timezone",
 			Usage:       "The timezone to use for log timestamps. If supplied, must be one of \"UTC\", \"local\" or \"none\" for no timestamps.",
@@ -503,5 +858,336 @@ func GetCliFlags() []cli.Flag {
 			DefaultText: "UTC, ie use UTC timezone",
 			EnvVars:     []string{"BAZEL_REMOTE_LOG_TIMEZONE"},
 		},
+		&cli.BoolFlag{
+			Name:        "restore_from_s3",
+			Usage:       "Whether to download all the objects under the configured s3.prefix into the local cache at startup, before serving requests. Requires an S3 proxy backend. An interrupted restore can be resumed by restarting with this flag again.",
+			DefaultText: "false, ie populate the cache lazily on misses",
+			EnvVars:     []string{"BAZEL_REMOTE_RESTORE_FROM_S3"},
+		},
+		&cli.IntFlag{
+			Name:        "max_ac_validation_entries",
+			Value:       0,
+			Usage:       "The maximum number of CAS blobs that will be checked when validating an ActionResult's dependencies. ActionResults which refer to more blobs than this are treated as an error.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_VALIDATION_ENTRIES"},
+		},
+		&cli.IntFlag{
+			Name:        "ac_validation_concurrency",
+			Value:       0,
+			Usage:       "The maximum number of output directory Tree blobs to read at the same time when validating an ActionResult's dependencies. Reading them concurrently reduces the latency of ActionCache hits for actions with many output directories.",
+			DefaultText: "0, ie Tree blobs are read one at a time",
+			EnvVars:     []string{"BAZEL_REMOTE_AC_VALIDATION_CONCURRENCY"},
+		},
+		&cli.BoolFlag{
+			Name:        "disable_raw",
+			Usage:       "Whether to disable the RAW keyspace, which is only used for HTTP ActionCache requests when --disable_http_ac_validation is specified. This avoids creating and scanning the raw.v2 directories at startup.",
+			DefaultText: "false, ie enable the RAW keyspace",
+			EnvVars:     []string{"BAZEL_REMOTE_DISABLE_RAW"},
+		},
+		&cli.BoolFlag{
+			Name:        "raw_content_types",
+			Usage:       "Whether to store the Content-Type header of HTTP PUT requests for the RAW keyspace (ie /ac/ requests when --disable_http_ac_validation is specified), and return it in the Content-Type header of GET responses. Content types are stored in the raw.content-types directory inside the cache directory.",
+			DefaultText: "false, ie always return application/octet-stream",
+			EnvVars:     []string{"BAZEL_REMOTE_RAW_CONTENT_TYPES"},
+		},
+		&cli.BoolFlag{
+			Name:        "ac_write_once",
+			Usage:       "Whether to prevent existing ActionCache entries from being replaced. Uploading an identical ActionResult (ignoring ExecutionMetadata) for an existing key is a no-op, while uploading a different ActionResult fails with AlreadyExists (gRPC) or 409 Conflict (HTTP).",
+			DefaultText: "false, ie allow ActionCache entries to be overwritten",
+			EnvVars:     []string{"BAZEL_REMOTE_AC_WRITE_ONCE"},
+		},
+		&cli.BoolFlag{
+			Name:        "zstd_long_mode",
+			Value:       false,
+			Usage:       "Whether to use a large (128 MiB) window when compressing CAS blobs with zstd. This improves the compression ratio of large blobs with repetitive content, at the cost of more CPU and memory usage. Blobs are compressed in chunks as large as the window, instead of 1 MiB chunks, so reads which start at an offset also need more memory. Only applies when --storage_mode is zstd.",
+			DefaultText: "false, ie use the default window size",
+			EnvVars:     []string{"BAZEL_REMOTE_ZSTD_LONG_MODE"},
+		},
+		&cli.StringFlag{
+			Name:    "zstd_level",
+			Value:   "fastest",
+			Usage:   "The zstd compression level to use for CAS blobs. Must be one of \"fastest\", \"default\", \"better\" or \"best\". Higher levels give better compression ratios, but cost more CPU on every upload. Blobs can be read regardless of the level they were compressed with. Only applies when --storage_mode is zstd.",
+			EnvVars: []string{"BAZEL_REMOTE_ZSTD_LEVEL"},
+		},
+		&cli.IntFlag{
+			Name:        "compression_bypass_sample_size",
+			Usage:       "If greater than 0, compress a sample of this many bytes from the start of each new CAS blob, and store the blob uncompressed if the sample does not compress well, eg because it is an already compressed archive or image. This saves CPU on incompressible content. Only applies when --storage_mode is zstd.",
+			DefaultText: "0, ie compress all CAS blobs",
+			EnvVars:     []string{"BAZEL_REMOTE_COMPRESSION_BYPASS_SAMPLE_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:        "zstd_max_size",
+			Usage:       "If greater than 0, store new CAS blobs larger than this many bytes uncompressed, and compress smaller blobs. Large blobs are often already compressed artifacts, which do not benefit from being compressed again. Only applies when --storage_mode is zstd.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_ZSTD_MAX_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_admin_endpoints",
+			Value:       false,
+			Usage:       "Whether to serve administrative HTTP endpoints under /admin/, eg POST /admin/evict?target_bytes=N to evict least recently used items until the cache size is at most N bytes. Requires authentication (--htpasswd_file, --tls_ca_file or LDAP), and these endpoints are never available to unauthenticated clients.",
+			DefaultText: "false, ie administrative endpoints are disabled",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_ADMIN_ENDPOINTS"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_deep_health_check",
+			Usage:       "Whether to serve GET /healthz/deep, which writes a small blob to the CAS, reads it back and removes it, and returns 200 only if this succeeds. Checks are run at most once every 5 seconds, other requests return the previous result. Requires authentication (--htpasswd_file, --tls_ca_file or LDAP).",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_DEEP_HEALTH_CHECK"},
+		},
+		&cli.StringFlag{
+			Name:        "resumable_uploads_dir",
+			Value:       "",
+			Usage:       "A directory for storing incomplete gRPC bytestream uploads, which allows clients to resume interrupted uploads from a non-zero offset. This must not be inside --dir or contain it. Incomplete uploads which are left over from a previous run are removed on startup, other files in this directory are left alone.",
+			DefaultText: "empty, ie resumable uploads are disabled",
+			EnvVars:     []string{"BAZEL_REMOTE_RESUMABLE_UPLOADS_DIR"},
+		},
+		&cli.Int64Flag{
+			Name:    "resumable_uploads_max_size",
+			Value:   10 * 1024 * 1024 * 1024,
+			Usage:   "The maximum total size in bytes of the incomplete uploads in --resumable_uploads_dir. Writes which would exceed it fail with RESOURCE_EXHAUSTED. Set to 0 for no limit.",
+			EnvVars: []string{"BAZEL_REMOTE_RESUMABLE_UPLOADS_MAX_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "resumable_uploads_ttl",
+			Value:   time.Hour,
+			Usage:   "How long incomplete uploads in --resumable_uploads_dir are kept after they were last written to. Set to 0 to keep them until the server is restarted.",
+			EnvVars: []string{"BAZEL_REMOTE_RESUMABLE_UPLOADS_TTL"},
+		},
+		&cli.StringFlag{
+			Name:    "write_size_mismatch_code",
+			Value:   "invalid_argument",
+			Usage:   "The gRPC status code for bytestream writes which finish before the amount of data in the resource name has been received, eg truncated uploads. Must be one of \"invalid_argument\", \"data_loss\", \"aborted\" (which most clients retry) or \"unknown\".",
+			EnvVars: []string{"BAZEL_REMOTE_WRITE_SIZE_MISMATCH_CODE"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_ac",
+			Value:       true,
+			Usage:       "Whether to serve the gRPC ActionCache service. When disabled, ActionCache RPCs fail with Unimplemented.",
+			DefaultText: "true",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_AC"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_cas",
+			Value:       true,
+			Usage:       "Whether to serve the gRPC ContentAddressableStorage service. When disabled, ContentAddressableStorage RPCs fail with Unimplemented.",
+			DefaultText: "true",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_CAS"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_bytestream",
+			Value:       true,
+			Usage:       "Whether to serve the gRPC ByteStream service. When disabled, ByteStream RPCs fail with Unimplemented.",
+			DefaultText: "true",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_BYTESTREAM"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_instance_tags",
+			Value:       false,
+			Usage:       "Whether to tag ActionCache entries with the instance name they were uploaded with, so that all the entries for an instance name can be evicted at once with POST /admin/evict_tag?tag=NAME. Tags are only kept in memory, and are lost on restart. Requires --enable_admin_endpoints.",
+			DefaultText: "false, ie instance names are ignored",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_INSTANCE_TAGS"},
+		},
+		&cli.StringFlag{
+			Name:    "fsync_policy",
+			Value:   "always",
+			Usage:   "When to flush new cache files to stable storage. Must be one of \"always\" (sync each file before it is added to the cache), \"never\" (leave it to the operating system, recently written items may be lost or corrupted on a crash) or \"batch\" (coalesce the syncs of concurrent writes).",
+			EnvVars: []string{"BAZEL_REMOTE_FSYNC_POLICY"},
+		},
+		&cli.IntFlag{
+			Name:        "max_tree_depth",
+			Value:       0,
+			Usage:       "The maximum depth of directory trees returned by GetTree or checked when validating an ActionResult's output directories. Deeper trees are treated as an error. Directories which refer to one of their ancestors are always rejected.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_TREE_DEPTH"},
+		},
+		&cli.Int64Flag{
+			Name:        "max_concurrent_gettree",
+			Usage:       "The maximum number of gRPC GetTree calls to run at the same time. Each GetTree call buffers a whole directory tree in memory, so this limits the memory used by concurrent calls on large trees. Calls beyond this limit fail with RESOURCE_EXHAUSTED.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_CONCURRENT_GETTREE"},
+		},
+		&cli.Int64Flag{
+			Name:        "max_gettree_total_bytes",
+			Usage:       "The maximum total size in bytes of the Directory blobs that a single gRPC GetTree call reads and returns. This bounds the memory used by a GetTree call on a huge tree, independent of --max_concurrent_gettree. Calls for larger trees fail with RESOURCE_EXHAUSTED.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_GETTREE_TOTAL_BYTES"},
+		},
+		&cli.IntFlag{
+			Name:        "max_writes_per_connection",
+			Usage:       "The maximum number of concurrent gRPC bytestream Write calls from a single client connection, identified by its remote address. Writes beyond this limit fail with RESOURCE_EXHAUSTED.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_WRITES_PER_CONNECTION"},
+		},
+		&cli.Float64Flag{
+			Name:        "backpressure_threshold",
+			Usage:       "If greater than 0, add an x-bazel-remote-load: high trailer to gRPC responses when more than this fraction (less than 1) of the cache size is reserved for in-progress uploads, so that load-aware clients can throttle their requests or switch to another replica. Response status codes are not affected.",
+			DefaultText: "0, ie disabled",
+			EnvVars:     []string{"BAZEL_REMOTE_BACKPRESSURE_THRESHOLD"},
+		},
+		&cli.Int64Flag{
+			Name:        "max_batch_total_size_bytes",
+			Usage:       "The maximum total size in bytes of the blobs requested in a single gRPC BatchReadBlobs call. Larger batches fail with RESOURCE_EXHAUSTED. This limit is advertised to clients by GetCapabilities, so that they can split their requests.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_BATCH_TOTAL_SIZE_BYTES"},
+		},
+		&cli.Int64Flag{
+			Name:        "min_response_compress_size",
+			Usage:       "The minimum size in bytes of blobs which gRPC BatchReadBlobs returns zstd compressed to clients that accept it. Smaller blobs are returned uncompressed, since compressing them costs more than it saves.",
+			DefaultText: "0, ie compress all blobs",
+			EnvVars:     []string{"BAZEL_REMOTE_MIN_RESPONSE_COMPRESS_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:    "max_inline_size",
+			Value:   3 * 1024 * 1024,
+			Usage:   "The maximum total size in bytes of the stdout, stderr and output file contents inlined in gRPC GetActionResult responses, when clients request them. Blobs which would exceed this limit are returned by digest only. Set to 0 to disable inlining. Note that gRPC clients reject responses larger than 4MiB by default.",
+			EnvVars: []string{"BAZEL_REMOTE_MAX_INLINE_SIZE"},
+		},
+		&cli.Int64Flag{
+			Name:        "max_ac_inline_size",
+			Usage:       "If set, gRPC UpdateActionResult stores inlined stdout, stderr and output file contents larger than this many bytes in the CAS, and only keeps their digests in the AC entry. This keeps AC entries small when clients upload large inlined blobs.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_INLINE_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:        "max_ac_output_files",
+			Usage:       "If set, gRPC UpdateActionResult rejects ActionResults with more than this many output files.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_OUTPUT_FILES"},
+		},
+		&cli.IntFlag{
+			Name:        "max_ac_output_directories",
+			Usage:       "If set, gRPC UpdateActionResult rejects ActionResults with more than this many output directories.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_OUTPUT_DIRECTORIES"},
+		},
+		&cli.IntFlag{
+			Name:        "max_ac_symlinks",
+			Usage:       "If set, gRPC UpdateActionResult rejects ActionResults with more than this many output symlinks in total, including file and directory symlinks.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_AC_SYMLINKS"},
+		},
+		&cli.BoolFlag{
+			Name:        "dedupe_batch_digests",
+			Usage:       "Whether to only read or store each distinct digest once in gRPC BatchReadBlobs and BatchUpdateBlobs requests which list it more than once. Responses still contain one entry per requested digest, in order.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_DEDUPE_BATCH_DIGESTS"},
+		},
+		&cli.BoolFlag{
+			Name:        "protect_ac_dependencies",
+			Value:       false,
+			Usage:       "Whether to move the CAS blobs referenced by an ActionResult to the front of the LRU when the ActionResult is uploaded, so that they are less likely to be evicted before the ActionCache entry that refers to them. This is best-effort, referenced blobs can still be evicted.",
+			DefaultText: "false, ie ActionResult uploads do not affect the LRU order of CAS blobs",
+			EnvVars:     []string{"BAZEL_REMOTE_PROTECT_AC_DEPENDENCIES"},
+		},
+		&cli.BoolFlag{
+			Name:        "prefetch_ac_outputs",
+			Usage:       "Whether to download the CAS blobs referenced by an ActionResult from the proxy backend in the background, after the ActionResult is returned to a client with dependency checks, so that subsequent reads of those blobs are local cache hits. Up to num_uploaders blobs are downloaded at the same time.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_PREFETCH_AC_OUTPUTS"},
+		},
+		&cli.BoolFlag{
+			Name:        "verify_on_read",
+			Usage:       "Whether to check CAS blobs against their hash when they are read from disk. Corrupt blobs fail the read and are removed from the cache. Only complete, uncompressed reads are verified. This costs CPU, see also verify_on_read_sample_rate.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_VERIFY_ON_READ"},
+		},
+		&cli.Float64Flag{
+			Name:    "verify_on_read_sample_rate",
+			Value:   1,
+			Usage:   "The fraction of CAS reads to verify, between 0 and 1, when verify_on_read is enabled.",
+			EnvVars: []string{"BAZEL_REMOTE_VERIFY_ON_READ_SAMPLE_RATE"},
+		},
+		&cli.IntFlag{
+			Name:        "startup_verify_sample",
+			Value:       0,
+			Usage:       "The number of randomly chosen CAS blobs to check against their hash once the existing cache files have been loaded at startup. This detects gross corruption, eg after an unclean shutdown, without the cost of verifying the whole cache. Blobs which fail verification are logged, see also startup_verify_evict.",
+			DefaultText: "0, ie disabled",
+			EnvVars:     []string{"BAZEL_REMOTE_STARTUP_VERIFY_SAMPLE"},
+		},
+		&cli.BoolFlag{
+			Name:        "startup_verify_evict",
+			Usage:       "Whether to remove the sampled CAS blobs which fail verification at startup from the cache, when startup_verify_sample is set.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_STARTUP_VERIFY_EVICT"},
+		},
+		&cli.BoolFlag{
+			Name:        "enable_bloom_filter",
+			Usage:       "Whether to keep an in-memory bloom filter of the keys in the cache, so that FindMissingBlobs can skip the LRU index lookup for blobs which are definitely missing. The filter is sized when the cache is loaded, using about 20 bytes of memory per existing item, with a minimum of 10MiB.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_ENABLE_BLOOM_FILTER"},
+		},
+		&cli.BoolFlag{
+			Name:        "synthesize_empty_tree",
+			Usage:       "Whether to treat the canonical empty Tree, ie a Tree with an empty root Directory, as always present in the CAS like the empty blob. This avoids ActionResult validation failures and FindMissingBlobs misses for clients which reference the empty Tree without uploading it.",
+			DefaultText: "false",
+			EnvVars:     []string{"BAZEL_REMOTE_SYNTHESIZE_EMPTY_TREE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allowed_instances",
+			Usage:   "A comma separated list of REAPI instance names which gRPC requests may use. Requests for other instance names fail with PermissionDenied. If empty, all instance names are allowed. Note that the default instance name is the empty string, which can only be allowed via the YAML config file.",
+			EnvVars: []string{"BAZEL_REMOTE_ALLOWED_INSTANCES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "denied_instances",
+			Usage:   "A comma separated list of REAPI instance names which gRPC requests may not use. Requests for these instance names fail with PermissionDenied.",
+			EnvVars: []string{"BAZEL_REMOTE_DENIED_INSTANCES"},
+		},
+		&cli.IntFlag{
+			Name:        "max_concurrent_proxy_downloads",
+			Value:       0,
+			Usage:       "The maximum number of blobs to download from the proxy backend at the same time. Other requests that miss the local cache wait until a download slot is available. This is independent of the number of concurrent local disk operations.",
+			DefaultText: "0, ie no limit",
+			EnvVars:     []string{"BAZEL_REMOTE_MAX_CONCURRENT_PROXY_DOWNLOADS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "high_priority_clients",
+			Usage:   "A comma separated list of client identities (basic auth usernames, or client certificate common names) whose requests are high priority. High priority requests are scheduled first when they wait for a limited resource, currently the --max_concurrent_proxy_downloads limit. Clients can also request high priority by setting the X-Bazel-Remote-Priority HTTP header or x-bazel-remote-priority gRPC metadata key to \"high\".",
+			EnvVars: []string{"BAZEL_REMOTE_HIGH_PRIORITY_CLIENTS"},
+		},
+		&cli.DurationFlag{
+			Name:        "tombstone_ttl",
+			Value:       0,
+			Usage:       "How long items which were removed via /admin/evict_tag, or because they were found to be corrupt, are prevented from being read through from the proxy backend. This gives time to also remove them from the proxy backend.",
+			DefaultText: "0s, ie disabled",
+			EnvVars:     []string{"BAZEL_REMOTE_TOMBSTONE_TTL"},
+		},
+		&cli.StringFlag{
+			Name:    "eviction_trash_dir",
+			Value:   "",
+			Usage:   "If set, evicted cache files are moved to the bazel-remote-evicted subdirectory of this directory instead of being removed immediately, so that they can be recovered manually, eg after an accidental reduction of max_size. Files are removed from that subdirectory after eviction_trash_ttl, other files are left alone. This directory must be on the same filesystem as the cache directory, but must not be inside it or contain it, and the files in it do not count towards max_size.",
+			EnvVars: []string{"BAZEL_REMOTE_EVICTION_TRASH_DIR"},
+		},
+		&cli.DurationFlag{
+			Name:    "eviction_trash_ttl",
+			Value:   time.Hour,
+			Usage:   "How long evicted files are kept in eviction_trash_dir before they are removed.",
+			EnvVars: []string{"BAZEL_REMOTE_EVICTION_TRASH_TTL"},
+		},
+		&cli.IntFlag{
+			Name:        "eviction_removal_concurrency",
+			Value:       0,
+			Usage:       "The maximum number of evicted files that are removed concurrently for each batch of evictions, eg those made room for by a single upload. Evicted files are always removed after the cache index lock is released, and all removals are also subject to a global limit.",
+			DefaultText: "0, ie no per-batch limit",
+			EnvVars:     []string{"BAZEL_REMOTE_EVICTION_REMOVAL_CONCURRENCY"},
+		},
+		&cli.StringFlag{
+			Name:    "temp_dir",
+			Value:   "",
+			Usage:   "If set, new cache files are written in this directory, and moved to their final location in the cache directory once they are complete. This avoids creating many incomplete files among the existing cache files during bursts of uploads. This directory must be on the same filesystem as the cache directory, but not inside it.",
+			EnvVars: []string{"BAZEL_REMOTE_TEMP_DIR"},
+		},
+		&cli.IntFlag{
+			Name:        "disk_write_retries",
+			Value:       0,
+			Usage:       "The number of times that a write to a new cache file is retried if it fails with one of the errors in --disk_write_retry_errnos, which can help on network filesystems with occasional transient errors. Only the unwritten part of the data is retried, after a short backoff.",
+			DefaultText: "0, ie no retries",
+			EnvVars:     []string{"BAZEL_REMOTE_DISK_WRITE_RETRIES"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "disk_write_retry_errnos",
+			Usage:       "A comma separated list of the errno names for which --disk_write_retries applies. Supported values are EAGAIN, EBUSY, ESTALE and ETIMEDOUT.",
+			DefaultText: "EAGAIN",
+			EnvVars:     []string{"BAZEL_REMOTE_DISK_WRITE_RETRY_ERRNOS"},
+		},
 	}
 }
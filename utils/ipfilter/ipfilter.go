@@ -0,0 +1,62 @@
+// Package ipfilter provides a net.Listener which only accepts connections
+// from allowed networks.
+package ipfilter
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// ParseCIDRs parses a list of CIDR notation networks, eg "10.0.0.0/8" or
+// "2001:db8::/32".
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+type listener struct {
+	net.Listener
+	allowed []*net.IPNet
+}
+
+// NewListener returns a net.Listener which wraps l, and closes connections
+// from IP addresses outside the allowed networks as soon as they are
+// accepted, before any data is read. Connections which do not have an IP
+// address, eg on unix sockets, are always accepted.
+func NewListener(l net.Listener, allowed []*net.IPNet) net.Listener {
+	return &listener{Listener: l, allowed: allowed}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || l.isAllowed(addr.IP) {
+			return conn, nil
+		}
+
+		log.Printf("Rejected connection from %s: not in the allowed networks", addr.IP)
+		conn.Close()
+	}
+}
+
+func (l *listener) isAllowed(ip net.IP) bool {
+	for _, n := range l.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
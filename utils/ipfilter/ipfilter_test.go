@@ -0,0 +1,73 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	_, err := ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseCIDRs([]string{"10.0.0.1"})
+	if err == nil {
+		t.Fatal("Expected an error for an address without a prefix length")
+	}
+}
+
+func TestListener(t *testing.T) {
+	for _, tc := range []struct {
+		cidr    string
+		allowed bool
+	}{
+		{"127.0.0.0/8", true},
+		{"10.0.0.0/8", false},
+	} {
+		allowed, err := ParseCIDRs([]string{tc.cidr})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := NewListener(inner, allowed)
+
+		accepted := make(chan bool)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				// The listener was closed while waiting for an
+				// allowed connection.
+				accepted <- false
+				return
+			}
+			conn.Close()
+			accepted <- true
+		}()
+
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !tc.allowed {
+			// Rejected connections are closed by the server.
+			_, err = conn.Read(make([]byte, 1))
+			if err == nil {
+				t.Errorf("Expected the connection to be closed with %s allowed", tc.cidr)
+			}
+			l.Close()
+		}
+
+		if got := <-accepted; got != tc.allowed {
+			t.Errorf("Expected accepted=%t with %s allowed, got %t", tc.allowed, tc.cidr, got)
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
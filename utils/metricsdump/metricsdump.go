@@ -0,0 +1,35 @@
+// Package metricsdump periodically writes prometheus metrics to a file,
+// for environments where they cannot be scraped from the /metrics
+// endpoint.
+package metricsdump
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Write writes the metrics gathered by g to filename, in the prometheus
+// text format. The file is replaced atomically, so readers never see a
+// partially written snapshot.
+func Write(filename string, g prometheus.Gatherer) error {
+	return prometheus.WriteToTextfile(filename, g)
+}
+
+// Start writes the metrics gathered by g to filename every interval, in
+// a background goroutine. Errors are logged, and do not stop later
+// writes.
+func Start(filename string, interval time.Duration, g prometheus.Gatherer) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := Write(filename, g)
+			if err != nil {
+				log.Printf("Failed to write metrics to %s: %v", filename, err)
+			}
+		}
+	}()
+}
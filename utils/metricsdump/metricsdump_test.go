@@ -0,0 +1,48 @@
+package metricsdump
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWrite(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_test_total",
+		Help: "A test counter",
+	})
+	reg.MustRegister(counter)
+	counter.Add(3)
+
+	filename := filepath.Join(t.TempDir(), "metrics.prom")
+	err := Write(filename, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "bazel_remote_test_total 3\n") {
+		t.Fatalf("Expected the counter value in the metrics file, found:\n%s", data)
+	}
+
+	counter.Inc()
+	err = Write(filename, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "bazel_remote_test_total 4\n") {
+		t.Fatalf("Expected the updated counter value in the metrics file, found:\n%s", data)
+	}
+}
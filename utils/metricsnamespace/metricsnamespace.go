@@ -0,0 +1,41 @@
+// Package metricsnamespace prefixes the names of gathered prometheus
+// metrics with a namespace, so that bazel-remote's metrics can be told
+// apart from those of other services scraped into the same prometheus.
+//
+// Most of bazel-remote's metrics, and those of the gRPC and HTTP metrics
+// libraries, are registered at package initialization time, before the
+// configuration is known. So rather than setting the Namespace option at
+// every registration site, the prefix is applied when the metrics are
+// gathered.
+package metricsnamespace
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type gatherer struct {
+	prefix string
+	g      prometheus.Gatherer
+}
+
+// NewGatherer returns a prometheus.Gatherer which returns the metrics
+// gathered by g, with their names prefixed by namespace and an underscore.
+func NewGatherer(namespace string, g prometheus.Gatherer) prometheus.Gatherer {
+	return &gatherer{
+		prefix: namespace + "_",
+		g:      g,
+	}
+}
+
+func (p *gatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := p.g.Gather()
+
+	// Gather returns newly created metric families, which we can modify.
+	for _, mf := range families {
+		name := p.prefix + mf.GetName()
+		mf.Name = &name
+	}
+
+	return families, err
+}
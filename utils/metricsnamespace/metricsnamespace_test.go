@@ -0,0 +1,43 @@
+package metricsnamespace
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bazel_remote_test_total",
+		Help: "A test counter",
+	})
+	reg.MustRegister(counter)
+	counter.Add(3)
+
+	families, err := NewGatherer("myteam", reg).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(families) != 1 {
+		t.Fatalf("Expected 1 metric family, got %d", len(families))
+	}
+
+	if families[0].GetName() != "myteam_bazel_remote_test_total" {
+		t.Errorf("Expected prefixed metric name, got %q", families[0].GetName())
+	}
+
+	if v := families[0].GetMetric()[0].GetCounter().GetValue(); v != 3 {
+		t.Errorf("Expected counter value 3, got %v", v)
+	}
+
+	// The underlying gatherer is not affected.
+	families, err = reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if families[0].GetName() != "bazel_remote_test_total" {
+		t.Errorf("Expected unprefixed metric name, got %q", families[0].GetName())
+	}
+}
@@ -0,0 +1,116 @@
+// Package metricsummary reads some of bazel-remote's prometheus metrics
+// and formats them as a single log line, eg to summarize a session at
+// shutdown.
+package metricsummary
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	requestsMetric    = "bazel_remote_incoming_requests_total"
+	entryBytesMetric  = "bazel_remote_disk_cache_entry_bytes"
+	evictedMetric     = "bazel_remote_disk_cache_evicted_bytes_total"
+	overwrittenMetric = "bazel_remote_disk_cache_overwritten_bytes_total"
+)
+
+// Summary is a snapshot of cache statistics since startup.
+type Summary struct {
+	// False if endpoint metrics are disabled, in which case the request
+	// counts are not available.
+	HaveRequests bool
+
+	Requests  uint64 // All incoming cache requests.
+	GetHits   uint64 // Successful AC and CAS Get requests.
+	GetMisses uint64 // Unsuccessful AC and CAS Get requests.
+
+	ItemsAdded       uint64 // Number of items added to the disk cache.
+	BytesAdded       uint64 // Uncompressed size of the items added.
+	EvictedBytes     uint64
+	OverwrittenBytes uint64
+}
+
+// Gather returns a Summary of the metrics in g.
+func Gather(g prometheus.Gatherer) (Summary, error) {
+	var s Summary
+
+	families, err := g.Gather()
+	if err != nil {
+		return s, err
+	}
+
+	for _, mf := range families {
+		switch mf.GetName() {
+		case requestsMetric:
+			s.HaveRequests = true
+			for _, m := range mf.GetMetric() {
+				v := uint64(m.GetCounter().GetValue())
+				s.Requests += v
+
+				if label(m, "method") != "get" {
+					continue
+				}
+				switch label(m, "status") {
+				case "hit":
+					s.GetHits += v
+				case "miss":
+					s.GetMisses += v
+				}
+			}
+		case entryBytesMetric:
+			for _, m := range mf.GetMetric() {
+				s.ItemsAdded += m.GetSummary().GetSampleCount()
+				s.BytesAdded += uint64(m.GetSummary().GetSampleSum())
+			}
+		case evictedMetric:
+			for _, m := range mf.GetMetric() {
+				s.EvictedBytes += uint64(m.GetCounter().GetValue())
+			}
+		case overwrittenMetric:
+			for _, m := range mf.GetMetric() {
+				s.OverwrittenBytes += uint64(m.GetCounter().GetValue())
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func label(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// String returns the summary as space separated key=value pairs.
+func (s Summary) String() string {
+	var fields []string
+
+	if s.HaveRequests {
+		hitRate := 0.0
+		if s.GetHits+s.GetMisses > 0 {
+			hitRate = 100 * float64(s.GetHits) / float64(s.GetHits+s.GetMisses)
+		}
+
+		fields = append(fields,
+			fmt.Sprintf("requests=%d", s.Requests),
+			fmt.Sprintf("get_hits=%d", s.GetHits),
+			fmt.Sprintf("get_misses=%d", s.GetMisses),
+			fmt.Sprintf("hit_rate=%.1f%%", hitRate))
+	}
+
+	fields = append(fields,
+		fmt.Sprintf("items_added=%d", s.ItemsAdded),
+		fmt.Sprintf("bytes_added=%d", s.BytesAdded),
+		fmt.Sprintf("evicted_bytes=%d", s.EvictedBytes),
+		fmt.Sprintf("overwritten_bytes=%d", s.OverwrittenBytes))
+
+	return strings.Join(fields, " ")
+}
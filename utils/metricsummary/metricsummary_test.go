@@ -0,0 +1,65 @@
+package metricsummary
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGather(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: requestsMetric,
+	}, []string{"method", "kind", "status"})
+	evicted := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: evictedMetric,
+	})
+	entryBytes := prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: entryBytesMetric,
+	})
+	reg.MustRegister(requests, evicted, entryBytes)
+
+	requests.WithLabelValues("get", "cas", "hit").Add(3)
+	requests.WithLabelValues("get", "ac", "miss").Add(1)
+	requests.WithLabelValues("put", "cas", "ok").Add(2)
+	evicted.Add(4096)
+	entryBytes.Observe(100)
+	entryBytes.Observe(200)
+
+	s, err := Gather(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Summary{
+		HaveRequests: true,
+		Requests:     6,
+		GetHits:      3,
+		GetMisses:    1,
+		ItemsAdded:   2,
+		BytesAdded:   300,
+		EvictedBytes: 4096,
+	}
+	if s != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, s)
+	}
+
+	str := s.String()
+	expectedStr := "requests=6 get_hits=3 get_misses=1 hit_rate=75.0% items_added=2 bytes_added=300 evicted_bytes=4096 overwritten_bytes=0"
+	if str != expectedStr {
+		t.Fatalf("Expected %q, got %q", expectedStr, str)
+	}
+}
+
+func TestGatherWithoutEndpointMetrics(t *testing.T) {
+	s, err := Gather(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStr := "items_added=0 bytes_added=0 evicted_bytes=0 overwritten_bytes=0"
+	if s.String() != expectedStr {
+		t.Fatalf("Expected %q, got %q", expectedStr, s.String())
+	}
+}
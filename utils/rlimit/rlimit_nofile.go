@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package rlimit
+
+import "syscall"
+
+// OpenFiles returns the current (soft) limit on the number of open files.
+func OpenFiles() (uint64, error) {
+	var limits syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limits)
+	if err != nil {
+		return 0, err
+	}
+
+	return limits.Cur, nil
+}
@@ -3,6 +3,8 @@
 
 package rlimit
 
+import "errors"
+
 // bazel-remote does not work with windows, due to the way we interact
 // with the filesystem. Let's try to give a reasonable compile-time
 // error message to prevent windows users from wasting time trying.
@@ -10,3 +12,7 @@ var _ = __BAZEL_REMOTE_WINDOWS_BUILDS_ARE_NOT_SUPPORTED__
 
 func Raise() {
 }
+
+func OpenFiles() (uint64, error) {
+	return 0, errors.New("RLIMIT_NOFILE is not supported on windows")
+}
@@ -46,6 +46,15 @@ const wipMode = FinalMode | os.ModeSetgid
 
 var errNoTempfile = errors.New("Failed to create a temp file")
 
+// Name returns the name of the file which Create would create for the
+// given base and random string.
+func Name(base string, random string, legacy bool) string {
+	if legacy {
+		return base + "-" + random + ".v1"
+	}
+	return base + "-" + random
+}
+
 // Create attempts to create a file whose name is of the form
 // <base>-<randomstring> and with a ".v1" suffix if `legacy` is
 // true. The file will be created with the setgid bit set, which
@@ -63,11 +72,7 @@ func (c *Creator) Create(base string, legacy bool) (*os.File, string, error) {
 
 	for i := 0; i < 10000; i++ {
 		random = c.ranqd1()
-		if legacy {
-			name = base + "-" + random + ".v1"
-		} else {
-			name = base + "-" + random
-		}
+		name = Name(base, random, legacy)
 
 		f, err = os.OpenFile(name, flags, wipMode)
 		if err == nil {
@@ -1,6 +1,8 @@
 package validate
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
 	"strings"
@@ -136,6 +138,85 @@ func ActionResult(ar *pb.ActionResult) error {
 	return nil
 }
 
+// OutputLimits are the maximum numbers of outputs of each type in an
+// ActionResult. Zero means no limit.
+type OutputLimits struct {
+	MaxFiles       int
+	MaxDirectories int
+
+	// Applies to the total of OutputSymlinks, OutputFileSymlinks and
+	// OutputDirectorySymlinks.
+	MaxSymlinks int
+}
+
+// OutputCounts checks that ar does not have more outputs than limits
+// allows. It assumes that ar is non-nil.
+func OutputCounts(ar *pb.ActionResult, limits OutputLimits) error {
+	if limits.MaxFiles > 0 && len(ar.OutputFiles) > limits.MaxFiles {
+		return fmt.Errorf("too many output files: %d, the maximum is %d",
+			len(ar.OutputFiles), limits.MaxFiles)
+	}
+
+	if limits.MaxDirectories > 0 && len(ar.OutputDirectories) > limits.MaxDirectories {
+		return fmt.Errorf("too many output directories: %d, the maximum is %d",
+			len(ar.OutputDirectories), limits.MaxDirectories)
+	}
+
+	//nolint:staticcheck // count deprecated fields without giving lint errors
+	numSymlinks := len(ar.OutputSymlinks) + len(ar.OutputFileSymlinks) +
+		len(ar.OutputDirectorySymlinks)
+	if limits.MaxSymlinks > 0 && numSymlinks > limits.MaxSymlinks {
+		return fmt.Errorf("too many output symlinks: %d, the maximum is %d",
+			numSymlinks, limits.MaxSymlinks)
+	}
+
+	return nil
+}
+
+// InlineBlobs checks that the inlined output file contents, stdout and
+// stderr in ar match their digests, if both are present. It assumes that
+// ar has already been checked with ActionResult.
+func InlineBlobs(ar *pb.ActionResult) error {
+	for _, f := range ar.OutputFiles {
+		err := inlineBlob(f.Contents, f.Digest)
+		if err != nil {
+			return fmt.Errorf("inline contents for path %q: %w", f.Path, err)
+		}
+	}
+
+	err := inlineBlob(ar.StdoutRaw, ar.StdoutDigest)
+	if err != nil {
+		return fmt.Errorf("inline stdout: %w", err)
+	}
+
+	err = inlineBlob(ar.StderrRaw, ar.StderrDigest)
+	if err != nil {
+		return fmt.Errorf("inline stderr: %w", err)
+	}
+
+	return nil
+}
+
+// Verify that data matches d, if data is non-empty and d is non-nil.
+func inlineBlob(data []byte, d *pb.Digest) error {
+	if len(data) == 0 || d == nil {
+		return nil
+	}
+
+	if int64(len(data)) != d.SizeBytes {
+		return fmt.Errorf("length %d does not match Digest SizeBytes %d",
+			len(data), d.SizeBytes)
+	}
+
+	hashBytes := sha256.Sum256(data)
+	hash := hex.EncodeToString(hashBytes[:])
+	if hash != d.Hash {
+		return fmt.Errorf("hash %s does not match Digest hash %s", hash, d.Hash)
+	}
+
+	return nil
+}
+
 // Verify that The digest hash and size are valid, if it is non-nil.
 func maybeNilDigest(d *pb.Digest) error {
 	if d == nil {
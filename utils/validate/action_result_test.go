@@ -59,3 +59,114 @@ func TestValidateNilPointers(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateInlineBlobs(t *testing.T) {
+	data := []byte("hello")
+	hash := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	tcs := []struct {
+		description  string
+		actionResult *pb.ActionResult
+		valid        bool
+	}{
+		{
+			description: "matching output file contents",
+			actionResult: &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{
+					Path:     "foo",
+					Digest:   &pb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+					Contents: data,
+				}},
+			},
+			valid: true,
+		},
+		{
+			description: "output file without inline contents",
+			actionResult: &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{
+					Path:   "foo",
+					Digest: &pb.Digest{Hash: hash, SizeBytes: 1234},
+				}},
+			},
+			valid: true,
+		},
+		{
+			description: "output file contents with the wrong length",
+			actionResult: &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{
+					Path:     "foo",
+					Digest:   &pb.Digest{Hash: hash, SizeBytes: 1234},
+					Contents: data,
+				}},
+			},
+			valid: false,
+		},
+		{
+			description: "output file contents with the wrong hash",
+			actionResult: &pb.ActionResult{
+				OutputFiles: []*pb.OutputFile{{
+					Path:     "foo",
+					Digest:   &pb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+					Contents: []byte("world"),
+				}},
+			},
+			valid: false,
+		},
+		{
+			description: "matching stdout",
+			actionResult: &pb.ActionResult{
+				StdoutRaw:    data,
+				StdoutDigest: &pb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+			},
+			valid: true,
+		},
+		{
+			description: "stderr with the wrong hash",
+			actionResult: &pb.ActionResult{
+				StderrRaw:    []byte("world"),
+				StderrDigest: &pb.Digest{Hash: hash, SizeBytes: int64(len(data))},
+			},
+			valid: false,
+		},
+	}
+
+	for _, tc := range tcs {
+		err := InlineBlobs(tc.actionResult)
+		if tc.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.description, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected an error", tc.description)
+		}
+	}
+}
+
+func TestValidateOutputCounts(t *testing.T) {
+	ar := &pb.ActionResult{
+		OutputFiles:        []*pb.OutputFile{{}, {}},
+		OutputDirectories:  []*pb.OutputDirectory{{}, {}},
+		OutputSymlinks:     []*pb.OutputSymlink{{}},
+		OutputFileSymlinks: []*pb.OutputSymlink{{}},
+	}
+
+	tcs := []struct {
+		limits OutputLimits
+		valid  bool
+	}{
+		{OutputLimits{}, true},
+		{OutputLimits{MaxFiles: 2, MaxDirectories: 2, MaxSymlinks: 2}, true},
+		{OutputLimits{MaxFiles: 1}, false},
+		{OutputLimits{MaxDirectories: 1}, false},
+		{OutputLimits{MaxSymlinks: 1}, false},
+	}
+
+	for _, tc := range tcs {
+		err := OutputCounts(ar, tc.limits)
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.limits, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.limits)
+		}
+	}
+}